@@ -0,0 +1,122 @@
+package admin_tokens
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const (
+	ScopePurge      = "purge"
+	ScopeQuarantine = "quarantine"
+	ScopeStats      = "stats"
+	ScopeReadOnly   = "read_only"
+	ScopeUpload     = "upload"
+)
+
+var Scopes = []string{ScopePurge, ScopeQuarantine, ScopeStats, ScopeReadOnly, ScopeUpload}
+
+// Tokens issued by the repo carry a prefix so that only they are looked up in the database, rather
+// than every access token which is sent to the repo.
+const issuedTokenPrefix = "mra_"
+
+// Issued tokens are checked on every request they're used for, so keep them around for a short while.
+// Forget clears a token when it is revoked.
+var issued = cache.New(1*time.Minute, 2*time.Minute)
+
+// Token is the name and scopes of an admin token which was used for a request.
+type Token struct {
+	Name   string
+	Scopes []string
+}
+
+func IsScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if the token may be used for a request to a route needing the given scope.
+// Read only tokens can make any request which doesn't change anything.
+func (t *Token) Allows(scope string, method string) bool {
+	for _, s := range t.Scopes {
+		if s == scope && scope != "" {
+			return true
+		}
+		if s == ScopeReadOnly && (method == http.MethodGet || method == http.MethodHead) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserId is what requests made with the token are attributed to, such as in the audit log.
+func (t *Token) UserId() string {
+	return "@admintoken/" + t.Name
+}
+
+// Lookup finds the admin token which was given in place of an access token. nil is returned if the
+// access token isn't an admin token.
+func Lookup(ctx rcontext.RequestContext, accessToken string) (*Token, error) {
+	for _, t := range config.Get().AdminTokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(accessToken)) == 1 {
+			return &Token{Name: t.Name, Scopes: t.Scopes}, nil
+		}
+	}
+
+	if !strings.HasPrefix(accessToken, issuedTokenPrefix) {
+		return nil, nil
+	}
+
+	tokenHash := Hash(accessToken)
+	if t, ok := issued.Get(tokenHash); ok {
+		return t.(*Token), nil
+	}
+
+	record, err := storage.GetDatabase().GetMetadataStore(ctx).GetAdminTokenByHash(tokenHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Token{Name: record.Name, Scopes: record.Scopes}
+	issued.SetDefault(tokenHash, t)
+	return t, nil
+}
+
+// Generate creates a new token to be issued, returning it along with the hash to store.
+func Generate() (string, string, error) {
+	b, err := util.GenerateRandomBytes(32)
+	if err != nil {
+		return "", "", err
+	}
+	token := issuedTokenPrefix + hex.EncodeToString(b)
+	return token, Hash(token), nil
+}
+
+func Hash(token string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(token))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Forget drops a revoked token from the cache, so it stops working immediately in this process.
+// Other processes stop accepting it within a minute.
+func Forget(tokenHash string) {
+	issued.Delete(tokenHash)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/admin_tokens"
 	"github.com/turt2live/matrix-media-repo/api/auth_cache"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/config"
@@ -85,7 +86,53 @@ func AccessTokenOptionalRoute(next func(r *http.Request, rctx rcontext.RequestCo
 	}
 }
 
+// checkAdminToken runs the route for requests made with an admin token, if the token has the scope
+// the route needs. The returned bool is false if the request wasn't made with an admin token.
+func checkAdminToken(next func(r *http.Request, rctx rcontext.RequestContext, user UserInfo) interface{}, scope string, r *http.Request, rctx rcontext.RequestContext) (interface{}, bool) {
+	accessToken := util.GetAccessTokenFromRequest(r)
+	if accessToken == "" {
+		return nil, false
+	}
+
+	token, err := admin_tokens.Lookup(rctx, accessToken)
+	if err != nil {
+		sentry.CaptureException(err)
+		rctx.Log.Error("Error checking admin token: ", err)
+		return InternalServerError("Unexpected Error"), true
+	}
+	if token == nil {
+		return nil, false
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{"adminToken": token.Name})
+	if !token.Allows(scope, r.Method) {
+		rctx.Log.Warn("Admin token is missing the scope for this route")
+		return MissingScope(), true
+	}
+
+	rctx.Log.Info("User authed using admin token")
+	return callUserNext(next, r, rctx, UserInfo{UserId: token.UserId(), AccessToken: accessToken, IsShared: true}), true
+}
+
+// ScopedAccessTokenRequiredRoute is an AccessTokenRequiredRoute which also accepts admin tokens
+// with the given scope, as a repository administrator.
+func ScopedAccessTokenRequiredRoute(scope string, next func(r *http.Request, rctx rcontext.RequestContext, user UserInfo) interface{}) func(*http.Request, rcontext.RequestContext) interface{} {
+	regularFunc := AccessTokenRequiredRoute(next)
+	return func(r *http.Request, rctx rcontext.RequestContext) interface{} {
+		if res, handled := checkAdminToken(next, scope, r, rctx); handled {
+			return res
+		}
+		return regularFunc(r, rctx)
+	}
+}
+
 func RepoAdminRoute(next func(r *http.Request, rctx rcontext.RequestContext, user UserInfo) interface{}) func(*http.Request, rcontext.RequestContext) interface{} {
+	return ScopedRepoAdminRoute("", next)
+}
+
+// ScopedRepoAdminRoute is a RepoAdminRoute which admin tokens with the given scope can also use.
+// Read only admin tokens can use any admin route for requests which don't change anything.
+func ScopedRepoAdminRoute(scope string, next func(r *http.Request, rctx rcontext.RequestContext, user UserInfo) interface{}) func(*http.Request, rcontext.RequestContext) interface{} {
 	regularFunc := AccessTokenRequiredRoute(func(r *http.Request, rctx rcontext.RequestContext, user UserInfo) interface{} {
 		if user.UserId == "" {
 			rctx.Log.Warn("Could not identify user for this admin route")
@@ -110,6 +157,10 @@ func RepoAdminRoute(next func(r *http.Request, rctx rcontext.RequestContext, use
 			}
 		}
 
+		if res, handled := checkAdminToken(next, scope, r, rctx); handled {
+			return res
+		}
+
 		return regularFunc(r, rctx)
 	}
 }
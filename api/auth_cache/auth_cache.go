@@ -10,6 +10,7 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 var tokenCache = cache.New(0*time.Second, 30*time.Second)
@@ -114,6 +115,13 @@ func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId
 			return r.SenderUserId, nil
 		}
 
+		// Appservices can only act as users on this server, whatever their namespaces allow, so media
+		// isn't attributed to (or counted against the quota of) users elsewhere
+		if !isLocalUser(appserviceUserId, ctx.Request.Host) {
+			ctx.Log.Warnf("Appservice %s tried to act as %s, who isn't on this server", r.Id, appserviceUserId)
+			break
+		}
+
 		for _, n := range r.UserNamespaces {
 			regex, ok := regexCache[n.Regex]
 			if !ok {
@@ -132,6 +140,27 @@ func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId
 	return checkTokenWithHomeserver(ctx, accessToken, appserviceUserId, true)
 }
 
+// GetCachedUserId returns the user ID the access token was last verified as belonging to, or an empty
+// string if it isn't in the cache. The homeserver is never asked.
+func GetCachedUserId(accessToken string, appserviceUserId string) string {
+	rwLock.Lock()
+	record, ok := tokenCache.Get(cacheKey(accessToken, appserviceUserId))
+	rwLock.Unlock()
+	if !ok {
+		return ""
+	}
+	token := record.(cachedToken)
+	if token.err != nil {
+		return ""
+	}
+	return token.userId
+}
+
+func isLocalUser(userId string, serverName string) bool {
+	_, domain, err := util.SplitUserId(userId)
+	return err == nil && domain == serverName
+}
+
 func cacheToken(ctx rcontext.RequestContext, accessToken string, appserviceUserId string, userId string, err error) {
 	v := cachedToken{
 		userId: userId,
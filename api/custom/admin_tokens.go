@@ -0,0 +1,136 @@
+package custom
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/admin_tokens"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type AdminTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type IssuedAdminToken struct {
+	*types.AdminToken
+	Token string `json:"token"`
+}
+
+func GetAdminTokens(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	tokens, err := storage.GetDatabase().GetMetadataStore(rctx).GetAdminTokens()
+	if err != nil {
+		rctx.Log.Error("Error getting admin tokens: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting admin tokens")
+	}
+
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(tokens))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(tokens[start:end], nextFrom).WithTotal(int64(len(tokens)))}
+	}
+	return &api.DoNotCacheResponse{Payload: tokens}
+}
+
+func CreateAdminToken(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read request")
+	}
+
+	req := &AdminTokenRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		return api.BadRequest("failed to parse admin token request")
+	}
+	if req.Name == "" {
+		return api.BadRequest("a name is required")
+	}
+	if len(req.Scopes) == 0 {
+		return api.BadRequest("at least one scope is required")
+	}
+	for _, scope := range req.Scopes {
+		if !admin_tokens.IsScope(scope) {
+			return api.BadRequest("scopes must be purge, quarantine, stats, or read_only")
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"name":   req.Name,
+		"scopes": req.Scopes,
+	})
+
+	token, tokenHash, err := admin_tokens.Generate()
+	if err != nil {
+		rctx.Log.Error("Error generating admin token: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error generating admin token")
+	}
+
+	record := &types.AdminToken{
+		Name:      req.Name,
+		TokenHash: tokenHash,
+		Scopes:    req.Scopes,
+		CreatedBy: user.UserId,
+		CreatedTs: util.NowMillis(),
+	}
+	err = storage.GetDatabase().GetMetadataStore(rctx).InsertAdminToken(record)
+	if err != nil {
+		rctx.Log.Error("Error saving admin token: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error saving admin token")
+	}
+
+	rctx.Log.Info("Issued admin token")
+	recordAdminAction(r, rctx, user, "create_admin_token", map[string]interface{}{"token_id": record.ID, "name": record.Name, "scopes": record.Scopes}, nil)
+
+	// This is the only time the token itself is available
+	return &api.DoNotCacheResponse{Payload: &IssuedAdminToken{AdminToken: record, Token: token}}
+}
+
+func DeleteAdminToken(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	tokenId, err := strconv.ParseInt(params["tokenId"], 10, 64)
+	if err != nil {
+		return api.BadRequest("invalid token ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"tokenId": tokenId,
+	})
+
+	tokenHash, err := storage.GetDatabase().GetMetadataStore(rctx).DeleteAdminToken(tokenId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error("Error revoking admin token: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error revoking admin token")
+	}
+	admin_tokens.Forget(tokenHash)
+
+	rctx.Log.Info("Revoked admin token")
+	recordAdminAction(r, rctx, user, "delete_admin_token", map[string]interface{}{"token_id": tokenId}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
+}
@@ -0,0 +1,98 @@
+package custom
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type AuditLogEntry struct {
+	ID           int64                  `json:"id"`
+	Ts           int64                  `json:"ts"`
+	UserId       string                 `json:"user_id"`
+	Host         string                 `json:"host"`
+	Action       string                 `json:"action"`
+	Params       map[string]interface{} `json:"params"`
+	AffectedMxcs []string               `json:"affected_mxcs"`
+}
+
+type AuditLogResponse struct {
+	Entries  []*AuditLogEntry `json:"entries"`
+	NextFrom int64            `json:"next_from,omitempty"`
+}
+
+// recordAdminAction adds a completed admin action to the audit log. The action has already happened
+// by this point, so failing to record it is reported rather than failing the request.
+func recordAdminAction(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, action string, params map[string]interface{}, affectedMxcs []string) {
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	err := storage.GetDatabase().GetMetadataStore(rctx).InsertAuditLogEntry(&types.AuditLogEntry{
+		Ts:           util.NowMillis(),
+		UserId:       user.UserId,
+		Host:         r.Host,
+		Action:       action,
+		Params:       params,
+		AffectedMxcs: affectedMxcs,
+	})
+	if err != nil {
+		rctx.Log.Error("Failed to record admin action in the audit log: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func GetAuditLog(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+	if errRes != nil {
+		return errRes
+	}
+	limit := page.Limit
+
+	// Entries are listed newest first, so from is the ID to continue below rather than an offset
+	beforeId := int64(math.MaxInt64)
+	if page.From > 0 {
+		beforeId = page.From
+	}
+
+	userId := r.URL.Query().Get("user_id")
+	action := r.URL.Query().Get("action")
+	mxc := r.URL.Query().Get("mxc")
+
+	entries, err := storage.GetDatabase().GetMetadataStore(rctx).GetAuditLog(userId, action, mxc, beforeId, limit)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get audit log")
+	}
+
+	resp := &AuditLogResponse{Entries: make([]*AuditLogEntry, 0)}
+	for _, e := range entries {
+		affected := e.AffectedMxcs
+		if affected == nil {
+			affected = make([]string, 0)
+		}
+		resp.Entries = append(resp.Entries, &AuditLogEntry{
+			ID:           e.ID,
+			Ts:           e.Ts,
+			UserId:       e.UserId,
+			Host:         e.Host,
+			Action:       e.Action,
+			Params:       e.Params,
+			AffectedMxcs: affected,
+		})
+	}
+	if int64(len(entries)) == limit {
+		resp.NextFrom = entries[len(entries)-1].ID
+	}
+
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(resp.Entries, resp.NextFrom)}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
@@ -0,0 +1,132 @@
+package custom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type BlockedHashRequest struct {
+	HashType string `json:"hash_type"`
+	Hash     string `json:"hash"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+}
+
+func readBlockedHashRequest(r *http.Request, rctx rcontext.RequestContext) (*BlockedHashRequest, *api.ErrorResponse) {
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return nil, api.InternalServerError("failed to read request")
+	}
+
+	req := &BlockedHashRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		return nil, api.BadRequest("failed to parse request: " + err.Error())
+	}
+	if req.HashType == "" {
+		req.HashType = types.HashTypeSha256
+	}
+	req.Hash, err = upload_controller.NormalizeBlockedHash(req.HashType, req.Hash)
+	if err != nil {
+		return nil, api.BadRequest(err.Error())
+	}
+
+	return req, nil
+}
+
+func GetBlockedHashes(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	hashes, err := storage.GetDatabase().GetMetadataStore(rctx).GetBlockedHashes()
+	if err != nil {
+		rctx.Log.Error("Error getting blocked hashes: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting blocked hashes")
+	}
+
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(hashes))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(hashes[start:end], nextFrom).WithTotal(int64(len(hashes)))}
+	}
+	return &api.DoNotCacheResponse{Payload: hashes}
+}
+
+func BlockHash(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	req, errRes := readBlockedHashRequest(r, rctx)
+	if errRes != nil {
+		return errRes
+	}
+	if req.Action == "" {
+		req.Action = config.Get().HashBlocklist.DefaultAction
+	}
+	if req.Action != types.BlockActionReject && req.Action != types.BlockActionQuarantine {
+		return api.BadRequest("action must be reject or quarantine")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"hashType": req.HashType,
+		"hash":     req.Hash,
+		"action":   req.Action,
+	})
+
+	err := storage.GetDatabase().GetMetadataStore(rctx).UpsertBlockedHash(&types.BlockedHash{
+		HashType: req.HashType,
+		Hash:     req.Hash,
+		Action:   req.Action,
+		Reason:   req.Reason,
+		AddedBy:  user.UserId,
+		AddedTs:  util.NowMillis(),
+	})
+	if err != nil {
+		rctx.Log.Error("Error blocking hash: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error blocking hash")
+	}
+
+	rctx.Log.Warn("Media matching the hash can no longer be stored")
+	recordAdminAction(r, rctx, user, "block_hash", map[string]interface{}{"hash_type": req.HashType, "hash": req.Hash, "action": req.Action, "reason": req.Reason}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
+}
+
+func UnblockHash(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	req, errRes := readBlockedHashRequest(r, rctx)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"hashType": req.HashType,
+		"hash":     req.Hash,
+	})
+
+	removed, err := storage.GetDatabase().GetMetadataStore(rctx).DeleteBlockedHash(req.HashType, req.Hash)
+	if err != nil {
+		rctx.Log.Error("Error unblocking hash: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error unblocking hash")
+	}
+	if !removed {
+		return api.NotFoundError()
+	}
+
+	rctx.Log.Info("Media matching the hash can be stored again")
+	recordAdminAction(r, rctx, user, "unblock_hash", map[string]interface{}{"hash_type": req.HashType, "hash": req.Hash}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
+}
@@ -0,0 +1,165 @@
+package custom
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+type CacheEntryInfo struct {
+	Sha256Hash string   `json:"sha256_hash"`
+	SizeBytes  int64    `json:"size_bytes"`
+	Downloads  int      `json:"downloads"`
+	Media      []string `json:"media"`
+}
+
+type CacheInfo struct {
+	TotalEntries int               `json:"total_entries"`
+	TotalBytes   int64             `json:"total_bytes"`
+	Entries      []*CacheEntryInfo `json:"entries"`
+}
+
+type CacheEviction struct {
+	Evicted []string `json:"evicted"`
+}
+
+func GetCacheEntries(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	page, errRes := api.ParsePage(r, 50)
+	if errRes != nil {
+		return errRes
+	}
+
+	entries, err := internal_cache.Get().Entries()
+	if err == internal_cache.ErrNotSupported {
+		return api.BadRequest("the cache in use does not support listing entries")
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to list cache entries")
+	}
+
+	info := &CacheInfo{
+		TotalEntries: len(entries),
+		Entries:      make([]*CacheEntryInfo, 0),
+	}
+	for _, e := range entries {
+		info.TotalBytes += e.SizeBytes
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Downloads == entries[j].Downloads {
+			return entries[i].SizeBytes > entries[j].SizeBytes
+		}
+		return entries[i].Downloads > entries[j].Downloads
+	})
+	start, end, nextFrom := page.Bounds(len(entries))
+	entries = entries[start:end]
+
+	mediaDb := storage.GetDatabase().GetMediaStore(rctx)
+	for _, e := range entries {
+		entry := &CacheEntryInfo{
+			Sha256Hash: e.Sha256Hash,
+			SizeBytes:  e.SizeBytes,
+			Downloads:  e.Downloads,
+			Media:      make([]string, 0),
+		}
+
+		// Thumbnails are cached too, so not every entry belongs to a media record
+		media, err := mediaDb.GetByHash(e.Sha256Hash)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("failed to get media for cache entry")
+		}
+		for _, m := range media {
+			entry.Media = append(entry.Media, m.MxcUri())
+		}
+
+		info.Entries = append(info.Entries, entry)
+	}
+
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(info.Entries, nextFrom).WithTotal(int64(info.TotalEntries))}
+	}
+	return &api.DoNotCacheResponse{Payload: info}
+}
+
+func EvictCacheEntry(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	origin := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	media, err := storage.GetDatabase().GetMediaStore(rctx).Get(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get media record")
+	}
+
+	thumbs, err := storage.GetDatabase().GetThumbnailStore(rctx).GetAllForMedia(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get thumbnails")
+	}
+
+	hashes := []string{media.Sha256Hash}
+	for _, t := range thumbs {
+		hashes = append(hashes, t.Sha256Hash)
+	}
+
+	evicted := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		err = internal_cache.Get().Evict(hash, rctx)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("failed to evict from cache")
+		}
+		evicted = append(evicted, hash)
+	}
+
+	recordAdminAction(r, rctx, user, "evict_cache", map[string]interface{}{"hashes": evicted}, []string{media.MxcUri()})
+
+	return &api.DoNotCacheResponse{Payload: &CacheEviction{Evicted: evicted}}
+}
+
+func FlushCache(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	err := internal_cache.Get().Flush()
+	if err == internal_cache.ErrNotSupported {
+		return api.BadRequest("the cache in use can't be flushed by the media repo")
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to flush cache")
+	}
+
+	rctx.Log.Info("Flushed the media cache")
+	recordAdminAction(r, rctx, user, "flush_cache", nil, nil)
+	return &api.EmptyResponse{}
+}
@@ -0,0 +1,24 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func ReloadConfig(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	rctx.Log.Info("User ", user.UserId, " has asked for the config to be reloaded")
+	result, err := config.Reload()
+	if err != nil {
+		rctx.Log.Error("Error reloading configuration: ", err)
+		sentry.CaptureException(err)
+		return api.BadRequest("Error reloading configuration, keeping the current config: " + err.Error())
+	}
+
+	recordAdminAction(r, rctx, user, "reload_config", map[string]interface{}{"requires_restart": result.RequiresRestart}, nil)
+
+	return &api.DoNotCacheResponse{Payload: result}
+}
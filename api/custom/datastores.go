@@ -1,19 +1,24 @@
 package custom
 
 import (
+	"encoding/json"
 	"github.com/getsentry/sentry-go"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
 type DatastoreMigration struct {
@@ -21,6 +26,27 @@ type DatastoreMigration struct {
 	TaskID int `json:"task_id"`
 }
 
+type DatastoreReadOnly struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+type DatastoreUsage struct {
+	Type string `json:"type"`
+	Uri  string `json:"uri"`
+	*types.DatastoreUsage
+	FreeBytes *int64 `json:"free_bytes,omitempty"`
+}
+
+type DatastorePurge struct {
+	TaskID               int    `json:"task_id"`
+	MigrateToDatastoreId string `json:"migrate_to_datastore_id,omitempty"`
+}
+
+type DatastoreGarbageCollection struct {
+	TaskID int  `json:"task_id"`
+	DryRun bool `json:"dry_run"`
+}
+
 func GetDatastores(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	datastores, err := storage.GetDatabase().GetMediaStore(rctx).GetAllDatastores()
 	if err != nil {
@@ -30,17 +56,118 @@ func GetDatastores(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 	}
 
 	response := make(map[string]interface{})
+	items := make([]map[string]interface{}, 0)
 
 	for _, ds := range datastores {
 		dsMap := make(map[string]interface{})
 		dsMap["type"] = ds.Type
 		dsMap["uri"] = ds.Uri
+		if ref, err := datastore.LocateDatastore(rctx, ds.DatastoreId); err == nil {
+			dsMap["read_only"] = ref.IsReadOnly(rctx)
+		}
 		response[ds.DatastoreId] = dsMap
+
+		item := map[string]interface{}{"datastore_id": ds.DatastoreId}
+		for k, v := range dsMap {
+			item[k] = v
+		}
+		items = append(items, item)
 	}
 
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(items))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(items[start:end], nextFrom).WithTotal(int64(len(items)))}
+	}
 	return &api.DoNotCacheResponse{Payload: response}
 }
 
+func GetDatastoreUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	datastores, err := storage.GetDatabase().GetMediaStore(rctx).GetAllDatastores()
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error getting datastores")
+	}
+
+	now := util.NowMillis()
+	dayAgoTs := now - int64(24*60*60*1000)
+	weekAgoTs := now - int64(7*24*60*60*1000)
+
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+	response := make(map[string]*DatastoreUsage)
+	for _, ds := range datastores {
+		usage, err := db.GetDatastoreUsage(ds.DatastoreId, dayAgoTs, weekAgoTs)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("Error getting datastore usage")
+		}
+
+		dsUsage := &DatastoreUsage{
+			Type:           ds.Type,
+			Uri:            ds.Uri,
+			DatastoreUsage: usage,
+		}
+		if ds.Type == "file" {
+			free, err := ds_file.FreeBytes(ds.Uri)
+			if err != nil {
+				rctx.Log.Warn("Error getting free space for ", ds.Uri, ": ", err)
+			} else {
+				dsUsage.FreeBytes = &free
+			}
+		}
+		response[ds.DatastoreId] = dsUsage
+	}
+
+	return &api.DoNotCacheResponse{Payload: response}
+}
+
+func SetDatastoreReadOnly(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	datastoreId := params["datastoreId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"datastoreId": datastoreId,
+	})
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error reading request")
+	}
+
+	req := &DatastoreReadOnly{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		return api.BadRequest("Error parsing request: " + err.Error())
+	}
+
+	ds, err := datastore.LocateDatastore(rctx, datastoreId)
+	if err != nil {
+		rctx.Log.Error(err)
+		return api.BadRequest("Error getting datastore. Does it exist?")
+	}
+
+	rctx.Log.Infof("User %s is setting the datastore read-only flag to %t", user.UserId, req.ReadOnly)
+	err = ds.SetReadOnly(req.ReadOnly, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error updating datastore")
+	}
+	recordAdminAction(r, rctx, user, "datastore_read_only", map[string]interface{}{"datastore_id": datastoreId, "read_only": req.ReadOnly}, nil)
+
+	// Datastores which are read-only in the config stay read-only
+	return &api.DoNotCacheResponse{Payload: &DatastoreReadOnly{ReadOnly: ds.IsReadOnly(rctx)}}
+}
+
 func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	beforeTsStr := r.URL.Query().Get("before_ts")
 	beforeTs := util.NowMillis()
@@ -52,15 +179,34 @@ func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, use
 		}
 	}
 
+	maxPerSecondStr := r.URL.Query().Get("max_per_second")
+	maxPerSecond := float64(0)
+	if maxPerSecondStr != "" {
+		maxPerSecond, err = strconv.ParseFloat(maxPerSecondStr, 64)
+		if err != nil {
+			return api.BadRequest("Error parsing max_per_second: " + err.Error())
+		}
+	}
+
+	opts := maintenance_controller.StorageMigrationOptions{
+		BeforeTs:     beforeTs,
+		Origin:       r.URL.Query().Get("origin"),
+		UserId:       r.URL.Query().Get("user_id"),
+		MaxPerSecond: maxPerSecond,
+	}
+
 	params := mux.Vars(r)
 
 	sourceDsId := params["sourceDsId"]
 	targetDsId := params["targetDsId"]
 
 	rctx = rctx.LogWithFields(logrus.Fields{
-		"beforeTs":   beforeTs,
-		"sourceDsId": sourceDsId,
-		"targetDsId": targetDsId,
+		"beforeTs":     beforeTs,
+		"origin":       opts.Origin,
+		"userId":       opts.UserId,
+		"maxPerSecond": maxPerSecond,
+		"sourceDsId":   sourceDsId,
+		"targetDsId":   targetDsId,
 	})
 
 	if sourceDsId == targetDsId {
@@ -80,14 +226,24 @@ func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, use
 	}
 
 	rctx.Log.Info("User ", user.UserId, " has started a datastore media transfer")
-	task, err := maintenance_controller.StartStorageMigration(sourceDatastore, targetDatastore, beforeTs, rctx)
-	if err != nil {
+	task, err := maintenance_controller.StartStorageMigration(sourceDatastore, targetDatastore, opts, rctx)
+	if err == common.ErrDatastoreReadOnly {
+		return api.BadRequest("Target datastore is read-only")
+	} else if err != nil {
 		rctx.Log.Error(err)
 		sentry.CaptureException(err)
 		return api.InternalServerError("Unexpected error starting migration")
 	}
+	recordAdminAction(r, rctx, user, "datastore_transfer", map[string]interface{}{
+		"source_datastore_id": sourceDsId,
+		"target_datastore_id": targetDsId,
+		"before_ts":           beforeTs,
+		"origin":              opts.Origin,
+		"user_id":             opts.UserId,
+		"task_id":             task.ID,
+	}, nil)
 
-	estimate, err := maintenance_controller.EstimateDatastoreSizeWithAge(beforeTs, sourceDsId, rctx)
+	estimate, err := maintenance_controller.EstimateStorageMigration(sourceDsId, opts, rctx)
 	if err != nil {
 		rctx.Log.Error(err)
 		sentry.CaptureException(err)
@@ -130,3 +286,91 @@ func GetDatastoreStorageEstimate(r *http.Request, rctx rcontext.RequestContext,
 	}
 	return &api.DoNotCacheResponse{Payload: result}
 }
+
+func CollectDatastoreGarbage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	dryRun := true
+	dryRunStr := r.URL.Query().Get("dry_run")
+	if dryRunStr != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return api.BadRequest("Error parsing dry_run: " + err.Error())
+		}
+	}
+
+	params := mux.Vars(r)
+
+	datastoreId := params["datastoreId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"datastoreId": datastoreId,
+		"dryRun":      dryRun,
+	})
+
+	ds, err := datastore.LocateDatastore(rctx, datastoreId)
+	if err != nil {
+		rctx.Log.Error(err)
+		return api.BadRequest("Error getting datastore. Does it exist?")
+	}
+
+	rctx.Log.Info("User ", user.UserId, " has started garbage collection of a datastore")
+	task, err := maintenance_controller.StartGarbageCollection(ds, dryRun, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error starting garbage collection")
+	}
+	recordAdminAction(r, rctx, user, "datastore_garbage_collect", map[string]interface{}{"datastore_id": datastoreId, "dry_run": dryRun, "task_id": task.ID}, nil)
+
+	return &api.DoNotCacheResponse{Payload: &DatastoreGarbageCollection{
+		TaskID: task.ID,
+		DryRun: dryRun,
+	}}
+}
+
+func PurgeDatastore(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	datastoreId := params["datastoreId"]
+	migrateToId := r.URL.Query().Get("migrate_to")
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"datastoreId": datastoreId,
+		"migrateTo":   migrateToId,
+	})
+
+	if datastoreId == migrateToId {
+		return api.BadRequest("Source and target datastore cannot be the same")
+	}
+
+	ds, err := datastore.LocateDatastore(rctx, datastoreId)
+	if err != nil {
+		rctx.Log.Error(err)
+		return api.BadRequest("Error getting datastore. Does it exist?")
+	}
+
+	var migrateTo *datastore.DatastoreRef
+	if migrateToId != "" {
+		migrateTo, err = datastore.LocateDatastore(rctx, migrateToId)
+		if err != nil {
+			rctx.Log.Error(err)
+			return api.BadRequest("Error getting target datastore. Does it exist?")
+		}
+	}
+
+	rctx.Log.Info("User ", user.UserId, " has started purging a datastore")
+	task, err := maintenance_controller.StartDatastorePurge(ds, migrateTo, rctx)
+	if err == common.ErrDatastoreReadOnly {
+		return api.BadRequest("Target datastore is read-only")
+	} else if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error starting datastore purge")
+	}
+	recordAdminAction(r, rctx, user, "datastore_purge", map[string]interface{}{"datastore_id": datastoreId, "migrate_to_datastore_id": migrateToId, "task_id": task.ID}, nil)
+
+	return &api.DoNotCacheResponse{Payload: &DatastorePurge{
+		TaskID:               task.ID,
+		MigrateToDatastoreId: migrateToId,
+	}}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/gorilla/mux"
@@ -17,6 +18,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/templating"
+	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
@@ -32,8 +34,9 @@ type ExportPartMetadata struct {
 }
 
 type ExportMetadata struct {
-	Entity string                `json:"entity"`
-	Parts  []*ExportPartMetadata `json:"parts"`
+	Entity    string                `json:"entity"`
+	ExpiresTs int64                 `json:"expires_ts,omitempty"`
+	Parts     []*ExportPartMetadata `json:"parts"`
 }
 
 func ExportUserData(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -68,6 +71,13 @@ func ExportUserData(r *http.Request, rctx rcontext.RequestContext, user api.User
 		sentry.CaptureException(err)
 		return api.InternalServerError("fatal error starting export")
 	}
+	recordAdminAction(r, rctx, user, "export_user", map[string]interface{}{
+		"user_id":      userId,
+		"include_data": includeData,
+		"s3_urls":      s3urls,
+		"export_id":    exportId,
+		"task_id":      task.ID,
+	}, nil)
 
 	return &api.DoNotCacheResponse{Payload: &ExportStarted{
 		TaskID:   task.ID,
@@ -121,6 +131,13 @@ func ExportServerData(r *http.Request, rctx rcontext.RequestContext, user api.Us
 		sentry.CaptureException(err)
 		return api.InternalServerError("fatal error starting export")
 	}
+	recordAdminAction(r, rctx, user, "export_server", map[string]interface{}{
+		"server_name":  serverName,
+		"include_data": includeData,
+		"s3_urls":      s3urls,
+		"export_id":    exportId,
+		"task_id":      task.ID,
+	}, nil)
 
 	return &api.DoNotCacheResponse{Payload: &ExportStarted{
 		TaskID:   task.ID,
@@ -148,6 +165,9 @@ func ViewExport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		sentry.CaptureException(err)
 		return api.InternalServerError("failed to get metadata")
 	}
+	if isExportExpired(exportInfo) {
+		return api.NotFoundError()
+	}
 
 	parts, err := exportDb.GetExportParts(exportId)
 	if err != nil {
@@ -168,6 +188,9 @@ func ViewExport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		Entity:      exportInfo.Entity,
 		ExportParts: make([]*templating.ViewExportPartModel, 0),
 	}
+	if exportInfo.ExpiresTs > 0 {
+		model.ExpiresHuman = util.FromMillis(exportInfo.ExpiresTs).Format(time.UnixDate)
+	}
 	for _, p := range parts {
 		model.ExportParts = append(model.ExportParts, &templating.ViewExportPartModel{
 			ExportID:       exportInfo.ExportID,
@@ -209,6 +232,9 @@ func GetExportMetadata(r *http.Request, rctx rcontext.RequestContext, user api.U
 		sentry.CaptureException(err)
 		return api.InternalServerError("failed to get metadata")
 	}
+	if isExportExpired(exportInfo) {
+		return api.NotFoundError()
+	}
 
 	parts, err := exportDb.GetExportParts(exportId)
 	if err != nil {
@@ -218,8 +244,9 @@ func GetExportMetadata(r *http.Request, rctx rcontext.RequestContext, user api.U
 	}
 
 	metadata := &ExportMetadata{
-		Entity: exportInfo.Entity,
-		Parts:  make([]*ExportPartMetadata, 0),
+		Entity:    exportInfo.Entity,
+		ExpiresTs: exportInfo.ExpiresTs,
+		Parts:     make([]*ExportPartMetadata, 0),
 	}
 	for _, p := range parts {
 		metadata.Parts = append(metadata.Parts, &ExportPartMetadata{
@@ -252,6 +279,16 @@ func DownloadExportPart(r *http.Request, rctx rcontext.RequestContext, user api.
 	})
 
 	db := storage.GetDatabase().GetExportStore(rctx)
+	exportInfo, err := db.GetExportMetadata(exportId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get metadata")
+	}
+	if isExportExpired(exportInfo) {
+		return api.NotFoundError()
+	}
+
 	part, err := db.GetExportPart(exportId, int(partId))
 	if err != nil {
 		rctx.Log.Error(err)
@@ -288,40 +325,19 @@ func DeleteExport(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 		"exportId": exportId,
 	})
 
-	db := storage.GetDatabase().GetExportStore(rctx)
-
-	rctx.Log.Info("Getting information on which parts to delete")
-	parts, err := db.GetExportParts(exportId)
-	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to delete export")
-	}
-
-	for _, part := range parts {
-		rctx.Log.Info("Locating datastore: " + part.DatastoreID)
-		ds, err := datastore.LocateDatastore(rctx, part.DatastoreID)
-		if err != nil {
-			rctx.Log.Error(err)
-			sentry.CaptureException(err)
-			return api.InternalServerError("failed to delete export")
-		}
-
-		rctx.Log.Info("Deleting object: " + part.Location)
-		err = ds.DeleteObject(part.Location)
-		if err != nil {
-			rctx.Log.Warn(err)
-			sentry.CaptureException(err)
-		}
-	}
-
-	rctx.Log.Info("Purging export from database")
-	err = db.DeleteExportAndParts(exportId)
+	err := data_controller.DeleteExport(exportId, rctx)
 	if err != nil {
 		rctx.Log.Error(err)
 		sentry.CaptureException(err)
 		return api.InternalServerError("failed to delete export")
 	}
+	recordAdminAction(r, rctx, user, "delete_export", map[string]interface{}{"export_id": exportId}, nil)
 
 	return api.EmptyResponse{}
 }
+
+// isExportExpired returns true if the export is past its expiry time but hasn't been deleted by
+// the purge task yet.
+func isExportExpired(exportInfo *types.ExportMetadata) bool {
+	return exportInfo.ExpiresTs > 0 && exportInfo.ExpiresTs <= util.NowMillis()
+}
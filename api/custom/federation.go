@@ -2,9 +2,15 @@ package custom
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/getsentry/sentry-go"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -13,48 +19,155 @@ import (
 	"github.com/turt2live/matrix-media-repo/matrix"
 )
 
+// FederationTestStep is the outcome of one step of testing federation with a server.
+type FederationTestStep struct {
+	Name       string                 `json:"name"`
+	Success    bool                   `json:"success"`
+	DurationMs int64                  `json:"duration_ms"`
+	Error      string                 `json:"error,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// The most of a file the federation test downloads
+const maxFederationTestDownloadBytes = 10 * 1024 * 1024
+
 func GetFederationInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	params := mux.Vars(r)
 
 	serverName := params["serverName"]
+	mediaId := r.URL.Query().Get("media_id")
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"serverName": serverName,
+		"mediaId":    mediaId,
 	})
 
-	url, hostname, err := matrix.GetServerApiUrl(serverName)
-	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+	steps := make([]*FederationTestStep, 0)
+	resp := make(map[string]interface{})
+	resp["steps"] = steps
+	runStep := func(name string, fn func(details map[string]interface{}) error) bool {
+		step := &FederationTestStep{Name: name, Details: make(map[string]interface{})}
+		start := time.Now()
+		err := fn(step.Details)
+		step.DurationMs = time.Since(start).Milliseconds()
+		step.Success = err == nil
+		if err != nil {
+			rctx.Log.Warn("Federation test step ", name, " failed: ", err)
+			step.Error = err.Error()
+		}
+		steps = append(steps, step)
+		resp["steps"] = steps
+		return step.Success
+	}
+
+	// These lookups only explain how the server was resolved: failing them is normal for many servers
+	host := serverName
+	if h, _, err := net.SplitHostPort(serverName); err == nil {
+		host = h
 	}
+	runStep("well_known", func(details map[string]interface{}) error {
+		client := &http.Client{Timeout: time.Duration(rctx.Config.TimeoutSeconds.Federation) * time.Second}
+		wkResponse, err := client.Get(fmt.Sprintf("https://%s/.well-known/matrix/server", host))
+		if err != nil {
+			return err
+		}
+		defer wkResponse.Body.Close()
+		details["status_code"] = wkResponse.StatusCode
+		if wkResponse.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code %d", wkResponse.StatusCode)
+		}
+		wk := make(map[string]interface{})
+		err = json.NewDecoder(io.LimitReader(wkResponse.Body, 64*1024)).Decode(&wk)
+		if err != nil {
+			return err
+		}
+		details["m.server"] = wk["m.server"]
+		return nil
+	})
+	runStep("srv", func(details map[string]interface{}) error {
+		_, addrs, err := net.LookupSRV("matrix", "tcp", host)
+		if err != nil {
+			return err
+		}
+		targets := make([]string, 0)
+		for _, addr := range addrs {
+			targets = append(targets, net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), fmt.Sprint(addr.Port)))
+		}
+		details["targets"] = targets
+		return nil
+	})
 
-	versionUrl := url + "/_matrix/federation/v1/version"
-	versionResponse, err := matrix.FederatedGet(versionUrl, hostname, rctx)
-	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+	// Resolve fresh so the test reflects the server's current setup
+	matrix.ForgetServerApiUrl(serverName)
+	var baseUrl, hostname string
+	resolved := runStep("resolve", func(details map[string]interface{}) error {
+		var err error
+		baseUrl, hostname, err = matrix.GetServerApiUrl(serverName)
+		if err != nil {
+			return err
+		}
+		details["base_url"] = baseUrl
+		details["hostname"] = hostname
+		resp["base_url"] = baseUrl
+		resp["hostname"] = hostname
+		return nil
+	})
+	if !resolved {
+		return &api.DoNotCacheResponse{Payload: resp}
 	}
 
-	c, err := ioutil.ReadAll(versionResponse.Body)
-	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+	runStep("version", func(details map[string]interface{}) error {
+		versionUrl := baseUrl + "/_matrix/federation/v1/version"
+		versionResponse, err := matrix.FederatedGet(versionUrl, hostname, rctx)
+		if err != nil {
+			return err
+		}
+		defer versionResponse.Body.Close()
+
+		c, err := ioutil.ReadAll(versionResponse.Body)
+		if err != nil {
+			return err
+		}
+
+		out := make(map[string]interface{})
+		err = json.Unmarshal(c, &out)
+		if err != nil {
+			return err
+		}
+		details["response"] = out
+		resp["versions_response"] = out
+		return nil
+	})
+
+	if mediaId != "" {
+		runStep("download", func(details map[string]interface{}) error {
+			downloadUrl := baseUrl + "/_matrix/media/r0/download/" + url.PathEscape(serverName) + "/" + url.PathEscape(mediaId) + "?allow_remote=false"
+			downloadResponse, err := matrix.FederatedGet(downloadUrl, hostname, rctx)
+			if err != nil {
+				return err
+			}
+			defer downloadResponse.Body.Close()
+
+			details["status_code"] = downloadResponse.StatusCode
+			details["content_type"] = downloadResponse.Header.Get("Content-Type")
+			if downloadResponse.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status code %d", downloadResponse.StatusCode)
+			}
+
+			// The file is only downloaded to prove it can be, so nothing is kept and large files are cut short
+			size, err := io.Copy(ioutil.Discard, io.LimitReader(downloadResponse.Body, maxFederationTestDownloadBytes))
+			details["size_bytes"] = size
+			details["truncated"] = size >= maxFederationTestDownloadBytes
+			return err
+		})
 	}
 
-	out := make(map[string]interface{})
-	err = json.Unmarshal(c, &out)
-	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+	for _, step := range steps {
+		if !step.Success && step.Name != "well_known" && step.Name != "srv" {
+			sentry.CaptureMessage(fmt.Sprintf("Federation test with %s failed at %s: %s", serverName, step.Name, step.Error))
+			break
+		}
 	}
 
-	resp := make(map[string]interface{})
-	resp["base_url"] = url
-	resp["hostname"] = hostname
-	resp["versions_response"] = out
 	return &api.DoNotCacheResponse{Payload: resp}
 }
@@ -2,21 +2,176 @@ package custom
 
 import (
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/patrickmn/go-cache"
 	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// Readiness probes can be frequent, so homeservers are only pinged this often
+var homeserverStatuses = cache.New(30*time.Second, 1*time.Minute)
+
 type HealthzResponse struct {
-	OK     bool   `json:"ok"`
-	Status string `json:"status"`
+	OK         bool                              `json:"ok"`
+	Status     string                            `json:"status"`
+	Datastores map[string]datastore.HealthStatus `json:"datastores,omitempty"`
+}
+
+type DependencyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Healthy    bool   `json:"healthy"`
+	Critical   bool   `json:"critical"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	CheckedTs  int64  `json:"last_check_ts,omitempty"`
+}
+
+type ReadyzResponse struct {
+	Ready        bool                `json:"ready"`
+	Dependencies []*DependencyStatus `json:"dependencies"`
 }
 
 func GetHealthz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	statuses := datastore.GetHealthStatuses()
+
+	status := "Probably not dead"
+	for _, s := range statuses {
+		if !s.Healthy {
+			status = "One or more datastores are unhealthy"
+			break
+		}
+	}
+
+	// Anyone can call this, so which datastores exist is only shown to admins
+	if !canSeeDatastores(user) {
+		statuses = nil
+	}
+
 	return &api.DoNotCacheResponse{
 		Payload: &HealthzResponse{
-			OK:     true,
-			Status: "Probably not dead",
+			OK:         true,
+			Status:     status,
+			Datastores: statuses,
 		},
 	}
 }
+
+func canSeeDatastores(user api.UserInfo) bool {
+	return user.UserId != "" && (util.IsGlobalAdmin(user.UserId) || user.IsShared)
+}
+
+func GetReadyz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	deps := make([]*DependencyStatus, 0)
+
+	start := time.Now()
+	err := storage.GetDatabase().Ping(rctx)
+	if err != nil {
+		rctx.Log.Warn("Database is unreachable: ", err)
+	}
+	deps = append(deps, &DependencyStatus{
+		Name:       "database",
+		Type:       "database",
+		Healthy:    err == nil,
+		Critical:   true,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+
+	// Probing the datastores here would write to them on every request, so the result of the
+	// last periodic health check is used instead. Only admins see the individual datastores.
+	statuses := datastore.GetHealthStatuses()
+	dsIds := make([]string, 0, len(statuses))
+	for id := range statuses {
+		dsIds = append(dsIds, id)
+	}
+	sort.Strings(dsIds)
+	showDatastores := canSeeDatastores(user)
+	for _, id := range dsIds {
+		s := statuses[id]
+		if !s.Healthy {
+			rctx.Log.Warnf("Datastore %s is unhealthy: %s", id, s.Error)
+		}
+		if !showDatastores {
+			continue
+		}
+		deps = append(deps, &DependencyStatus{
+			Name:      id,
+			Type:      "datastore",
+			Healthy:   s.Healthy,
+			Critical:  false,
+			CheckedTs: s.LastCheckTs,
+		})
+	}
+
+	// A single datastore being down is fine, as long as every kind of media can still be stored
+	for _, kind := range common.AllKinds {
+		healthy := datastore.HasWritableDatastore(kind, rctx)
+		if !healthy {
+			rctx.Log.Warnf("No healthy, writable datastore for %s", kind)
+		}
+		deps = append(deps, &DependencyStatus{
+			Name:     kind,
+			Type:     "uploads",
+			Healthy:  healthy,
+			Critical: true,
+		})
+	}
+
+	// Homeservers are reported, but don't affect readiness: the repo can still serve media when
+	// one of them is down.
+	domains := config.AllDomains()
+	hsDeps := make([]*DependencyStatus, len(domains))
+	wg := &sync.WaitGroup{}
+	for i, d := range domains {
+		wg.Add(1)
+		go func(i int, serverName string) {
+			defer wg.Done()
+			if cached, found := homeserverStatuses.Get(serverName); found {
+				hsDeps[i] = cached.(*DependencyStatus)
+				return
+			}
+
+			start := time.Now()
+			err := matrix.PingHomeserver(rctx, serverName)
+			if err != nil {
+				rctx.Log.Warnf("Homeserver %s is unreachable: %s", serverName, err)
+			}
+			hsDeps[i] = &DependencyStatus{
+				Name:       serverName,
+				Type:       "homeserver",
+				Healthy:    err == nil,
+				Critical:   false,
+				DurationMs: time.Since(start).Milliseconds(),
+				CheckedTs:  util.NowMillis(),
+			}
+			homeserverStatuses.Set(serverName, hsDeps[i], cache.DefaultExpiration)
+		}(i, d.Name)
+	}
+	wg.Wait()
+	sort.Slice(hsDeps, func(i int, j int) bool {
+		return hsDeps[i].Name < hsDeps[j].Name
+	})
+	deps = append(deps, hsDeps...)
+
+	ready := true
+	for _, d := range deps {
+		if d.Critical && !d.Healthy {
+			ready = false
+			break
+		}
+	}
+
+	resp := &ReadyzResponse{Ready: ready, Dependencies: deps}
+	if !ready {
+		return &api.StatusCodeResponse{StatusCode: http.StatusServiceUnavailable, Payload: resp}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
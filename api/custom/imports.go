@@ -16,6 +16,12 @@ type ImportStarted struct {
 	TaskID   int    `json:"task_id"`
 }
 
+type ImportVerification struct {
+	Found    int      `json:"found"`
+	Expected int      `json:"expected"`
+	Missing  []string `json:"missing"`
+}
+
 func StartImport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	if !rctx.Config.Archiving.Enabled {
 		return api.BadRequest("archiving is not enabled")
@@ -29,6 +35,8 @@ func StartImport(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		return api.InternalServerError("fatal error starting import")
 	}
 
+	recordAdminAction(r, rctx, user, "start_import", map[string]interface{}{"import_id": importId, "task_id": task.ID}, nil)
+
 	return &api.DoNotCacheResponse{Payload: &ImportStarted{
 		TaskID:   task.ID,
 		ImportID: importId,
@@ -51,6 +59,7 @@ func AppendToImport(r *http.Request, rctx rcontext.RequestContext, user api.User
 		sentry.CaptureException(err)
 		return api.InternalServerError("fatal error appending to import")
 	}
+	recordAdminAction(r, rctx, user, "append_to_import", map[string]interface{}{"import_id": importId}, nil)
 
 	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
 }
@@ -70,6 +79,26 @@ func StopImport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		sentry.CaptureException(err)
 		return api.InternalServerError("fatal error stopping import")
 	}
+	recordAdminAction(r, rctx, user, "stop_import", map[string]interface{}{"import_id": importId}, nil)
 
 	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
 }
+
+func VerifyImport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	if !rctx.Config.Archiving.Enabled {
+		return api.BadRequest("archiving is not enabled")
+	}
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	found, expected, missing, err := data_controller.VerifyImport(r.Body, rctx)
+	if err != nil {
+		rctx.Log.Warn(err)
+		return api.BadRequest("the archive could not be read or has no manifest")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &ImportVerification{
+		Found:    found,
+		Expected: expected,
+		Missing:  missing,
+	}}
+}
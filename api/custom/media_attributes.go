@@ -18,7 +18,14 @@ import (
 )
 
 type Attributes struct {
-	Purpose string `json:"purpose"`
+	Purpose   string `json:"purpose"`
+	Protected bool   `json:"protected"`
+	ExpiresTs int64  `json:"expires_ts,omitempty"`
+
+	OriginalSizeBytes int64 `json:"original_size_bytes,omitempty"`
+
+	RestrictedRoomId  string `json:"restricted_room_id,omitempty"`
+	RestrictedEventId string `json:"restricted_event_id,omitempty"`
 }
 
 func canChangeAttributes(rctx rcontext.RequestContext, r *http.Request, origin string, user api.UserInfo) bool {
@@ -59,7 +66,14 @@ func GetAttributes(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 	}
 
 	return &api.DoNotCacheResponse{Payload: &Attributes{
-		Purpose: attrs.Purpose,
+		Purpose:   attrs.Purpose,
+		Protected: attrs.Protected,
+		ExpiresTs: attrs.ExpiresTs,
+
+		OriginalSizeBytes: attrs.OriginalSizeBytes,
+
+		RestrictedRoomId:  attrs.RestrictedRoomId,
+		RestrictedEventId: attrs.RestrictedEventId,
 	}}
 }
 
@@ -115,5 +129,28 @@ func SetAttributes(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 		}
 	}
 
+	if attrs.Protected != newAttrs.Protected {
+		err = db.UpsertProtected(origin, mediaId, newAttrs.Protected)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("failed to update attributes: protected")
+		}
+	}
+
+	if attrs.ExpiresTs != newAttrs.ExpiresTs {
+		if newAttrs.ExpiresTs < 0 {
+			return api.BadRequest("expires_ts must be a timestamp, or 0 to not expire")
+		}
+		err = db.UpsertExpiry(origin, mediaId, newAttrs.ExpiresTs)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("failed to update attributes: expires_ts")
+		}
+	}
+
+	recordAdminAction(r, rctx, user, "set_media_attributes", map[string]interface{}{"purpose": newAttrs.Purpose, "protected": newAttrs.Protected, "expires_ts": newAttrs.ExpiresTs}, []string{"mxc://" + origin + "/" + mediaId})
+
 	return &api.DoNotCacheResponse{Payload: newAttrs}
 }
@@ -0,0 +1,203 @@
+package custom
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+type MediaRecordThumbnail struct {
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	Method            string `json:"method"`
+	Animated          bool   `json:"animated"`
+	ContentType       string `json:"content_type"`
+	SizeBytes         int64  `json:"size_bytes"`
+	Sha256Hash        string `json:"sha256_hash"`
+	DatastoreId       string `json:"datastore_id"`
+	DatastoreLocation string `json:"datastore_location"`
+	CreatedTs         int64  `json:"created_ts"`
+}
+
+// MediaRecordAttribution is where the media was uploaded from, if that was recorded.
+type MediaRecordAttribution struct {
+	IpAddress  string `json:"ip_address"`
+	UserAgent  string `json:"user_agent"`
+	TokenHash  string `json:"access_token_sha256,omitempty"`
+	RecordedTs int64  `json:"recorded_ts"`
+}
+
+type MediaRecord struct {
+	Mxc               string                  `json:"mxc"`
+	UploadedBy        string                  `json:"uploaded_by"`
+	UploadName        string                  `json:"upload_name"`
+	ContentType       string                  `json:"content_type"`
+	DetectedType      string                  `json:"detected_content_type,omitempty"`
+	SizeBytes         int64                   `json:"size_bytes"`
+	StoredSizeBytes   int64                   `json:"stored_size_bytes"`
+	Sha256Hash        string                  `json:"sha256_hash"`
+	DatastoreId       string                  `json:"datastore_id"`
+	DatastoreLocation string                  `json:"datastore_location"`
+	Quarantined       bool                    `json:"quarantined"`
+	CreatedTs         int64                   `json:"created_ts"`
+	Thumbnails        []*MediaRecordThumbnail `json:"thumbnails"`
+	SameHash          []string                `json:"same_hash"`
+	UploadAttribution *MediaRecordAttribution `json:"upload_attribution,omitempty"`
+}
+
+type MediaRedownload struct {
+	Redownloaded              bool             `json:"redownloaded"`
+	Error                     string           `json:"error,omitempty"`
+	OldSha256Hash             string           `json:"old_sha256_hash"`
+	OldSizeBytes              int64            `json:"old_size_bytes"`
+	NewSha256Hash             string           `json:"new_sha256_hash,omitempty"`
+	NewSizeBytes              int64            `json:"new_size_bytes,omitempty"`
+	BytesReclaimed            int64            `json:"bytes_reclaimed"`
+	BytesReclaimedByDatastore map[string]int64 `json:"bytes_reclaimed_by_datastore"`
+}
+
+func GetMediaRecord(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	origin := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	mediaDb := storage.GetDatabase().GetMediaStore(rctx)
+	media, err := mediaDb.Get(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get media record")
+	}
+
+	thumbs, err := storage.GetDatabase().GetThumbnailStore(rctx).GetAllForMedia(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get thumbnails")
+	}
+
+	sameHash, err := mediaDb.GetByHash(media.Sha256Hash)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get media with the same hash")
+	}
+
+	record := &MediaRecord{
+		Mxc:               media.MxcUri(),
+		UploadedBy:        media.UserId,
+		UploadName:        media.UploadName,
+		ContentType:       media.ContentType,
+		DetectedType:      media.DetectedContentType,
+		SizeBytes:         media.SizeBytes,
+		StoredSizeBytes:   media.StoredSizeBytes,
+		Sha256Hash:        media.Sha256Hash,
+		DatastoreId:       media.DatastoreId,
+		DatastoreLocation: media.Location,
+		Quarantined:       media.Quarantined,
+		CreatedTs:         media.CreationTs,
+		Thumbnails:        make([]*MediaRecordThumbnail, 0),
+		SameHash:          make([]string, 0),
+	}
+	for _, t := range thumbs {
+		record.Thumbnails = append(record.Thumbnails, &MediaRecordThumbnail{
+			Width:             t.Width,
+			Height:            t.Height,
+			Method:            t.Method,
+			Animated:          t.Animated,
+			ContentType:       t.ContentType,
+			SizeBytes:         t.SizeBytes,
+			Sha256Hash:        t.Sha256Hash,
+			DatastoreId:       t.DatastoreId,
+			DatastoreLocation: t.Location,
+			CreatedTs:         t.CreationTs,
+		})
+	}
+	for _, m := range sameHash {
+		if m.Origin == media.Origin && m.MediaId == media.MediaId {
+			continue
+		}
+		record.SameHash = append(record.SameHash, m.MxcUri())
+	}
+
+	attribution, err := storage.GetDatabase().GetMetadataStore(rctx).GetUploadAttribution(origin, mediaId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get upload attribution")
+	}
+	if attribution != nil {
+		record.UploadAttribution = &MediaRecordAttribution{
+			IpAddress:  attribution.IpAddress,
+			UserAgent:  attribution.UserAgent,
+			TokenHash:  attribution.TokenHash,
+			RecordedTs: attribution.RecordedTs,
+		}
+	}
+
+	return &api.DoNotCacheResponse{Payload: record}
+}
+
+func RedownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	origin := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+	})
+
+	old, media, reclaimed, err := maintenance_controller.RedownloadRemoteMedia(origin, mediaId, rctx)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err == common.ErrMediaNotRemote {
+		return api.BadRequest("only remote media can be downloaded again")
+	}
+	if err == common.ErrMediaQuarantined {
+		return api.BadRequest("quarantined media can't be downloaded again")
+	}
+	if old == nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to remove the old copy of the media")
+	}
+
+	// The old copy is gone by now, so a failed download is reported rather than treated as an error
+	resp := &MediaRedownload{
+		Redownloaded:              err == nil,
+		OldSha256Hash:             old.Sha256Hash,
+		OldSizeBytes:              old.SizeBytes,
+		BytesReclaimed:            reclaimed.Total(),
+		BytesReclaimedByDatastore: reclaimed.ByDatastore,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.NewSha256Hash = media.Sha256Hash
+		resp.NewSizeBytes = media.SizeBytes
+	}
+
+	recordAdminAction(r, rctx, user, "redownload_media", map[string]interface{}{"redownloaded": resp.Redownloaded}, []string{old.MxcUri()})
+
+	return &api.DoNotCacheResponse{Payload: resp}
+}
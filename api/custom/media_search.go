@@ -0,0 +1,106 @@
+package custom
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+type MediaSearchEntry struct {
+	MxcUri      string `json:"mxc"`
+	UploadedBy  string `json:"uploaded_by"`
+	UploadName  string `json:"upload_name"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Sha256Hash  string `json:"sha256_hash"`
+	DatastoreId string `json:"datastore_id"`
+	CreatedTs   int64  `json:"created_ts"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+type MediaSearchResponse struct {
+	Media    []*MediaSearchEntry `json:"media"`
+	NextFrom int64               `json:"next_from,omitempty"`
+}
+
+func SearchMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	query := r.URL.Query()
+
+	page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+	if errRes != nil {
+		return errRes
+	}
+	limit := page.Limit
+	from := page.From
+
+	filter := &types.MediaSearchFilter{
+		Origin:      query.Get("origin"),
+		UserId:      query.Get("user_id"),
+		ContentType: query.Get("content_type"),
+	}
+	for param, dest := range map[string]**int64{
+		"min_size":        &filter.MinSizeBytes,
+		"max_size":        &filter.MaxSizeBytes,
+		"uploaded_after":  &filter.AfterTs,
+		"uploaded_before": &filter.BeforeTs,
+	} {
+		val := query.Get(param)
+		if val == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || parsed < 0 {
+			return api.BadRequest(param + " must be a non-negative integer")
+		}
+		*dest = &parsed
+	}
+	if val := query.Get("quarantined"); val != "" {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			return api.BadRequest("quarantined must be true or false")
+		}
+		filter.Quarantined = &parsed
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filter": query.Encode(),
+		"limit":  limit,
+		"from":   from,
+	})
+
+	records, err := storage.GetDatabase().GetMediaStore(rctx).SearchMedia(filter, limit, from)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to search media")
+	}
+
+	resp := &MediaSearchResponse{Media: make([]*MediaSearchEntry, 0)}
+	for _, media := range records {
+		resp.Media = append(resp.Media, &MediaSearchEntry{
+			MxcUri:      media.MxcUri(),
+			UploadedBy:  media.UserId,
+			UploadName:  media.UploadName,
+			ContentType: media.ContentType,
+			SizeBytes:   media.SizeBytes,
+			Sha256Hash:  media.Sha256Hash,
+			DatastoreId: media.DatastoreId,
+			CreatedTs:   media.CreationTs,
+			Quarantined: media.Quarantined,
+		})
+	}
+	if int64(len(records)) == limit {
+		resp.NextFrom = from + limit
+	}
+
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(resp.Media, resp.NextFrom)}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
@@ -2,7 +2,9 @@ package custom
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/getsentry/sentry-go"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 
@@ -16,10 +18,11 @@ import (
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
-type MediaPurgedResponse struct {
-	NumRemoved int `json:"total_removed"`
+type PurgeStartedResponse struct {
+	TaskID int `json:"task_id"`
 }
 
 func PurgeRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -37,14 +40,10 @@ func PurgeRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	})
 
 	// We don't bother clearing the cache because it's still probably useful there
-	removed, err := maintenance_controller.PurgeRemoteMediaBefore(beforeTs, rctx)
-	if err != nil {
-		rctx.Log.Error("Error purging remote media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Error purging remote media")
-	}
-
-	return &api.DoNotCacheResponse{Payload: &MediaPurgedResponse{NumRemoved: removed}}
+	purgeParams := map[string]interface{}{"before_ts": beforeTs}
+	return startPurge(r, rctx, user, "purge_remote", purgeParams, func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+		return maintenance_controller.PurgeRemoteMediaBefore(beforeTs, task, ctx)
+	})
 }
 
 func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -84,7 +83,7 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 		}
 	}
 
-	err := maintenance_controller.PurgeMedia(server, mediaId, rctx)
+	reclaimed, err := maintenance_controller.PurgeMedia(server, mediaId, rctx)
 	if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
 		return api.NotFoundError()
 	}
@@ -94,36 +93,146 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 		return api.InternalServerError("error purging media")
 	}
 
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true}}
+	recordAdminAction(r, rctx, user, "purge_media", nil, []string{"mxc://" + server + "/" + mediaId})
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{
+		"purged":                       true,
+		"bytes_reclaimed":              reclaimed.Total(),
+		"bytes_reclaimed_by_datastore": reclaimed.ByDatastore,
+	}}
 }
 
-func PurgeQuarantined(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
-	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
-	localServerName := r.Host
+type MediaListPurgeResult struct {
+	Mxc    string `json:"mxc"`
+	Purged bool   `json:"purged"`
+	Error  string `json:"error,omitempty"`
+}
 
-	var affected []*types.Media
-	var err error
+const maxPurgeListSize = 1000
 
-	if isGlobalAdmin {
-		affected, err = maintenance_controller.PurgeQuarantined(rctx)
-	} else if isLocalAdmin {
-		affected, err = maintenance_controller.PurgeQuarantinedFor(localServerName, rctx)
-	} else {
-		return api.AuthFailed()
-	}
+func PurgeMediaList(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
+	localServerName := r.Host
 
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
+		rctx.Log.Error(err)
 		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("failed to read request")
 	}
 
 	mxcs := make([]string, 0)
-	for _, a := range affected {
-		mxcs = append(mxcs, a.MxcUri())
+	err = json.Unmarshal(b, &mxcs)
+	if err != nil {
+		return api.BadRequest("expected a JSON array of mxc URIs")
+	}
+	if len(mxcs) == 0 {
+		return api.BadRequest("no mxc URIs given")
+	}
+	if len(mxcs) > maxPurgeListSize {
+		return api.BadRequest("too many mxc URIs: at most " + strconv.Itoa(maxPurgeListSize) + " can be purged at a time")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"numMxcs": len(mxcs),
+	})
+
+	// Work out which media the user may purge before touching anything, using the same rules
+	// as purging a single record.
+	results := make([]*MediaListPurgeResult, 0)
+	allowed := make([]string, 0)
+	seen := make(map[string]bool)
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	for _, mxc := range mxcs {
+		if seen[mxc] {
+			continue
+		}
+		seen[mxc] = true
+
+		result := &MediaListPurgeResult{Mxc: mxc}
+		results = append(results, result)
+
+		server, mediaId, err := util.SplitMxc(mxc)
+		if err != nil {
+			result.Error = "invalid mxc URI"
+			continue
+		}
+		if !isGlobalAdmin {
+			if server != localServerName {
+				result.Error = "not allowed"
+				continue
+			}
+			if !isLocalAdmin {
+				m, err := db.Get(server, mediaId)
+				if err == sql.ErrNoRows {
+					result.Error = "not found"
+					continue
+				}
+				if err != nil {
+					rctx.Log.Error("Error checking ownership of media: " + err.Error())
+					sentry.CaptureException(err)
+					result.Error = "error checking media ownership"
+					continue
+				}
+				if m.UserId != user.UserId {
+					result.Error = "not allowed"
+					continue
+				}
+			}
+		}
+		allowed = append(allowed, mxc)
+	}
+
+	failed, reclaimed := maintenance_controller.PurgeMediaList(allowed, rctx)
+
+	affected := make([]string, 0)
+	for _, result := range results {
+		if result.Error != "" {
+			continue
+		}
+		err, isFailed := failed[result.Mxc]
+		if !isFailed {
+			result.Purged = true
+			affected = append(affected, result.Mxc)
+		} else if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
+			result.Error = "not found"
+		} else {
+			sentry.CaptureException(err)
+			result.Error = "error purging media"
+		}
+	}
+
+	if len(affected) > 0 {
+		recordAdminAction(r, rctx, user, "purge_media_list", nil, affected)
+	}
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{
+		"results":                      results,
+		"total_purged":                 len(affected),
+		"bytes_reclaimed":              reclaimed.Total(),
+		"bytes_reclaimed_by_datastore": reclaimed.ByDatastore,
+	}}
+}
+
+func PurgeQuarantined(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
+	localServerName := r.Host
+
+	var purge maintenance_controller.PurgeFunc
+	if isGlobalAdmin {
+		purge = func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+			return maintenance_controller.PurgeQuarantined(task, ctx)
+		}
+	} else if isLocalAdmin {
+		purge = func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+			return maintenance_controller.PurgeQuarantinedFor(localServerName, task, ctx)
+		}
+	} else {
+		return api.AuthFailed()
 	}
 
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+	return startPurge(r, rctx, user, "purge_quarantined", nil, purge)
 }
 
 func PurgeOldMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -151,20 +260,10 @@ func PurgeOldMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 		"include_local": includeLocal,
 	})
 
-	affected, err := maintenance_controller.PurgeOldMedia(beforeTs, includeLocal, rctx)
-
-	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
-	}
-
-	mxcs := make([]string, 0)
-	for _, a := range affected {
-		mxcs = append(mxcs, a.MxcUri())
-	}
-
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+	purgeParams := map[string]interface{}{"before_ts": beforeTs, "include_local": includeLocal}
+	return startPurge(r, rctx, user, "purge_old", purgeParams, func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+		return maintenance_controller.PurgeOldMedia(beforeTs, includeLocal, task, ctx)
+	})
 }
 
 func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -203,20 +302,10 @@ func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		return api.AuthFailed()
 	}
 
-	affected, err := maintenance_controller.PurgeUserMedia(userId, beforeTs, rctx)
-
-	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
-	}
-
-	mxcs := make([]string, 0)
-	for _, a := range affected {
-		mxcs = append(mxcs, a.MxcUri())
-	}
-
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+	purgeParams := map[string]interface{}{"user_id": userId, "before_ts": beforeTs}
+	return startPurge(r, rctx, user, "purge_user", purgeParams, func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+		return maintenance_controller.PurgeUserMedia(userId, beforeTs, task, ctx)
+	})
 }
 
 func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -283,20 +372,10 @@ func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		}
 	}
 
-	affected, err := maintenance_controller.PurgeRoomMedia(mxcs, beforeTs, rctx)
-
-	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
-	}
-
-	mxcs = make([]string, 0)
-	for _, a := range affected {
-		mxcs = append(mxcs, a.MxcUri())
-	}
-
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+	purgeParams := map[string]interface{}{"room_id": roomId, "before_ts": beforeTs}
+	return startPurge(r, rctx, user, "purge_room", purgeParams, func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+		return maintenance_controller.PurgeRoomMedia(mxcs, beforeTs, task, ctx)
+	})
 }
 
 func PurgeDomainMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -328,20 +407,33 @@ func PurgeDomainMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 		return api.AuthFailed()
 	}
 
-	affected, err := maintenance_controller.PurgeDomainMedia(serverName, beforeTs, rctx)
+	purgeParams := map[string]interface{}{"server_name": serverName, "before_ts": beforeTs}
+	return startPurge(r, rctx, user, "purge_server", purgeParams, func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *maintenance_controller.ReclaimedBytes, error) {
+		return maintenance_controller.PurgeDomainMedia(serverName, beforeTs, task, ctx)
+	})
+}
 
-	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+// startPurge runs the purge in the background, returning the task to follow. The purge is recorded in
+// the audit log once it is done, along with the media it purged.
+func startPurge(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, action string, params map[string]interface{}, purge maintenance_controller.PurgeFunc) interface{} {
+	if params == nil {
+		params = make(map[string]interface{})
 	}
 
-	mxcs := make([]string, 0)
-	for _, a := range affected {
-		mxcs = append(mxcs, a.MxcUri())
+	task, err := maintenance_controller.StartPurge(action, params, purge, func(purged []*types.Media, ctx rcontext.RequestContext) {
+		mxcs := make([]string, 0)
+		for _, m := range purged {
+			mxcs = append(mxcs, m.MxcUri())
+		}
+		recordAdminAction(r, ctx, user, action, params, mxcs)
+	}, rctx)
+	if err != nil {
+		rctx.Log.Error("Error starting purge: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error starting purge")
 	}
 
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+	return &api.DoNotCacheResponse{Payload: &PurgeStartedResponse{TaskID: task.ID}}
 }
 
 func getPurgeRequestInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) (bool, bool) {
@@ -0,0 +1,225 @@
+package custom
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type PurgeScheduleRequest struct {
+	Kind          string `json:"kind"`
+	Target        string `json:"target"`
+	IncludeLocal  bool   `json:"include_local"`
+	OlderThanDays int    `json:"older_than_days"`
+	TimeOfDay     string `json:"time_of_day"`
+	IntervalDays  int    `json:"interval_days"`
+}
+
+type PurgeSchedule struct {
+	ID            int64  `json:"id"`
+	Kind          string `json:"kind"`
+	Target        string `json:"target,omitempty"`
+	IncludeLocal  bool   `json:"include_local"`
+	OlderThanDays int    `json:"older_than_days"`
+	TimeOfDay     string `json:"time_of_day"`
+	IntervalDays  int    `json:"interval_days"`
+	CreatedBy     string `json:"created_by"`
+	CreatedTs     int64  `json:"created_ts"`
+	NextRunTs     int64  `json:"next_run_ts"`
+}
+
+type PurgeScheduleRun struct {
+	StartTs        int64  `json:"start_ts"`
+	EndTs          int64  `json:"end_ts"`
+	Purged         int    `json:"purged"`
+	BytesReclaimed int64  `json:"bytes_reclaimed"`
+	Error          string `json:"error,omitempty"`
+}
+
+func purgeScheduleResponse(s *types.PurgeSchedule) *PurgeSchedule {
+	return &PurgeSchedule{
+		ID:            s.ID,
+		Kind:          s.Kind,
+		Target:        s.Target,
+		IncludeLocal:  s.IncludeLocal,
+		OlderThanDays: s.OlderThanDays,
+		TimeOfDay:     s.TimeOfDay,
+		IntervalDays:  s.IntervalDays,
+		CreatedBy:     s.CreatedBy,
+		CreatedTs:     s.CreatedTs,
+		NextRunTs:     s.NextRunTs,
+	}
+}
+
+func GetPurgeSchedules(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	schedules, err := storage.GetDatabase().GetMetadataStore(rctx).GetPurgeSchedules()
+	if err != nil {
+		rctx.Log.Error("Error getting purge schedules: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting purge schedules")
+	}
+
+	resp := make([]*PurgeSchedule, 0)
+	for _, s := range schedules {
+		resp = append(resp, purgeScheduleResponse(s))
+	}
+
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(resp))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(resp[start:end], nextFrom).WithTotal(int64(len(resp)))}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
+
+func CreatePurgeSchedule(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read request")
+	}
+
+	req := &PurgeScheduleRequest{IntervalDays: 1}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		return api.BadRequest("failed to parse request: " + err.Error())
+	}
+
+	schedule := &types.PurgeSchedule{
+		Kind:          req.Kind,
+		Target:        req.Target,
+		IncludeLocal:  req.IncludeLocal,
+		OlderThanDays: req.OlderThanDays,
+		TimeOfDay:     req.TimeOfDay,
+		IntervalDays:  req.IntervalDays,
+		CreatedBy:     user.UserId,
+		CreatedTs:     util.NowMillis(),
+	}
+	err = maintenance_controller.ValidatePurgeSchedule(schedule)
+	if err != nil {
+		return api.BadRequest(err.Error())
+	}
+	schedule.NextRunTs, err = maintenance_controller.FirstPurgeScheduleRun(schedule, schedule.CreatedTs)
+	if err != nil {
+		return api.BadRequest(err.Error())
+	}
+
+	err = storage.GetDatabase().GetMetadataStore(rctx).InsertPurgeSchedule(schedule)
+	if err != nil {
+		rctx.Log.Error("Error creating purge schedule: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error creating purge schedule")
+	}
+
+	recordAdminAction(r, rctx, user, "create_purge_schedule", map[string]interface{}{
+		"schedule_id":     schedule.ID,
+		"kind":            schedule.Kind,
+		"target":          schedule.Target,
+		"include_local":   schedule.IncludeLocal,
+		"older_than_days": schedule.OlderThanDays,
+		"time_of_day":     schedule.TimeOfDay,
+		"interval_days":   schedule.IntervalDays,
+	}, nil)
+
+	return &api.DoNotCacheResponse{Payload: purgeScheduleResponse(schedule)}
+}
+
+func DeletePurgeSchedule(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	scheduleId, err := strconv.ParseInt(params["scheduleId"], 10, 64)
+	if err != nil {
+		return api.BadRequest("invalid schedule ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"scheduleId": scheduleId,
+	})
+
+	deleted, err := storage.GetDatabase().GetMetadataStore(rctx).DeletePurgeSchedule(scheduleId)
+	if err != nil {
+		rctx.Log.Error("Error deleting purge schedule: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error deleting purge schedule")
+	}
+	if !deleted {
+		return api.NotFoundError()
+	}
+
+	recordAdminAction(r, rctx, user, "delete_purge_schedule", map[string]interface{}{"schedule_id": scheduleId}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
+}
+
+func GetPurgeScheduleRuns(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	scheduleId, err := strconv.ParseInt(params["scheduleId"], 10, 64)
+	if err != nil {
+		return api.BadRequest("invalid schedule ID")
+	}
+
+	page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"scheduleId": scheduleId,
+	})
+
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+	_, err = db.GetPurgeSchedule(scheduleId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error("Error getting purge schedule: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting purge schedule")
+	}
+
+	runs, err := db.GetPurgeScheduleRuns(scheduleId, page.Limit, page.From)
+	if err != nil {
+		rctx.Log.Error("Error getting purge schedule runs: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting purge schedule runs")
+	}
+
+	resp := make([]*PurgeScheduleRun, 0)
+	for _, run := range runs {
+		resp = append(resp, &PurgeScheduleRun{
+			StartTs:        run.StartTs,
+			EndTs:          run.EndTs,
+			Purged:         run.Purged,
+			BytesReclaimed: run.BytesReclaimed,
+			Error:          run.Error,
+		})
+	}
+
+	if api.IsAdminV1Request(r) {
+		nextFrom := int64(0)
+		if int64(len(runs)) == page.Limit {
+			nextFrom = page.From + page.Limit
+		}
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(resp, nextFrom)}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"github.com/getsentry/sentry-go"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -17,7 +18,33 @@ import (
 )
 
 type MediaQuarantinedResponse struct {
-	NumQuarantined int `json:"num_quarantined"`
+	NumQuarantined int      `json:"num_quarantined"`
+	Affected       []string `json:"affected"`
+}
+
+// RoomMediaQuarantinedResponse also lists all the media found in the room, including media which
+// was not quarantined (such as pinned media, or media on other servers).
+type RoomMediaQuarantinedResponse struct {
+	*MediaQuarantinedResponse
+	RoomMedia []string `json:"room_media"`
+}
+
+type QuarantinedMediaEntry struct {
+	MxcUri        string `json:"mxc"`
+	Origin        string `json:"origin"`
+	UploadedBy    string `json:"uploaded_by"`
+	UploadName    string `json:"upload_name"`
+	ContentType   string `json:"content_type"`
+	SizeBytes     int64  `json:"size_bytes"`
+	Sha256Hash    string `json:"sha256_hash"`
+	CreatedTs     int64  `json:"created_ts"`
+	QuarantinedTs int64  `json:"quarantined_ts,omitempty"`
+}
+
+type QuarantinedMediaResponse struct {
+	Total    int64                    `json:"total"`
+	Media    []*QuarantinedMediaEntry `json:"media"`
+	NextFrom int64                    `json:"next_from,omitempty"`
 }
 
 // Developer note: This isn't broken out into a dedicated controller class because the logic is slightly
@@ -45,11 +72,12 @@ func QuarantineRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api
 		return api.InternalServerError("error retrieving media in room")
 	}
 
-	var mxcs []string
+	mxcs := make([]string, 0)
 	mxcs = append(mxcs, allMedia.LocalMxcs...)
 	mxcs = append(mxcs, allMedia.RemoteMxcs...)
 
 	total := 0
+	affected := make([]string, 0)
 	for _, mxc := range mxcs {
 		server, mediaId, err := util.SplitMxc(mxc)
 		if err != nil {
@@ -69,9 +97,15 @@ func QuarantineRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api
 		}
 
 		total += resp.(*MediaQuarantinedResponse).NumQuarantined
+		affected = append(affected, resp.(*MediaQuarantinedResponse).Affected...)
 	}
 
-	return &api.DoNotCacheResponse{Payload: &MediaQuarantinedResponse{NumQuarantined: total}}
+	recordAdminAction(r, rctx, user, "quarantine_room", map[string]interface{}{"room_id": roomId}, affected)
+
+	return &api.DoNotCacheResponse{Payload: &RoomMediaQuarantinedResponse{
+		MediaQuarantinedResponse: &MediaQuarantinedResponse{NumQuarantined: total, Affected: affected},
+		RoomMedia:                mxcs,
+	}}
 }
 
 func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -80,12 +114,24 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 		return api.AuthFailed()
 	}
 
+	// Unlike purging, all of the user's media is quarantined unless a timestamp is given
+	var err error
+	beforeTs := int64(0)
+	beforeTsStr := r.URL.Query().Get("before_ts")
+	if beforeTsStr != "" {
+		beforeTs, err = strconv.ParseInt(beforeTsStr, 10, 64)
+		if err != nil {
+			return api.BadRequest("Error parsing before_ts: " + err.Error())
+		}
+	}
+
 	params := mux.Vars(r)
 
 	userId := params["userId"]
 
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"userId":     userId,
+		"beforeTs":   beforeTs,
 		"localAdmin": isLocalAdmin,
 	})
 
@@ -101,7 +147,12 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 	}
 
 	db := storage.GetDatabase().GetMediaStore(rctx)
-	userMedia, err := db.GetMediaByUser(userId)
+	var userMedia []*types.Media
+	if beforeTs > 0 {
+		userMedia, err = db.GetMediaByUserBefore(userId, beforeTs)
+	} else {
+		userMedia, err = db.GetMediaByUser(userId)
+	}
 	if err != nil {
 		rctx.Log.Error("Error while listing media for the user: " + err.Error())
 		sentry.CaptureException(err)
@@ -109,6 +160,7 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 	}
 
 	total := 0
+	affected := make([]string, 0)
 	for _, media := range userMedia {
 		resp, ok := doQuarantineOn(media, allowOtherHosts, rctx)
 		if !ok {
@@ -116,9 +168,12 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 		}
 
 		total += resp.(*MediaQuarantinedResponse).NumQuarantined
+		affected = append(affected, resp.(*MediaQuarantinedResponse).Affected...)
 	}
 
-	return &api.DoNotCacheResponse{Payload: &MediaQuarantinedResponse{NumQuarantined: total}}
+	recordAdminAction(r, rctx, user, "quarantine_user", map[string]interface{}{"user_id": userId, "before_ts": beforeTs}, affected)
+
+	return &api.DoNotCacheResponse{Payload: &MediaQuarantinedResponse{NumQuarantined: total, Affected: affected}}
 }
 
 func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -141,6 +196,19 @@ func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user a
 	}
 
 	db := storage.GetDatabase().GetMediaStore(rctx)
+
+	// Block new downloads first so nothing slips through while the known media is quarantined
+	blockNew := r.URL.Query().Get("block_new") == "true" && !util.IsServerOurs(serverName)
+	if blockNew {
+		err := db.InsertQuarantinedOrigin(serverName, user.UserId, util.NowMillis())
+		if err != nil {
+			rctx.Log.Error("Error quarantining server: " + err.Error())
+			sentry.CaptureException(err)
+			return api.InternalServerError("error quarantining server")
+		}
+		rctx.Log.Warn("No new media will be downloaded from " + serverName)
+	}
+
 	userMedia, err := db.GetAllMediaForServer(serverName)
 	if err != nil {
 		rctx.Log.Error("Error while listing media for the server: " + err.Error())
@@ -149,6 +217,7 @@ func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user a
 	}
 
 	total := 0
+	affected := make([]string, 0)
 	for _, media := range userMedia {
 		resp, ok := doQuarantineOn(media, allowOtherHosts, rctx)
 		if !ok {
@@ -156,9 +225,119 @@ func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user a
 		}
 
 		total += resp.(*MediaQuarantinedResponse).NumQuarantined
+		affected = append(affected, resp.(*MediaQuarantinedResponse).Affected...)
 	}
 
-	return &api.DoNotCacheResponse{Payload: &MediaQuarantinedResponse{NumQuarantined: total}}
+	recordAdminAction(r, rctx, user, "quarantine_server", map[string]interface{}{"server_name": serverName, "block_new": blockNew}, affected)
+
+	return &api.DoNotCacheResponse{Payload: &MediaQuarantinedResponse{NumQuarantined: total, Affected: affected}}
+}
+
+// GetQuarantinedMedia lists quarantined media, most recently quarantined first, so it can be reviewed
+// before being purged.
+func GetQuarantinedMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	origin := r.URL.Query().Get("origin")
+
+	page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+	if errRes != nil {
+		return errRes
+	}
+	limit := page.Limit
+	from := page.From
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin": origin,
+		"limit":  limit,
+		"from":   from,
+	})
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+
+	total, err := db.GetQuarantinedMediaCount(origin)
+	if err != nil {
+		rctx.Log.Error("Error counting quarantined media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error counting quarantined media")
+	}
+
+	records, err := db.GetQuarantinedMediaPaginated(origin, limit, from)
+	if err != nil {
+		rctx.Log.Error("Error getting quarantined media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting quarantined media")
+	}
+
+	resp := &QuarantinedMediaResponse{
+		Total: total,
+		Media: make([]*QuarantinedMediaEntry, 0),
+	}
+	for _, m := range records {
+		resp.Media = append(resp.Media, &QuarantinedMediaEntry{
+			MxcUri:        m.MxcUri(),
+			Origin:        m.Origin,
+			UploadedBy:    m.UserId,
+			UploadName:    m.UploadName,
+			ContentType:   m.ContentType,
+			SizeBytes:     m.SizeBytes,
+			Sha256Hash:    m.Sha256Hash,
+			CreatedTs:     m.CreationTs,
+			QuarantinedTs: m.QuarantinedTs,
+		})
+	}
+	if next := from + int64(len(records)); next < total {
+		resp.NextFrom = next
+	}
+
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(resp.Media, resp.NextFrom).WithTotal(total)}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
+
+// GetQuarantinedServers lists the remote servers which no new media is downloaded from.
+func GetQuarantinedServers(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	origins, err := storage.GetDatabase().GetMediaStore(rctx).GetQuarantinedOrigins()
+	if err != nil {
+		rctx.Log.Error("Error getting quarantined servers: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting quarantined servers")
+	}
+
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(origins))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(origins[start:end], nextFrom).WithTotal(int64(len(origins)))}
+	}
+	return &api.DoNotCacheResponse{Payload: origins}
+}
+
+// UnblockQuarantinedServer allows new media to be downloaded from the server again. Media which was
+// already quarantined stays quarantined.
+func UnblockQuarantinedServer(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	serverName := params["serverName"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"serverName": serverName,
+	})
+
+	removed, err := storage.GetDatabase().GetMediaStore(rctx).DeleteQuarantinedOrigin(serverName)
+	if err != nil {
+		rctx.Log.Error("Error unblocking server: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error unblocking server")
+	}
+	if !removed {
+		return api.NotFoundError()
+	}
+
+	rctx.Log.Info("New media can be downloaded from " + serverName + " again")
+	recordAdminAction(r, rctx, user, "unblock_server", map[string]interface{}{"server_name": serverName}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
 }
 
 func QuarantineMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -182,7 +361,10 @@ func QuarantineMedia(r *http.Request, rctx rcontext.RequestContext, user api.Use
 		return api.BadRequest("unable to quarantine media on other homeservers")
 	}
 
-	resp, _ := doQuarantine(rctx, server, mediaId, allowOtherHosts)
+	resp, ok := doQuarantine(rctx, server, mediaId, allowOtherHosts)
+	if ok {
+		recordAdminAction(r, rctx, user, "quarantine_media", nil, resp.(*MediaQuarantinedResponse).Affected)
+	}
 	return &api.DoNotCacheResponse{Payload: resp}
 }
 
@@ -192,7 +374,7 @@ func doQuarantine(ctx rcontext.RequestContext, origin string, mediaId string, al
 	if err != nil {
 		if err == sql.ErrNoRows {
 			ctx.Log.Warn("Media not found, could not quarantine: " + origin + "/" + mediaId)
-			return &MediaQuarantinedResponse{0}, true
+			return &MediaQuarantinedResponse{NumQuarantined: 0, Affected: []string{}}, true
 		}
 
 		ctx.Log.Error("Error fetching media: " + err.Error())
@@ -214,31 +396,33 @@ func doQuarantineOn(media *types.Media, allowOtherHosts bool, ctx rcontext.Reque
 	}
 	if attr.Purpose == types.PurposePinned {
 		ctx.Log.Warn("Refusing to quarantine media due to it being pinned")
-		return &MediaQuarantinedResponse{NumQuarantined: 0}, true
+		return &MediaQuarantinedResponse{NumQuarantined: 0, Affected: []string{}}, true
 	}
 
 	// We reset the entire cache to avoid any lingering links floating around, such as thumbnails or other media.
 	// The reset is done before actually quarantining the media because that could fail for some reason
 	internal_cache.Get().Reset()
 
-	num, err := setMediaQuarantined(media, true, allowOtherHosts, ctx)
+	affected, err := setMediaQuarantined(media, true, allowOtherHosts, ctx)
 	if err != nil {
 		ctx.Log.Error("Error quarantining media: " + err.Error())
 		sentry.CaptureException(err)
 		return api.InternalServerError("Error quarantining media"), false
 	}
 
-	return &MediaQuarantinedResponse{NumQuarantined: num}, true
+	return &MediaQuarantinedResponse{NumQuarantined: len(affected), Affected: affected}, true
 }
 
-func setMediaQuarantined(media *types.Media, isQuarantined bool, allowOtherHosts bool, ctx rcontext.RequestContext) (int, error) {
+// setMediaQuarantined flags the media, and all other media with the same hash, returning the MXC URIs
+// of everything which was flagged.
+func setMediaQuarantined(media *types.Media, isQuarantined bool, allowOtherHosts bool, ctx rcontext.RequestContext) ([]string, error) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
-	numQuarantined := 0
+	affected := make([]string, 0)
 
 	// Quarantine all media with the same hash, including the one requested
 	otherMedia, err := db.GetByHash(media.Sha256Hash)
 	if err != nil {
-		return numQuarantined, err
+		return affected, err
 	}
 	for _, m := range otherMedia {
 		if m.Origin != media.Origin && !allowOtherHosts {
@@ -248,14 +432,14 @@ func setMediaQuarantined(media *types.Media, isQuarantined bool, allowOtherHosts
 
 		err := db.SetQuarantined(m.Origin, m.MediaId, isQuarantined)
 		if err != nil {
-			return numQuarantined, err
+			return affected, err
 		}
 
-		numQuarantined++
+		affected = append(affected, m.MxcUri())
 		ctx.Log.Warn("Media has been quarantined: " + m.Origin + "/" + m.MediaId)
 	}
 
-	return numQuarantined, nil
+	return affected, nil
 }
 
 func getQuarantineRequestInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) (bool, bool, bool) {
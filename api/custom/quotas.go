@@ -0,0 +1,139 @@
+package custom
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type UserQuotaSettings struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+type UserQuotaInfo struct {
+	UserId        string `json:"user_id"`
+	MaxBytes      int64  `json:"max_bytes"`
+	MaxFiles      int64  `json:"max_files"`
+	UpdatedTs     int64  `json:"updated_ts"`
+	UploadedBytes int64  `json:"uploaded_bytes"`
+	UploadedFiles int64  `json:"uploaded_files"`
+}
+
+func GetUserQuota(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+	})
+
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+	q, err := db.GetUserQuota(userId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get quota")
+	}
+
+	uploadedBytes := int64(0)
+	stat, err := db.GetUserStats(userId)
+	if err != nil && err != sql.ErrNoRows {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get user stats")
+	}
+	if stat != nil {
+		uploadedBytes = stat.UploadedBytes
+	}
+
+	uploadedFiles, err := storage.GetDatabase().GetMediaStore(rctx).GetMediaCountByUser(userId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to count user media")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &UserQuotaInfo{
+		UserId:        q.UserId,
+		MaxBytes:      q.MaxBytes,
+		MaxFiles:      q.MaxFiles,
+		UpdatedTs:     q.UpdatedTs,
+		UploadedBytes: uploadedBytes,
+		UploadedFiles: uploadedFiles,
+	}}
+}
+
+func SetUserQuota(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+	})
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read quota")
+	}
+
+	settings := &UserQuotaSettings{}
+	err = json.Unmarshal(b, &settings)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.BadRequest("failed to parse quota")
+	}
+	if settings.MaxBytes < 0 || settings.MaxFiles < 0 {
+		return api.BadRequest("max_bytes and max_files must not be negative")
+	}
+
+	q, err := storage.GetDatabase().GetMetadataStore(rctx).SetUserQuota(userId, settings.MaxBytes, settings.MaxFiles)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to set quota")
+	}
+
+	recordAdminAction(r, rctx, user, "set_user_quota", map[string]interface{}{"user_id": userId, "max_bytes": q.MaxBytes, "max_files": q.MaxFiles}, nil)
+
+	return &api.DoNotCacheResponse{Payload: q}
+}
+
+func DeleteUserQuota(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+	})
+
+	err := storage.GetDatabase().GetMetadataStore(rctx).DeleteUserQuota(userId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to delete quota")
+	}
+
+	recordAdminAction(r, rctx, user, "delete_user_quota", map[string]interface{}{"user_id": userId}, nil)
+
+	return &api.EmptyResponse{}
+}
@@ -0,0 +1,138 @@
+package custom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type UserRateLimitSettings struct {
+	Action            string  `json:"action"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+func isRateLimitAction(action string) bool {
+	for _, a := range ratelimit.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func GetUserRateLimits(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+	})
+
+	limits, err := storage.GetDatabase().GetMetadataStore(rctx).GetUserRateLimits(userId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get rate limits")
+	}
+
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(limits))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(limits[start:end], nextFrom).WithTotal(int64(len(limits)))}
+	}
+	return &api.DoNotCacheResponse{Payload: limits}
+}
+
+func SetUserRateLimit(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+	})
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read rate limit")
+	}
+
+	settings := &UserRateLimitSettings{}
+	err = json.Unmarshal(b, &settings)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.BadRequest("failed to parse rate limit")
+	}
+	if !isRateLimitAction(settings.Action) {
+		return api.BadRequest("action must be one of upload, download, or preview")
+	}
+	if settings.RequestsPerSecond < 0 || settings.Burst < 0 {
+		return api.BadRequest("requests_per_second and burst must not be negative")
+	}
+	if settings.RequestsPerSecond > 0 && settings.Burst == 0 {
+		return api.BadRequest("burst must be at least 1 when requests_per_second is set")
+	}
+
+	l, err := storage.GetDatabase().GetMetadataStore(rctx).SetUserRateLimit(userId, settings.Action, settings.RequestsPerSecond, settings.Burst)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to set rate limit")
+	}
+	ratelimit.ForgetUser(userId)
+
+	recordAdminAction(r, rctx, user, "set_user_rate_limit", map[string]interface{}{
+		"user_id":             userId,
+		"action":              l.Action,
+		"requests_per_second": l.RequestsPerSecond,
+		"burst":               l.Burst,
+	}, nil)
+
+	return &api.DoNotCacheResponse{Payload: l}
+}
+
+func DeleteUserRateLimit(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+	action := r.URL.Query().Get("action")
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+		"action": action,
+	})
+
+	if action != "" && !isRateLimitAction(action) {
+		return api.BadRequest("action must be one of upload, download, or preview")
+	}
+
+	err := storage.GetDatabase().GetMetadataStore(rctx).DeleteUserRateLimit(userId, action)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to delete rate limit")
+	}
+	ratelimit.ForgetUser(userId)
+
+	recordAdminAction(r, rctx, user, "delete_user_rate_limit", map[string]interface{}{"user_id": userId, "action": action}, nil)
+
+	return &api.EmptyResponse{}
+}
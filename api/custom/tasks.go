@@ -13,12 +13,14 @@ import (
 )
 
 type TaskStatus struct {
-	TaskID     int                    `json:"task_id"`
-	Name       string                 `json:"task_name"`
-	Params     map[string]interface{} `json:"params"`
-	StartTs    int64                  `json:"start_ts"`
-	EndTs      int64                  `json:"end_ts"`
-	IsFinished bool                   `json:"is_finished"`
+	TaskID      int                    `json:"task_id"`
+	Name        string                 `json:"task_name"`
+	Params      map[string]interface{} `json:"params"`
+	StartTs     int64                  `json:"start_ts"`
+	EndTs       int64                  `json:"end_ts"`
+	IsFinished  bool                   `json:"is_finished"`
+	IsCancelled bool                   `json:"is_cancelled"`
+	Progress    map[string]interface{} `json:"progress,omitempty"`
 }
 
 func GetTask(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -45,12 +47,14 @@ func GetTask(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) i
 	}
 
 	return &api.DoNotCacheResponse{Payload: &TaskStatus{
-		TaskID:     task.ID,
-		Name:       task.Name,
-		Params:     task.Params,
-		StartTs:    task.StartTs,
-		EndTs:      task.EndTs,
-		IsFinished: task.EndTs > 0,
+		TaskID:      task.ID,
+		Name:        task.Name,
+		Params:      task.Params,
+		StartTs:     task.StartTs,
+		EndTs:       task.EndTs,
+		IsFinished:  task.EndTs > 0,
+		IsCancelled: task.Cancelled,
+		Progress:    task.Progress,
 	}}
 }
 
@@ -67,15 +71,25 @@ func ListAllTasks(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 	statusObjs := make([]*TaskStatus, 0)
 	for _, task := range tasks {
 		statusObjs = append(statusObjs, &TaskStatus{
-			TaskID:     task.ID,
-			Name:       task.Name,
-			Params:     task.Params,
-			StartTs:    task.StartTs,
-			EndTs:      task.EndTs,
-			IsFinished: task.EndTs > 0,
+			TaskID:      task.ID,
+			Name:        task.Name,
+			Params:      task.Params,
+			StartTs:     task.StartTs,
+			EndTs:       task.EndTs,
+			IsFinished:  task.EndTs > 0,
+			IsCancelled: task.Cancelled,
+			Progress:    task.Progress,
 		})
 	}
 
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(statusObjs))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(statusObjs[start:end], nextFrom).WithTotal(int64(len(statusObjs)))}
+	}
 	return &api.DoNotCacheResponse{Payload: statusObjs}
 }
 
@@ -95,14 +109,55 @@ func ListUnfinishedTasks(r *http.Request, rctx rcontext.RequestContext, user api
 			continue
 		}
 		statusObjs = append(statusObjs, &TaskStatus{
-			TaskID:     task.ID,
-			Name:       task.Name,
-			Params:     task.Params,
-			StartTs:    task.StartTs,
-			EndTs:      task.EndTs,
-			IsFinished: task.EndTs > 0,
+			TaskID:      task.ID,
+			Name:        task.Name,
+			Params:      task.Params,
+			StartTs:     task.StartTs,
+			EndTs:       task.EndTs,
+			IsFinished:  task.EndTs > 0,
+			IsCancelled: task.Cancelled,
+			Progress:    task.Progress,
 		})
 	}
 
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(statusObjs))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(statusObjs[start:end], nextFrom).WithTotal(int64(len(statusObjs)))}
+	}
 	return &api.DoNotCacheResponse{Payload: statusObjs}
 }
+
+func CancelTask(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	taskIdStr := params["taskId"]
+	taskId, err := strconv.Atoi(taskIdStr)
+	if err != nil {
+		rctx.Log.Error(err)
+		return api.BadRequest("invalid task ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"taskId": taskId,
+	})
+
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+
+	cancelled, err := db.CancelBackgroundTask(taskId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to cancel task")
+	}
+	if !cancelled {
+		return api.BadRequest("task does not exist or has already finished")
+	}
+
+	rctx.Log.Info("Task cancelled by ", user.UserId)
+	recordAdminAction(r, rctx, user, "cancel_task", map[string]interface{}{"task_id": taskId}, nil)
+	return &api.EmptyResponse{}
+}
@@ -0,0 +1,106 @@
+package custom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type UploadBanRequest struct {
+	Pattern string `json:"pattern"`
+}
+
+func readUploadBanRequest(r *http.Request, rctx rcontext.RequestContext) (*UploadBanRequest, *api.ErrorResponse) {
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return nil, api.InternalServerError("failed to read request")
+	}
+
+	req := &UploadBanRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		return nil, api.BadRequest("failed to parse request: " + err.Error())
+	}
+	if req.Pattern == "" {
+		return nil, api.BadRequest("a user ID or pattern is required")
+	}
+
+	return req, nil
+}
+
+func GetUploadBans(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	bans, err := storage.GetDatabase().GetMetadataStore(rctx).GetUploadBans()
+	if err != nil {
+		rctx.Log.Error("Error getting upload bans: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error getting upload bans")
+	}
+
+	if api.IsAdminV1Request(r) {
+		page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+		if errRes != nil {
+			return errRes
+		}
+		start, end, nextFrom := page.Bounds(len(bans))
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(bans[start:end], nextFrom).WithTotal(int64(len(bans)))}
+	}
+	return &api.DoNotCacheResponse{Payload: bans}
+}
+
+func BanUploads(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	req, errRes := readUploadBanRequest(r, rctx)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"pattern": req.Pattern,
+	})
+
+	err := storage.GetDatabase().GetMetadataStore(rctx).InsertUploadBan(req.Pattern, user.UserId, util.NowMillis())
+	if err != nil {
+		rctx.Log.Error("Error banning uploads: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error banning uploads")
+	}
+
+	rctx.Log.Warn("Users matching " + req.Pattern + " can no longer upload media")
+	recordAdminAction(r, rctx, user, "ban_uploads", map[string]interface{}{"pattern": req.Pattern}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
+}
+
+func UnbanUploads(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	req, errRes := readUploadBanRequest(r, rctx)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"pattern": req.Pattern,
+	})
+
+	removed, err := storage.GetDatabase().GetMetadataStore(rctx).DeleteUploadBan(req.Pattern)
+	if err != nil {
+		rctx.Log.Error("Error unbanning uploads: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error unbanning uploads")
+	}
+	if !removed {
+		return api.NotFoundError()
+	}
+
+	rctx.Log.Info("Users matching " + req.Pattern + " can upload media again")
+	recordAdminAction(r, rctx, user, "unban_uploads", map[string]interface{}{"pattern": req.Pattern}, nil)
+	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
+}
@@ -0,0 +1,102 @@
+package custom
+
+import (
+	"encoding/json"
+	"github.com/getsentry/sentry-go"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type UrlPreviewSettings struct {
+	Disabled bool `json:"disabled"`
+}
+
+func checkUrlPreviewSettingsRequest(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, entityId string) *api.ErrorResponse {
+	if !strings.HasPrefix(entityId, "@") && !strings.HasPrefix(entityId, "!") {
+		return api.BadRequest("expected a user ID or room ID")
+	}
+
+	// Settings are stored per-host, so local admins can only affect previews on their own server
+	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
+	if !isGlobalAdmin && !isLocalAdmin {
+		return api.AuthFailed()
+	}
+
+	return nil
+}
+
+func GetUrlPreviewSettings(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	entityId := params["entityId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"entityId": entityId,
+	})
+
+	if errRes := checkUrlPreviewSettingsRequest(r, rctx, user, entityId); errRes != nil {
+		return errRes
+	}
+
+	db := storage.GetDatabase().GetUrlStore(rctx)
+	optedOut, err := db.IsOptedOut(r.Host, []string{entityId})
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to get URL preview settings")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &UrlPreviewSettings{
+		Disabled: optedOut,
+	}}
+}
+
+func SetUrlPreviewSettings(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	entityId := params["entityId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"entityId": entityId,
+	})
+
+	if errRes := checkUrlPreviewSettingsRequest(r, rctx, user, entityId); errRes != nil {
+		return errRes
+	}
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read URL preview settings")
+	}
+
+	newSettings := &UrlPreviewSettings{}
+	err = json.Unmarshal(b, &newSettings)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.BadRequest("failed to parse URL preview settings")
+	}
+
+	db := storage.GetDatabase().GetUrlStore(rctx)
+	err = db.SetOptedOut(r.Host, entityId, newSettings.Disabled)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to update URL preview settings")
+	}
+
+	recordAdminAction(r, rctx, user, "set_url_preview_settings", map[string]interface{}{"entity_id": entityId, "disabled": newSettings.Disabled}, nil)
+
+	return &api.DoNotCacheResponse{Payload: newSettings}
+}
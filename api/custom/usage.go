@@ -46,6 +46,24 @@ type MediaUsageEntry struct {
 	CreatedTs         int64  `json:"created_ts"`
 }
 
+type UserMediaEntry struct {
+	MxcUri      string `json:"mxc"`
+	SizeBytes   int64  `json:"size_bytes"`
+	ContentType string `json:"content_type"`
+	UploadName  string `json:"upload_name"`
+	CreatedTs   int64  `json:"created_ts"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+type UserMediaResponse struct {
+	Total    int64             `json:"total"`
+	Media    []*UserMediaEntry `json:"media"`
+	NextFrom int64             `json:"next_from,omitempty"`
+}
+
+const defaultTopUsersLimit = 50
+const defaultRemoteServersLimit = 50
+
 func GetDomainUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	params := mux.Vars(r)
 
@@ -207,3 +225,149 @@ func GetUploadsUsage(r *http.Request, rctx rcontext.RequestContext, user api.Use
 
 	return &api.DoNotCacheResponse{Payload: parsed}
 }
+
+func GetUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	userId := params["userId"]
+
+	page, errRes := api.ParsePage(r, api.DefaultPageLimit)
+	if errRes != nil {
+		return errRes
+	}
+	limit := page.Limit
+	from := page.From
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"userId": userId,
+		"limit":  limit,
+		"from":   from,
+	})
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+
+	total, err := db.GetMediaCountByUser(userId)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Failed to count media for user")
+	}
+
+	records, err := db.GetMediaByUserPaginated(userId, limit, from)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Failed to get media records for user")
+	}
+
+	resp := &UserMediaResponse{
+		Total: total,
+		Media: make([]*UserMediaEntry, 0),
+	}
+	for _, media := range records {
+		resp.Media = append(resp.Media, &UserMediaEntry{
+			MxcUri:      media.MxcUri(),
+			SizeBytes:   media.SizeBytes,
+			ContentType: media.ContentType,
+			UploadName:  media.UploadName,
+			CreatedTs:   media.CreationTs,
+			Quarantined: media.Quarantined,
+		})
+	}
+	if next := from + int64(len(records)); next < total {
+		resp.NextFrom = next
+	}
+
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(resp.Media, resp.NextFrom).WithTotal(total)}
+	}
+	return &api.DoNotCacheResponse{Payload: resp}
+}
+
+func GetTopUsersUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	serverName := params["serverName"]
+
+	orderBy := r.URL.Query().Get("order_by")
+	if orderBy == "" {
+		orderBy = "bytes"
+	}
+	if orderBy != "bytes" && orderBy != "media" && orderBy != "last_upload" {
+		return api.BadRequest("order_by must be one of bytes, media, or last_upload")
+	}
+
+	page, errRes := api.ParsePage(r, defaultTopUsersLimit)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"serverName": serverName,
+		"orderBy":    orderBy,
+		"limit":      page.Limit,
+		"from":       page.From,
+	})
+
+	// The ranking is worked out by the database, so the earlier pages are fetched and skipped
+	usage, err := storage.GetDatabase().GetMetadataStore(rctx).GetUserStorageUsage(serverName, orderBy, page.From+page.Limit+1)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Failed to get usage for users")
+	}
+
+	start, end, nextFrom := page.Bounds(len(usage))
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(usage[start:end], nextFrom)}
+	}
+	return &api.DoNotCacheResponse{Payload: usage[start:end]}
+}
+
+func GetRemoteServersUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	orderBy := r.URL.Query().Get("order_by")
+	if orderBy == "" {
+		orderBy = "bytes"
+	}
+	if orderBy != "bytes" && orderBy != "media" && orderBy != "last_access" {
+		return api.BadRequest("order_by must be one of bytes, media, or last_access")
+	}
+
+	page, errRes := api.ParsePage(r, defaultRemoteServersLimit)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"orderBy": orderBy,
+		"limit":   page.Limit,
+		"from":    page.From,
+	})
+
+	origins, err := storage.GetDatabase().GetMediaStore(rctx).GetOrigins()
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Failed to get origins")
+	}
+
+	localOrigins := make([]string, 0)
+	for _, origin := range origins {
+		if util.IsServerOurs(origin) {
+			localOrigins = append(localOrigins, origin)
+		}
+	}
+
+	usage, err := storage.GetDatabase().GetMetadataStore(rctx).GetOriginUsage(localOrigins, orderBy, page.From+page.Limit+1)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Failed to get usage for remote servers")
+	}
+
+	start, end, nextFrom := page.Bounds(len(usage))
+	if api.IsAdminV1Request(r) {
+		return &api.DoNotCacheResponse{Payload: api.NewPaginatedResponse(usage[start:end], nextFrom)}
+	}
+	return &api.DoNotCacheResponse{Payload: usage[start:end]}
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// UploadBodyLimitedRoute rejects requests which say they are bigger than the limit before anything else
+// is done with them, and stops reading the body of requests which turn out to be bigger (such as chunked
+// uploads). Handlers drain the body of rejected uploads, so without this a client could keep streaming
+// data at the server long after its upload was refused. A limit of zero or less is not applied.
+func UploadBodyLimitedRoute(limit func(rctx rcontext.RequestContext) int64, next func(*http.Request, rcontext.RequestContext) interface{}) func(*http.Request, rcontext.RequestContext) interface{} {
+	return func(r *http.Request, rctx rcontext.RequestContext) interface{} {
+		maxBytes := limit(rctx)
+		if maxBytes > 0 {
+			if r.ContentLength > maxBytes {
+				rctx.Log.Warn("Request body is larger than allowed - rejecting before reading it")
+				return RequestTooLarge()
+			}
+			r.Body = util.NewHardLimitedReader(r.Body, maxBytes)
+		}
+		return next(r, rctx)
+	}
+}
+
+// MaxUploadBytes is the limit for requests which upload a single file.
+func MaxUploadBytes(rctx rcontext.RequestContext) int64 {
+	return rctx.Config.Uploads.MaxSizeBytes
+}
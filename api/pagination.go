@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminV1Prefix is the path prefix of the versioned admin API. The admin routes under each client
+// API version (such as /_matrix/media/unstable/admin) are aliases which keep their original response
+// shapes, while listings under this prefix are all paginated the same way.
+const AdminV1Prefix = "/_matrix/media/admin/v1"
+
+const DefaultPageLimit = 100
+const MaxPageLimit = 1000
+
+// Page is the part of a listing a request asked for: up to Limit items starting at From. What From
+// counts depends on the listing, though for most it is an offset into the results. A zero From is
+// the start of the listing.
+type Page struct {
+	Limit int64
+	From  int64
+}
+
+// PaginatedResponse is the shape of every listing in the versioned admin API. NextToken is passed
+// back as the from parameter to get the next page, and is omitted on the last page.
+type PaginatedResponse struct {
+	Items     interface{} `json:"items"`
+	Total     *int64      `json:"total,omitempty"`
+	NextToken string      `json:"next_token,omitempty"`
+}
+
+func IsAdminV1Request(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, AdminV1Prefix+"/")
+}
+
+// ParsePage reads the limit and from query parameters of a listing request. Limits over MaxPageLimit
+// are capped rather than rejected.
+func ParsePage(r *http.Request, defaultLimit int64) (*Page, *ErrorResponse) {
+	page := &Page{Limit: defaultLimit}
+
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr != "" {
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, BadRequest("limit must be a positive integer")
+		}
+		page.Limit = limit
+	}
+	if page.Limit > MaxPageLimit {
+		page.Limit = MaxPageLimit
+	}
+
+	fromStr := r.URL.Query().Get("from")
+	if fromStr != "" {
+		from, err := strconv.ParseInt(fromStr, 10, 64)
+		if err != nil || from < 0 {
+			return nil, BadRequest("from is not a valid pagination token")
+		}
+		page.From = from
+	}
+
+	return page, nil
+}
+
+// Bounds returns the part of a listing of count items which is in the page, for listings which are
+// paginated in memory, along with where the next page starts (0 if this is the last page).
+func (p *Page) Bounds(count int) (int, int, int64) {
+	start := int(p.From)
+	if start > count {
+		start = count
+	}
+	end := start + int(p.Limit)
+	if end >= count {
+		return start, count, 0
+	}
+	return start, end, int64(end)
+}
+
+// NewPaginatedResponse builds the response for a page of items. A nextFrom of 0 means there are no
+// more pages.
+func NewPaginatedResponse(items interface{}, nextFrom int64) *PaginatedResponse {
+	resp := &PaginatedResponse{Items: items}
+	if nextFrom > 0 {
+		resp.NextToken = strconv.FormatInt(nextFrom, 10)
+	}
+	return resp
+}
+
+func (p *PaginatedResponse) WithTotal(total int64) *PaginatedResponse {
+	p.Total = &total
+	return p
+}
@@ -0,0 +1,157 @@
+package r0
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type MediaCreatedResponse struct {
+	ContentUri      string `json:"content_uri"`
+	UnusedExpiresAt int64  `json:"unused_expires_at"`
+}
+
+func CreateMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	banned, err := upload_controller.IsUserBannedFromUploading(user.UserId, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking upload bans: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if banned {
+		rctx.Log.Warn("User is banned from uploading")
+		return api.UploadsBanned()
+	}
+
+	upload, err := upload_controller.CreateMedia(user.UserId, r.Host, rctx)
+	if err == common.ErrTooManyPendingUploads {
+		return api.TooManyPendingUploads()
+	}
+	if err != nil {
+		rctx.Log.Error("Unexpected error creating media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &MediaCreatedResponse{
+		ContentUri:      "mxc://" + upload.Origin + "/" + upload.MediaId,
+		UnusedExpiresAt: upload.ExpiresTs,
+	}
+}
+
+func UploadPendingMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+	filename := filepath.Base(r.URL.Query().Get("filename"))
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":   server,
+		"mediaId":  mediaId,
+		"filename": filename,
+	})
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	expiresTs, errRes := getUploadExpiry(r, rctx)
+	if errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
+
+	thumbnailSizes, errRes := getEagerThumbnailSizes(r, rctx)
+	if errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
+
+	body, errRes := GetVerifiedBody(r)
+	if errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
+
+	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
+	if errRes := CheckUploadAllowed(r, rctx, user, contentLength); errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
+
+	uploadStartTs := util.NowMillis()
+	media, err := upload_controller.UploadPendingMedia(body, contentLength, contentType, filename, user.UserId, server, mediaId, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		} else if err == common.ErrMediaAlreadyUploaded {
+			return api.CannotOverwriteMedia()
+		} else if err == common.ErrNotMediaUploader {
+			return api.NotMediaUploader()
+		} else if err == common.ErrMediaQuarantined {
+			return api.BadRequest("This file is not permitted on this server")
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		} else if err == common.ErrQuotaExceeded {
+			return api.QuotaExceeded()
+		} else if err == common.ErrContentDigestMismatch {
+			return api.DigestMismatch()
+		}
+
+		rctx.Log.Error("Unexpected error storing media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	if expiresTs > 0 {
+		err = upload_controller.SetUploadExpiry(media, expiresTs, uploadStartTs, rctx)
+		if err != nil {
+			rctx.Log.Error("Unexpected error setting media expiry: " + err.Error())
+			sentry.CaptureException(err)
+			return api.InternalServerError("Unexpected Error")
+		}
+	}
+
+	thumbnail_controller.GenerateThumbnailsInBackground(media, thumbnailSizes, rctx)
+
+	return &api.EmptyResponse{}
+}
+
+// getUploadWaitTimeout returns how long a download should wait for media which hasn't been uploaded yet,
+// using the client's timeout_ms if it gave one.
+func getUploadWaitTimeout(r *http.Request, rctx rcontext.RequestContext) (time.Duration, *api.ErrorResponse) {
+	timeout := time.Duration(rctx.Config.Features.MSC2246Async.DefaultDownloadWaitSecs) * time.Second
+	timeoutStr := r.URL.Query().Get("timeout_ms")
+	if timeoutStr != "" {
+		parsed, err := strconv.ParseInt(timeoutStr, 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, api.BadRequest("timeout_ms does not appear to be a positive integer")
+		}
+		timeout = time.Duration(parsed) * time.Millisecond
+	}
+
+	maxTimeout := time.Duration(rctx.Config.Features.MSC2246Async.MaxDownloadWaitSecs) * time.Second
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return timeout, nil
+}
@@ -12,6 +12,8 @@ import (
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/types"
 )
 
 type DownloadMediaResponse struct {
@@ -20,6 +22,15 @@ type DownloadMediaResponse struct {
 	SizeBytes         int64
 	Data              io.ReadCloser
 	TargetDisposition string
+
+	// KnownMedia is set instead of Data when the download is to be redirected to the media's datastore
+	// rather than served by the media repo.
+	KnownMedia *types.Media
+
+	// Sha256Hash and CreationTs describe the contents for conditional requests. They are left empty
+	// when the contents aren't known to stay the same.
+	Sha256Hash string
+	CreationTs int64
 }
 
 func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -43,7 +54,7 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 	if allowRemote != "" {
 		parsedFlag, err := strconv.ParseBool(allowRemote)
 		if err != nil {
-			return api.InternalServerError("allow_remote flag does not appear to be a boolean")
+			return api.BadRequest("allow_remote flag does not appear to be a boolean")
 		}
 		downloadRemote = parsedFlag
 	}
@@ -55,10 +66,35 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 		"allowRemote": downloadRemote,
 	})
 
+	if ratelimit.IsUserRateLimited(rctx, user.UserId, ratelimit.ActionDownload) {
+		rctx.Log.Warn("User has exceeded the download rate limit")
+		return api.RateLimitReached()
+	}
+
+	if errRes := CheckMediaAccess(r, rctx, user, server, mediaId); errRes != nil {
+		return errRes
+	}
+
+	if res := GetRedirectedDownload(server, mediaId, filename, targetDisposition, rctx); res != nil {
+		return res
+	}
+
 	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, false, rctx)
+	if err == common.ErrMediaNotFound && rctx.Config.Features.MSC2246Async.Enabled {
+		timeout, errRes := getUploadWaitTimeout(r, rctx)
+		if errRes != nil {
+			return errRes
+		}
+		err = download_controller.WaitForUpload(server, mediaId, timeout, rctx)
+		if err == nil {
+			streamedMedia, err = download_controller.GetMedia(server, mediaId, downloadRemote, false, rctx)
+		}
+	}
 	if err != nil {
 		if err == common.ErrMediaNotFound {
 			return api.NotFoundError()
+		} else if err == common.ErrMediaNotYetUploaded {
+			return api.NotYetUploaded()
 		} else if err == common.ErrMediaTooLarge {
 			return api.RequestTooLarge()
 		} else if err == common.ErrMediaQuarantined {
@@ -73,11 +109,44 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 		filename = streamedMedia.UploadName
 	}
 
-	return &DownloadMediaResponse{
+	res := &DownloadMediaResponse{
 		ContentType:       streamedMedia.ContentType,
 		Filename:          filename,
 		SizeBytes:         streamedMedia.SizeBytes,
 		Data:              streamedMedia.Stream,
 		TargetDisposition: targetDisposition,
 	}
+	if streamedMedia.KnownMedia != nil {
+		res.Sha256Hash = streamedMedia.KnownMedia.Sha256Hash
+		res.CreationTs = streamedMedia.KnownMedia.CreationTs
+	}
+	return res
+}
+
+// GetRedirectedDownload returns a response which redirects the download to the media's datastore, or
+// nil if the media repo has to serve the download itself. Access to the media must already have been
+// checked.
+func GetRedirectedDownload(server string, mediaId string, filename string, targetDisposition string, rctx rcontext.RequestContext) *DownloadMediaResponse {
+	media, err := download_controller.GetRedirectableMedia(server, mediaId, rctx)
+	if err != nil {
+		rctx.Log.Warn("Error checking if the download can be redirected, serving it directly: ", err)
+		sentry.CaptureException(err)
+		return nil
+	}
+	if media == nil {
+		return nil
+	}
+
+	if filename == "" {
+		filename = media.UploadName
+	}
+	return &DownloadMediaResponse{
+		ContentType:       media.EffectiveContentType(rctx.Config.Uploads.UseDetectedContentType),
+		Filename:          filename,
+		SizeBytes:         media.SizeBytes,
+		TargetDisposition: targetDisposition,
+		KnownMedia:        media,
+		Sha256Hash:        media.Sha256Hash,
+		CreationTs:        media.CreationTs,
+	}
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/resource_handler"
 )
 
 type MatrixOpenGraph struct {
@@ -54,6 +55,20 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		return api.BadRequest("Scheme not accepted")
 	}
 
+	// Clients may optionally tell us which room the URL is being previewed in so we can
+	// respect any opt-outs for that room.
+	roomId := params.Get("room_id")
+	optedOut, err := preview_controller.IsOptedOut(r.Host, user.UserId, roomId, rctx)
+	if err != nil {
+		rctx.Log.Error("Error checking URL preview opt-out: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("unexpected error during request")
+	}
+	if optedOut {
+		rctx.Log.Info("URL previews are disabled for this user or room")
+		return api.NotFoundError()
+	}
+
 	languageHeader := rctx.Config.UrlPreviews.DefaultLanguage
 	if r.Header.Get("Accept-Language") != "" {
 		languageHeader = r.Header.Get("Accept-Language")
@@ -65,6 +80,8 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 			return api.NotFoundError()
 		} else if err == common.ErrInvalidHost || err == common.ErrHostBlacklisted {
 			return api.BadRequest(err.Error())
+		} else if err == common.ErrRateLimitExceeded || err == resource_handler.ErrQueueFull || err == resource_handler.ErrQueueTimeout {
+			return api.RateLimitReached()
 		} else {
 			sentry.CaptureException(err)
 			return api.InternalServerError("unexpected error during request")
@@ -0,0 +1,30 @@
+package r0
+
+import (
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// CheckMediaAccess returns the error response for why the user can't download the media, or nil if they can.
+func CheckMediaAccess(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, server string, mediaId string) interface{} {
+	if !rctx.Config.Features.MSC3911Restrictions.Enabled || user.IsShared {
+		return nil
+	}
+
+	allowed, err := download_controller.CanAccessMedia(server, mediaId, user.UserId, user.AccessToken, util.GetAppserviceUserIdFromRequest(r), r.RemoteAddr, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking media restrictions: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !allowed {
+		rctx.Log.Warn("User cannot see the room or event the media is restricted to")
+		return api.NotFoundError() // We lie for security
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
 	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
 )
 
@@ -84,10 +85,26 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		return api.BadRequest("Width and height must be greater than zero")
 	}
 
+	if errRes := CheckMediaAccess(r, rctx, user, server, mediaId); errRes != nil {
+		return errRes
+	}
+
 	streamedThumbnail, err := thumbnail_controller.GetThumbnail(server, mediaId, width, height, animated, method, downloadRemote, rctx)
+	if err == common.ErrMediaNotFound && rctx.Config.Features.MSC2246Async.Enabled {
+		timeout, errRes := getUploadWaitTimeout(r, rctx)
+		if errRes != nil {
+			return errRes
+		}
+		err = download_controller.WaitForUpload(server, mediaId, timeout, rctx)
+		if err == nil {
+			streamedThumbnail, err = thumbnail_controller.GetThumbnail(server, mediaId, width, height, animated, method, downloadRemote, rctx)
+		}
+	}
 	if err != nil {
 		if err == common.ErrMediaNotFound {
 			return api.NotFoundError()
+		} else if err == common.ErrMediaNotYetUploaded {
+			return api.NotYetUploaded()
 		} else if err == common.ErrMediaTooLarge {
 			return api.RequestTooLarge()
 		}
@@ -101,5 +118,7 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		SizeBytes:   streamedThumbnail.Thumbnail.SizeBytes,
 		Data:        streamedThumbnail.Stream,
 		Filename:    "thumbnail.png",
+		Sha256Hash:  streamedThumbnail.Thumbnail.Sha256Hash,
+		CreationTs:  streamedThumbnail.Thumbnail.CreationTs,
 	}
 }
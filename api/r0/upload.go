@@ -1,19 +1,25 @@
 package r0
 
 import (
+	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"path/filepath"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/info_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
 	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
@@ -35,36 +41,43 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		contentType = "application/octet-stream" // binary
 	}
 
-	if upload_controller.IsRequestTooLarge(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+	expiresTs, errRes := getUploadExpiry(r, rctx)
+	if errRes != nil {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		return api.RequestTooLarge()
+		return errRes
 	}
 
-	if upload_controller.IsRequestTooSmall(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+	thumbnailSizes, errRes := getEagerThumbnailSizes(r, rctx)
+	if errRes != nil {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		return api.RequestTooSmall()
+		return errRes
 	}
 
-	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId)
-	if err != nil {
-		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
-	}
-	if !inQuota {
+	body, errRes := GetVerifiedBody(r)
+	if errRes != nil {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		return api.QuotaExceeded()
+		return errRes
 	}
 
 	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
+	if errRes := CheckUploadAllowed(r, rctx, user, contentLength); errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
 
-	media, err := upload_controller.UploadMedia(r.Body, contentLength, contentType, filename, user.UserId, r.Host, rctx)
+	uploadStartTs := util.NowMillis()
+	media, err := upload_controller.UploadMedia(body, contentLength, contentType, filename, user.UserId, r.Host, rctx)
 	if err != nil {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
 
 		if err == common.ErrMediaQuarantined {
 			return api.BadRequest("This file is not permitted on this server")
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		} else if err == common.ErrQuotaExceeded {
+			return api.QuotaExceeded()
+		} else if err == common.ErrContentDigestMismatch {
+			return api.DigestMismatch()
 		}
 
 		rctx.Log.Error("Unexpected error storing media: " + err.Error())
@@ -72,6 +85,17 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		return api.InternalServerError("Unexpected Error")
 	}
 
+	if expiresTs > 0 {
+		err = upload_controller.SetUploadExpiry(media, expiresTs, uploadStartTs, rctx)
+		if err != nil {
+			rctx.Log.Error("Unexpected error setting media expiry: " + err.Error())
+			sentry.CaptureException(err)
+			return api.InternalServerError("Unexpected Error")
+		}
+	}
+
+	thumbnail_controller.GenerateThumbnailsInBackground(media, thumbnailSizes, rctx)
+
 	if rctx.Config.Features.MSC2448Blurhash.Enabled && r.URL.Query().Get("xyz.amorgan.generate_blurhash") == "true" {
 		hash, err := info_controller.GetOrCalculateBlurhash(media, rctx)
 		if err != nil {
@@ -89,3 +113,109 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		ContentUri: media.MxcUri(),
 	}
 }
+
+// CheckUploadAllowed returns the error response for why the user can't upload a file of the given size,
+// or nil if they can.
+func CheckUploadAllowed(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, contentLength int64) interface{} {
+	if upload_controller.IsRequestTooLarge(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+		return api.RequestTooLarge()
+	}
+
+	if upload_controller.IsRequestTooSmall(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+		return api.RequestTooSmall()
+	}
+
+	return CheckUploadOfSizeAllowed(rctx, user, r.RemoteAddr, contentLength)
+}
+
+// CheckUploadOfSizeAllowed is CheckUploadAllowed for a file whose size has already been checked, such as
+// one file of several in a request. Each call counts as an upload towards the rate limits.
+func CheckUploadOfSizeAllowed(rctx rcontext.RequestContext, user api.UserInfo, remoteAddr string, contentLength int64) interface{} {
+	if retryAfter := ratelimit.GetUploadRetryAfter(rctx, user.UserId, remoteAddr); retryAfter > 0 {
+		rctx.Log.Warn("User has exceeded the upload rate limit")
+		return api.RateLimitReachedRetryAfter(retryAfter)
+	}
+
+	banned, err := upload_controller.IsUserBannedFromUploading(user.UserId, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking upload bans: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if banned {
+		rctx.Log.Warn("User is banned from uploading")
+		return api.UploadsBanned()
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId, contentLength)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		rctx.Log.Warn("Upload would exceed the user's quota")
+		return api.QuotaExceeded()
+	}
+
+	return nil
+}
+
+// GetVerifiedBody returns the request body, which fails to read with common.ErrContentDigestMismatch if it
+// doesn't match the SHA-256 hash the client gave in a Content-Digest or Digest header.
+func GetVerifiedBody(r *http.Request) (io.ReadCloser, *api.ErrorResponse) {
+	digest, err := util.GetSha256Digest(r.Header)
+	if err != nil {
+		return nil, api.BadRequest("Invalid digest header: " + err.Error())
+	}
+	if digest == nil {
+		return r.Body, nil
+	}
+	return util.NewDigestVerifyingReader(r.Body, digest), nil
+}
+
+// getUploadExpiry returns when the media being uploaded should be purged, using the client's expires_in_ms,
+// or zero if it shouldn't expire.
+func getUploadExpiry(r *http.Request, rctx rcontext.RequestContext) (int64, *api.ErrorResponse) {
+	expiresInStr := r.URL.Query().Get("expires_in_ms")
+	if expiresInStr == "" {
+		return 0, nil
+	}
+	if !rctx.Config.Uploads.ExpiringMedia.Enabled {
+		return 0, api.BadRequest("Expiring media is not enabled on this server")
+	}
+
+	expiresIn, err := strconv.ParseInt(expiresInStr, 10, 64)
+	if err != nil || expiresIn <= 0 {
+		return 0, api.BadRequest("expires_in_ms does not appear to be a positive integer")
+	}
+	if maxExpiry := rctx.Config.Uploads.ExpiringMedia.MaxExpiryMs; maxExpiry > 0 && expiresIn > maxExpiry {
+		return 0, api.BadRequest(fmt.Sprintf("expires_in_ms must be at most %d", maxExpiry))
+	}
+	now := util.NowMillis()
+	if expiresIn > math.MaxInt64-now {
+		return 0, api.BadRequest("expires_in_ms is too large")
+	}
+	return now + expiresIn, nil
+}
+
+// getEagerThumbnailSizes returns the thumbnail sizes the client asked to have generated as soon as the
+// media is uploaded, using thumbnail_sizes.
+func getEagerThumbnailSizes(r *http.Request, rctx rcontext.RequestContext) ([]thumbnail_controller.ThumbnailSize, *api.ErrorResponse) {
+	sizesStr := r.URL.Query().Get("thumbnail_sizes")
+	if sizesStr == "" {
+		return nil, nil
+	}
+	if !rctx.Config.Uploads.EagerThumbnails.Enabled {
+		return nil, api.BadRequest("Generating thumbnails at upload is not enabled on this server")
+	}
+
+	sizes, err := thumbnail_controller.ParseThumbnailSizes(sizesStr)
+	if err != nil {
+		return nil, api.BadRequest("Invalid thumbnail_sizes: " + err.Error())
+	}
+	if len(sizes) > rctx.Config.Uploads.EagerThumbnails.MaxSizes {
+		return nil, api.BadRequest(fmt.Sprintf("No more than %d thumbnail sizes can be requested", rctx.Config.Uploads.EagerThumbnails.MaxSizes))
+	}
+	return sizes, nil
+}
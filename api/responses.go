@@ -1,6 +1,10 @@
 package api
 
-import "github.com/turt2live/matrix-media-repo/common"
+import (
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
 
 type EmptyResponse struct{}
 
@@ -8,6 +12,19 @@ type DoNotCacheResponse struct {
 	Payload interface{}
 }
 
+// StatusCodeResponse is a JSON payload sent with a status code other than 200 OK.
+type StatusCodeResponse struct {
+	StatusCode int
+	Payload    interface{}
+}
+
+// HeadersResponse is a response without a body, for protocols which reply using only the status code
+// and headers.
+type HeadersResponse struct {
+	StatusCode int
+	Headers    map[string]string
+}
+
 type HtmlResponse struct {
 	HTML string
 }
@@ -18,6 +35,12 @@ type ErrorResponse struct {
 	InternalCode string `json:"mr_errcode"`
 }
 
+// RateLimitedResponse is a rate limit error which tells the client when it can try again.
+type RateLimitedResponse struct {
+	ErrorResponse
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
 func InternalServerError(message string) *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeUnknown}
 }
@@ -30,6 +53,10 @@ func RateLimitReached() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Rate Limited", common.ErrCodeRateLimitExceeded}
 }
 
+func RateLimitReachedRetryAfter(retryAfter time.Duration) *RateLimitedResponse {
+	return &RateLimitedResponse{*RateLimitReached(), retryAfter.Milliseconds()}
+}
+
 func NotFoundError() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNotFound, "Not found", common.ErrCodeNotFound}
 }
@@ -54,6 +81,38 @@ func BadRequest(message string) *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeBadRequest}
 }
 
+func UploadsBanned() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "You are not allowed to upload media", common.ErrCodeForbidden}
+}
+
+func MissingScope() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "This token is not allowed to use this endpoint", common.ErrCodeForbidden}
+}
+
 func QuotaExceeded() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeForbidden, "Quota Exceeded", common.ErrCodeQuotaExceeded}
+	return &ErrorResponse{common.ErrCodeForbidden, "Uploading this file would exceed your storage quota", common.ErrCodeQuotaExceeded}
+}
+
+func TooManyPendingUploads() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Too many media IDs are waiting to be uploaded", common.ErrCodeRateLimitExceeded}
+}
+
+func NotYetUploaded() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeNotYetUploaded, "Media has not been uploaded yet", common.ErrCodeNotYetUploaded}
+}
+
+func CannotOverwriteMedia() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeCannotOverwriteMedia, "Media has already been uploaded", common.ErrCodeCannotOverwriteMedia}
+}
+
+func DigestMismatch() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeDigestMismatch, "The uploaded content does not match its digest", common.ErrCodeDigestMismatch}
+}
+
+func NotMediaUploader() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "Media was created by another user", common.ErrCodeForbidden}
+}
+
+func InvalidSignature() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, "The link is invalid or has expired", common.ErrCodeForbidden}
 }
@@ -0,0 +1,164 @@
+package unstable
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// Allowance for the headers and boundary of each part of a batch, on top of the file itself
+const batchPartOverheadBytes = 64 * 1024
+
+type BatchUploadResult struct {
+	Filename   string `json:"filename,omitempty"`
+	ContentUri string `json:"content_uri,omitempty"`
+	Code       string `json:"errcode,omitempty"`
+	Message    string `json:"error,omitempty"`
+	RetryAfter int64  `json:"retry_after_ms,omitempty"`
+}
+
+type BatchUploadResponse struct {
+	Results []*BatchUploadResult `json:"results"`
+}
+
+func BatchUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if !rctx.Config.Uploads.Batch.Enabled {
+		return api.NotFoundError()
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return api.BadRequest("Expected a multipart/form-data request")
+	}
+
+	results := make([]*BatchUploadResult, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rctx.Log.Warn("Error reading multipart request: ", err)
+			if len(results) > 0 {
+				// The client needs to know which files were uploaded before the request broke
+				break
+			}
+			return api.BadRequest("Invalid multipart request")
+		}
+
+		var result *BatchUploadResult
+		if len(results) >= rctx.Config.Uploads.Batch.MaxFiles {
+			// Files already uploaded have MXCs the client needs, so the rest are skipped rather than failing the request
+			errRes := api.BadRequest("Too many files in the batch")
+			result = &BatchUploadResult{Filename: batchPartFilename(part), Code: errRes.Code, Message: errRes.Message}
+		} else {
+			result = uploadBatchPart(part, rctx, user, r.RemoteAddr, r.Host)
+		}
+		part.Close()
+		results = append(results, result)
+	}
+
+	return &BatchUploadResponse{Results: results}
+}
+
+// MaxBatchUploadBytes is the most a batch can hold: the maximum number of files, each of the maximum size.
+func MaxBatchUploadBytes(rctx rcontext.RequestContext) int64 {
+	if rctx.Config.Uploads.MaxSizeBytes <= 0 {
+		return 0
+	}
+	return (rctx.Config.Uploads.MaxSizeBytes + batchPartOverheadBytes) * int64(rctx.Config.Uploads.Batch.MaxFiles)
+}
+
+func uploadBatchPart(part *multipart.Part, rctx rcontext.RequestContext, user api.UserInfo, remoteAddr string, origin string) *BatchUploadResult {
+	filename := batchPartFilename(part)
+	result := &BatchUploadResult{Filename: filename}
+	fail := func(errRes *api.ErrorResponse) *BatchUploadResult {
+		result.Code = errRes.Code
+		result.Message = errRes.Message
+		return result
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filename": filename,
+	})
+
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	var data io.Reader = part
+	digest, err := util.GetSha256Digest(http.Header(part.Header))
+	if err != nil {
+		return fail(api.BadRequest("Invalid digest header: " + err.Error()))
+	}
+	if digest != nil {
+		data = util.NewDigestVerifyingReader(ioutil.NopCloser(part), digest)
+	}
+	maxBytes := rctx.Config.Uploads.MaxSizeBytes
+	if maxBytes > 0 {
+		data = io.LimitReader(data, maxBytes+1)
+	}
+	contents, err := ioutil.ReadAll(data)
+	if err == common.ErrContentDigestMismatch {
+		return fail(api.DigestMismatch())
+	}
+	if err != nil {
+		rctx.Log.Warn("Error reading file from batch: ", err)
+		return fail(api.BadRequest("Unable to read file"))
+	}
+	size := int64(len(contents))
+	if upload_controller.IsRequestTooLarge(size, "", rctx) {
+		return fail(api.RequestTooLarge())
+	}
+	if upload_controller.IsRequestTooSmall(size, "", rctx) {
+		return fail(api.RequestTooSmall())
+	}
+
+	switch errRes := r0.CheckUploadOfSizeAllowed(rctx, user, remoteAddr, size).(type) {
+	case *api.ErrorResponse:
+		return fail(errRes)
+	case *api.RateLimitedResponse:
+		result.RetryAfter = errRes.RetryAfterMs
+		return fail(&errRes.ErrorResponse)
+	}
+
+	media, err := upload_controller.UploadMedia(ioutil.NopCloser(bytes.NewReader(contents)), size, contentType, filename, user.UserId, origin, rctx)
+	if err != nil {
+		if err == common.ErrMediaQuarantined {
+			return fail(api.BadRequest("This file is not permitted on this server"))
+		} else if err == common.ErrMediaTooLarge {
+			return fail(api.RequestTooLarge())
+		}
+
+		rctx.Log.Error("Unexpected error storing media: " + err.Error())
+		sentry.CaptureException(err)
+		return fail(api.InternalServerError("Unexpected Error"))
+	}
+
+	result.ContentUri = media.MxcUri()
+	return result
+}
+
+func batchPartFilename(part *multipart.Part) string {
+	filename := part.FileName()
+	if filename == "" {
+		return ""
+	}
+	return filepath.Base(filename)
+}
@@ -0,0 +1,104 @@
+package unstable
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/ryanuber/go-glob"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+func UploadMediaWithId(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+	filename := filepath.Base(r.URL.Query().Get("filename"))
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":   server,
+		"mediaId":  mediaId,
+		"filename": filename,
+	})
+
+	if !canChooseMediaId(user, rctx) {
+		rctx.Log.Warn("User is not allowed to choose media IDs")
+		return api.AuthFailed()
+	}
+	if server != r.Host {
+		return api.BadRequest("Media can only be uploaded to the server the request was made to")
+	}
+	if !upload_controller.IsValidCustomMediaId(mediaId) {
+		return api.BadRequest("Media IDs can only contain letters, numbers, dashes, and underscores")
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
+	if errRes := r0.CheckUploadAllowed(r, rctx, user, contentLength); errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
+
+	body, errRes := r0.GetVerifiedBody(r)
+	if errRes != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return errRes
+	}
+
+	media, err := upload_controller.UploadMediaWithId(body, contentLength, contentType, filename, user.UserId, server, mediaId, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+
+		if err == common.ErrMediaAlreadyUploaded {
+			return api.CannotOverwriteMedia()
+		} else if err == common.ErrMediaQuarantined {
+			return api.BadRequest("This file is not permitted on this server")
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		} else if err == common.ErrQuotaExceeded {
+			return api.QuotaExceeded()
+		} else if err == common.ErrContentDigestMismatch {
+			return api.DigestMismatch()
+		}
+
+		rctx.Log.Error("Unexpected error storing media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &r0.MediaUploadedResponse{
+		ContentUri: media.MxcUri(),
+	}
+}
+
+// canChooseMediaId returns whether the user may upload media with an ID of their choosing. Admin tokens
+// are only let through to here if they have the upload scope.
+func canChooseMediaId(user api.UserInfo, rctx rcontext.RequestContext) bool {
+	if !rctx.Config.Uploads.CustomMediaIds.Enabled {
+		return false
+	}
+	if user.IsShared {
+		return true
+	}
+	for _, g := range rctx.Config.Uploads.CustomMediaIds.AllowedUsers {
+		if glob.Glob(g, user.UserId) {
+			return true
+		}
+	}
+	return false
+}
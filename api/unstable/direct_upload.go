@@ -0,0 +1,149 @@
+package unstable
+
+import (
+	"encoding/json"
+	"github.com/getsentry/sentry-go"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type DirectUploadRequest struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	SizeBytes   int64  `json:"size"`
+}
+
+type DirectUploadResponse struct {
+	UploadId   string            `json:"upload_id"`
+	UploadUrl  string            `json:"upload_url"`
+	FormFields map[string]string `json:"form_fields"`
+	ExpiresTs  int64             `json:"expires_ts"`
+}
+
+func StartDirectUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error reading request")
+	}
+
+	req := &DirectUploadRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		return api.BadRequest("Error parsing request: " + err.Error())
+	}
+
+	filename := ""
+	if req.Filename != "" {
+		filename = filepath.Base(req.Filename)
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filename":  filename,
+		"sizeBytes": req.SizeBytes,
+	})
+
+	if req.SizeBytes <= 0 {
+		return api.BadRequest("The size of the file must be given")
+	}
+	if upload_controller.IsRequestTooLarge(req.SizeBytes, "", rctx) {
+		return api.RequestTooLarge()
+	}
+	if upload_controller.IsRequestTooSmall(req.SizeBytes, "", rctx) {
+		return api.RequestTooSmall()
+	}
+	if retryAfter := ratelimit.GetUploadRetryAfter(rctx, user.UserId, r.RemoteAddr); retryAfter > 0 {
+		rctx.Log.Warn("User has exceeded the upload rate limit")
+		return api.RateLimitReachedRetryAfter(retryAfter)
+	}
+
+	banned, err := upload_controller.IsUserBannedFromUploading(user.UserId, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking upload bans: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if banned {
+		rctx.Log.Warn("User is banned from uploading")
+		return api.UploadsBanned()
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId, req.SizeBytes)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		rctx.Log.Warn("Upload would exceed the user's quota")
+		return api.QuotaExceeded()
+	}
+
+	upload, target, err := upload_controller.StartDirectUpload(contentType, filename, req.SizeBytes, user.UserId, r.Host, rctx)
+	if err != nil {
+		if err == datastore.ErrDirectUploadsUnsupported {
+			return api.BadRequest("Direct uploads are not available for this file - upload it normally instead")
+		}
+		rctx.Log.Error("Unexpected error starting direct upload: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &DirectUploadResponse{
+		UploadId:   upload.UploadId,
+		UploadUrl:  target.Url,
+		FormFields: target.FormFields,
+		ExpiresTs:  target.ExpiresTs,
+	}}
+}
+
+func CompleteDirectUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	uploadId := params["uploadId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"uploadId": uploadId,
+	})
+
+	media, err := upload_controller.CompleteDirectUpload(uploadId, user.UserId, rctx)
+	if err != nil {
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		} else if err == common.ErrMediaTooSmall {
+			return api.RequestTooSmall()
+		} else if err == common.ErrUploadSizeMismatch {
+			return api.BadRequest("The uploaded file is not the size which was given")
+		} else if err == common.ErrMediaQuarantined {
+			return api.BadRequest("This file is not permitted on this server")
+		}
+		rctx.Log.Error("Unexpected error completing direct upload: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &r0.MediaUploadedResponse{
+		ContentUri: media.MxcUri(),
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/api/r0"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/ipfs_proxy"
+	"github.com/turt2live/matrix-media-repo/storage"
 )
 
 func IPFSDownload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -32,6 +33,10 @@ func IPFSDownload(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 		"server":        server,
 	})
 
+	if errRes := checkIpfsContentAccess(r, rctx, user, ipfsContentId); errRes != nil {
+		return errRes
+	}
+
 	obj, err := ipfs_proxy.GetObject(ipfsContentId, rctx)
 	if err != nil {
 		rctx.Log.Error(err)
@@ -47,3 +52,36 @@ func IPFSDownload(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 		TargetDisposition: targetDisposition,
 	}
 }
+
+// checkIpfsContentAccess applies the restrictions of any media stored in an IPFS datastore under the
+// content ID, as the content ID can be used to download that media as well.
+func checkIpfsContentAccess(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, ipfsContentId string) interface{} {
+	if !rctx.Config.Features.MSC3911Restrictions.Enabled || user.IsShared {
+		return nil
+	}
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	datastores, err := db.GetAllDatastores()
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("unexpected error")
+	}
+	for _, ds := range datastores {
+		if ds.Type != "ipfs" {
+			continue
+		}
+		media, err := db.GetMediaByLocation(ds.DatastoreId, ipfsContentId)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("unexpected error")
+		}
+		for _, m := range media {
+			if errRes := r0.CheckMediaAccess(r, rctx, user, m.Origin, m.MediaId); errRes != nil {
+				return errRes
+			}
+		}
+	}
+	return nil
+}
@@ -27,7 +27,7 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	if allowRemote != "" {
 		parsedFlag, err := strconv.ParseBool(allowRemote)
 		if err != nil {
-			return api.InternalServerError("allow_remote flag does not appear to be a boolean")
+			return api.BadRequest("allow_remote flag does not appear to be a boolean")
 		}
 		downloadRemote = parsedFlag
 	}
@@ -38,6 +38,11 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		"allowRemote": downloadRemote,
 	})
 
+	// The copy isn't restricted, so only people who can see the original may make one
+	if errRes := r0.CheckMediaAccess(r, rctx, user, server, mediaId); errRes != nil {
+		return errRes
+	}
+
 	// TODO: There's a lot of room for improvement here. Instead of re-uploading media, we should just update the DB.
 
 	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, true, rctx)
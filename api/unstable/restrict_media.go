@@ -0,0 +1,79 @@
+package unstable
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type RestrictMediaRequest struct {
+	RoomId  string `json:"room_id"`
+	EventId string `json:"event_id"`
+}
+
+func RestrictMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read request")
+	}
+	req := &RestrictMediaRequest{}
+	err = json.Unmarshal(b, req)
+	if err != nil || !strings.HasPrefix(req.RoomId, "!") {
+		return api.BadRequest("A room_id is required")
+	}
+	if req.EventId != "" && !strings.HasPrefix(req.EventId, "$") {
+		return api.BadRequest("event_id does not appear to be an event ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":  server,
+		"mediaId": mediaId,
+		"roomId":  req.RoomId,
+		"eventId": req.EventId,
+	})
+
+	if server != r.Host {
+		return api.NotFoundError()
+	}
+
+	err = upload_controller.RestrictMedia(server, mediaId, req.RoomId, req.EventId, user.UserId, user.AccessToken, util.GetAppserviceUserIdFromRequest(r), r.RemoteAddr, rctx)
+	if err != nil {
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		} else if err == common.ErrNotMediaUploader {
+			return api.NotMediaUploader()
+		} else if err == common.ErrEventNotFound {
+			return api.BadRequest("The room or event could not be found, or you cannot see it")
+		} else if err == common.ErrMediaAlreadyRestricted {
+			return api.BadRequest("Media is already restricted")
+		} else if err == matrix.ErrInvalidToken {
+			return api.AuthFailed()
+		}
+
+		rctx.Log.Error("Unexpected error restricting media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &api.EmptyResponse{}
+}
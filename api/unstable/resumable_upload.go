@@ -0,0 +1,200 @@
+package unstable
+
+import (
+	"encoding/base64"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// Resumable uploads follow the core tus protocol (https://tus.io/protocols/resumable-upload) along with
+// its creation, expiration, and termination extensions.
+const tusVersion = "1.0.0"
+
+func StartResumableUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		return &api.HeadersResponse{StatusCode: http.StatusPreconditionFailed, Headers: map[string]string{"Tus-Version": tusVersion}}
+	}
+
+	sizeBytes, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || sizeBytes <= 0 {
+		return api.BadRequest("Upload-Length must be the size of the file")
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	filename := ""
+	if metadata["filename"] != "" {
+		filename = filepath.Base(metadata["filename"])
+	}
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filename":  filename,
+		"sizeBytes": sizeBytes,
+	})
+
+	if upload_controller.IsRequestTooLarge(sizeBytes, "", rctx) {
+		return api.RequestTooLarge()
+	}
+	if upload_controller.IsRequestTooSmall(sizeBytes, "", rctx) {
+		return api.RequestTooSmall()
+	}
+	if retryAfter := ratelimit.GetUploadRetryAfter(rctx, user.UserId, r.RemoteAddr); retryAfter > 0 {
+		rctx.Log.Warn("User has exceeded the upload rate limit")
+		return api.RateLimitReachedRetryAfter(retryAfter)
+	}
+
+	banned, err := upload_controller.IsUserBannedFromUploading(user.UserId, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking upload bans: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if banned {
+		rctx.Log.Warn("User is banned from uploading")
+		return api.UploadsBanned()
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId, sizeBytes)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		rctx.Log.Warn("Upload would exceed the user's quota")
+		return api.QuotaExceeded()
+	}
+
+	upload, err := upload_controller.StartResumableUpload(sizeBytes, contentType, filename, user.UserId, r.Host, rctx)
+	if err != nil {
+		rctx.Log.Error("Unexpected error starting resumable upload: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	headers := resumableUploadHeaders(upload)
+	headers["Location"] = strings.TrimSuffix(r.URL.Path, "/") + "/" + upload.UploadId
+	return &api.HeadersResponse{StatusCode: http.StatusCreated, Headers: headers}
+}
+
+// ResumableUpload handles the requests made to an upload once it has been started, telling the client
+// where to resume from (HEAD), receiving the next chunk (PATCH), or cancelling it (DELETE).
+func ResumableUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+	params := mux.Vars(r)
+
+	uploadId := params["uploadId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"uploadId": uploadId,
+	})
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		return &api.HeadersResponse{StatusCode: http.StatusPreconditionFailed, Headers: map[string]string{"Tus-Version": tusVersion}}
+	}
+
+	if r.Method == http.MethodHead {
+		upload, err := upload_controller.GetResumableUpload(uploadId, user.UserId, rctx)
+		if err != nil {
+			return resumableUploadError(err, rctx)
+		}
+		headers := resumableUploadHeaders(upload)
+		headers["Cache-Control"] = "no-store"
+		return &api.HeadersResponse{StatusCode: http.StatusOK, Headers: headers}
+	}
+
+	if r.Method == http.MethodDelete {
+		err := upload_controller.CancelResumableUpload(uploadId, user.UserId, rctx)
+		if err != nil {
+			return resumableUploadError(err, rctx)
+		}
+		return &api.HeadersResponse{StatusCode: http.StatusNoContent, Headers: map[string]string{"Tus-Resumable": tusVersion}}
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return &api.StatusCodeResponse{StatusCode: http.StatusUnsupportedMediaType, Payload: api.BadRequest("Chunks must be sent as application/offset+octet-stream")}
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return api.BadRequest("Upload-Offset must be where the chunk starts")
+	}
+
+	upload, media, err := upload_controller.AppendToResumableUpload(uploadId, offset, r.Body, user.UserId, rctx)
+	if err != nil {
+		return resumableUploadError(err, rctx)
+	}
+
+	headers := resumableUploadHeaders(upload)
+	if media != nil {
+		rctx.Log.Info("Resumable upload finished")
+		headers["Matrix-Content-Uri"] = media.MxcUri()
+	}
+	return &api.HeadersResponse{StatusCode: http.StatusNoContent, Headers: headers}
+}
+
+func resumableUploadHeaders(upload *types.ResumableUpload) map[string]string {
+	return map[string]string{
+		"Tus-Resumable":      tusVersion,
+		"Upload-Offset":      strconv.FormatInt(upload.OffsetBytes, 10),
+		"Upload-Length":      strconv.FormatInt(upload.SizeBytes, 10),
+		"Upload-Expires":     time.Unix(0, upload.ExpiresTs*int64(time.Millisecond)).UTC().Format(http.TimeFormat),
+		"Matrix-Content-Uri": "mxc://" + upload.Origin + "/" + upload.MediaId,
+	}
+}
+
+func resumableUploadError(err error, rctx rcontext.RequestContext) interface{} {
+	if err == common.ErrMediaNotFound {
+		return api.NotFoundError()
+	} else if err == common.ErrUploadOffsetMismatch {
+		return &api.StatusCodeResponse{StatusCode: http.StatusConflict, Payload: api.BadRequest("Upload-Offset does not match the upload")}
+	} else if err == common.ErrMediaTooLarge {
+		return api.RequestTooLarge()
+	} else if err == common.ErrMediaQuarantined {
+		return api.BadRequest("This file is not permitted on this server")
+	}
+	rctx.Log.Error("Unexpected error handling resumable upload: " + err.Error())
+	sentry.CaptureException(err)
+	return api.InternalServerError("Unexpected Error")
+}
+
+// parseUploadMetadata reads the Upload-Metadata header, which is a comma separated list of keys
+// followed by their base64 encoded values.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) < 2 {
+			metadata[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		metadata[parts[0]] = string(value)
+	}
+	return metadata
+}
@@ -0,0 +1,158 @@
+package unstable
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type CreateSignedUrlRequest struct {
+	ExpiresInSeconds int `json:"expires_in_seconds"`
+}
+
+type SignedUrlResponse struct {
+	Url       string `json:"url"`
+	ExpiresTs int64  `json:"expires_ts"`
+}
+
+func CreateSignedUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	cfg := config.Get().SignedUrls
+	if cfg.Secret == "" {
+		rctx.Log.Warn("Signed URLs are enabled but no secret is configured")
+		return api.InternalServerError("Signed URLs are not configured")
+	}
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read request")
+	}
+	req := &CreateSignedUrlRequest{}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, req)
+		if err != nil {
+			return api.BadRequest("Could not parse request")
+		}
+	}
+	if req.ExpiresInSeconds <= 0 {
+		req.ExpiresInSeconds = cfg.DefaultExpirySeconds
+	}
+	if req.ExpiresInSeconds > cfg.MaxExpirySeconds {
+		return api.BadRequest(fmt.Sprintf("Links cannot last longer than %d seconds", cfg.MaxExpirySeconds))
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":           server,
+		"mediaId":          mediaId,
+		"expiresInSeconds": req.ExpiresInSeconds,
+	})
+
+	if errRes := r0.CheckMediaAccess(r, rctx, user, server, mediaId); errRes != nil {
+		return errRes
+	}
+
+	// Only media the repo already has can be linked to, so following a link never downloads anything
+	media, err := download_controller.FindMediaRecord(server, mediaId, false, rctx)
+	if err != nil {
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		}
+		rctx.Log.Error("Unexpected error locating media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if media.Quarantined {
+		return api.NotFoundError() // We lie for security
+	}
+
+	expiry := time.Duration(req.ExpiresInSeconds) * time.Second
+	expiresTs := util.NowMillis() + expiry.Milliseconds()
+	signature := download_controller.SignDownload(server, mediaId, expiresTs)
+	rctx.Log.Infof("Signed a download link for %s which expires at %d", user.UserId, expiresTs)
+
+	query := url.Values{}
+	query.Set("expires_ts", strconv.FormatInt(expiresTs, 10))
+	query.Set("sig", signature)
+	return &api.DoNotCacheResponse{Payload: &SignedUrlResponse{
+		Url:       fmt.Sprintf("%s/_matrix/media/unstable/signed_download/%s/%s?%s", strings.TrimSuffix(rctx.Config.ClientServerApi, "/"), server, url.PathEscape(mediaId), query.Encode()),
+		ExpiresTs: expiresTs,
+	}}
+}
+
+func SignedDownload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+	filename := params["filename"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":   server,
+		"mediaId":  mediaId,
+		"filename": filename,
+	})
+
+	expiresTs, err := strconv.ParseInt(r.URL.Query().Get("expires_ts"), 10, 64)
+	if err != nil || !download_controller.IsValidDownloadSignature(server, mediaId, expiresTs, r.URL.Query().Get("sig")) {
+		rctx.Log.Warn("Download link is invalid or has expired")
+		return api.InvalidSignature()
+	}
+
+	// The signature stands in for an access token, so restrictions on the media aren't checked again
+	if res := r0.GetRedirectedDownload(server, mediaId, filename, "infer", rctx); res != nil {
+		return res
+	}
+
+	streamedMedia, err := download_controller.GetMedia(server, mediaId, false, false, rctx)
+	if err != nil {
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		} else if err == common.ErrMediaQuarantined {
+			return api.NotFoundError() // We lie for security
+		}
+		rctx.Log.Error("Unexpected error locating media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	if filename == "" {
+		filename = streamedMedia.UploadName
+	}
+
+	res := &r0.DownloadMediaResponse{
+		ContentType:       streamedMedia.ContentType,
+		Filename:          filename,
+		SizeBytes:         streamedMedia.SizeBytes,
+		Data:              streamedMedia.Stream,
+		TargetDisposition: "infer",
+	}
+	if streamedMedia.KnownMedia != nil {
+		res.Sha256Hash = streamedMedia.KnownMedia.Sha256Hash
+		res.CreationTs = streamedMedia.KnownMedia.CreationTs
+	}
+	return res
+}
@@ -0,0 +1,100 @@
+package unstable
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type UploadFromUrlRequest struct {
+	Url      string `json:"url"`
+	Filename string `json:"filename"`
+}
+
+func UploadFromUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	if !rctx.Config.Uploads.FromUrl.Enabled {
+		return api.NotFoundError()
+	}
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("failed to read request")
+	}
+	req := &UploadFromUrlRequest{}
+	err = json.Unmarshal(b, req)
+	if err != nil || req.Url == "" {
+		return api.BadRequest("A url is required")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"url": req.Url,
+	})
+
+	// The size isn't known until the URL has been fetched, so the quota is checked again afterwards
+	if errRes := r0.CheckUploadAllowed(r, rctx, user, 0); errRes != nil {
+		return errRes
+	}
+
+	fetched, err := upload_controller.FetchUrlForUpload(req.Url, rctx)
+	if err != nil {
+		if err == common.ErrInvalidHost || err == common.ErrHostBlacklisted || err == common.ErrHostNotFound {
+			return api.BadRequest(err.Error())
+		} else if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		}
+		rctx.Log.Warn("Error downloading URL for upload: ", err)
+		return api.BadRequest("Unable to download the url")
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId, int64(len(fetched.Contents)))
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		rctx.Log.Warn("Upload would exceed the user's quota")
+		return api.QuotaExceeded()
+	}
+
+	filename := fetched.Filename
+	if req.Filename != "" {
+		filename = req.Filename
+	}
+	filename = filepath.Base(filename)
+
+	contents := ioutil.NopCloser(bytes.NewReader(fetched.Contents))
+	media, err := upload_controller.UploadMedia(contents, int64(len(fetched.Contents)), fetched.ContentType, filename, user.UserId, r.Host, rctx)
+	if err != nil {
+		if err == common.ErrMediaQuarantined {
+			return api.BadRequest("This file is not permitted on this server")
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		}
+
+		rctx.Log.Error("Unexpected error storing media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &r0.MediaUploadedResponse{
+		ContentUri: media.MxcUri(),
+	}
+}
@@ -0,0 +1,69 @@
+package webserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util"
+	"golang.org/x/time/rate"
+)
+
+// Writes are split up so that concurrent downloads take turns at the shared limit
+const maxThrottledChunkBytes = 32 * 1024
+
+// throttleDownload limits how fast the response body can be written, both for this request and for all
+// downloads together.
+func throttleDownload(w http.ResponseWriter, r *http.Request) io.Writer {
+	limiters := make([]*rate.Limiter, 0, 2)
+	// Shared by every download, so the cap holds no matter how many are running at once
+	if l := util.GetBandwidthLimiter("downloads", config.Get().Downloads.Bandwidth.MaxBytesPerSecond); l != nil {
+		limiters = append(limiters, l)
+	}
+	if perRequest := config.Get().Downloads.Bandwidth.MaxBytesPerSecondPerRequest; perRequest > 0 {
+		limiters = append(limiters, rate.NewLimiter(rate.Limit(perRequest), int(perRequest)))
+	}
+	if len(limiters) == 0 {
+		// Left as-is so files can still be sent with sendfile
+		return w
+	}
+
+	chunkSize := maxThrottledChunkBytes
+	for _, l := range limiters {
+		if l.Burst() < chunkSize {
+			chunkSize = l.Burst()
+		}
+	}
+	return &throttledWriter{w: w, ctx: r.Context(), limiters: limiters, chunkSize: chunkSize}
+}
+
+type throttledWriter struct {
+	w         io.Writer
+	ctx       context.Context
+	limiters  []*rate.Limiter
+	chunkSize int
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > t.chunkSize {
+			n = t.chunkSize
+		}
+		for _, l := range t.limiters {
+			// Stops waiting if the client goes away
+			if err := l.WaitN(t.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
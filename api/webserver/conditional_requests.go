@@ -0,0 +1,49 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// strongEtag returns the ETag for content with the given SHA-256 hash. Media and thumbnails never change
+// once stored, so their hash identifies the exact bytes served.
+func strongEtag(sha256Hash string) string {
+	if sha256Hash == "" {
+		return ""
+	}
+	return "\"" + sha256Hash + "\""
+}
+
+// isNotModified returns whether the copy the client already has is still current, according to the
+// request's If-None-Match or If-Modified-Since headers. If-Modified-Since is ignored when If-None-Match
+// is given, as required by RFC 7232.
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have second precision
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
@@ -0,0 +1,35 @@
+package webserver
+
+import (
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// pickContentDisposition decides whether a download is shown inline or as an attachment. Content types
+// configured as attachments are never shown inline, even if the client asked for that, as the browser
+// could otherwise run scripts from them on the media repo's origin. When the client leaves the choice to
+// the media repo ("infer"), only the content types configured as inline are shown inline.
+func pickContentDisposition(requested string, mediaType string, cfg config.ContentDispositionConfig) string {
+	if matchesAnyContentType(mediaType, cfg.Attachment) {
+		return "attachment"
+	}
+	if requested == "" {
+		return "inline"
+	}
+	if requested == "infer" {
+		if mediaType != "" && matchesAnyContentType(mediaType, cfg.Inline) {
+			return "inline"
+		}
+		return "attachment"
+	}
+	return requested
+}
+
+func matchesAnyContentType(mediaType string, patterns []string) bool {
+	for _, p := range patterns {
+		if glob.Glob(p, mediaType) {
+			return true
+		}
+	}
+	return false
+}
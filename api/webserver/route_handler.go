@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alioygur/is"
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,6 +26,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
@@ -75,8 +77,9 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	contextLog.Info("Received request")
 
 	// Send CORS and other basic headers
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Upload-Length, Upload-Offset, Upload-Expires, Matrix-Content-Uri")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';")
 	w.Header().Set("X-Robots-Tag", "noindex, nofollow, noarchive, noimageindex")
@@ -84,6 +87,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Process response
 	var res interface{} = api.AuthFailed()
+	var rctx rcontext.RequestContext
 	if util.IsServerOurs(r.Host) || h.ignoreHost {
 		contextLog.Info("Host is valid - processing request")
 		cfg := config.GetDomain(r.Host)
@@ -99,7 +103,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ctx = context.WithValue(ctx, "mr.logger", contextLog)
 		ctx = context.WithValue(ctx, "mr.serverConfig", cfg)
 		ctx = context.WithValue(ctx, "mr.request", r)
-		rctx := rcontext.RequestContext{Context: ctx, Log: contextLog, Config: *cfg, Request: r}
+		rctx = rcontext.RequestContext{Context: ctx, Log: contextLog, Config: *cfg, Request: r}
 		r = r.WithContext(rctx)
 
 		metrics.HttpRequests.With(prometheus.Labels{
@@ -137,6 +141,10 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	statusCode := http.StatusOK
 	switch result := res.(type) {
+	case *api.StatusCodeResponse:
+		statusCode = result.StatusCode
+		res = result.Payload
+		break
 	case *api.ErrorResponse:
 		switch result.InternalCode {
 		case common.ErrCodeUnknownToken:
@@ -157,22 +165,34 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case common.ErrCodeForbidden:
 			statusCode = http.StatusForbidden
 			break
+		case common.ErrCodeQuotaExceeded:
+			statusCode = http.StatusForbidden
+			break
+		case common.ErrCodeRateLimitExceeded:
+			statusCode = http.StatusTooManyRequests
+			break
+		case common.ErrCodeNotYetUploaded:
+			statusCode = http.StatusGatewayTimeout
+			break
+		case common.ErrCodeCannotOverwriteMedia:
+			statusCode = http.StatusConflict
+			break
+		case common.ErrCodeDigestMismatch:
+			statusCode = http.StatusBadRequest
+			break
 		default: // Treat as unknown (a generic server error)
 			statusCode = http.StatusInternalServerError
 			break
 		}
 		break
+	case *api.RateLimitedResponse:
+		statusCode = http.StatusTooManyRequests
+		break
 	case *r0.DownloadMediaResponse:
-		metrics.HttpResponses.With(prometheus.Labels{
-			"host":       r.Host,
-			"action":     h.action,
-			"method":     r.Method,
-			"statusCode": strconv.Itoa(http.StatusOK),
-		}).Inc()
-
 		contentType := result.ContentType
 		mediaType, params, err := mime.ParseMediaType(result.ContentType)
 		if err != nil {
+			mediaType = strings.ToLower(strings.TrimSpace(strings.Split(result.ContentType, ";")[0]))
 			sentry.CaptureException(err)
 			contextLog.Warn("Failed to parse content type header for media on reply: " + err.Error())
 		} else {
@@ -184,24 +204,34 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		w.Header().Set("Cache-Control", "private, max-age=259200") // 3 days
+		etag := strongEtag(result.Sha256Hash)
+		lastModified := time.Time{}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if result.CreationTs > 0 {
+			lastModified = util.FromMillis(result.CreationTs)
+			w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		}
+		if isNotModified(r, etag, lastModified) {
+			if result.Data != nil {
+				result.Data.Close()
+			}
+			metrics.HttpResponses.With(prometheus.Labels{
+				"host":       r.Host,
+				"action":     h.action,
+				"method":     r.Method,
+				"statusCode": strconv.Itoa(http.StatusNotModified),
+			}).Inc()
+			w.WriteHeader(http.StatusNotModified)
+			return // Prevent sending conflicting responses
+		}
+
 		w.Header().Set("Content-Type", contentType)
 		if result.SizeBytes > 0 {
 			w.Header().Set("Content-Length", fmt.Sprint(result.SizeBytes))
 		}
-		disposition := result.TargetDisposition
-		if disposition == "" {
-			disposition = "inline"
-		} else if disposition == "infer" {
-			if result.ContentType == "" {
-				disposition = "attachment"
-			} else {
-				if util.HasAnyPrefix(result.ContentType, []string{"image/", "audio/", "video/", "text/plain"}) {
-					disposition = "inline"
-				} else {
-					disposition = "attachment"
-				}
-			}
-		}
+		disposition := pickContentDisposition(result.TargetDisposition, mediaType, rctx.Config.Downloads.ContentDisposition)
 		fname := result.Filename
 		if fname == "" {
 			exts, err := mime.ExtensionsByType(result.ContentType)
@@ -221,8 +251,49 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			w.Header().Set("Content-Disposition", disposition+"; filename*=utf-8''"+url.QueryEscape(fname))
 		}
+
+		if result.Data == nil && result.KnownMedia != nil {
+			redirectUrl, err := datastore.DownloadRedirectUrl(result.KnownMedia, contentType, w.Header().Get("Content-Disposition"), rctx)
+			if err == nil {
+				metrics.HttpResponses.With(prometheus.Labels{
+					"host":       r.Host,
+					"action":     h.action,
+					"method":     r.Method,
+					"statusCode": strconv.Itoa(http.StatusTemporaryRedirect),
+				}).Inc()
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Length")
+				w.Header().Del("Content-Disposition")
+				w.Header().Del("ETag")
+				w.Header().Del("Last-Modified")
+				w.Header().Set("Cache-Control", "no-store") // the URL expires
+				http.Redirect(w, r, redirectUrl, http.StatusTemporaryRedirect)
+				return // Prevent sending conflicting responses
+			}
+
+			contextLog.Warn("Error generating redirect for download, serving it directly: " + err.Error())
+			sentry.CaptureException(err)
+			result.Data, err = datastore.DownloadStream(rctx, result.KnownMedia.DatastoreId, result.KnownMedia.Location)
+			if err != nil {
+				contextLog.Error("Error downloading media after failing to redirect: " + err.Error())
+				sentry.CaptureException(err)
+				for _, header := range []string{"Content-Length", "Content-Disposition", "ETag", "Last-Modified", "Cache-Control"} {
+					w.Header().Del(header)
+				}
+				res = api.InternalServerError("Unexpected Error")
+				statusCode = http.StatusInternalServerError
+				break
+			}
+		}
+
+		metrics.HttpResponses.With(prometheus.Labels{
+			"host":       r.Host,
+			"action":     h.action,
+			"method":     r.Method,
+			"statusCode": strconv.Itoa(http.StatusOK),
+		}).Inc()
 		defer result.Data.Close()
-		writeResponseData(w, result.Data, result.SizeBytes)
+		writeResponseData(throttleDownload(w, r), result.Data, result.SizeBytes)
 		return // Prevent sending conflicting responses
 	case *r0.IdenticonResponse:
 		metrics.HttpResponses.With(prometheus.Labels{
@@ -235,6 +306,18 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "image/png")
 		writeResponseData(w, result.Avatar, 0)
 		return // Prevent sending conflicting responses
+	case *api.HeadersResponse:
+		metrics.HttpResponses.With(prometheus.Labels{
+			"host":       r.Host,
+			"action":     h.action,
+			"method":     r.Method,
+			"statusCode": strconv.Itoa(result.StatusCode),
+		}).Inc()
+		for name, value := range result.Headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(result.StatusCode)
+		return
 	case *api.HtmlResponse:
 		metrics.HttpResponses.With(prometheus.Labels{
 			"host":       r.Host,
@@ -266,7 +349,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(res)
 }
 
-func writeResponseData(w http.ResponseWriter, s io.Reader, expectedBytes int64) {
+func writeResponseData(w io.Writer, s io.Reader, expectedBytes int64) {
 	b, err := io.Copy(w, s)
 	if err != nil {
 		// Should only blow up this request
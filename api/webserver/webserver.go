@@ -16,17 +16,22 @@ import (
 	"github.com/didip/tollbooth"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/admin_tokens"
 	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/auth_cache"
 	"github.com/turt2live/matrix-media-repo/api/custom"
 	"github.com/turt2live/matrix-media-repo/api/features"
 	"github.com/turt2live/matrix-media-repo/api/r0"
 	"github.com/turt2live/matrix-media-repo/api/unstable"
 	"github.com/turt2live/matrix-media-repo/api/webserver/debug"
 	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 type route struct {
-	method  string
+	method  string // or several, separated by commas
 	handler handler
 }
 
@@ -39,35 +44,60 @@ func Init() *sync.WaitGroup {
 	counter := &requestCounter{}
 
 	optionsHandler := handler{api.EmptyResponseHandler, "options_request", counter, false}
-	uploadHandler := handler{api.AccessTokenRequiredRoute(r0.UploadMedia), "upload", counter, false}
+	uploadHandler := handler{api.UploadBodyLimitedRoute(api.MaxUploadBytes, api.AccessTokenRequiredRoute(r0.UploadMedia)), "upload", counter, false}
+	createMediaHandler := handler{api.AccessTokenRequiredRoute(r0.CreateMedia), "create_media", counter, false}
+	uploadPendingHandler := handler{api.UploadBodyLimitedRoute(api.MaxUploadBytes, api.AccessTokenRequiredRoute(r0.UploadPendingMedia)), "upload_pending", counter, false}
 	downloadHandler := handler{api.AccessTokenOptionalRoute(r0.DownloadMedia), "download", counter, false}
 	thumbnailHandler := handler{api.AccessTokenOptionalRoute(r0.ThumbnailMedia), "thumbnail", counter, false}
 	previewUrlHandler := handler{api.AccessTokenRequiredRoute(r0.PreviewUrl), "url_preview", counter, false}
 	identiconHandler := handler{api.AccessTokenOptionalRoute(r0.Identicon), "identicon", counter, false}
-	purgeRemote := handler{api.RepoAdminRoute(custom.PurgeRemoteMedia), "purge_remote_media", counter, false}
-	purgeOneHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeIndividualRecord), "purge_individual_media", counter, false}
-	purgeQuarantinedHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeQuarantined), "purge_quarantined", counter, false}
-	purgeUserMediaHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeUserMedia), "purge_user_media", counter, false}
-	purgeRoomHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeRoomMedia), "purge_room_media", counter, false}
-	purgeDomainHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeDomainMedia), "purge_domain_media", counter, false}
-	purgeOldHandler := handler{api.RepoAdminRoute(custom.PurgeOldMedia), "purge_old_media", counter, false}
-	quarantineHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineMedia), "quarantine_media", counter, false}
-	quarantineRoomHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineRoomMedia), "quarantine_room", counter, false}
-	quarantineUserHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineUserMedia), "quarantine_user", counter, false}
-	quarantineDomainHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineDomainMedia), "quarantine_domain", counter, false}
+	purgeRemote := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopePurge, custom.PurgeRemoteMedia), "purge_remote_media", counter, false}
+	purgeOneHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopePurge, custom.PurgeIndividualRecord), "purge_individual_media", counter, false}
+	purgeMediaListHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopePurge, custom.PurgeMediaList), "purge_media_list", counter, false}
+	purgeQuarantinedHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopePurge, custom.PurgeQuarantined), "purge_quarantined", counter, false}
+	purgeUserMediaHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopePurge, custom.PurgeUserMedia), "purge_user_media", counter, false}
+	purgeRoomHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopePurge, custom.PurgeRoomMedia), "purge_room_media", counter, false}
+	purgeDomainHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopePurge, custom.PurgeDomainMedia), "purge_domain_media", counter, false}
+	purgeOldHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopePurge, custom.PurgeOldMedia), "purge_old_media", counter, false}
+	quarantineHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopeQuarantine, custom.QuarantineMedia), "quarantine_media", counter, false}
+	quarantineRoomHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopeQuarantine, custom.QuarantineRoomMedia), "quarantine_room", counter, false}
+	quarantineUserHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopeQuarantine, custom.QuarantineUserMedia), "quarantine_user", counter, false}
+	quarantineDomainHandler := handler{api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopeQuarantine, custom.QuarantineDomainMedia), "quarantine_domain", counter, false}
+	quarantinedServersHandler := handler{api.RepoAdminRoute(custom.GetQuarantinedServers), "list_quarantined_servers", counter, false}
+	quarantinedMediaHandler := handler{api.RepoAdminRoute(custom.GetQuarantinedMedia), "list_quarantined_media", counter, false}
+	unblockServerHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeQuarantine, custom.UnblockQuarantinedServer), "unblock_quarantined_server", counter, false}
 	localCopyHandler := handler{api.AccessTokenRequiredRoute(unstable.LocalCopy), "local_copy", counter, false}
 	infoHandler := handler{api.AccessTokenRequiredRoute(unstable.MediaInfo), "info", counter, false}
+	startDirectUploadHandler := handler{api.AccessTokenRequiredRoute(unstable.StartDirectUpload), "start_direct_upload", counter, false}
+	completeDirectUploadHandler := handler{api.AccessTokenRequiredRoute(unstable.CompleteDirectUpload), "complete_direct_upload", counter, false}
+	startResumableUploadHandler := handler{api.AccessTokenRequiredRoute(unstable.StartResumableUpload), "start_resumable_upload", counter, false}
+	resumableUploadHandler := handler{api.UploadBodyLimitedRoute(api.MaxUploadBytes, api.AccessTokenRequiredRoute(unstable.ResumableUpload)), "resumable_upload", counter, false}
+	batchUploadHandler := handler{api.UploadBodyLimitedRoute(unstable.MaxBatchUploadBytes, api.AccessTokenRequiredRoute(unstable.BatchUpload)), "batch_upload", counter, false}
+	uploadFromUrlHandler := handler{api.AccessTokenRequiredRoute(unstable.UploadFromUrl), "upload_from_url", counter, false}
+	restrictMediaHandler := handler{api.AccessTokenRequiredRoute(unstable.RestrictMedia), "restrict_media", counter, false}
+	createSignedUrlHandler := handler{api.AccessTokenRequiredRoute(unstable.CreateSignedUrl), "create_signed_url", counter, false}
+	signedDownloadHandler := handler{api.AccessTokenOptionalRoute(unstable.SignedDownload), "signed_download", counter, false}
+	customUploadHandler := handler{api.UploadBodyLimitedRoute(api.MaxUploadBytes, api.ScopedAccessTokenRequiredRoute(admin_tokens.ScopeUpload, unstable.UploadMediaWithId)), "custom_upload", counter, false}
 	configHandler := handler{api.AccessTokenRequiredRoute(r0.PublicConfig), "config", counter, false}
-	storageEstimateHandler := handler{api.RepoAdminRoute(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter, false}
+	storageEstimateHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter, false}
 	datastoreListHandler := handler{api.RepoAdminRoute(custom.GetDatastores), "list_datastores", counter, false}
 	dsTransferHandler := handler{api.RepoAdminRoute(custom.MigrateBetweenDatastores), "datastore_transfer", counter, false}
+	dsPurgeHandler := handler{api.RepoAdminRoute(custom.PurgeDatastore), "datastore_purge", counter, false}
+	dsGarbageCollectHandler := handler{api.RepoAdminRoute(custom.CollectDatastoreGarbage), "datastore_garbage_collection", counter, false}
+	datastoreUsageHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetDatastoreUsage), "get_datastore_usage", counter, false}
+	dsReadOnlyHandler := handler{api.RepoAdminRoute(custom.SetDatastoreReadOnly), "set_datastore_read_only", counter, false}
 	fedTestHandler := handler{api.RepoAdminRoute(custom.GetFederationInfo), "federation_test", counter, false}
 	healthzHandler := handler{api.AccessTokenOptionalRoute(custom.GetHealthz), "healthz", counter, true}
-	domainUsageHandler := handler{api.RepoAdminRoute(custom.GetDomainUsage), "domain_usage", counter, false}
-	userUsageHandler := handler{api.RepoAdminRoute(custom.GetUserUsage), "user_usage", counter, false}
-	uploadsUsageHandler := handler{api.RepoAdminRoute(custom.GetUploadsUsage), "uploads_usage", counter, false}
+	readyzHandler := handler{api.AccessTokenOptionalRoute(custom.GetReadyz), "readyz", counter, true}
+	domainUsageHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetDomainUsage), "domain_usage", counter, false}
+	userUsageHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetUserUsage), "user_usage", counter, false}
+	uploadsUsageHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetUploadsUsage), "uploads_usage", counter, false}
+	remoteServersUsageHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetRemoteServersUsage), "remote_servers_usage", counter, false}
+	topUsersUsageHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopeStats, custom.GetTopUsersUsage), "top_users_usage", counter, false}
+	userMediaHandler := handler{api.RepoAdminRoute(custom.GetUserMedia), "list_user_media", counter, false}
 	getBackgroundTaskHandler := handler{api.RepoAdminRoute(custom.GetTask), "get_background_task", counter, false}
 	listAllBackgroundTasksHandler := handler{api.RepoAdminRoute(custom.ListAllTasks), "list_all_background_tasks", counter, false}
+	cancelBackgroundTaskHandler := handler{api.RepoAdminRoute(custom.CancelTask), "cancel_background_task", counter, false}
 	listUnfinishedBackgroundTasksHandler := handler{api.RepoAdminRoute(custom.ListUnfinishedTasks), "list_unfinished_background_tasks", counter, false}
 	exportUserDataHandler := handler{api.AccessTokenRequiredRoute(custom.ExportUserData), "export_user_data", counter, false}
 	exportServerDataHandler := handler{api.AccessTokenRequiredRoute(custom.ExportServerData), "export_server_data", counter, false}
@@ -78,12 +108,119 @@ func Init() *sync.WaitGroup {
 	startImportHandler := handler{api.RepoAdminRoute(custom.StartImport), "start_import", counter, false}
 	appendToImportHandler := handler{api.RepoAdminRoute(custom.AppendToImport), "append_to_import", counter, false}
 	stopImportHandler := handler{api.RepoAdminRoute(custom.StopImport), "stop_import", counter, false}
+	verifyImportHandler := handler{api.RepoAdminRoute(custom.VerifyImport), "verify_import", counter, false}
 	versionHandler := handler{api.AccessTokenOptionalRoute(custom.GetVersion), "get_version", counter, false}
 	ipfsDownloadHandler := handler{api.AccessTokenOptionalRoute(unstable.IPFSDownload), "ipfs_download", counter, false}
 	logoutHandler := handler{api.AccessTokenRequiredRoute(r0.Logout), "logout", counter, false}
 	logoutAllHandler := handler{api.AccessTokenRequiredRoute(r0.LogoutAll), "logout_all", counter, false}
+	mediaRecordHandler := handler{api.RepoAdminRoute(custom.GetMediaRecord), "get_media_record", counter, false}
+	redownloadMediaHandler := handler{api.RepoAdminRoute(custom.RedownloadMedia), "redownload_media", counter, false}
+	searchMediaHandler := handler{api.RepoAdminRoute(custom.SearchMedia), "search_media", counter, false}
+	getPurgeSchedulesHandler := handler{api.RepoAdminRoute(custom.GetPurgeSchedules), "get_purge_schedules", counter, false}
+	createPurgeScheduleHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopePurge, custom.CreatePurgeSchedule), "create_purge_schedule", counter, false}
+	deletePurgeScheduleHandler := handler{api.ScopedRepoAdminRoute(admin_tokens.ScopePurge, custom.DeletePurgeSchedule), "delete_purge_schedule", counter, false}
+	purgeScheduleRunsHandler := handler{api.RepoAdminRoute(custom.GetPurgeScheduleRuns), "get_purge_schedule_runs", counter, false}
+	reloadConfigHandler := handler{api.RepoAdminRoute(custom.ReloadConfig), "reload_config", counter, false}
+	cacheEntriesHandler := handler{api.RepoAdminRoute(custom.GetCacheEntries), "get_cache_entries", counter, false}
+	cacheEvictHandler := handler{api.RepoAdminRoute(custom.EvictCacheEntry), "evict_cache_entry", counter, false}
+	cacheFlushHandler := handler{api.RepoAdminRoute(custom.FlushCache), "flush_cache", counter, false}
+	getUserQuotaHandler := handler{api.RepoAdminRoute(custom.GetUserQuota), "get_user_quota", counter, false}
+	setUserQuotaHandler := handler{api.RepoAdminRoute(custom.SetUserQuota), "set_user_quota", counter, false}
+	deleteUserQuotaHandler := handler{api.RepoAdminRoute(custom.DeleteUserQuota), "delete_user_quota", counter, false}
+	getUserRateLimitsHandler := handler{api.RepoAdminRoute(custom.GetUserRateLimits), "get_user_rate_limits", counter, false}
+	setUserRateLimitHandler := handler{api.RepoAdminRoute(custom.SetUserRateLimit), "set_user_rate_limit", counter, false}
+	deleteUserRateLimitHandler := handler{api.RepoAdminRoute(custom.DeleteUserRateLimit), "delete_user_rate_limit", counter, false}
+	auditLogHandler := handler{api.RepoAdminRoute(custom.GetAuditLog), "get_audit_log", counter, false}
+	uploadBansHandler := handler{api.RepoAdminRoute(custom.GetUploadBans), "get_upload_bans", counter, false}
+	banUploadsHandler := handler{api.RepoAdminRoute(custom.BanUploads), "ban_uploads", counter, false}
+	unbanUploadsHandler := handler{api.RepoAdminRoute(custom.UnbanUploads), "unban_uploads", counter, false}
+	blockedHashesHandler := handler{api.RepoAdminRoute(custom.GetBlockedHashes), "get_blocked_hashes", counter, false}
+	blockHashHandler := handler{api.RepoAdminRoute(custom.BlockHash), "block_hash", counter, false}
+	unblockHashHandler := handler{api.RepoAdminRoute(custom.UnblockHash), "unblock_hash", counter, false}
 	getMediaAttrsHandler := handler{api.AccessTokenRequiredRoute(custom.GetAttributes), "get_media_attributes", counter, false}
 	setMediaAttrsHandler := handler{api.AccessTokenRequiredRoute(custom.SetAttributes), "set_media_attributes", counter, false}
+	getUrlPreviewSettingsHandler := handler{api.AccessTokenRequiredRoute(custom.GetUrlPreviewSettings), "get_url_preview_settings", counter, false}
+	setUrlPreviewSettingsHandler := handler{api.AccessTokenRequiredRoute(custom.SetUrlPreviewSettings), "set_url_preview_settings", counter, false}
+	getAdminTokensHandler := handler{api.RepoAdminRoute(custom.GetAdminTokens), "get_admin_tokens", counter, false}
+	createAdminTokenHandler := handler{api.RepoAdminRoute(custom.CreateAdminToken), "create_admin_token", counter, false}
+	deleteAdminTokenHandler := handler{api.RepoAdminRoute(custom.DeleteAdminToken), "delete_admin_token", counter, false}
+
+	// Admin routes are served under each of the versions below, and again under the versioned admin API
+	adminRoutes := make(map[string]route)
+	adminRoutes["/purge/remote"] = route{"POST", purgeRemote}
+	adminRoutes["/purge/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", purgeOneHandler}
+	adminRoutes["/purge/quarantined"] = route{"POST", purgeQuarantinedHandler}
+	adminRoutes["/purge/media"] = route{"POST", purgeMediaListHandler}
+	adminRoutes["/purge/user/{userId:[^/]+}"] = route{"POST", purgeUserMediaHandler}
+	adminRoutes["/purge/room/{roomId:[^/]+}"] = route{"POST", purgeRoomHandler}
+	adminRoutes["/purge/server/{serverName:[^/]+}"] = route{"POST", purgeDomainHandler}
+	adminRoutes["/purge/old"] = route{"POST", purgeOldHandler}
+	adminRoutes["/purge_schedules"] = route{"GET", getPurgeSchedulesHandler}
+	adminRoutes["/purge_schedules/create"] = route{"POST", createPurgeScheduleHandler}
+	adminRoutes["/purge_schedules/{scheduleId:[0-9]+}/delete"] = route{"DELETE", deletePurgeScheduleHandler}
+	adminRoutes["/purge_schedules/{scheduleId:[0-9]+}/runs"] = route{"GET", purgeScheduleRunsHandler}
+	adminRoutes["/quarantine/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", quarantineHandler}
+	adminRoutes["/quarantine/room/{roomId:[^/]+}"] = route{"POST", quarantineRoomHandler}
+	adminRoutes["/quarantine/user/{userId:[^/]+}"] = route{"POST", quarantineUserHandler}
+	adminRoutes["/quarantine/server/{serverName:[^/]+}"] = route{"POST", quarantineDomainHandler}
+	adminRoutes["/quarantine/server/{serverName:[^/]+}/unblock"] = route{"POST", unblockServerHandler}
+	adminRoutes["/quarantine/servers"] = route{"GET", quarantinedServersHandler}
+	adminRoutes["/quarantine/media"] = route{"GET", quarantinedMediaHandler}
+	adminRoutes["/datastores/{datastoreId:[^/]+}/size_estimate"] = route{"GET", storageEstimateHandler}
+	adminRoutes["/datastores"] = route{"GET", datastoreListHandler}
+	adminRoutes["/datastores/usage"] = route{"GET", datastoreUsageHandler}
+	adminRoutes["/datastores/{sourceDsId:[^/]+}/transfer_to/{targetDsId:[^/]+}"] = route{"POST", dsTransferHandler}
+	adminRoutes["/datastores/{datastoreId:[^/]+}/garbage_collect"] = route{"POST", dsGarbageCollectHandler}
+	adminRoutes["/datastores/{datastoreId:[^/]+}/purge"] = route{"POST", dsPurgeHandler}
+	adminRoutes["/datastores/{datastoreId:[^/]+}/read_only"] = route{"POST", dsReadOnlyHandler}
+	adminRoutes["/federation/test/{serverName:[a-zA-Z0-9.:\\-_]+}"] = route{"GET", fedTestHandler}
+	adminRoutes["/usage/{serverName:[a-zA-Z0-9.:\\-_]+}"] = route{"GET", domainUsageHandler}
+	adminRoutes["/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/users"] = route{"GET", userUsageHandler}
+	adminRoutes["/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/uploads"] = route{"GET", uploadsUsageHandler}
+	adminRoutes["/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/users/top"] = route{"GET", topUsersUsageHandler}
+	adminRoutes["/usage/remote/servers"] = route{"GET", remoteServersUsageHandler}
+	adminRoutes["/tasks/{taskId:[0-9]+}"] = route{"GET", getBackgroundTaskHandler}
+	adminRoutes["/tasks/{taskId:[0-9]+}/cancel"] = route{"POST", cancelBackgroundTaskHandler}
+	adminRoutes["/tasks/all"] = route{"GET", listAllBackgroundTasksHandler}
+	adminRoutes["/tasks/unfinished"] = route{"GET", listUnfinishedBackgroundTasksHandler}
+	adminRoutes["/user/{userId:[^/]+}/media"] = route{"GET", userMediaHandler}
+	adminRoutes["/user/{userId:[^/]+}/quota"] = route{"GET", getUserQuotaHandler}
+	adminRoutes["/user/{userId:[^/]+}/quota/set"] = route{"POST", setUserQuotaHandler}
+	adminRoutes["/user/{userId:[^/]+}/quota/delete"] = route{"DELETE", deleteUserQuotaHandler}
+	adminRoutes["/user/{userId:[^/]+}/rate_limits"] = route{"GET", getUserRateLimitsHandler}
+	adminRoutes["/user/{userId:[^/]+}/rate_limits/set"] = route{"POST", setUserRateLimitHandler}
+	adminRoutes["/user/{userId:[^/]+}/rate_limits/delete"] = route{"DELETE", deleteUserRateLimitHandler}
+	adminRoutes["/user/{userId:[^/]+}/export"] = route{"POST", exportUserDataHandler}
+	adminRoutes["/server/{serverName:[^/]+}/export"] = route{"POST", exportServerDataHandler}
+	adminRoutes["/export/{exportId:[a-zA-Z0-9.:\\-_]+}/view"] = route{"GET", viewExportHandler}
+	adminRoutes["/export/{exportId:[a-zA-Z0-9.:\\-_]+}/metadata"] = route{"GET", getExportMetadataHandler}
+	adminRoutes["/export/{exportId:[a-zA-Z0-9.:\\-_]+}/part/{partId:[0-9]+}"] = route{"GET", downloadExportPartHandler}
+	adminRoutes["/export/{exportId:[a-zA-Z0-9.:\\-_]+}/delete"] = route{"DELETE", deleteExportHandler}
+	adminRoutes["/import"] = route{"POST", startImportHandler}
+	adminRoutes["/import/{importId:[a-zA-Z0-9.:\\-_]+}/part"] = route{"POST", appendToImportHandler}
+	adminRoutes["/import/{importId:[a-zA-Z0-9.:\\-_]+}/close"] = route{"POST", stopImportHandler}
+	adminRoutes["/import/verify"] = route{"POST", verifyImportHandler}
+	adminRoutes["/media/search"] = route{"GET", searchMediaHandler}
+	adminRoutes["/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", mediaRecordHandler}
+	adminRoutes["/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/redownload"] = route{"POST", redownloadMediaHandler}
+	adminRoutes["/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/attributes"] = route{"GET", getMediaAttrsHandler}
+	adminRoutes["/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/attributes/set"] = route{"POST", setMediaAttrsHandler}
+	adminRoutes["/config/reload"] = route{"POST", reloadConfigHandler}
+	adminRoutes["/audit_log"] = route{"GET", auditLogHandler}
+	adminRoutes["/upload_bans"] = route{"GET", uploadBansHandler}
+	adminRoutes["/upload_bans/ban"] = route{"POST", banUploadsHandler}
+	adminRoutes["/upload_bans/unban"] = route{"POST", unbanUploadsHandler}
+	adminRoutes["/blocked_hashes"] = route{"GET", blockedHashesHandler}
+	adminRoutes["/blocked_hashes/block"] = route{"POST", blockHashHandler}
+	adminRoutes["/blocked_hashes/unblock"] = route{"POST", unblockHashHandler}
+	adminRoutes["/cache"] = route{"GET", cacheEntriesHandler}
+	adminRoutes["/cache/evict/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", cacheEvictHandler}
+	adminRoutes["/cache/flush"] = route{"POST", cacheFlushHandler}
+	adminRoutes["/url_previews/{entityId:[^/]+}/settings"] = route{"GET", getUrlPreviewSettingsHandler}
+	adminRoutes["/url_previews/{entityId:[^/]+}/settings/set"] = route{"POST", setUrlPreviewSettingsHandler}
+	adminRoutes["/tokens"] = route{"GET", getAdminTokensHandler}
+	adminRoutes["/tokens/create"] = route{"POST", createAdminTokenHandler}
+	adminRoutes["/tokens/{tokenId:[0-9]+}/delete"] = route{"DELETE", deleteAdminTokenHandler}
 
 	routes := make(map[string]route)
 	// r0 is typically clients and v1 is typically servers. v1 is deprecated.
@@ -106,40 +243,11 @@ func Init() *sync.WaitGroup {
 		routes["/_matrix/client/"+version+"/logout/all"] = route{"POST", logoutAllHandler}
 
 		// Routes that we define but are not part of the spec (management)
-		routes["/_matrix/media/"+version+"/admin/purge_remote"] = route{"POST", purgeRemote} // deprecated
-		routes["/_matrix/media/"+version+"/admin/purge/remote"] = route{"POST", purgeRemote}
-		routes["/_matrix/media/"+version+"/admin/purge/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", purgeOneHandler}
-		routes["/_matrix/media/"+version+"/admin/purge/quarantined"] = route{"POST", purgeQuarantinedHandler}
-		routes["/_matrix/media/"+version+"/admin/purge/user/{userId:[^/]+}"] = route{"POST", purgeUserMediaHandler}
-		routes["/_matrix/media/"+version+"/admin/purge/room/{roomId:[^/]+}"] = route{"POST", purgeRoomHandler}
-		routes["/_matrix/media/"+version+"/admin/purge/server/{serverName:[^/]+}"] = route{"POST", purgeDomainHandler}
-		routes["/_matrix/media/"+version+"/admin/purge/old"] = route{"POST", purgeOldHandler}
+		routes["/_matrix/media/"+version+"/admin/purge_remote"] = route{"POST", purgeRemote}                             // deprecated
 		routes["/_matrix/media/"+version+"/admin/room/{roomId:[^/]+}/quarantine"] = route{"POST", quarantineRoomHandler} // deprecated
-		routes["/_matrix/media/"+version+"/admin/quarantine/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", quarantineHandler}
-		routes["/_matrix/media/"+version+"/admin/quarantine/room/{roomId:[^/]+}"] = route{"POST", quarantineRoomHandler}
-		routes["/_matrix/media/"+version+"/admin/quarantine/user/{userId:[^/]+}"] = route{"POST", quarantineUserHandler}
-		routes["/_matrix/media/"+version+"/admin/quarantine/server/{serverName:[^/]+}"] = route{"POST", quarantineDomainHandler}
-		routes["/_matrix/media/"+version+"/admin/datastores/{datastoreId:[^/]+}/size_estimate"] = route{"GET", storageEstimateHandler}
-		routes["/_matrix/media/"+version+"/admin/datastores"] = route{"GET", datastoreListHandler}
-		routes["/_matrix/media/"+version+"/admin/datastores/{sourceDsId:[^/]+}/transfer_to/{targetDsId:[^/]+}"] = route{"POST", dsTransferHandler}
-		routes["/_matrix/media/"+version+"/admin/federation/test/{serverName:[a-zA-Z0-9.:\\-_]+}"] = route{"GET", fedTestHandler}
-		routes["/_matrix/media/"+version+"/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}"] = route{"GET", domainUsageHandler}
-		routes["/_matrix/media/"+version+"/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/users"] = route{"GET", userUsageHandler}
-		routes["/_matrix/media/"+version+"/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/uploads"] = route{"GET", uploadsUsageHandler}
-		routes["/_matrix/media/"+version+"/admin/tasks/{taskId:[0-9]+}"] = route{"GET", getBackgroundTaskHandler}
-		routes["/_matrix/media/"+version+"/admin/tasks/all"] = route{"GET", listAllBackgroundTasksHandler}
-		routes["/_matrix/media/"+version+"/admin/tasks/unfinished"] = route{"GET", listUnfinishedBackgroundTasksHandler}
-		routes["/_matrix/media/"+version+"/admin/user/{userId:[^/]+}/export"] = route{"POST", exportUserDataHandler}
-		routes["/_matrix/media/"+version+"/admin/server/{serverName:[^/]+}/export"] = route{"POST", exportServerDataHandler}
-		routes["/_matrix/media/"+version+"/admin/export/{exportId:[a-zA-Z0-9.:\\-_]+}/view"] = route{"GET", viewExportHandler}
-		routes["/_matrix/media/"+version+"/admin/export/{exportId:[a-zA-Z0-9.:\\-_]+}/metadata"] = route{"GET", getExportMetadataHandler}
-		routes["/_matrix/media/"+version+"/admin/export/{exportId:[a-zA-Z0-9.:\\-_]+}/part/{partId:[0-9]+}"] = route{"GET", downloadExportPartHandler}
-		routes["/_matrix/media/"+version+"/admin/export/{exportId:[a-zA-Z0-9.:\\-_]+}/delete"] = route{"DELETE", deleteExportHandler}
-		routes["/_matrix/media/"+version+"/admin/import"] = route{"POST", startImportHandler}
-		routes["/_matrix/media/"+version+"/admin/import/{importId:[a-zA-Z0-9.:\\-_]+}/part"] = route{"POST", appendToImportHandler}
-		routes["/_matrix/media/"+version+"/admin/import/{importId:[a-zA-Z0-9.:\\-_]+}/close"] = route{"POST", stopImportHandler}
-		routes["/_matrix/media/"+version+"/admin/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/attributes"] = route{"GET", getMediaAttrsHandler}
-		routes["/_matrix/media/"+version+"/admin/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/attributes/set"] = route{"POST", setMediaAttrsHandler}
+		for path, adminRoute := range adminRoutes {
+			routes["/_matrix/media/"+version+"/admin"+path] = adminRoute
+		}
 
 		// Routes that we should handle but aren't in the media namespace (synapse compat)
 		routes["/_matrix/client/"+version+"/admin/purge_media_cache"] = route{"POST", purgeRemote}
@@ -149,9 +257,43 @@ func Init() *sync.WaitGroup {
 			routes["/_matrix/media/"+version+"/local_copy/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", localCopyHandler}
 			routes["/_matrix/media/"+version+"/info/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", infoHandler}
 			routes["/_matrix/media/"+version+"/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"DELETE", purgeOneHandler}
+			routes["/_matrix/media/"+version+"/direct_upload"] = route{"POST", startDirectUploadHandler}
+			routes["/_matrix/media/"+version+"/direct_upload/{uploadId:[a-zA-Z0-9]+}/complete"] = route{"POST", completeDirectUploadHandler}
+			routes["/_matrix/media/"+version+"/upload_from_url"] = route{"POST", uploadFromUrlHandler}
+			routes["/_matrix/media/"+version+"/batch_upload"] = route{"POST", batchUploadHandler}
+
+			if config.Get().Uploads.Resumable.Enabled {
+				routes["/_matrix/media/"+version+"/resumable_upload"] = route{"POST", startResumableUploadHandler}
+				routes["/_matrix/media/"+version+"/resumable_upload/{uploadId:[a-zA-Z0-9]+}"] = route{"HEAD,PATCH,DELETE", resumableUploadHandler}
+			}
+			if config.Get().Uploads.CustomMediaIds.Enabled {
+				routes["/_matrix/media/"+version+"/custom_upload/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"PUT", customUploadHandler}
+			}
+		}
+	}
+
+	for path, adminRoute := range adminRoutes {
+		routes[api.AdminV1Prefix+path] = adminRoute
+	}
+
+	if config.Get().Features.MSC2246Async.Enabled {
+		asyncVersions := append([]string{"unstable/fi.mau.msc2246"}, versions...)
+		for _, version := range asyncVersions {
+			routes["/_matrix/media/"+version+"/create"] = route{"POST", createMediaHandler}
+			routes["/_matrix/media/"+version+"/upload/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"PUT", uploadPendingHandler}
 		}
 	}
 
+	if config.Get().Features.MSC3911Restrictions.Enabled {
+		routes["/_matrix/media/unstable/org.matrix.msc3911/restrict/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", restrictMediaHandler}
+	}
+
+	if config.Get().SignedUrls.Enabled {
+		routes["/_matrix/media/unstable/signed_url/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", createSignedUrlHandler}
+		routes["/_matrix/media/unstable/signed_download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", signedDownloadHandler}
+		routes["/_matrix/media/unstable/signed_download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/{filename:.+}"] = route{"GET", signedDownloadHandler}
+	}
+
 	if config.Get().Features.IPFS.Enabled {
 		routes[features.IPFSDownloadRoute] = route{"GET", ipfsDownloadHandler}
 		routes[features.IPFSLiveDownloadRouteR0] = route{"GET", ipfsDownloadHandler}
@@ -161,16 +303,17 @@ func Init() *sync.WaitGroup {
 
 	for routePath, route := range routes {
 		logrus.Info("Registering route: " + route.method + " " + routePath)
-		rtr.Handle(routePath, route.handler).Methods(route.method)
+		rtr.Handle(routePath, route.handler).Methods(strings.Split(route.method, ",")...)
 		rtr.Handle(routePath, optionsHandler).Methods("OPTIONS")
 
 		// This is a hack to a ensure that trailing slashes also match the routes correctly
-		rtr.Handle(routePath+"/", route.handler).Methods(route.method)
+		rtr.Handle(routePath+"/", route.handler).Methods(strings.Split(route.method, ",")...)
 		rtr.Handle(routePath+"/", optionsHandler).Methods("OPTIONS")
 	}
 
 	// Health check endpoints
 	rtr.Handle("/healthz", healthzHandler).Methods("OPTIONS", "GET", "HEAD")
+	rtr.Handle("/readyz", readyzHandler).Methods("OPTIONS", "GET", "HEAD")
 
 	rtr.NotFoundHandler = handler{api.NotFoundHandler, "not_found", counter, true}
 	rtr.MethodNotAllowedHandler = handler{api.MethodNotAllowedHandler, "method_not_allowed", counter, true}
@@ -188,7 +331,14 @@ func Init() *sync.WaitGroup {
 		limiter.SetMessage(string(b))
 		limiter.SetMessageContentType("application/json")
 
-		handler = tollbooth.LimitHandler(limiter, rtr)
+		limited := tollbooth.LimitHandler(limiter, rtr)
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasRateLimitOverrides(r) {
+				rtr.ServeHTTP(w, r)
+			} else {
+				limited.ServeHTTP(w, r)
+			}
+		})
 	}
 
 	address := net.JoinHostPort(config.Get().General.BindAddress, strconv.Itoa(config.Get().General.Port))
@@ -241,3 +391,15 @@ func Stop() {
 		}
 	}
 }
+
+// hasRateLimitOverrides returns true if the request is from a user with their own rate limits, which
+// replace the per-IP limit. Only access tokens which have already been verified are considered, as the
+// homeserver shouldn't be asked about every request before it is rate limited.
+func hasRateLimitOverrides(r *http.Request) bool {
+	accessToken := util.GetAccessTokenFromRequest(r)
+	if accessToken == "" {
+		return false
+	}
+	userId := auth_cache.GetCachedUserId(accessToken, util.GetAppserviceUserIdFromRequest(r))
+	return userId != "" && ratelimit.HasOverrides(rcontext.Initial(), userId)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/assets"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/logging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/common/runtime"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
+)
+
+type manifestReference struct {
+	Kind string `json:"kind"`
+	Id   string `json:"id"`
+	Mxc  string `json:"mxc,omitempty"`
+}
+
+type manifestObject struct {
+	Path       string               `json:"path"`
+	Location   string               `json:"location"`
+	Sha256Hash string               `json:"sha256"`
+	SizeBytes  int64                `json:"size_bytes"`
+	References []*manifestReference `json:"references"`
+}
+
+type manifest struct {
+	DatastoreId string            `json:"datastore_id"`
+	Type        string            `json:"type"`
+	Uri         string            `json:"uri"`
+	ExportedTs  int64             `json:"exported_ts"`
+	Objects     []*manifestObject `json:"objects"`
+	Missing     []string          `json:"missing"`
+}
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	datastoreId := flag.String("datastore", "", "The ID of the datastore to export")
+	destination := flag.String("destination", "./datastore-export.tar.gz", "The archive to write. Archives ending in .gz or .tgz are compressed")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	if *datastoreId == "" {
+		flag.Usage()
+		os.Exit(1)
+		return
+	}
+
+	config.Path = *configPath
+	assets.SetupMigrations(*migrationsPath)
+
+	var err error
+	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info("Starting up...")
+	runtime.RunStartupSequence()
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"datastoreId": *datastoreId})
+	ds, err := datastore.LocateDatastore(ctx, *datastoreId)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info("Finding objects in ", ds.Uri)
+	refs, err := storage.GetDatabase().GetMetadataStore(ctx).GetObjectReferencesInDatastore(ds.DatastoreId)
+	if err != nil {
+		panic(err)
+	}
+
+	objects := make([]*manifestObject, 0)
+	byLocation := make(map[string]*manifestObject)
+	for _, ref := range refs {
+		obj, ok := byLocation[ref.Location]
+		if !ok {
+			obj = &manifestObject{
+				Path:       path.Join("objects", ref.Location),
+				Location:   ref.Location,
+				References: make([]*manifestReference, 0),
+			}
+			byLocation[ref.Location] = obj
+			objects = append(objects, obj)
+		}
+
+		mRef := &manifestReference{Kind: ref.Kind, Id: ref.Id}
+		if ref.Kind == "media" {
+			mRef.Mxc = "mxc://" + ref.Id
+		}
+		obj.References = append(obj.References, mRef)
+	}
+
+	f, err := os.Create(*destination)
+	if err != nil {
+		panic(err)
+	}
+
+	// Closed explicitly once done, as that's when the end of the archive is written out
+	var archive io.Writer = f
+	var gz *gzip.Writer
+	if strings.HasSuffix(*destination, ".gz") || strings.HasSuffix(*destination, ".tgz") {
+		gz = gzip.NewWriter(f)
+		archive = gz
+	}
+	tw := tar.NewWriter(archive)
+
+	export := &manifest{
+		DatastoreId: ds.DatastoreId,
+		Type:        ds.Type,
+		Uri:         ds.Uri,
+		ExportedTs:  util.NowMillis(),
+		Objects:     make([]*manifestObject, 0),
+		Missing:     make([]string, 0),
+	}
+	for i, obj := range objects {
+		logrus.Infof("Exporting %s (%d/%d)", obj.Location, i+1, len(objects))
+		err = writeObject(tw, ds, obj)
+		if err != nil {
+			logrus.Warn("Skipping ", obj.Location, ": ", err)
+			export.Missing = append(export.Missing, obj.Location)
+			continue
+		}
+		export.Objects = append(export.Objects, obj)
+	}
+
+	logrus.Info("Writing manifest")
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "manifest.json",
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, err = tw.Write(b)
+	if err != nil {
+		panic(err)
+	}
+
+	err = tw.Close()
+	if err != nil {
+		panic(err)
+	}
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Infof("Export complete! %d objects written to %s, %d could not be read", len(export.Objects), *destination, len(export.Missing))
+}
+
+// writeObject adds the object to the archive, recording its hash and size in the manifest entry.
+// Tar needs the size up front, so the object is buffered to a temporary file first.
+func writeObject(tw *tar.Writer, ds *datastore.DatastoreRef, obj *manifestObject) error {
+	stream, err := ds.DownloadFile(obj.Location)
+	if err != nil {
+		return err
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+
+	tmp, err := scratch.CreateFile("exports", "media-repo-export")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), stream)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    obj.Path,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmp)
+	if err != nil {
+		// The archive is broken at this point, so there's no skipping the object
+		panic(err)
+	}
+
+	obj.Sha256Hash = hex.EncodeToString(hasher.Sum(nil))
+	obj.SizeBytes = size
+	return nil
+}
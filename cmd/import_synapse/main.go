@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"sync"
 	"time"
@@ -30,6 +31,7 @@ type fetchRequest struct {
 	media      *synapse.LocalMedia
 	csApiUrl   string
 	serverName string
+	mediaStore string
 }
 
 func main() {
@@ -43,6 +45,7 @@ func main() {
 	configPath := flag.String("config", "media-repo.yaml", "The path to the media repo configuration (configured for the media repo's database)")
 	migrationsPath := flag.String("migrations", "./migrations", "The absolute path the media repo's migrations folder")
 	numWorkers := flag.Int("workers", 1, "The number of workers to use when downloading media. Using multiple workers risks deduplication not working as efficiently.")
+	mediaStore := flag.String("mediaStore", "", "The path to Synapse's media_store directory. If set, media is read from here instead of being downloaded from the homeserver.")
 	flag.Parse()
 
 	// Override config path with config for Docker users
@@ -100,7 +103,11 @@ func main() {
 		panic(err)
 	}
 
-	logrus.Info(fmt.Sprintf("Downloading %d media records", len(records)))
+	if *mediaStore != "" {
+		logrus.Info(fmt.Sprintf("Importing %d media records from %s", len(records), *mediaStore))
+	} else {
+		logrus.Info(fmt.Sprintf("Downloading %d media records", len(records)))
+	}
 
 	pool := tunny.NewFunc(*numWorkers, fetchMedia)
 
@@ -120,7 +127,7 @@ func main() {
 
 		logrus.Info(fmt.Sprintf("Queuing %s (%d/%d %d%%)", record.MediaId, i+1, len(records), percent))
 		go func() {
-			result := pool.Process(&fetchRequest{media: record, serverName: *serverName, csApiUrl: csApiUrl})
+			result := pool.Process(&fetchRequest{media: record, serverName: *serverName, csApiUrl: csApiUrl, mediaStore: *mediaStore})
 			onComplete(result, nil)
 		}()
 	}
@@ -149,7 +156,12 @@ func fetchMedia(req interface{}) interface{} {
 		return nil
 	}
 
-	body, err := downloadMedia(payload.csApiUrl, payload.serverName, record.MediaId)
+	var body io.ReadCloser
+	if payload.mediaStore != "" {
+		body, err = openMediaFile(payload.mediaStore, record)
+	} else {
+		body, err = downloadMedia(payload.csApiUrl, payload.serverName, record.MediaId)
+	}
 	if err != nil {
 		logrus.Error(err.Error())
 		return nil
@@ -165,6 +177,14 @@ func fetchMedia(req interface{}) interface{} {
 	return nil
 }
 
+func openMediaFile(mediaStore string, record *synapse.LocalMedia) (io.ReadCloser, error) {
+	filePath := record.FilePath()
+	if filePath == "" {
+		return nil, errors.New("invalid media ID: " + record.MediaId)
+	}
+	return os.Open(path.Join(mediaStore, filePath))
+}
+
 func downloadMedia(baseUrl string, serverName string, mediaId string) (io.ReadCloser, error) {
 	downloadUrl := baseUrl + "/_matrix/media/r0/download/" + serverName + "/" + mediaId
 	resp, err := http.Get(downloadUrl)
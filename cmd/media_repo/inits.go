@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 )
@@ -27,8 +30,17 @@ func scanAndStartUnfinishedTasks() error {
 			"prev_task_name": task.Name,
 		})
 
+		if task.Cancelled {
+			taskCtx.Log.Infof("Not resuming task %d (%s) as it was cancelled", task.ID, task.Name)
+			err = db.FinishedBackgroundTask(task.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		if task.Name == "storage_migration" {
-			beforeTs := int64(task.Params["before_ts"].(float64))
+			opts := maintenance_controller.StorageMigrationOptionsFromParams(task.Params)
 			sourceDsId := task.Params["source_datastore_id"].(string)
 			targetDsId := task.Params["target_datastore_id"].(string)
 
@@ -41,10 +53,71 @@ func scanAndStartUnfinishedTasks() error {
 				return err
 			}
 
-			newTask, err := maintenance_controller.StartStorageMigration(sourceDs, targetDs, beforeTs, taskCtx)
+			newTask, err := maintenance_controller.StartStorageMigration(sourceDs, targetDs, opts, taskCtx)
+			if err == common.ErrDatastoreReadOnly {
+				taskCtx.Log.Warnf("Not resuming task %d (%s) as the target datastore is now read-only", task.ID, task.Name)
+				err = db.FinishedBackgroundTask(task.ID)
+				if err != nil {
+					return err
+				}
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			err = db.FinishedBackgroundTask(task.ID)
+			if err != nil {
+				return err
+			}
+
+			taskCtx.Log.Infof("Started replacement task ID %d for unfinished task %d (%s)", newTask.ID, task.ID, task.Name)
+		} else if task.Name == "garbage_collection" {
+			dsId := task.Params["datastore_id"].(string)
+			dryRun := task.Params["dry_run"].(bool)
+
+			ds, err := datastore.LocateDatastore(taskCtx, dsId)
+			if err != nil {
+				return err
+			}
+
+			newTask, err := maintenance_controller.StartGarbageCollection(ds, dryRun, taskCtx)
+			if err != nil {
+				return err
+			}
+
+			err = db.FinishedBackgroundTask(task.ID)
+			if err != nil {
+				return err
+			}
+
+			taskCtx.Log.Infof("Started replacement task ID %d for unfinished task %d (%s)", newTask.ID, task.ID, task.Name)
+		} else if task.Name == "datastore_purge" {
+			dsId := task.Params["datastore_id"].(string)
+			migrateToId := task.Params["migrate_to_datastore_id"].(string)
+
+			ds, err := datastore.LocateDatastore(taskCtx, dsId)
 			if err != nil {
 				return err
 			}
+			var migrateTo *datastore.DatastoreRef
+			if migrateToId != "" {
+				migrateTo, err = datastore.LocateDatastore(taskCtx, migrateToId)
+				if err != nil {
+					return err
+				}
+			}
+
+			newTask, err := maintenance_controller.StartDatastorePurge(ds, migrateTo, taskCtx)
+			if err == common.ErrDatastoreReadOnly {
+				taskCtx.Log.Warnf("Not resuming task %d (%s) as the target datastore is now read-only", task.ID, task.Name)
+				err = db.FinishedBackgroundTask(task.ID)
+				if err != nil {
+					return err
+				}
+				continue
+			} else if err != nil {
+				return err
+			}
 
 			err = db.FinishedBackgroundTask(task.ID)
 			if err != nil {
@@ -52,6 +125,21 @@ func scanAndStartUnfinishedTasks() error {
 			}
 
 			taskCtx.Log.Infof("Started replacement task ID %d for unfinished task %d (%s)", newTask.ID, task.ID, task.Name)
+		} else if task.Name == "storage_tiering" {
+			// The next recurring run moves whatever this one didn't get to. Resuming it as well would have
+			// both moving the same media.
+			taskCtx.Log.Infof("Not resuming task %d (%s) as the next storage tiering run will finish it", task.ID, task.Name)
+			err = db.FinishedBackgroundTask(task.ID)
+			if err != nil {
+				return err
+			}
+		} else if strings.HasPrefix(task.Name, "purge_") || task.Name == "integrity_scrub" {
+			// These are started again by whoever wanted them, rather than being picked up halfway
+			taskCtx.Log.Infof("Not resuming task %d (%s) as it was interrupted", task.ID, task.Name)
+			err = db.FinishedBackgroundTask(task.ID)
+			if err != nil {
+				return err
+			}
 		} else {
 			taskCtx.Log.Warn(fmt.Sprintf("Unknown task %s at ID %d - ignoring", task.Name, task.ID))
 		}
@@ -60,3 +148,7 @@ func scanAndStartUnfinishedTasks() error {
 	return nil
 }
 
+func reconcileInterruptedUploads() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"stage": "startup"})
+	upload_controller.ReconcileStagedUploads(ctx)
+}
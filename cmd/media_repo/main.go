@@ -75,6 +75,9 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	logrus.Info("Reconciling interrupted uploads...")
+	reconcileInterruptedUploads()
+
 	logrus.Info("Starting recurring tasks...")
 	tasks.StartAll()
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/assets"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/logging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/common/runtime"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	datastoreId := flag.String("datastore", "", "The ID of the file datastore to reshard")
+	dryRun := flag.Bool("dryRun", false, "If set, only report which files would be moved")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	if *datastoreId == "" {
+		flag.Usage()
+		os.Exit(1)
+		return
+	}
+
+	config.Path = *configPath
+	assets.SetupMigrations(*migrationsPath)
+
+	var err error
+	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info("Starting up...")
+	runtime.RunStartupSequence()
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"datastoreId": *datastoreId, "dryRun": *dryRun})
+	ds, err := datastore.LocateDatastore(ctx, *datastoreId)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Warn("The media repo must not be running while the datastore is resharded")
+	logrus.Info("Resharding ", ds.Uri)
+	moved, err := ds.Reshard(*dryRun, ctx)
+	if err != nil {
+		logrus.Errorf("Stopped after moving %d files: %s", moved, err)
+		logrus.Error("Fix the problem and run this again to continue")
+		os.Exit(1)
+		return
+	}
+
+	if *dryRun {
+		logrus.Infof("Done! %d files would be moved", moved)
+	} else {
+		logrus.Infof("Done! Moved %d files", moved)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/assets"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/logging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/common/runtime"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const (
+	problemMissing      = "missing"
+	problemUnreadable   = "unreadable"
+	problemSizeMismatch = "size_mismatch"
+	problemHashMismatch = "hash_mismatch"
+)
+
+type problem struct {
+	Kind           string `json:"kind"`
+	Id             string `json:"id"`
+	Location       string `json:"location"`
+	Problem        string `json:"problem"`
+	Error          string `json:"error,omitempty"`
+	ExpectedSize   int64  `json:"expected_size_bytes"`
+	ActualSize     int64  `json:"actual_size_bytes,omitempty"`
+	ExpectedSha256 string `json:"expected_sha256,omitempty"`
+	ActualSha256   string `json:"actual_sha256,omitempty"`
+}
+
+type datastoreReport struct {
+	DatastoreId       string     `json:"datastore_id"`
+	Type              string     `json:"type"`
+	Uri               string     `json:"uri"`
+	CheckedMedia      int        `json:"checked_media"`
+	CheckedThumbnails int        `json:"checked_thumbnails"`
+	CheckedObjects    int        `json:"checked_objects"`
+	Problems          []*problem `json:"problems"`
+}
+
+type report struct {
+	CheckedTs  int64              `json:"checked_ts"`
+	HashesRead bool               `json:"hashes_read"`
+	Datastores []*datastoreReport `json:"datastores"`
+}
+
+// objectResult is what was found at a location, shared by every record which points at it.
+type objectResult struct {
+	problem    string
+	err        error
+	sizeBytes  int64
+	sha256Hash string
+}
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	datastoreId := flag.String("datastore", "", "The ID of the datastore to verify. If not set, all datastores are verified")
+	output := flag.String("output", "./verify-report.json", "The file to write the report to, or - for stdout")
+	existenceOnly := flag.Bool("existenceOnly", false, "If set, only check that files exist instead of reading them to check their size and hash")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	config.Path = *configPath
+	assets.SetupMigrations(*migrationsPath)
+
+	var err error
+	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info("Starting up...")
+	runtime.RunStartupSequence()
+
+	ctx := rcontext.Initial()
+	datastores := make([]*datastore.DatastoreRef, 0)
+	if *datastoreId != "" {
+		ds, err := datastore.LocateDatastore(ctx, *datastoreId)
+		if err != nil {
+			panic(err)
+		}
+		datastores = append(datastores, ds)
+	} else {
+		all, err := storage.GetDatabase().GetMediaStore(ctx).GetAllDatastores()
+		if err != nil {
+			panic(err)
+		}
+		for _, ds := range all {
+			ref, err := datastore.LocateDatastore(ctx, ds.DatastoreId)
+			if err != nil {
+				logrus.Warn("Skipping datastore ", ds.DatastoreId, " (", ds.Uri, "): ", err)
+				continue
+			}
+			datastores = append(datastores, ref)
+		}
+	}
+
+	result := &report{
+		CheckedTs:  util.NowMillis(),
+		HashesRead: !*existenceOnly,
+		Datastores: make([]*datastoreReport, 0),
+	}
+	problems := 0
+	for _, ds := range datastores {
+		dsReport, err := verifyDatastore(ds, !*existenceOnly, ctx.LogWithFields(logrus.Fields{"datastoreId": ds.DatastoreId}))
+		if err != nil {
+			panic(err)
+		}
+		result.Datastores = append(result.Datastores, dsReport)
+		problems += len(dsReport.Problems)
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if *output == "-" {
+		fmt.Println(string(b))
+	} else {
+		err = ioutil.WriteFile(*output, b, 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	logrus.Infof("Verification complete! Found %d problems in %d datastores", problems, len(result.Datastores))
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+func verifyDatastore(ds *datastore.DatastoreRef, readFiles bool, ctx rcontext.RequestContext) (*datastoreReport, error) {
+	ctx.Log.Info("Verifying ", ds.Uri)
+
+	media, err := storage.GetDatabase().GetMediaStore(ctx).GetAllMediaInDatastore(ds.DatastoreId)
+	if err != nil {
+		return nil, err
+	}
+	thumbnails, err := storage.GetDatabase().GetThumbnailStore(ctx).GetAllInDatastore(ds.DatastoreId)
+	if err != nil {
+		return nil, err
+	}
+
+	dsReport := &datastoreReport{
+		DatastoreId:       ds.DatastoreId,
+		Type:              ds.Type,
+		Uri:               ds.Uri,
+		CheckedMedia:      len(media),
+		CheckedThumbnails: len(thumbnails),
+		Problems:          make([]*problem, 0),
+	}
+
+	// Deduplicated media shares objects, so each object is only read once
+	results := make(map[string]*objectResult)
+	check := func(kind string, id string, location string, sizeBytes int64, sha256Hash string) {
+		res, ok := results[location]
+		if !ok {
+			if len(results) > 0 && len(results)%100 == 0 {
+				ctx.Log.Infof("Checked %d objects", len(results))
+			}
+			res = checkObject(ds, location, readFiles)
+			results[location] = res
+		}
+
+		p := &problem{
+			Kind:           kind,
+			Id:             id,
+			Location:       location,
+			Problem:        res.problem,
+			ExpectedSize:   sizeBytes,
+			ExpectedSha256: sha256Hash,
+		}
+		if res.err != nil {
+			p.Error = res.err.Error()
+		}
+		if p.Problem == "" && readFiles {
+			// Older thumbnails may not have had their hash recorded
+			if res.sizeBytes != sizeBytes {
+				p.Problem = problemSizeMismatch
+			} else if sha256Hash != "" && res.sha256Hash != sha256Hash {
+				p.Problem = problemHashMismatch
+			}
+			p.ActualSize = res.sizeBytes
+			p.ActualSha256 = res.sha256Hash
+		}
+		if p.Problem != "" {
+			ctx.Log.Warn("Found problem with ", kind, " ", id, ": ", p.Problem)
+			dsReport.Problems = append(dsReport.Problems, p)
+		}
+	}
+
+	for _, m := range media {
+		check("media", m.Origin+"/"+m.MediaId, m.Location, m.SizeBytes, m.Sha256Hash)
+	}
+	for _, t := range thumbnails {
+		check("thumbnail", thumbnailId(t), t.Location, t.SizeBytes, t.Sha256Hash)
+	}
+
+	dsReport.CheckedObjects = len(results)
+	return dsReport, nil
+}
+
+// checkObject confirms the object exists and, if readFiles is set, measures and hashes its original
+// content (after decryption and decompression).
+func checkObject(ds *datastore.DatastoreRef, location string, readFiles bool) *objectResult {
+	if !ds.ObjectExists(location) {
+		return &objectResult{problem: problemMissing}
+	}
+	if !readFiles {
+		return &objectResult{}
+	}
+
+	stream, err := ds.DownloadFile(location)
+	if err != nil {
+		return &objectResult{problem: problemUnreadable, err: err}
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+
+	counter := &countingReader{r: stream}
+	hash, err := util.GetSha256HashOfStream(ioutil.NopCloser(counter))
+	if err != nil {
+		return &objectResult{problem: problemUnreadable, err: err}
+	}
+	return &objectResult{sizeBytes: counter.n, sha256Hash: hash}
+}
+
+func thumbnailId(t *types.Thumbnail) string {
+	return fmt.Sprintf("%s/%s?width=%d&height=%d&method=%s&animated=%t", t.Origin, t.MediaId, t.Width, t.Height, t.Method, t.Animated)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -253,6 +253,15 @@ func UniqueDatastores() []DatastoreConfig {
 					} else if dsc.Type == "s3" && edsc.Options["endpoint"] == dsc.Options["endpoint"] && edsc.Options["bucketName"] == dsc.Options["bucketName"] {
 						found = true
 						break
+					} else if dsc.Type == "azure" && edsc.Options["accountName"] == dsc.Options["accountName"] && edsc.Options["containerName"] == dsc.Options["containerName"] {
+						found = true
+						break
+					} else if dsc.Type == "gcs" && edsc.Options["bucketName"] == dsc.Options["bucketName"] {
+						found = true
+						break
+					} else if dsc.Type == "webdav" && edsc.Options["baseUrl"] == dsc.Options["baseUrl"] {
+						found = true
+						break
 					}
 				}
 			}
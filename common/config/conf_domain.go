@@ -20,6 +20,23 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 		Downloads: DownloadsConfig{
 			MaxSizeBytes:        104857600, // 100mb
 			FailureCacheMinutes: 15,
+			ContentDisposition: ContentDispositionConfig{
+				Inline: []string{
+					"image/*",
+					"audio/*",
+					"video/*",
+					"text/plain",
+				},
+				Attachment: []string{
+					"image/svg+xml",
+					"text/html",
+					"application/xhtml+xml",
+					"text/xml",
+					"application/xml",
+					"text/javascript",
+					"application/javascript",
+				},
+			},
 		},
 		UrlPreviews: UrlPreviewsConfig{
 			Enabled:          true,
@@ -30,6 +47,8 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			MaxPageSizeBytes: 10485760, // 10mb
 			FilePreviewTypes: []string{
 				"image/*",
+				"video/*",
+				"audio/*",
 			},
 			DisallowedNetworks: []string{
 				"127.0.0.1/8",
@@ -45,8 +64,16 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AllowedNetworks: []string{
 				"0.0.0.0/0", // "Everything"
 			},
+			AllowExceptions: []string{},
 			DefaultLanguage: "en-US,en",
 			OEmbed:          false,
+			MaxRedirects:    5,
+			Proxy:           "",
+			UserAgent:       "matrix-media-repo",
+			BotIdentity:     "",
+			FromAddress:     "",
+			FaviconFallback: true,
+			FetchLimits:     []UrlPreviewFetchLimit{},
 		},
 		Thumbnails: ThumbnailsConfig{
 			MaxSourceBytes:      10485760, // 10mb
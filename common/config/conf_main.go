@@ -2,20 +2,32 @@ package config
 
 type MainRepoConfig struct {
 	MinimumRepoConfig `yaml:",inline"`
-	General           GeneralConfig         `yaml:"repo"`
-	Homeservers       []HomeserverConfig    `yaml:"homeservers,flow"`
-	Admins            []string              `yaml:"admins,flow"`
-	Database          DatabaseConfig        `yaml:"database"`
-	Downloads         MainDownloadsConfig   `yaml:"downloads"`
-	Thumbnails        MainThumbnailsConfig  `yaml:"thumbnails"`
-	UrlPreviews       MainUrlPreviewsConfig `yaml:"urlPreviews"`
-	RateLimit         RateLimitConfig       `yaml:"rateLimit"`
-	Metrics           MetricsConfig         `yaml:"metrics"`
-	SharedSecret      SharedSecretConfig    `yaml:"sharedSecretAuth"`
-	Federation        FederationConfig      `yaml:"federation"`
-	Plugins           []PluginConfig        `yaml:"plugins,flow"`
-	Sentry            SentryConfig          `yaml:"sentry"`
-	Redis             RedisConfig           `yaml:"redis"`
+	General           GeneralConfig          `yaml:"repo"`
+	Homeservers       []HomeserverConfig     `yaml:"homeservers,flow"`
+	Admins            []string               `yaml:"admins,flow"`
+	Database          DatabaseConfig         `yaml:"database"`
+	Downloads         MainDownloadsConfig    `yaml:"downloads"`
+	Thumbnails        MainThumbnailsConfig   `yaml:"thumbnails"`
+	UrlPreviews       MainUrlPreviewsConfig  `yaml:"urlPreviews"`
+	RateLimit         RateLimitConfig        `yaml:"rateLimit"`
+	Metrics           MetricsConfig          `yaml:"metrics"`
+	SharedSecret      SharedSecretConfig     `yaml:"sharedSecretAuth"`
+	AdminTokens       []AdminTokenConfig     `yaml:"adminTokens,flow"`
+	Federation        FederationConfig       `yaml:"federation"`
+	Plugins           []PluginConfig         `yaml:"plugins,flow"`
+	SpamChecker       SpamCheckerConfig      `yaml:"spamChecker"`
+	HashBlocklist     HashBlocklistConfig    `yaml:"hashBlocklist"`
+	SignedUrls        SignedUrlsConfig       `yaml:"signedUrls"`
+	Sentry            SentryConfig           `yaml:"sentry"`
+	Redis             RedisConfig            `yaml:"redis"`
+	StorageTiering    StorageTieringConfig   `yaml:"storageTiering"`
+	Compression       CompressionConfig      `yaml:"compression"`
+	IntegrityScrub    IntegrityScrubConfig   `yaml:"integrityScrub"`
+	Replication       ReplicationConfig      `yaml:"replication"`
+	DatastoreRouting  []DatastoreRoutingRule `yaml:"datastoreRouting,flow"`
+	DatastoreHealth   DatastoreHealthConfig  `yaml:"datastoreHealth"`
+	WriteBehind       WriteBehindConfig      `yaml:"writeBehind"`
+	Temp              TempConfig             `yaml:"temp"`
 }
 
 func NewDefaultMainConfig() MainRepoConfig {
@@ -43,6 +55,23 @@ func NewDefaultMainConfig() MainRepoConfig {
 			DownloadsConfig: DownloadsConfig{
 				MaxSizeBytes:        104857600, // 100mb
 				FailureCacheMinutes: 15,
+				ContentDisposition: ContentDispositionConfig{
+					Inline: []string{
+						"image/*",
+						"audio/*",
+						"video/*",
+						"text/plain",
+					},
+					Attachment: []string{
+						"image/svg+xml",
+						"text/html",
+						"application/xhtml+xml",
+						"text/xml",
+						"application/xml",
+						"text/javascript",
+						"application/javascript",
+					},
+				},
 			},
 			NumWorkers: 10,
 			Cache: CacheConfig{
@@ -55,6 +84,10 @@ func NewDefaultMainConfig() MainRepoConfig {
 				MinEvictedTimeSeconds: 60,
 			},
 			ExpireDays: 0,
+			Bandwidth: DownloadBandwidthConfig{
+				MaxBytesPerSecond:           0,
+				MaxBytesPerSecondPerRequest: 0,
+			},
 		},
 		UrlPreviews: MainUrlPreviewsConfig{
 			UrlPreviewsConfig: UrlPreviewsConfig{
@@ -66,6 +99,8 @@ func NewDefaultMainConfig() MainRepoConfig {
 				MaxPageSizeBytes: 10485760, // 10mb
 				FilePreviewTypes: []string{
 					"image/*",
+					"video/*",
+					"audio/*",
 				},
 				DisallowedNetworks: []string{
 					"127.0.0.1/8",
@@ -81,11 +116,36 @@ func NewDefaultMainConfig() MainRepoConfig {
 				AllowedNetworks: []string{
 					"0.0.0.0/0", // "Everything"
 				},
+				AllowExceptions: []string{},
 				DefaultLanguage: "en-US,en",
 				OEmbed:          false,
+				MaxRedirects:    5,
+				Proxy:           "",
+				UserAgent:       "matrix-media-repo",
+				BotIdentity:     "",
+				FromAddress:     "",
+				FaviconFallback: true,
+				FetchLimits:     []UrlPreviewFetchLimit{},
+			},
+			NumWorkers:           10,
+			MaxQueueSize:         100,
+			QueueTimeoutSeconds:  60,
+			ExpireDays:           0,
+			CacheBucketMinutes:   60,
+			MaxCacheAgeMinutes:   0,
+			StaleWhileRevalidate: true,
+			OEmbedProvidersFile:  "",
+			RateLimit: UrlPreviewRateLimitConfig{
+				Enabled: false,
+				PerUser: RateLimitBucketConfig{
+					RequestsPerSecond: 1,
+					BurstCount:        10,
+				},
+				PerHost: RateLimitBucketConfig{
+					RequestsPerSecond: 2,
+					BurstCount:        20,
+				},
 			},
-			NumWorkers: 10,
-			ExpireDays: 0,
 		},
 		Thumbnails: MainThumbnailsConfig{
 			ThumbnailsConfig: ThumbnailsConfig{
@@ -117,6 +177,22 @@ func NewDefaultMainConfig() MainRepoConfig {
 			Enabled:           true,
 			RequestsPerSecond: 5,
 			BurstCount:        10,
+			PerUser: UserRateLimitsConfig{
+				Uploads: RateLimitBucketConfig{
+					RequestsPerSecond: 0,
+					BurstCount:        0,
+				},
+				Downloads: RateLimitBucketConfig{
+					RequestsPerSecond: 0,
+					BurstCount:        0,
+				},
+			},
+			PerIp: IpRateLimitsConfig{
+				Uploads: RateLimitBucketConfig{
+					RequestsPerSecond: 0,
+					BurstCount:        0,
+				},
+			},
 		},
 		Metrics: MetricsConfig{
 			Enabled:     false,
@@ -127,10 +203,30 @@ func NewDefaultMainConfig() MainRepoConfig {
 			Enabled: false,
 			Token:   "ReplaceMe",
 		},
+		AdminTokens: []AdminTokenConfig{},
 		Federation: FederationConfig{
 			BackoffAt: 20,
 		},
 		Plugins: []PluginConfig{},
+		SpamChecker: SpamCheckerConfig{
+			Url:             "",
+			SharedSecret:    "",
+			TimeoutSeconds:  10,
+			MaxContentBytes: 10485760, // 10mb
+			FailClosed:      false,
+		},
+		HashBlocklist: HashBlocklistConfig{
+			Enabled:          false,
+			Files:            []string{},
+			DefaultAction:    "reject",
+			MaxDHashDistance: 4,
+		},
+		SignedUrls: SignedUrlsConfig{
+			Enabled:              false,
+			Secret:               "",
+			DefaultExpirySeconds: 86400,  // 1 day
+			MaxExpirySeconds:     604800, // 7 days
+		},
 		Sentry: SentryConfig{
 			Enabled:     false,
 			Dsn:         "not supplied",
@@ -141,5 +237,50 @@ func NewDefaultMainConfig() MainRepoConfig {
 			Enabled: false,
 			Shards:  []RedisShardConfig{},
 		},
+		StorageTiering: StorageTieringConfig{
+			Enabled:       false,
+			MoveAfterDays: 30,
+			Promotion: TierPromotionConfig{
+				Enabled:       false,
+				MinDownloads:  3,
+				WindowMinutes: 60,
+			},
+		},
+		IntegrityScrub: IntegrityScrubConfig{
+			Enabled:             false,
+			FilesPerRun:         100,
+			QuarantineCorrupted: false,
+		},
+		Replication: ReplicationConfig{
+			Factor: 1,
+		},
+		DatastoreRouting: []DatastoreRoutingRule{},
+		DatastoreHealth: DatastoreHealthConfig{
+			Enabled:         false,
+			IntervalSeconds: 60,
+			TimeoutSeconds:  30,
+		},
+		WriteBehind: WriteBehindConfig{
+			StagingPath:          "",
+			RetryIntervalSeconds: 30,
+		},
+		Temp: TempConfig{
+			Path:                   "",
+			StaleAfterMinutes:      60,
+			CleanupIntervalMinutes: 30,
+		},
+		Compression: CompressionConfig{
+			Enabled: false,
+			ContentTypes: []string{
+				"text/*",
+				"image/svg+xml",
+				"application/json",
+				"application/xml",
+				"audio/wav",
+				"audio/x-wav",
+				"audio/aiff",
+				"audio/x-aiff",
+			},
+		},
 	}
 }
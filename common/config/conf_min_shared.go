@@ -18,6 +18,7 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 			Enabled:            true,
 			SelfService:        false,
 			TargetBytesPerPart: 209715200, // 200mb
+			ExpireAfterHours:   0,
 		},
 		Uploads: UploadsConfig{
 			MaxSizeBytes:         104857600, // 100mb
@@ -27,6 +28,58 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 				Enabled:    false,
 				UserQuotas: []QuotaUserConfig{},
 			},
+			Resumable: ResumableUploadsConfig{
+				Enabled:       false,
+				ExpirySeconds: 86400,
+			},
+			Deduplication: DeduplicationConfig{
+				SkipExistingFiles:   true,
+				ReturnExistingMedia: true,
+			},
+			StripMetadata: false,
+			Images: ImageLimitsConfig{
+				MaxWidth:  0,
+				MaxHeight: 0,
+				MaxPixels: 0,
+			},
+			UseDetectedContentType: false,
+			ExpiringMedia: ExpiringMediaConfig{
+				Enabled:     false,
+				MaxExpiryMs: 31536000000, // 365 days
+			},
+			CustomMediaIds: CustomMediaIdsConfig{
+				Enabled:      false,
+				AllowedUsers: []string{},
+			},
+			Recompress: RecompressConfig{
+				Enabled:      false,
+				MinSizeBytes: 10485760, // 10mb
+				MaxWidth:     4096,
+				MaxHeight:    4096,
+				JpegQuality:  85,
+			},
+			Filenames: FilenamesConfig{
+				Enabled:       true,
+				MaxLength:     255,
+				Normalization: "nfc",
+				AsciiOnly:     false,
+			},
+			FromUrl: UploadFromUrlConfig{
+				Enabled:        false,
+				TimeoutSeconds: 60,
+			},
+			Batch: BatchUploadsConfig{
+				Enabled:  false,
+				MaxFiles: 100,
+			},
+			EagerThumbnails: EagerThumbnailsConfig{
+				Enabled:  false,
+				MaxSizes: 4,
+			},
+			Attribution: UploadAttributionConfig{
+				Enabled:       false,
+				RetentionDays: 30,
+			},
 		},
 		Identicons: IdenticonsConfig{
 			Enabled: true,
@@ -53,6 +106,17 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 				YComponents:     3,
 				Punch:           1,
 			},
+			MSC2246Async: MSC2246Config{
+				Enabled:                 false,
+				AsyncUploadExpirySecs:   86400,
+				DefaultDownloadWaitSecs: 20,
+				MaxDownloadWaitSecs:     60,
+				MaxPendingPerUser:       50,
+			},
+			MSC3911Restrictions: MSC3911Config{
+				Enabled:            false,
+				AccessCacheSeconds: 60,
+			},
 			IPFS: IPFSConfig{
 				Enabled: false,
 				Daemon: IPFSDaemonConfig{
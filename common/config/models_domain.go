@@ -4,6 +4,7 @@ type ArchivingConfig struct {
 	Enabled            bool  `yaml:"enabled"`
 	SelfService        bool  `yaml:"selfService"`
 	TargetBytesPerPart int64 `yaml:"targetBytesPerPart"`
+	ExpireAfterHours   int   `yaml:"expireAfterHours"`
 }
 
 type QuotaUserConfig struct {
@@ -17,27 +18,116 @@ type QuotasConfig struct {
 }
 
 type UploadsConfig struct {
-	MaxSizeBytes         int64        `yaml:"maxBytes"`
-	MinSizeBytes         int64        `yaml:"minBytes"`
-	ReportedMaxSizeBytes int64        `yaml:"reportedMaxBytes"`
-	Quota                QuotasConfig `yaml:"quotas"`
+	MaxSizeBytes           int64                   `yaml:"maxBytes"`
+	MinSizeBytes           int64                   `yaml:"minBytes"`
+	ReportedMaxSizeBytes   int64                   `yaml:"reportedMaxBytes"`
+	Quota                  QuotasConfig            `yaml:"quotas"`
+	Resumable              ResumableUploadsConfig  `yaml:"resumable"`
+	Deduplication          DeduplicationConfig     `yaml:"deduplication"`
+	StripMetadata          bool                    `yaml:"stripMetadata"`
+	Images                 ImageLimitsConfig       `yaml:"images"`
+	UseDetectedContentType bool                    `yaml:"useDetectedContentType"`
+	ExpiringMedia          ExpiringMediaConfig     `yaml:"expiringMedia"`
+	CustomMediaIds         CustomMediaIdsConfig    `yaml:"customMediaIds"`
+	Recompress             RecompressConfig        `yaml:"recompress"`
+	Filenames              FilenamesConfig         `yaml:"filenames"`
+	FromUrl                UploadFromUrlConfig     `yaml:"fromUrl"`
+	Batch                  BatchUploadsConfig      `yaml:"batch"`
+	EagerThumbnails        EagerThumbnailsConfig   `yaml:"eagerThumbnails"`
+	Attribution            UploadAttributionConfig `yaml:"attribution"`
+}
+
+type UploadAttributionConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	RetentionDays int  `yaml:"retentionDays"`
+}
+
+type EagerThumbnailsConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	MaxSizes int  `yaml:"maxSizes"`
+}
+
+type BatchUploadsConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	MaxFiles int  `yaml:"maxFiles"`
+}
+
+type UploadFromUrlConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	TimeoutSeconds int  `yaml:"timeoutSeconds"`
+}
+
+type FilenamesConfig struct {
+	Enabled       bool   `yaml:"sanitize"`
+	MaxLength     int    `yaml:"maxLength"`
+	Normalization string `yaml:"normalization"`
+	AsciiOnly     bool   `yaml:"asciiOnly"`
+}
+
+type RecompressConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MinSizeBytes int64 `yaml:"minSizeBytes"`
+	MaxWidth     int   `yaml:"maxWidth"`
+	MaxHeight    int   `yaml:"maxHeight"`
+	JpegQuality  int   `yaml:"jpegQuality"`
+}
+
+type CustomMediaIdsConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	AllowedUsers []string `yaml:"allowedUsers,flow"`
+}
+
+type ExpiringMediaConfig struct {
+	Enabled     bool  `yaml:"enabled"`
+	MaxExpiryMs int64 `yaml:"maxExpiryMs"`
+}
+
+type ImageLimitsConfig struct {
+	MaxWidth  int `yaml:"maxWidth"`
+	MaxHeight int `yaml:"maxHeight"`
+	MaxPixels int `yaml:"maxPixels"`
+}
+
+type DeduplicationConfig struct {
+	SkipExistingFiles   bool `yaml:"skipExistingFiles"`
+	ReturnExistingMedia bool `yaml:"returnExistingMedia"`
+}
+
+type ResumableUploadsConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	ExpirySeconds int  `yaml:"expirySeconds"`
 }
 
 type DatastoreConfig struct {
-	Type       string            `yaml:"type"`
-	Enabled    bool              `yaml:"enabled"`
-	MediaKinds []string          `yaml:"forKinds,flow"`
-	Options    map[string]string `yaml:"opts,flow"`
+	Type                   string            `yaml:"type"`
+	Enabled                bool              `yaml:"enabled"`
+	MediaKinds             []string          `yaml:"forKinds,flow"`
+	Tier                   string            `yaml:"tier"`
+	MirrorTo               []string          `yaml:"mirrorTo,flow"`
+	MaxSizeBytes           int64             `yaml:"maxBytes"`
+	WriteBehind            bool              `yaml:"writeBehind"`
+	ReadOnly               bool              `yaml:"readOnly"`
+	MaxReadBytesPerSecond  int64             `yaml:"maxReadBytesPerSecond"`
+	MaxWriteBytesPerSecond int64             `yaml:"maxWriteBytesPerSecond"`
+	Options                map[string]string `yaml:"opts,flow"`
 }
 
 type DownloadsConfig struct {
-	MaxSizeBytes        int64 `yaml:"maxBytes"`
-	FailureCacheMinutes int   `yaml:"failureCacheMinutes"`
+	MaxSizeBytes        int64                    `yaml:"maxBytes"`
+	FailureCacheMinutes int                      `yaml:"failureCacheMinutes"`
+	ContentDisposition  ContentDispositionConfig `yaml:"contentDisposition"`
+}
+
+type ContentDispositionConfig struct {
+	Inline     []string `yaml:"inline,flow"`
+	Attachment []string `yaml:"attachment,flow"`
 }
 
 type ThumbnailsConfig struct {
 	MaxSourceBytes      int64           `yaml:"maxSourceBytes"`
 	MaxPixels           int             `yaml:"maxPixels"`
+	MaxWidth            int             `yaml:"maxWidth"`
+	MaxHeight           int             `yaml:"maxHeight"`
 	Types               []string        `yaml:"types,flow"`
 	MaxAnimateSizeBytes int64           `yaml:"maxAnimateSizeBytes"`
 	Sizes               []ThumbnailSize `yaml:"sizes,flow"`
@@ -53,18 +143,32 @@ type ThumbnailSize struct {
 }
 
 type UrlPreviewsConfig struct {
-	Enabled            bool     `yaml:"enabled"`
-	NumWords           int      `yaml:"numWords"`
-	NumTitleWords      int      `yaml:"numTitleWords"`
-	MaxLength          int      `yaml:"maxLength"`
-	MaxTitleLength     int      `yaml:"maxTitleLength"`
-	MaxPageSizeBytes   int64    `yaml:"maxPageSizeBytes"`
-	FilePreviewTypes   []string `yaml:"filePreviewTypes,flow"`
-	DisallowedNetworks []string `yaml:"disallowedNetworks,flow"`
-	AllowedNetworks    []string `yaml:"allowedNetworks,flow"`
-	UnsafeCertificates bool     `yaml:"previewUnsafeCertificates"`
-	DefaultLanguage    string   `yaml:"defaultLanguage"`
-	OEmbed             bool     `yaml:"oEmbed"`
+	Enabled            bool                   `yaml:"enabled"`
+	NumWords           int                    `yaml:"numWords"`
+	NumTitleWords      int                    `yaml:"numTitleWords"`
+	MaxLength          int                    `yaml:"maxLength"`
+	MaxTitleLength     int                    `yaml:"maxTitleLength"`
+	MaxPageSizeBytes   int64                  `yaml:"maxPageSizeBytes"`
+	FilePreviewTypes   []string               `yaml:"filePreviewTypes,flow"`
+	DisallowedNetworks []string               `yaml:"disallowedNetworks,flow"`
+	AllowedNetworks    []string               `yaml:"allowedNetworks,flow"`
+	AllowExceptions    []string               `yaml:"allowExceptions,flow"`
+	UnsafeCertificates bool                   `yaml:"previewUnsafeCertificates"`
+	DefaultLanguage    string                 `yaml:"defaultLanguage"`
+	OEmbed             bool                   `yaml:"oEmbed"`
+	MaxRedirects       int                    `yaml:"maxRedirects"`
+	Proxy              string                 `yaml:"proxy"`
+	UserAgent          string                 `yaml:"userAgent"`
+	BotIdentity        string                 `yaml:"botIdentity"`
+	FromAddress        string                 `yaml:"fromAddress"`
+	FaviconFallback    bool                   `yaml:"faviconFallback"`
+	FetchLimits        []UrlPreviewFetchLimit `yaml:"fetchLimits"`
+}
+
+type UrlPreviewFetchLimit struct {
+	ContentTypes   []string `yaml:"contentTypes,flow"`
+	MaxBytes       int64    `yaml:"maxBytes"`
+	TimeoutSeconds int      `yaml:"timeoutSeconds"`
 }
 
 type IdenticonsConfig struct {
@@ -85,9 +189,11 @@ type TimeoutsConfig struct {
 }
 
 type FeatureConfig struct {
-	MSC2448Blurhash MSC2448Config `yaml:"MSC2448"`
-	IPFS            IPFSConfig    `yaml:"IPFS"`
-	Redis           RedisConfig   `yaml:"redis"`
+	MSC2448Blurhash     MSC2448Config `yaml:"MSC2448"`
+	MSC2246Async        MSC2246Config `yaml:"MSC2246"`
+	MSC3911Restrictions MSC3911Config `yaml:"MSC3911"`
+	IPFS                IPFSConfig    `yaml:"IPFS"`
+	Redis               RedisConfig   `yaml:"redis"`
 }
 
 type MSC2448Config struct {
@@ -101,6 +207,19 @@ type MSC2448Config struct {
 	Punch           int  `yaml:"punch"`
 }
 
+type MSC2246Config struct {
+	Enabled                 bool `yaml:"enabled"`
+	AsyncUploadExpirySecs   int  `yaml:"asyncUploadExpirySecs"`
+	DefaultDownloadWaitSecs int  `yaml:"defaultDownloadWaitSecs"`
+	MaxDownloadWaitSecs     int  `yaml:"maxDownloadWaitSecs"`
+	MaxPendingPerUser       int  `yaml:"maxPendingPerUser"`
+}
+
+type MSC3911Config struct {
+	Enabled            bool `yaml:"enabled"`
+	AccessCacheSeconds int  `yaml:"accessCacheSeconds"`
+}
+
 type IPFSConfig struct {
 	Enabled bool             `yaml:"enabled"`
 	Daemon  IPFSDaemonConfig `yaml:"builtInDaemon"`
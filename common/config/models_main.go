@@ -29,9 +29,15 @@ type DbPoolConfig struct {
 
 type MainDownloadsConfig struct {
 	DownloadsConfig `yaml:",inline"`
-	NumWorkers      int         `yaml:"numWorkers"`
-	Cache           CacheConfig `yaml:"cache"`
-	ExpireDays      int         `yaml:"expireAfterDays"`
+	NumWorkers      int                     `yaml:"numWorkers"`
+	Cache           CacheConfig             `yaml:"cache"`
+	ExpireDays      int                     `yaml:"expireAfterDays"`
+	Bandwidth       DownloadBandwidthConfig `yaml:"bandwidth"`
+}
+
+type DownloadBandwidthConfig struct {
+	MaxBytesPerSecond           int64 `yaml:"maxBytesPerSecond"`
+	MaxBytesPerSecondPerRequest int64 `yaml:"maxBytesPerSecondPerRequest"`
 }
 
 type CacheConfig struct {
@@ -51,17 +57,46 @@ type MainThumbnailsConfig struct {
 }
 
 type MainUrlPreviewsConfig struct {
-	UrlPreviewsConfig `yaml:",inline"`
-	NumWorkers        int `yaml:"numWorkers"`
-	ExpireDays        int `yaml:"expireAfterDays"`
+	UrlPreviewsConfig    `yaml:",inline"`
+	NumWorkers           int                       `yaml:"numWorkers"`
+	MaxQueueSize         int                       `yaml:"maxQueueSize"`
+	QueueTimeoutSeconds  int                       `yaml:"queueTimeoutSeconds"`
+	ExpireDays           int                       `yaml:"expireAfterDays"`
+	CacheBucketMinutes   int                       `yaml:"cacheBucketMinutes"`
+	MaxCacheAgeMinutes   int                       `yaml:"maxCacheAgeMinutes"`
+	StaleWhileRevalidate bool                      `yaml:"staleWhileRevalidate"`
+	OEmbedProvidersFile  string                    `yaml:"oEmbedProvidersFile"`
+	RateLimit            UrlPreviewRateLimitConfig `yaml:"rateLimit"`
 }
 
-type RateLimitConfig struct {
+type UrlPreviewRateLimitConfig struct {
+	Enabled bool                  `yaml:"enabled"`
+	PerUser RateLimitBucketConfig `yaml:"perUser"`
+	PerHost RateLimitBucketConfig `yaml:"perHost"`
+}
+
+type RateLimitBucketConfig struct {
 	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
-	Enabled           bool    `yaml:"enabled"`
 	BurstCount        int     `yaml:"burst"`
 }
 
+type RateLimitConfig struct {
+	RequestsPerSecond float64              `yaml:"requestsPerSecond"`
+	Enabled           bool                 `yaml:"enabled"`
+	BurstCount        int                  `yaml:"burst"`
+	PerUser           UserRateLimitsConfig `yaml:"perUser"`
+	PerIp             IpRateLimitsConfig   `yaml:"perIp"`
+}
+
+type UserRateLimitsConfig struct {
+	Uploads   RateLimitBucketConfig `yaml:"uploads"`
+	Downloads RateLimitBucketConfig `yaml:"downloads"`
+}
+
+type IpRateLimitsConfig struct {
+	Uploads RateLimitBucketConfig `yaml:"uploads"`
+}
+
 type MetricsConfig struct {
 	Enabled     bool   `yaml:"enabled"`
 	BindAddress string `yaml:"bindAddress"`
@@ -73,10 +108,38 @@ type SharedSecretConfig struct {
 	Token   string `yaml:"token"`
 }
 
+type AdminTokenConfig struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes,flow"`
+}
+
 type FederationConfig struct {
 	BackoffAt int `yaml:"backoffAt"`
 }
 
+type SpamCheckerConfig struct {
+	Url             string `yaml:"url"`
+	SharedSecret    string `yaml:"sharedSecret"`
+	TimeoutSeconds  int    `yaml:"timeoutSeconds"`
+	MaxContentBytes int64  `yaml:"maxContentBytes"`
+	FailClosed      bool   `yaml:"failClosed"`
+}
+
+type HashBlocklistConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	Files            []string `yaml:"files,flow"`
+	DefaultAction    string   `yaml:"defaultAction"`
+	MaxDHashDistance int      `yaml:"maxDHashDistance"`
+}
+
+type SignedUrlsConfig struct {
+	Enabled              bool   `yaml:"enabled"`
+	Secret               string `yaml:"secret"`
+	DefaultExpirySeconds int    `yaml:"defaultExpirySeconds"`
+	MaxExpirySeconds     int    `yaml:"maxExpirySeconds"`
+}
+
 type PluginConfig struct {
 	Executable string                 `yaml:"exec"`
 	Config     map[string]interface{} `yaml:"config"`
@@ -97,4 +160,59 @@ type RedisConfig struct {
 type RedisShardConfig struct {
 	Name    string `yaml:"name"`
 	Address string `yaml:"addr"`
+}
+
+type StorageTieringConfig struct {
+	Enabled       bool                `yaml:"enabled"`
+	MoveAfterDays int                 `yaml:"moveAfterDays"`
+	Promotion     TierPromotionConfig `yaml:"promotion"`
+}
+
+type TierPromotionConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	MinDownloads  int  `yaml:"minDownloads"`
+	WindowMinutes int  `yaml:"windowMinutes"`
+}
+
+type IntegrityScrubConfig struct {
+	Enabled             bool `yaml:"enabled"`
+	FilesPerRun         int  `yaml:"filesPerRun"`
+	QuarantineCorrupted bool `yaml:"quarantineCorrupted"`
+}
+
+type CompressionConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	ContentTypes []string `yaml:"contentTypes,flow"`
+}
+
+type ReplicationConfig struct {
+	Factor int `yaml:"factor"`
+}
+
+type DatastoreRoutingRule struct {
+	Origins      []string          `yaml:"origins,flow"`
+	UserIds      []string          `yaml:"userIds,flow"`
+	ContentTypes []string          `yaml:"contentTypes,flow"`
+	MinSizeBytes int64             `yaml:"minBytes"`
+	MaxSizeBytes int64             `yaml:"maxBytes"`
+	Datastore    string            `yaml:"datastore"`
+	StorageClass string            `yaml:"storageClass"`
+	ObjectTags   map[string]string `yaml:"objectTags"`
+}
+
+type DatastoreHealthConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	IntervalSeconds int  `yaml:"intervalSeconds"`
+	TimeoutSeconds  int  `yaml:"timeoutSeconds"`
+}
+
+type WriteBehindConfig struct {
+	StagingPath          string `yaml:"stagingPath"`
+	RetryIntervalSeconds int    `yaml:"retryIntervalSeconds"`
+}
+
+type TempConfig struct {
+	Path                   string `yaml:"path"`
+	StaleAfterMinutes      int    `yaml:"staleAfterMinutes"`
+	CleanupIntervalMinutes int    `yaml:"cleanupIntervalMinutes"`
 }
\ No newline at end of file
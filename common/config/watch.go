@@ -2,6 +2,8 @@ package config
 
 import (
 	"github.com/getsentry/sentry-go"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/bep/debounce"
@@ -44,15 +46,38 @@ func Watch() *fsnotify.Watcher {
 	return watcher
 }
 
+// ReloadResult describes what was changed by reloading the config.
+type ReloadResult struct {
+	// Reloaded lists the components which were restarted or refreshed to pick up the new config.
+	// Everything else is read from the config as it is needed, so applies straight away.
+	Reloaded []string `json:"reloaded"`
+	// RequiresRestart lists the changed settings which only apply once the media repo is restarted.
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+var reloadLock = &sync.Mutex{}
+
 func onFileChanged() {
 	logrus.Info("Config file change detected - reloading")
-	configNow := Get()
-	configNew, domainsNew, err := reloadConfig()
+	_, err := Reload()
 	if err != nil {
 		logrus.Error("Error reloading configuration - ignoring")
 		logrus.Error(err)
 		sentry.CaptureException(err)
-		return
+	}
+}
+
+// Reload reads the config files again and applies them. If they can't be read, the current config is
+// kept and an error is returned.
+func Reload() (*ReloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	configNow := Get()
+	domainsNow := domains
+	configNew, domainsNew, err := reloadConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	logrus.Info("Applying reloaded config live")
@@ -61,6 +86,11 @@ func onFileChanged() {
 	PrintDomainInfo()
 	CheckDeprecations()
 
+	result := &ReloadResult{
+		Reloaded:        make([]string, 0),
+		RequiresRestart: make([]string, 0),
+	}
+
 	bindAddressChange := configNew.General.BindAddress != configNow.General.BindAddress
 	bindPortChange := configNew.General.Port != configNow.General.Port
 	forwardAddressChange := configNew.General.TrustAnyForward != configNow.General.TrustAnyForward
@@ -69,6 +99,7 @@ func onFileChanged() {
 	if bindAddressChange || bindPortChange || forwardAddressChange || forwardedHostChange || featureChanged {
 		logrus.Warn("Webserver configuration changed - remounting")
 		globals.WebReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "webserver")
 	}
 
 	metricsEnableChange := configNew.Metrics.Enabled != configNow.Metrics.Enabled
@@ -77,6 +108,7 @@ func onFileChanged() {
 	if metricsEnableChange || metricsBindAddressChange || metricsBindPortChange {
 		logrus.Warn("Metrics configuration changed - remounting")
 		globals.MetricsReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "metrics")
 	}
 
 	databaseChange := configNew.Database.Postgres != configNow.Database.Postgres
@@ -85,18 +117,38 @@ func onFileChanged() {
 	if databaseChange || poolConnsChange || poolIdleChange {
 		logrus.Warn("Database configuration changed - reconnecting")
 		globals.DatabaseReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "database")
 	}
 
-	logChange := configNew.General.LogDirectory != configNow.General.LogDirectory
-	if logChange {
+	// Logging is only set up on startup
+	logDirChange := configNew.General.LogDirectory != configNow.General.LogDirectory
+	logColorsChange := configNew.General.LogColors != configNow.General.LogColors
+	jsonLogsChange := configNew.General.JsonLogs != configNow.General.JsonLogs
+	if logDirChange || logColorsChange || jsonLogsChange {
 		logrus.Warn("Log configuration changed - restart the media repo to apply changes")
 	}
+	if logDirChange {
+		result.RequiresRestart = append(result.RequiresRestart, "repo.logDirectory")
+	}
+	if logColorsChange {
+		result.RequiresRestart = append(result.RequiresRestart, "repo.logColors")
+	}
+	if jsonLogsChange {
+		result.RequiresRestart = append(result.RequiresRestart, "repo.jsonLogs")
+	}
+
+	// Sentry is only set up on startup too
+	if configNew.Sentry != configNow.Sentry {
+		logrus.Warn("Sentry configuration changed - restart the media repo to apply changes")
+		result.RequiresRestart = append(result.RequiresRestart, "sentry")
+	}
 
 	ipfsDaemonChange := configNew.Features.IPFS.Daemon.Enabled != configNow.Features.IPFS.Daemon.Enabled
 	ipfsDaemonPathChange := configNew.Features.IPFS.Daemon.RepoPath != configNow.Features.IPFS.Daemon.RepoPath
 	if ipfsDaemonChange || ipfsDaemonPathChange {
 		logrus.Warn("IPFS Daemon options changed - reloading")
 		globals.IPFSReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "ipfs_daemon")
 	}
 
 	redisEnabledChange := configNew.Features.Redis.Enabled != configNow.Features.Redis.Enabled
@@ -111,27 +163,70 @@ func onFileChanged() {
 	if redisEnabledChange || redisShardsChange || cacheEnabledChange || cacheMaxSizeChange || cacheMaxFileSizeChange || cacheTrackedMinChange || cacheMinDownloadsChange || cacheMinCacheTimeChange || cacheMinEvictedTimeChange {
 		logrus.Warn("Cache configuration changed - reloading")
 		globals.CacheReplaceChan <- true
+		result.Reloaded = append(result.Reloaded, "cache")
 	}
 
-	// Always flush the access token cache
-	logrus.Warn("Flushing access token cache")
-	globals.AccessTokenReloadChan <- true
+	// Per-domain configs can override most things, so any change to them counts for everything
+	// which could be overridden.
+	domainsChange := !reflect.DeepEqual(domainsNew, domainsNow)
 
-	// Always update the datastores
-	logrus.Warn("Updating datastores to ensure accuracy")
-	globals.DatastoresReloadChan <- true
+	homeserversChange := !reflect.DeepEqual(configNew.Homeservers, configNow.Homeservers)
+	accessTokensChange := !reflect.DeepEqual(configNew.AccessTokens, configNow.AccessTokens)
+	sharedSecretChange := configNew.SharedSecret != configNow.SharedSecret
+	adminTokensChange := !reflect.DeepEqual(configNew.AdminTokens, configNow.AdminTokens)
+	if homeserversChange || accessTokensChange || sharedSecretChange || adminTokensChange || domainsChange {
+		logrus.Warn("Access token configuration changed - flushing access token cache")
+		globals.AccessTokenReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "access_tokens")
+	}
 
-	logrus.Info("Reloading all plugins")
-	globals.PluginReloadChan <- true
+	datastoresChange := !reflect.DeepEqual(configNew.DataStores, configNow.DataStores)
+	stagingPathChange := configNew.WriteBehind.StagingPath != configNow.WriteBehind.StagingPath
+	if datastoresChange || stagingPathChange || domainsChange {
+		logrus.Warn("Datastore configuration changed - updating datastores")
+		globals.DatastoresReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "datastores")
+	}
+
+	if !reflect.DeepEqual(configNew.Plugins, configNow.Plugins) {
+		logrus.Warn("Plugin configuration changed - reloading plugins")
+		globals.PluginReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "plugins")
+	}
 
-	logrus.Info("Restarting recurring tasks")
-	globals.RecurringTasksReloadChan <- true
+	// Most recurring tasks check the config each time they run, but these intervals are only read
+	// when the tasks start
+	healthIntervalChange := configNew.DatastoreHealth.IntervalSeconds != configNow.DatastoreHealth.IntervalSeconds
+	tempCleanupIntervalChange := configNew.Temp.CleanupIntervalMinutes != configNow.Temp.CleanupIntervalMinutes
+	writeBehindIntervalChange := configNew.WriteBehind.RetryIntervalSeconds != configNow.WriteBehind.RetryIntervalSeconds
+	if healthIntervalChange || tempCleanupIntervalChange || writeBehindIntervalChange {
+		logrus.Warn("Recurring task intervals changed - restarting recurring tasks")
+		globals.RecurringTasksReloadChan <- true
+		result.Reloaded = append(result.Reloaded, "recurring_tasks")
+	}
+
+	return result, nil
 }
 
 func hasWebFeatureChanged(configNew *MainRepoConfig, configNow *MainRepoConfig) bool {
 	if configNew.Features.MSC2448Blurhash.Enabled != configNow.Features.MSC2448Blurhash.Enabled {
 		return true
 	}
+	if configNew.Features.MSC2246Async.Enabled != configNow.Features.MSC2246Async.Enabled {
+		return true
+	}
+	if configNew.Features.MSC3911Restrictions.Enabled != configNow.Features.MSC3911Restrictions.Enabled {
+		return true
+	}
+	if configNew.SignedUrls.Enabled != configNow.SignedUrls.Enabled {
+		return true
+	}
+	if configNew.Uploads.Resumable.Enabled != configNow.Uploads.Resumable.Enabled {
+		return true
+	}
+	if configNew.Uploads.CustomMediaIds.Enabled != configNow.Uploads.CustomMediaIds.Enabled {
+		return true
+	}
 	if configNew.Features.IPFS.Enabled != configNow.Features.IPFS.Enabled {
 		return true
 	}
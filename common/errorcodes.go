@@ -16,3 +16,6 @@ const ErrCodeRateLimitExceeded = "M_LIMIT_EXCEEDED"
 const ErrCodeUnknown = "M_UNKNOWN"
 const ErrCodeForbidden = "M_FORBIDDEN"
 const ErrCodeQuotaExceeded = "M_QUOTA_EXCEEDED"
+const ErrCodeNotYetUploaded = "M_NOT_YET_UPLOADED"
+const ErrCodeCannotOverwriteMedia = "M_CANNOT_OVERWRITE_MEDIA"
+const ErrCodeDigestMismatch = "M_DIGEST_MISMATCH"
@@ -6,7 +6,21 @@ import (
 
 var ErrMediaNotFound = errors.New("media not found")
 var ErrMediaTooLarge = errors.New("media too large")
+var ErrMediaTooSmall = errors.New("media too small")
 var ErrInvalidHost = errors.New("invalid host")
 var ErrHostNotFound = errors.New("host not found")
 var ErrHostBlacklisted = errors.New("host not allowed")
 var ErrMediaQuarantined = errors.New("media quarantined")
+var ErrRateLimitExceeded = errors.New("rate limit exceeded")
+var ErrDatastoreReadOnly = errors.New("datastore is read-only")
+var ErrMediaNotRemote = errors.New("media is not from a remote server")
+var ErrMediaNotYetUploaded = errors.New("media not yet uploaded")
+var ErrMediaAlreadyUploaded = errors.New("media already uploaded")
+var ErrNotMediaUploader = errors.New("media was created by another user")
+var ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+var ErrContentDigestMismatch = errors.New("content does not match its digest")
+var ErrQuotaExceeded = errors.New("quota exceeded")
+var ErrTooManyPendingUploads = errors.New("too many media IDs waiting to be uploaded")
+var ErrUploadSizeMismatch = errors.New("upload does not match its declared size")
+var ErrMediaAlreadyRestricted = errors.New("media is already restricted")
+var ErrEventNotFound = errors.New("room or event not found")
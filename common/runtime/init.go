@@ -12,7 +12,12 @@ import (
 	"github.com/turt2live/matrix-media-repo/plugins"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_azure"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_gcs"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_webdav"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
 )
 
 func RunStartupSequence() {
@@ -21,6 +26,7 @@ func RunStartupSequence() {
 	config.CheckDeprecations()
 	LoadDatabase()
 	LoadDatastores()
+	CleanupTempFiles()
 	plugins.ReloadPlugins()
 
 	logrus.Info("Starting IPFS (if enabled)...")
@@ -32,6 +38,14 @@ func LoadDatabase() {
 	storage.GetDatabase()
 }
 
+func CleanupTempFiles() {
+	logrus.Info("Cleaning up stale temporary files in ", scratch.BasePath(), "...")
+	removed := scratch.CleanupStale(logrus.WithFields(logrus.Fields{"stage": "startup"}))
+	if removed > 0 {
+		logrus.Infof("Removed %d stale temporary files", removed)
+	}
+}
+
 func LoadDatastores() {
 	mediaStore := storage.GetDatabase().GetMediaStore(rcontext.Initial())
 
@@ -48,6 +62,21 @@ func LoadDatastores() {
 			sentry.CaptureException(err)
 			logrus.Fatal(err)
 		}
+
+		if ds.Type == "file" {
+			if _, err = ds_file.LayoutFromOptions(ds.Options); err != nil {
+				logrus.Fatal("Invalid file datastore layout for ", uri, ": ", err)
+			}
+		}
+
+		if ds.WriteBehind {
+			if ds.Type == "ipfs" {
+				logrus.Fatal("Write-behind is not supported for IPFS datastores")
+			}
+			if config.Get().WriteBehind.StagingPath == "" {
+				logrus.Fatal("writeBehind.stagingPath must be set to use write-behind datastores")
+			}
+		}
 	}
 
 	// Print all the known datastores at startup. Doubles as a way to initialize the database.
@@ -60,6 +89,20 @@ func LoadDatastores() {
 	for _, ds := range datastores {
 		logrus.Info(fmt.Sprintf("\t%s (%s): %s", ds.Type, ds.DatastoreId, ds.Uri))
 
+		if conf, err := datastore.GetDatastoreConfig(ds); err == nil {
+			encrypted, err := datastore.IsEncrypted(ds.DatastoreId, conf)
+			if err != nil {
+				sentry.CaptureException(err)
+				logrus.Fatal("Invalid encryption key for datastore ", ds.DatastoreId, ": ", err)
+			}
+			if encrypted {
+				logrus.Info("\t\tContents are encrypted at rest")
+			}
+			if conf.WriteBehind {
+				logrus.Info("\t\tUploads are staged locally and written in the background")
+			}
+		}
+
 		if ds.Type == "s3" {
 			conf, err := datastore.GetDatastoreConfig(ds)
 			if err != nil {
@@ -80,6 +123,64 @@ func LoadDatastores() {
 			if err != nil {
 				logrus.Warn("\t\tTemporary path does not exist!")
 			}
+		} else if ds.Type == "azure" {
+			conf, err := datastore.GetDatastoreConfig(ds)
+			if err != nil {
+				continue
+			}
+
+			azure, err := ds_azure.GetOrCreateAzureDatastore(ds.DatastoreId, conf)
+			if err != nil {
+				logrus.Warn("\t\tInvalid azure configuration: ", err)
+				continue
+			}
+
+			err = azure.EnsureContainerExists()
+			if err != nil {
+				logrus.Warn("\t\tContainer does not exist or is not accessible!")
+			}
+
+			err = azure.EnsureTempPathExists()
+			if err != nil {
+				logrus.Warn("\t\tTemporary path does not exist!")
+			}
+		} else if ds.Type == "gcs" {
+			conf, err := datastore.GetDatastoreConfig(ds)
+			if err != nil {
+				continue
+			}
+
+			gcs, err := ds_gcs.GetOrCreateGcsDatastore(ds.DatastoreId, conf)
+			if err != nil {
+				logrus.Warn("\t\tInvalid gcs configuration: ", err)
+				continue
+			}
+
+			err = gcs.EnsureBucketExists()
+			if err != nil {
+				logrus.Warn("\t\tBucket does not exist or is not accessible!")
+			}
+		} else if ds.Type == "webdav" {
+			conf, err := datastore.GetDatastoreConfig(ds)
+			if err != nil {
+				continue
+			}
+
+			webdav, err := ds_webdav.GetOrCreateWebDavDatastore(ds.DatastoreId, conf)
+			if err != nil {
+				logrus.Warn("\t\tInvalid webdav configuration: ", err)
+				continue
+			}
+
+			err = webdav.EnsureCollectionExists()
+			if err != nil {
+				logrus.Warn("\t\tCollection does not exist or is not accessible!")
+			}
+
+			err = webdav.EnsureTempPathExists()
+			if err != nil {
+				logrus.Warn("\t\tTemporary path does not exist!")
+			}
 		}
 	}
 }
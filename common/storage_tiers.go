@@ -0,0 +1,4 @@
+package common
+
+const TierHot = "hot"
+const TierCold = "cold"
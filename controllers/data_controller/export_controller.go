@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/storage"
@@ -153,8 +154,13 @@ func StartUserExport(userId string, s3urls bool, includeData bool, ctx rcontext.
 }
 
 func compileArchive(exportId string, entityId string, archiveDs *datastore.DatastoreRef, media []*types.Media, s3urls bool, includeData bool, ctx rcontext.RequestContext) {
+	expiresTs := int64(0)
+	if ctx.Config.Archiving.ExpireAfterHours > 0 {
+		expiresTs = util.NowMillis() + int64(ctx.Config.Archiving.ExpireAfterHours)*60*60*1000
+	}
+
 	exportDb := storage.GetDatabase().GetExportStore(ctx)
-	err := exportDb.InsertExport(exportId, entityId)
+	err := exportDb.InsertExport(exportId, entityId, expiresTs)
 	if err != nil {
 		ctx.Log.Error(err)
 		sentry.CaptureException(err)
@@ -393,3 +399,54 @@ func compileArchive(exportId string, entityId string, archiveDs *datastore.Datas
 		}
 	}
 }
+
+func DeleteExport(exportId string, ctx rcontext.RequestContext) error {
+	db := storage.GetDatabase().GetExportStore(ctx)
+
+	ctx.Log.Info("Getting information on which parts to delete")
+	parts, err := db.GetExportParts(exportId)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		ctx.Log.Info("Locating datastore: " + part.DatastoreID)
+		ds, err := datastore.LocateDatastore(ctx, part.DatastoreID)
+		if err != nil {
+			return err
+		}
+
+		ctx.Log.Info("Deleting object: " + part.Location)
+		err = ds.DeleteObject(part.Location)
+		if err != nil {
+			ctx.Log.Warn(err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	ctx.Log.Info("Purging export from database")
+	return db.DeleteExportAndParts(exportId)
+}
+
+// PurgeExpiredExports deletes every export which has passed its expiry time, returning how many
+// were deleted. Exports which fail to delete are skipped and tried again next time.
+func PurgeExpiredExports(ctx rcontext.RequestContext) (int, error) {
+	db := storage.GetDatabase().GetExportStore(ctx)
+	exportIds, err := db.GetExpiredExportIds(util.NowMillis())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, exportId := range exportIds {
+		err = DeleteExport(exportId, ctx.LogWithFields(logrus.Fields{"exportId": exportId}))
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			continue
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -393,6 +393,18 @@ func doImport(updateChannel chan *importUpdate, taskId int, importId string, ctx
 						if userId == "" {
 							uploader = record.Uploader
 						}
+						dsRef, err := datastore.LocateDatastore(ctx, ds.DatastoreId)
+						if err != nil {
+							ctx.Log.Errorf("Error locating datastore: %s", err.Error())
+							sentry.CaptureException(err)
+							break
+						}
+						compressed, err := dsRef.IsObjectCompressed(location)
+						if err != nil {
+							ctx.Log.Errorf("Error reading file from datastore: %s", err.Error())
+							sentry.CaptureException(err)
+							break
+						}
 						media := &types.Media{
 							Origin:      record.Origin,
 							MediaId:     record.MediaId,
@@ -404,6 +416,7 @@ func doImport(updateChannel chan *importUpdate, taskId int, importId string, ctx
 							DatastoreId: ds.DatastoreId,
 							Location:    location,
 							CreationTs:  record.CreatedTs,
+							Compressed:  compressed,
 						}
 
 						err = db.Insert(media)
@@ -37,7 +37,7 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				minMedia = &types.MinimalMedia{
 					Origin:      media.Origin,
 					MediaId:     media.MediaId,
-					ContentType: media.ContentType,
+					ContentType: media.EffectiveContentType(ctx.Config.Uploads.UseDetectedContentType),
 					UploadName:  media.UploadName,
 					SizeBytes:   media.SizeBytes,
 					Stream:      nil, // we'll populate this later if we need to
@@ -102,6 +102,8 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				ctx.Log.Warn("Failed to upsert the last access time: ", err)
 			}
 
+			maybePromoteMedia(media, ctx)
+
 			localCache.Set(origin+"/"+mediaId, media, cache.DefaultExpiration)
 
 			cached, err := internal_cache.Get().GetMedia(media.Sha256Hash, internal_cache.StreamerForMedia(media), ctx)
@@ -168,6 +170,36 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 	return value, err
 }
 
+// WaitForUpload waits up to the timeout for the contents of media created with the async upload API to
+// be uploaded, returning nil once they are. Returns common.ErrMediaNotFound if the media isn't waiting
+// for an upload, or common.ErrMediaNotYetUploaded if it still is when the timeout passes.
+func WaitForUpload(origin string, mediaId string, timeout time.Duration, ctx rcontext.RequestContext) error {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	deadline := time.Now().Add(timeout)
+	waited := false
+	for {
+		upload, err := db.GetPendingUpload(origin, mediaId)
+		if err != nil {
+			return err
+		}
+		if upload == nil || upload.ExpiresTs < util.NowMillis() {
+			if waited && upload == nil {
+				return nil
+			}
+			return common.ErrMediaNotFound
+		}
+		if !time.Now().Before(deadline) {
+			return common.ErrMediaNotYetUploaded
+		}
+
+		if !waited {
+			ctx.Log.Info("Waiting for media to be uploaded")
+			waited = true
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
 func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
 
@@ -194,6 +226,9 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 				ctx.Log.Warn("Remote media not being downloaded")
 				return nil, common.ErrMediaNotFound
 			}
+			if isOriginQuarantined(origin, ctx) {
+				return nil, common.ErrMediaQuarantined
+			}
 
 			mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
 			defer close(mediaChan)
@@ -243,7 +278,7 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 	return &types.MinimalMedia{
 		Origin:      media.Origin,
 		MediaId:     media.MediaId,
-		ContentType: media.ContentType,
+		ContentType: media.EffectiveContentType(ctx.Config.Uploads.UseDetectedContentType),
 		UploadName:  media.UploadName,
 		SizeBytes:   media.SizeBytes,
 		Stream:      mediaStream,
@@ -253,7 +288,10 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 
 func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.Media, error) {
 	cacheKey := origin + "/" + mediaId
-	v, _, err := globals.DefaultRequestGroup.DoWithoutPost(cacheKey, func() (interface{}, error) {
+	// Requests which mustn't download remote media can't share the result of ones which may, and the
+	// other way around
+	requestKey := fmt.Sprintf("%s?r=%t", cacheKey, downloadRemote)
+	v, _, err := globals.DefaultRequestGroup.DoWithoutPost(requestKey, func() (interface{}, error) {
 		db := storage.GetDatabase().GetMediaStore(ctx)
 
 		var media *types.Media
@@ -279,6 +317,9 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 					ctx.Log.Warn("Remote media not being downloaded")
 					return nil, common.ErrMediaNotFound
 				}
+				if isOriginQuarantined(origin, ctx) {
+					return nil, common.ErrMediaQuarantined
+				}
 
 				mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
 				defer close(mediaChan)
@@ -308,3 +349,28 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 
 	return value, err
 }
+
+// ForgetMediaRecord drops any record or download failure cached for the media, so the next request
+// looks it up (or downloads it) again.
+func ForgetMediaRecord(origin string, mediaId string) {
+	cacheKey := origin + "/" + mediaId
+	localCache.Delete(cacheKey)
+	if downloadErrorsCache != nil {
+		downloadErrorsCache.Delete(cacheKey)
+	}
+}
+
+// isOriginQuarantined returns true if no new media should be downloaded from the server. Media
+// which was already downloaded is quarantined separately.
+func isOriginQuarantined(origin string, ctx rcontext.RequestContext) bool {
+	quarantined, err := storage.GetDatabase().GetMediaStore(ctx).IsOriginQuarantined(origin)
+	if err != nil {
+		ctx.Log.Error("Error checking if origin is quarantined: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+	if quarantined {
+		ctx.Log.Warn("Not downloading media from quarantined server ", origin)
+	}
+	return quarantined
+}
@@ -176,7 +176,7 @@ func downloadResourceWorkFn(request *resource_handler.WorkRequest) (resp *worker
 
 		ctx.Log.Info("Remote media persisted under datastore ", media.DatastoreId, " at ", media.Location)
 		r.media = media
-		r.contentType = media.ContentType
+		r.contentType = media.EffectiveContentType(ctx.Config.Uploads.UseDetectedContentType)
 		r.filename = media.UploadName
 		r.stream = ms
 		return r
@@ -0,0 +1,80 @@
+package download_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Download counts by hash. Each count expires once its window is over, which starts at the first
+// download counted.
+var promotionCounts = cache.New(1*time.Hour, 2*time.Hour)
+
+var promotionsInProgress = &sync.Map{} // [string] => bool
+var promotionLock = &sync.Mutex{}
+
+// maybePromoteMedia counts a download of media from a cold datastore, copying it to a hot datastore
+// once it has been downloaded often enough. The copy happens in the background, one file at a time,
+// so downloads aren't held up.
+func maybePromoteMedia(media *types.Media, ctx rcontext.RequestContext) {
+	conf := config.Get().StorageTiering.Promotion
+	if !conf.Enabled {
+		return
+	}
+
+	ds, err := datastore.LocateDatastore(ctx, media.DatastoreId)
+	if err != nil || !ds.IsCold() {
+		return
+	}
+
+	window := time.Duration(conf.WindowMinutes) * time.Minute
+	if promotionCounts.Add(media.Sha256Hash, 1, window) != nil {
+		_, _ = promotionCounts.IncrementInt(media.Sha256Hash, 1)
+	}
+	if count, ok := promotionCounts.Get(media.Sha256Hash); !ok || count.(int) < conf.MinDownloads {
+		return
+	}
+
+	if _, running := promotionsInProgress.LoadOrStore(media.Sha256Hash, true); running {
+		return
+	}
+	promotionCounts.Delete(media.Sha256Hash)
+
+	kind := common.KindRemoteMedia
+	if util.IsServerOurs(media.Origin) {
+		kind = common.KindLocalMedia
+	}
+	rctx := rcontext.Initial().LogWithFields(logrus.Fields{"mediaSha256": media.Sha256Hash, "datastoreId": ds.DatastoreId})
+
+	go func() {
+		defer promotionsInProgress.Delete(media.Sha256Hash)
+		promotionLock.Lock()
+		defer promotionLock.Unlock()
+
+		hotDs := datastore.PickHotDatastore(kind, rctx)
+		if hotDs == nil {
+			rctx.Log.Warn("No hot datastore can currently take frequently downloaded media - not promoting it")
+			return
+		}
+
+		rctx.Log.Info("Promoting frequently downloaded media to ", hotDs.DatastoreId)
+		err := datastore.TransferObject(media.Sha256Hash, media.Location, media.SizeBytes, ds, hotDs, rctx)
+		if err != nil {
+			rctx.Log.Error("Failed to promote media: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+
+		// Cached records would still point at the old location
+		localCache.Flush()
+	}()
+}
@@ -0,0 +1,36 @@
+package download_controller
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// GetRedirectableMedia returns the media if downloads of it can be redirected to its datastore, which
+// is decided without opening the media. Returns nil if the download has to be served by the media
+// repo instead, including when the media isn't known yet.
+func GetRedirectableMedia(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	media, err := FindMediaRecord(origin, mediaId, false, ctx)
+	if err == common.ErrMediaNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	redirect, err := datastore.CanRedirectDownload(media, ctx)
+	if err != nil || !redirect {
+		return nil, err
+	}
+
+	err = storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
+	if err != nil {
+		sentry.CaptureException(err)
+		ctx.Log.Warn("Failed to upsert the last access time: ", err)
+	}
+	return media, nil
+}
@@ -0,0 +1,52 @@
+package download_controller
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+var restrictionAccessCache = cache.New(1*time.Minute, 2*time.Minute)
+
+// CanAccessMedia returns whether the user is allowed to download the media. Media restricted to a room or
+// event (MSC3911) can only be downloaded by its uploader and people the homeserver lets see the room or
+// event. Unrestricted media can be downloaded by anyone, including users who aren't logged in.
+func CanAccessMedia(origin string, mediaId string, userId string, accessToken string, appserviceUserId string, ipAddr string, ctx rcontext.RequestContext) (bool, error) {
+	attrs, err := storage.GetDatabase().GetMediaAttributesStore(ctx).GetAttributesDefaulted(origin, mediaId)
+	if err != nil {
+		return false, err
+	}
+	if attrs.RestrictedRoomId == "" {
+		return true, nil
+	}
+	if userId == "" {
+		return false, nil
+	}
+
+	media, err := storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil && media.UserId == userId {
+		return true, nil
+	}
+
+	cacheKey := fmt.Sprintf("%s %s %s", userId, attrs.RestrictedRoomId, attrs.RestrictedEventId)
+	if canSee, found := restrictionAccessCache.Get(cacheKey); found {
+		return canSee.(bool), nil
+	}
+
+	canSee, err := matrix.CanSeeEvent(ctx, origin, accessToken, appserviceUserId, ipAddr, attrs.RestrictedRoomId, attrs.RestrictedEventId)
+	if err != nil {
+		return false, err
+	}
+	if ctx.Config.Features.MSC3911Restrictions.AccessCacheSeconds > 0 {
+		restrictionAccessCache.Set(cacheKey, canSee, time.Duration(ctx.Config.Features.MSC3911Restrictions.AccessCacheSeconds)*time.Second)
+	}
+	return canSee, nil
+}
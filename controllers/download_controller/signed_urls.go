@@ -0,0 +1,29 @@
+package download_controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// SignDownload returns the signature letting anyone download the media until expiresTs.
+func SignDownload(origin string, mediaId string, expiresTs int64) string {
+	mac := hmac.New(sha256.New, []byte(config.Get().SignedUrls.Secret))
+	// The media ID can't contain slashes, so the fields can't run into each other
+	mac.Write([]byte(fmt.Sprintf("%s/%s/%d", origin, mediaId, expiresTs)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsValidDownloadSignature returns whether the signature was made with SignDownload for the media and
+// expiry, and the expiry hasn't passed yet.
+func IsValidDownloadSignature(origin string, mediaId string, expiresTs int64, signature string) bool {
+	if config.Get().SignedUrls.Secret == "" || expiresTs < util.NowMillis() {
+		return false
+	}
+	expected := SignDownload(origin, mediaId, expiresTs)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
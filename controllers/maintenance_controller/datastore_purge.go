@@ -0,0 +1,166 @@
+package maintenance_controller
+
+import (
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// StartDatastorePurge empties the datastore. Media is deleted, or moved to migrateTo if that is set,
+// in which case media that can't be moved is left in place rather than lost. Thumbnails are always
+// deleted as they can be generated again. Returns an error only if starting up the background task
+// failed.
+func StartDatastorePurge(ds *datastore.DatastoreRef, migrateTo *datastore.DatastoreRef, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	migrateToId := ""
+	if migrateTo != nil {
+		if migrateTo.IsReadOnly(ctx) {
+			return nil, common.ErrDatastoreReadOnly
+		}
+		migrateToId = migrateTo.DatastoreId
+	}
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	task, err := db.CreateBackgroundTask("datastore_purge", map[string]interface{}{
+		"datastore_id":            ds.DatastoreId,
+		"migrate_to_datastore_id": migrateToId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go doDatastorePurge(task, ds, migrateTo, ctx)
+
+	return task, nil
+}
+
+func doDatastorePurge(task *types.BackgroundTask, ds *datastore.DatastoreRef, migrateTo *datastore.DatastoreRef, ctx rcontext.RequestContext) {
+	ctx = ctx.LogWithFields(logrus.Fields{"datastoreId": ds.DatastoreId})
+	ctx.Log.Info("Starting datastore purge")
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	progress := map[string]interface{}{}
+	reportProgress := func() {
+		err := db.SetBackgroundTaskProgress(task.ID, progress)
+		if err != nil {
+			ctx.Log.Warn("Failed to update task progress: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+	moved := 0
+	purged := 0
+	failed := 0
+	reclaimed := newReclaimedBytes()
+	updateCounts := func() {
+		progress["moved_media"] = moved
+		progress["purged_media"] = purged
+		progress["failed_media"] = failed
+		progress["bytes_reclaimed"] = reclaimed.Total()
+	}
+	defer func() {
+		updateCounts()
+		reportProgress()
+		err := db.FinishedBackgroundTask(task.ID)
+		if err != nil {
+			ctx.Log.Error(err)
+			ctx.Log.Error("Failed to flag task as finished")
+			sentry.CaptureException(err)
+		}
+	}()
+
+	media, err := storage.GetDatabase().GetMediaStore(ctx).GetAllMediaInDatastore(ds.DatastoreId)
+	if err != nil {
+		ctx.Log.Error("Error getting media in datastore: ", err)
+		sentry.CaptureException(err)
+		progress["error"] = err.Error()
+		return
+	}
+
+	progress["total_media"] = len(media)
+	updateCounts()
+	reportProgress()
+
+	// Records sharing a hash are moved together, so we only need to move each hash once
+	movedHashes := make(map[string]bool)
+	checkpoint := newTaskCheckpoint(task)
+	for _, m := range media {
+		if checkpoint.Tick(ctx) {
+			updateCounts()
+			reportProgress()
+		}
+		if checkpoint.Cancelled() {
+			ctx.Log.Info("Datastore purge was cancelled")
+			progress["cancelled"] = true
+			return
+		}
+
+		rctx := ctx.LogWithFields(logrus.Fields{"origin": m.Origin, "mediaId": m.MediaId})
+		if migrateTo != nil {
+			if !movedHashes[m.Sha256Hash] {
+				err = datastore.TransferObject(m.Sha256Hash, m.Location, m.SizeBytes, ds, migrateTo, rctx)
+				if err != nil {
+					rctx.Log.Error("Failed to move media, leaving it in place: ", err)
+					sentry.CaptureException(err)
+					failed++
+					continue
+				}
+				movedHashes[m.Sha256Hash] = true
+			}
+			moved++
+		} else {
+			err = doPurge(m, reclaimed, rctx)
+			if err != nil {
+				rctx.Log.Error("Failed to purge media: ", err)
+				sentry.CaptureException(err)
+				failed++
+				continue
+			}
+			purged++
+		}
+	}
+
+	// Moving media also moves the thumbnails sharing its hash, so look the thumbnails up afterwards
+	thumbs, err := storage.GetDatabase().GetThumbnailStore(ctx).GetAllInDatastore(ds.DatastoreId)
+	if err != nil {
+		ctx.Log.Error("Error getting thumbnails in datastore: ", err)
+		sentry.CaptureException(err)
+		progress["error"] = err.Error()
+		return
+	}
+
+	purgedThumbs := 0
+	seenMedia := make(map[string]bool)
+	for _, t := range thumbs {
+		key := t.Origin + "/" + t.MediaId
+		if seenMedia[key] {
+			continue
+		}
+		seenMedia[key] = true
+
+		if checkpoint.Tick(ctx) {
+			updateCounts()
+			reportProgress()
+		}
+		if checkpoint.Cancelled() {
+			ctx.Log.Info("Datastore purge was cancelled")
+			progress["cancelled"] = true
+			return
+		}
+
+		err = purgeThumbnails(t.Origin, t.MediaId, reclaimed, ctx)
+		if err != nil {
+			ctx.Log.Error("Failed to purge thumbnails of ", key, ": ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		purgedThumbs++
+	}
+	progress["purged_thumbnails_for_media"] = purgedThumbs
+
+	ctx.Log.Info(fmt.Sprintf("Finished datastore purge: %d moved, %d purged, %d failed", moved, purged, failed))
+}
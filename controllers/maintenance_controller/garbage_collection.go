@@ -0,0 +1,182 @@
+package maintenance_controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Objects which were written recently may belong to an upload which hasn't created its database
+// record yet, so they are never considered orphaned.
+const orphanMinAge = 1 * time.Hour
+
+// The number of orphaned and missing files to list in the task's progress. Everything is still
+// counted beyond this.
+const maxReportedObjects = 1000
+
+// StartGarbageCollection finds files in the datastore which no media, thumbnail, or export points
+// at, and records which point at files that no longer exist. Orphaned files are deleted unless
+// dryRun is set. Returns an error only if starting up the background task failed.
+func StartGarbageCollection(ds *datastore.DatastoreRef, dryRun bool, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	task, err := db.CreateBackgroundTask("garbage_collection", map[string]interface{}{
+		"datastore_id": ds.DatastoreId,
+		"dry_run":      dryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go doGarbageCollection(task, ds, dryRun, ctx)
+
+	return task, nil
+}
+
+func doGarbageCollection(task *types.BackgroundTask, ds *datastore.DatastoreRef, dryRun bool, ctx rcontext.RequestContext) {
+	ctx = ctx.LogWithFields(logrus.Fields{"datastoreId": ds.DatastoreId, "dryRun": dryRun})
+	ctx.Log.Info("Starting garbage collection")
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	progress := map[string]interface{}{"dry_run": dryRun}
+	defer func() {
+		err := db.SetBackgroundTaskProgress(task.ID, progress)
+		if err != nil {
+			ctx.Log.Error("Failed to record garbage collection results: ", err)
+			sentry.CaptureException(err)
+		}
+		err = db.FinishedBackgroundTask(task.ID)
+		if err != nil {
+			ctx.Log.Error(err)
+			ctx.Log.Error("Failed to flag task as finished")
+			sentry.CaptureException(err)
+		}
+	}()
+
+	// List the datastore before looking at the database so that anything uploaded while we list
+	// is already recorded by the time we check for references.
+	objects, err := ds.ListObjects()
+	if err != nil {
+		ctx.Log.Error("Error listing datastore: ", err)
+		sentry.CaptureException(err)
+		progress["error"] = err.Error()
+		return
+	}
+	refs, err := db.GetObjectReferencesInDatastore(ds.DatastoreId)
+	if err != nil {
+		ctx.Log.Error("Error getting references to datastore: ", err)
+		sentry.CaptureException(err)
+		progress["error"] = err.Error()
+		return
+	}
+
+	referenced := make(map[string]bool)
+	for _, ref := range refs {
+		referenced[ref.Location] = true
+	}
+	listed := make(map[string]bool)
+	for _, obj := range objects {
+		listed[obj.Location] = true
+	}
+
+	orphanCutoffTs := util.NowMillis() - orphanMinAge.Milliseconds()
+	orphans := make([]*types.ObjectListing, 0)
+	orphanedBytes := int64(0)
+	foreign := 0
+	for _, obj := range objects {
+		if referenced[obj.Location] || obj.LastModifiedTs > orphanCutoffTs {
+			continue
+		}
+		if !datastore.IsOwnObjectName(obj.Location) {
+			// Not written by the media repo, so it isn't ours to delete
+			foreign++
+			continue
+		}
+		orphans = append(orphans, obj)
+		orphanedBytes += obj.SizeBytes
+	}
+
+	missing := make([]*types.ObjectReference, 0)
+	for _, ref := range refs {
+		if !listed[ref.Location] {
+			missing = append(missing, ref)
+		}
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Found %d orphaned files (%d bytes) and %d records with missing files", len(orphans), orphanedBytes, len(missing)))
+
+	progress["objects_checked"] = len(objects)
+	progress["orphaned_files"] = len(orphans)
+	progress["orphaned_bytes"] = orphanedBytes
+	progress["missing_files"] = len(missing)
+	progress["foreign_files"] = foreign
+	progress["orphans"] = reportedOrphans(orphans)
+	progress["missing"] = reportedMissing(missing)
+
+	if dryRun {
+		return
+	}
+
+	deleted := 0
+	deletedBytes := int64(0)
+	checkpoint := newTaskCheckpoint(task)
+	for _, obj := range orphans {
+		if checkpoint.Stopped(ctx) {
+			ctx.Log.Info("Garbage collection was cancelled")
+			progress["cancelled"] = true
+			break
+		}
+
+		// Check again in case something started using the file while we were working
+		shared, err := isObjectShared(ds.DatastoreId, obj.Location, 0, ctx)
+		if err != nil || shared {
+			continue
+		}
+
+		ctx.Log.Info("Deleting orphaned file: ", obj.Location)
+		err = ds.DeleteObject(obj.Location)
+		if err != nil {
+			ctx.Log.Warn("Error deleting orphaned file ", obj.Location, ": ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		deleted++
+		deletedBytes += obj.SizeBytes
+	}
+
+	progress["deleted_files"] = deleted
+	progress["deleted_bytes"] = deletedBytes
+	ctx.Log.Info(fmt.Sprintf("Deleted %d orphaned files (%d bytes)", deleted, deletedBytes))
+}
+
+func reportedOrphans(orphans []*types.ObjectListing) []string {
+	locations := make([]string, 0)
+	for i, obj := range orphans {
+		if i >= maxReportedObjects {
+			break
+		}
+		locations = append(locations, obj.Location)
+	}
+	return locations
+}
+
+func reportedMissing(missing []*types.ObjectReference) []map[string]string {
+	reported := make([]map[string]string, 0)
+	for i, ref := range missing {
+		if i >= maxReportedObjects {
+			break
+		}
+		reported = append(reported, map[string]string{
+			"kind":     ref.Kind,
+			"id":       ref.Id,
+			"location": ref.Location,
+		})
+	}
+	return reported
+}
@@ -0,0 +1,187 @@
+package maintenance_controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const (
+	integrityOk         = "ok"
+	integrityCorrupted  = "corrupted"
+	integrityMissing    = "missing"
+	integrityUnreadable = "unreadable"
+)
+
+// StartIntegrityScrub re-hashes up to limit media files in the background, starting with those which
+// were checked the longest time ago, and flags any which no longer match the hash they were stored
+// with. Corrupted media is quarantined if quarantineCorrupted is set. Returns an error only if starting
+// up the background task failed.
+func StartIntegrityScrub(limit int, quarantineCorrupted bool, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	task, err := db.CreateBackgroundTask("integrity_scrub", map[string]interface{}{
+		"limit":                limit,
+		"quarantine_corrupted": quarantineCorrupted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		// Scrubs can outlive whatever started them
+		ctx.Context = context.Background()
+		doIntegrityScrub(task, limit, quarantineCorrupted, ctx)
+	}()
+
+	return task, nil
+}
+
+func doIntegrityScrub(task *types.BackgroundTask, limit int, quarantineCorrupted bool, ctx rcontext.RequestContext) {
+	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+	progress := make(map[string]interface{})
+	defer func() {
+		err := metadataDb.SetBackgroundTaskProgress(task.ID, progress)
+		if err != nil {
+			ctx.Log.Error("Failed to record integrity scrub results: ", err)
+			sentry.CaptureException(err)
+		}
+		err = metadataDb.FinishedBackgroundTask(task.ID)
+		if err != nil {
+			ctx.Log.Error(err)
+			ctx.Log.Error("Failed to flag task as finished")
+			sentry.CaptureException(err)
+		}
+	}()
+
+	records, err := metadataDb.GetMediaForIntegrityCheck(limit)
+	if err != nil {
+		ctx.Log.Error("Error finding media to check: ", err)
+		sentry.CaptureException(err)
+		progress["error"] = err.Error()
+		return
+	}
+
+	checked := 0
+	corrupted := 0
+	unreadable := 0
+	progress["total"] = len(records)
+	reportProgress := func() {
+		progress["checked"] = checked
+		progress["failed"] = corrupted
+		progress["unreadable"] = unreadable
+		err := metadataDb.SetBackgroundTaskProgress(task.ID, progress)
+		if err != nil {
+			ctx.Log.Warn("Failed to update task progress: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	checkpoint := newTaskCheckpoint(task)
+	for _, record := range records {
+		if checkpoint.Tick(ctx) {
+			reportProgress()
+		}
+		if checkpoint.Cancelled() {
+			ctx.Log.Info("Integrity scrub was cancelled")
+			progress["cancelled"] = true
+			break
+		}
+		checked++
+
+		rctx := ctx.LogWithFields(logrus.Fields{"mediaSha256": record.Sha256Hash, "datastoreId": record.DatastoreId})
+
+		result := checkIntegrity(record, rctx)
+		metrics.IntegrityChecks.With(prometheus.Labels{"result": result}).Inc()
+
+		if result == integrityUnreadable {
+			// Likely a problem reaching the datastore rather than with the file, so leave the media to
+			// be checked again on the next run instead of recording it as failed.
+			unreadable++
+			continue
+		}
+
+		err = metadataDb.UpsertIntegrityCheck(record.Sha256Hash, util.NowMillis(), result != integrityOk)
+		if err != nil {
+			rctx.Log.Error("Failed to record integrity check: ", err)
+			sentry.CaptureException(err)
+		}
+
+		if result == integrityOk {
+			continue
+		}
+		corrupted++
+
+		if result == integrityCorrupted && quarantineCorrupted {
+			err = quarantineHash(record.Sha256Hash, rctx)
+			if err != nil {
+				rctx.Log.Error("Failed to quarantine corrupted media: ", err)
+				sentry.CaptureException(err)
+			}
+		}
+	}
+
+	progress["checked"] = checked
+	progress["failed"] = corrupted
+	progress["unreadable"] = unreadable
+	ctx.Log.Info(fmt.Sprintf("Checked the integrity of %d files: %d failed, %d could not be read", checked, corrupted, unreadable))
+}
+
+func checkIntegrity(record *types.MinimalMediaMetadata, ctx rcontext.RequestContext) string {
+	ds, err := datastore.LocateDatastore(ctx, record.DatastoreId)
+	if err != nil {
+		ctx.Log.Warn("Datastore could not be found: ", err)
+		return integrityUnreadable
+	}
+
+	stream, err := ds.DownloadFile(record.Location)
+	if err != nil {
+		if !ds.ObjectExists(record.Location) {
+			ctx.Log.Warn("Media file is missing: ", err)
+			return integrityMissing
+		}
+		ctx.Log.Warn("Media file could not be opened: ", err)
+		return integrityUnreadable
+	}
+
+	hash, err := util.GetSha256HashOfStream(stream)
+	if err != nil {
+		// A failed download can't tell us whether the file itself is intact
+		ctx.Log.Warn("Media file could not be read: ", err)
+		return integrityUnreadable
+	}
+	if hash != record.Sha256Hash {
+		ctx.Log.Warn("Media file is corrupted: hash is now ", hash)
+		return integrityCorrupted
+	}
+	return integrityOk
+}
+
+func quarantineHash(sha256Hash string, ctx rcontext.RequestContext) error {
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+	media, err := mediaDb.GetByHash(sha256Hash)
+	if err != nil {
+		return err
+	}
+
+	// Like quarantining through the admin API, don't leave cached copies of the media around
+	internal_cache.Get().Reset()
+
+	for _, m := range media {
+		ctx.Log.Warn("Quarantining corrupted media ", m.Origin, "/", m.MediaId)
+		err = mediaDb.SetQuarantined(m.Origin, m.MediaId, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
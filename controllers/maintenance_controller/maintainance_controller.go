@@ -1,116 +1,227 @@
 package maintenance_controller
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"os"
 
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
+	"golang.org/x/time/rate"
 )
 
+// StorageMigrationOptions limits which media a storage migration moves, and how quickly.
+type StorageMigrationOptions struct {
+	// BeforeTs only includes media last accessed before this timestamp.
+	BeforeTs int64
+	// Origin only includes media from this origin when not empty.
+	Origin string
+	// UserId only includes media uploaded by this user when not empty.
+	UserId string
+	// MaxPerSecond caps how many objects are moved each second. Zero or less is unlimited.
+	MaxPerSecond float64
+}
+
+// StorageMigrationOptionsFromParams reads the options back out of a storage migration task's params.
+func StorageMigrationOptionsFromParams(params map[string]interface{}) StorageMigrationOptions {
+	opts := StorageMigrationOptions{}
+	if v, ok := params["before_ts"].(float64); ok {
+		opts.BeforeTs = int64(v)
+	}
+	if v, ok := params["origin"].(string); ok {
+		opts.Origin = v
+	}
+	if v, ok := params["user_id"].(string); ok {
+		opts.UserId = v
+	}
+	if v, ok := params["max_per_second"].(float64); ok {
+		opts.MaxPerSecond = v
+	}
+	return opts
+}
+
 // Returns an error only if starting up the background task failed.
-func StartStorageMigration(sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, beforeTs int64, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+func StartStorageMigration(sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, opts StorageMigrationOptions, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	task, err := createStorageMigrationTask("storage_migration", sourceDs, targetDs, opts, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go doStorageMigration(task, sourceDs, targetDs, opts, ctx)
+
+	return task, nil
+}
+
+// RunStorageTiering moves media which hasn't been accessed since beforeTs from the hot datastore to
+// the cold datastore, returning once the move is complete.
+func RunStorageTiering(hotDs *datastore.DatastoreRef, coldDs *datastore.DatastoreRef, beforeTs int64, ctx rcontext.RequestContext) error {
+	opts := StorageMigrationOptions{BeforeTs: beforeTs}
+	task, err := createStorageMigrationTask("storage_tiering", hotDs, coldDs, opts, ctx)
+	if err != nil {
+		return err
+	}
+
+	doStorageMigration(task, hotDs, coldDs, opts, ctx)
+	return nil
+}
+
+func createStorageMigrationTask(name string, sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, opts StorageMigrationOptions, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	if targetDs.IsReadOnly(ctx) {
+		return nil, common.ErrDatastoreReadOnly
+	}
+
 	db := storage.GetDatabase().GetMetadataStore(ctx)
-	task, err := db.CreateBackgroundTask("storage_migration", map[string]interface{}{
+	return db.CreateBackgroundTask(name, map[string]interface{}{
 		"source_datastore_id": sourceDs.DatastoreId,
 		"target_datastore_id": targetDs.DatastoreId,
-		"before_ts":           beforeTs,
+		"before_ts":           opts.BeforeTs,
+		"origin":              opts.Origin,
+		"user_id":             opts.UserId,
+		"max_per_second":      opts.MaxPerSecond,
 	})
+}
+
+func doStorageMigration(task *types.BackgroundTask, sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, opts StorageMigrationOptions, ctx rcontext.RequestContext) {
+	ctx.Log.Info("Starting transfer")
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+
+	media, err := db.GetOldMediaInDatastore(sourceDs.DatastoreId, opts.BeforeTs, opts.Origin, opts.UserId)
 	if err != nil {
-		return nil, err
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
 	}
 
-	go func() {
-		ctx.Log.Info("Starting transfer")
-
-		db := storage.GetDatabase().GetMetadataStore(ctx)
-
-		doUpdate := func(records []*types.MinimalMediaMetadata) {
-			for _, record := range records {
-				rctx := ctx.LogWithFields(logrus.Fields{"mediaSha256": record.Sha256Hash})
-
-				rctx.Log.Info("Starting transfer of media")
-				sourceStream, err := sourceDs.DownloadFile(record.Location)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to start download from source datastore")
-					sentry.CaptureException(err)
-					continue
-				}
-
-				newLocation, err := targetDs.UploadFile(sourceStream, record.SizeBytes, rctx)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to upload file to target datastore")
-					sentry.CaptureException(err)
-					continue
-				}
-
-				rctx.Log.Info("Updating media records...")
-				err = db.ChangeDatastoreOfHash(targetDs.DatastoreId, newLocation.Location, record.Sha256Hash)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to update database records")
-					sentry.CaptureException(err)
-					continue
-				}
-
-				rctx.Log.Info("Deleting media from old datastore")
-				err = sourceDs.DeleteObject(record.Location)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to delete old media")
-					sentry.CaptureException(err)
-					continue
-				}
-
-				rctx.Log.Info("Media updated!")
-			}
-		}
+	thumbs, err := db.GetOldThumbnailsInDatastore(sourceDs.DatastoreId, opts.BeforeTs, opts.Origin, opts.UserId)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
 
-		media, err := db.GetOldMediaInDatastore(sourceDs.DatastoreId, beforeTs)
-		if err != nil {
-			ctx.Log.Error(err)
-			sentry.CaptureException(err)
-			return
-		}
-		doUpdate(media)
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.MaxPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.MaxPerSecond), 1)
+	}
 
-		thumbs, err := db.GetOldThumbnailsInDatastore(sourceDs.DatastoreId, beforeTs)
+	progress := map[string]interface{}{
+		"total":  len(media) + len(thumbs),
+		"moved":  0,
+		"failed": 0,
+	}
+	moved := 0
+	failed := 0
+	reportProgress := func() {
+		progress["moved"] = moved
+		progress["failed"] = failed
+		err := db.SetBackgroundTaskProgress(task.ID, progress)
 		if err != nil {
-			ctx.Log.Error(err)
+			ctx.Log.Warn("Failed to update task progress: ", err)
 			sentry.CaptureException(err)
-			return
 		}
-		doUpdate(thumbs)
+	}
+	reportProgress()
 
-		err = db.FinishedBackgroundTask(task.ID)
-		if err != nil {
-			ctx.Log.Error(err)
-			ctx.Log.Error("Failed to flag task as finished")
-			sentry.CaptureException(err)
+	// Records sharing a hash are moved together, so we only need to handle each hash once
+	movedHashes := make(map[string]bool)
+
+	checkpoint := newTaskCheckpoint(task)
+	doUpdate := func(records []*types.MinimalMediaMetadata) {
+		for _, record := range records {
+			if checkpoint.Tick(ctx) {
+				reportProgress()
+			}
+			if checkpoint.Cancelled() {
+				return
+			}
+
+			if movedHashes[record.Sha256Hash] {
+				moved++
+				continue
+			}
+
+			err := limiter.Wait(context.Background())
+			if err != nil {
+				ctx.Log.Warn("Error waiting for rate limiter: ", err)
+			}
+
+			if moveObject(record, sourceDs, targetDs, ctx) {
+				movedHashes[record.Sha256Hash] = true
+				moved++
+			} else {
+				failed++
+			}
 		}
-		ctx.Log.Info("Finished transfer")
-	}()
+	}
 
-	return task, nil
+	doUpdate(media)
+	doUpdate(thumbs)
+
+	if checkpoint.Cancelled() {
+		ctx.Log.Info("Transfer was cancelled")
+		progress["cancelled"] = true
+	}
+	reportProgress()
+
+	err = db.FinishedBackgroundTask(task.ID)
+	if err != nil {
+		ctx.Log.Error(err)
+		ctx.Log.Error("Failed to flag task as finished")
+		sentry.CaptureException(err)
+	}
+	ctx.Log.Info(fmt.Sprintf("Finished transfer: %d moved, %d failed", moved, failed))
+}
+
+// isTaskCancelled returns true if an admin asked for the task to stop. If that can't be checked, the
+// task carries on.
+func isTaskCancelled(task *types.BackgroundTask, ctx rcontext.RequestContext) bool {
+	cancelled, err := storage.GetDatabase().GetMetadataStore(ctx).IsBackgroundTaskCancelled(task.ID)
+	if err != nil {
+		ctx.Log.Warn("Failed to check if the task was cancelled: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+	return cancelled
+}
+
+// moveObject transfers a record's object to the target datastore, leaving the source in place if
+// the copy can't be verified. Returns true if the object was moved.
+func moveObject(record *types.MinimalMediaMetadata, sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, ctx rcontext.RequestContext) bool {
+	rctx := ctx.LogWithFields(logrus.Fields{"mediaSha256": record.Sha256Hash})
+
+	rctx.Log.Info("Starting transfer of media")
+	err := datastore.TransferObject(record.Sha256Hash, record.Location, record.SizeBytes, sourceDs, targetDs, rctx)
+	if err != nil {
+		rctx.Log.Error("Failed to transfer media: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+
+	rctx.Log.Info("Media updated!")
+	return true
 }
 
 func EstimateDatastoreSizeWithAge(beforeTs int64, datastoreId string, ctx rcontext.RequestContext) (*types.DatastoreMigrationEstimate, error) {
+	return EstimateStorageMigration(datastoreId, StorageMigrationOptions{BeforeTs: beforeTs}, ctx)
+}
+
+func EstimateStorageMigration(datastoreId string, opts StorageMigrationOptions, ctx rcontext.RequestContext) (*types.DatastoreMigrationEstimate, error) {
 	estimates := &types.DatastoreMigrationEstimate{}
 	seenHashes := make(map[string]bool)
 	seenMediaHashes := make(map[string]bool)
 	seenThumbnailHashes := make(map[string]bool)
 
 	db := storage.GetDatabase().GetMetadataStore(ctx)
-	media, err := db.GetOldMediaInDatastore(datastoreId, beforeTs)
+	media, err := db.GetOldMediaInDatastore(datastoreId, opts.BeforeTs, opts.Origin, opts.UserId)
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +242,7 @@ func EstimateDatastoreSizeWithAge(beforeTs int64, datastoreId string, ctx rconte
 		seenMediaHashes[record.Sha256Hash] = true
 	}
 
-	thumbnails, err := db.GetOldThumbnailsInDatastore(datastoreId, beforeTs)
+	thumbnails, err := db.GetOldThumbnailsInDatastore(datastoreId, opts.BeforeTs, opts.Origin, opts.UserId)
 	if err != nil {
 		return nil, err
 	}
@@ -155,13 +266,47 @@ func EstimateDatastoreSizeWithAge(beforeTs int64, datastoreId string, ctx rconte
 	return estimates, nil
 }
 
-func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, error) {
+// ReclaimedBytes tallies the bytes freed by a purge, by datastore ID. Files which were already missing
+// or are still used by other records don't count.
+type ReclaimedBytes struct {
+	ByDatastore map[string]int64
+	deleted     map[string]bool
+}
+
+func newReclaimedBytes() *ReclaimedBytes {
+	return &ReclaimedBytes{
+		ByDatastore: make(map[string]int64),
+		deleted:     make(map[string]bool),
+	}
+}
+
+func (r *ReclaimedBytes) add(datastoreId string, location string, sizeBytes int64) {
+	// Some datastores don't complain about deleting a file twice
+	key := datastoreId + "/" + location
+	if r.deleted[key] {
+		return
+	}
+	r.deleted[key] = true
+	r.ByDatastore[datastoreId] += sizeBytes
+}
+
+func (r *ReclaimedBytes) Total() int64 {
+	total := int64(0)
+	for _, b := range r.ByDatastore {
+		total += b
+	}
+	return total
+}
+
+// PurgeRemoteMediaBefore deletes the files of remote media downloaded before beforeTs, returning the media
+// whose files were deleted. The task is nil unless the purge is running as a background task.
+func PurgeRemoteMediaBefore(beforeTs int64, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
 	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
 
 	origins, err := db.GetOrigins()
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	var excludedOrigins []string
@@ -173,18 +318,35 @@ func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, e
 
 	oldMedia, err := db.GetOldMedia(excludedOrigins, beforeTs)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
 
 	ctx.Log.Info(fmt.Sprintf("Starting removal of %d remote media files (db records will be kept)", len(oldMedia)))
 
-	removed := 0
+	removed := make([]*types.Media, 0)
+	reclaimed := newReclaimedBytes()
+	checkpoint := newTaskCheckpoint(task)
 	for _, media := range oldMedia {
+		if checkpoint.Stopped(ctx) {
+			ctx.Log.Info("Purge was cancelled")
+			break
+		}
 		if media.Quarantined {
 			ctx.Log.Warn("Not removing quarantined media to maintain quarantined status: " + media.Origin + "/" + media.MediaId)
 			continue
 		}
 
+		protected, err := isProtected(media, ctx)
+		if err != nil {
+			ctx.Log.Warn("Cannot check if media " + media.Origin + "/" + media.MediaId + " is protected because: " + err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+		if protected {
+			ctx.Log.Info("Not removing protected media: " + media.Origin + "/" + media.MediaId)
+			continue
+		}
+
 		ds, err := datastore.LocateDatastore(ctx, media.DatastoreId)
 		if err != nil {
 			ctx.Log.Error("Error finding datastore for media " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
@@ -192,13 +354,21 @@ func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, e
 			continue
 		}
 
-		// Delete the file first
-		err = ds.DeleteObject(media.Location)
+		// Delete the file first, unless other records still need it
+		shared, err := isObjectShared(media.DatastoreId, media.Location, 1, ctx)
 		if err != nil {
+			ctx.Log.Warn("Cannot check references to media " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+		if shared {
+			ctx.Log.Info("Not removing shared media file: " + media.Origin + "/" + media.MediaId)
+		} else if err = ds.DeleteObject(media.Location); err != nil {
 			ctx.Log.Warn("Cannot remove media " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
 			sentry.CaptureException(err)
 		} else {
-			removed++
+			removed = append(removed, media)
+			reclaimed.add(media.DatastoreId, media.Location, media.StoredSizeBytes)
 			ctx.Log.Info("Removed remote media file: " + media.Origin + "/" + media.MediaId)
 		}
 
@@ -216,7 +386,18 @@ func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, e
 			sentry.CaptureException(err)
 			continue
 		}
+		err = thumbsDb.DeleteAllForMedia(media.Origin, media.MediaId)
+		if err != nil {
+			ctx.Log.Warn("Error removing thumbnails for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
 		for _, thumb := range thumbs {
+			shared, err := isObjectShared(thumb.DatastoreId, thumb.Location, 0, ctx)
+			if err != nil || shared {
+				continue
+			}
+
 			ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
 			ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
 			if err != nil {
@@ -226,88 +407,73 @@ func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, e
 			}
 
 			err = ds.DeleteObject(thumb.Location)
-			if err != nil {
+			if err != nil && !os.IsNotExist(err) {
 				ctx.Log.Warn("Error removing thumbnail for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
 				sentry.CaptureException(err)
 				continue
 			}
-		}
-		err = thumbsDb.DeleteAllForMedia(media.Origin, media.MediaId)
-		if err != nil {
-			ctx.Log.Warn("Error removing thumbnails for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
-			sentry.CaptureException(err)
+			reclaimed.add(thumb.DatastoreId, thumb.Location, thumb.SizeBytes)
 		}
 	}
 
-	return removed, nil
+	return removed, reclaimed, nil
 }
 
-func PurgeQuarantined(ctx rcontext.RequestContext) ([]*types.Media, error) {
+func PurgeQuarantined(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 	records, err := mediaDb.GetAllQuarantinedMedia()
 	if err != nil {
-		return nil, err
-	}
-
-	for _, r := range records {
-		err = doPurge(r, ctx)
-		if err != nil {
-			return nil, err
-		}
+		return nil, nil, err
 	}
 
-	return records, nil
+	return purgeAll(records, reclaimed, task, ctx)
 }
 
-func PurgeQuarantinedFor(serverName string, ctx rcontext.RequestContext) ([]*types.Media, error) {
+func PurgeQuarantinedFor(serverName string, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 	records, err := mediaDb.GetQuarantinedMediaFor(serverName)
 	if err != nil {
-		return nil, err
-	}
-
-	for _, r := range records {
-		err = doPurge(r, ctx)
-		if err != nil {
-			return nil, err
-		}
+		return nil, nil, err
 	}
 
-	return records, nil
+	return purgeAll(records, reclaimed, task, ctx)
 }
 
-func PurgeUserMedia(userId string, beforeTs int64, ctx rcontext.RequestContext) ([]*types.Media, error) {
+func PurgeUserMedia(userId string, beforeTs int64, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 	records, err := mediaDb.GetMediaByUserBefore(userId, beforeTs)
 	if err != nil {
-		return nil, err
-	}
-
-	for _, r := range records {
-		err = doPurge(r, ctx)
-		if err != nil {
-			return nil, err
-		}
+		return nil, nil, err
 	}
 
-	return records, nil
+	return purgeUnprotected(records, reclaimed, task, ctx)
 }
 
-func PurgeOldMedia(beforeTs int64, includeLocal bool, ctx rcontext.RequestContext) ([]*types.Media, error) {
+func PurgeOldMedia(beforeTs int64, includeLocal bool, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
 	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 
 	oldHashes, err := metadataDb.GetOldMedia(beforeTs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	purged := make([]*types.Media, 0)
+	checkpoint := newTaskCheckpoint(task)
 
 	for _, r := range oldHashes {
+		if checkpoint.Stopped(ctx) {
+			ctx.Log.Info("Purge was cancelled")
+			break
+		}
+
 		media, err := mediaDb.GetByHash(r.Sha256Hash)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for _, m := range media {
@@ -315,28 +481,44 @@ func PurgeOldMedia(beforeTs int64, includeLocal bool, ctx rcontext.RequestContex
 				continue
 			}
 
-			err = doPurge(m, ctx)
+			protected, err := isProtected(m, ctx)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
+			}
+			if protected {
+				ctx.Log.Info("Not purging protected media: " + m.Origin + "/" + m.MediaId)
+				continue
+			}
+
+			err = doPurge(m, reclaimed, ctx)
+			if err != nil {
+				return nil, nil, err
 			}
 
 			purged = append(purged, m)
 		}
 	}
 
-	return purged, nil
+	return purged, reclaimed, nil
 }
 
-func PurgeRoomMedia(mxcs []string, beforeTs int64, ctx rcontext.RequestContext) ([]*types.Media, error) {
+func PurgeRoomMedia(mxcs []string, beforeTs int64, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 
 	purged := make([]*types.Media, 0)
+	checkpoint := newTaskCheckpoint(task)
 
 	// we have to manually find each record because the SQL query is too complex
 	for _, mxc := range mxcs {
+		if checkpoint.Stopped(ctx) {
+			ctx.Log.Info("Purge was cancelled")
+			break
+		}
+
 		domain, mediaId, err := util.SplitMxc(mxc)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		record, err := mediaDb.Get(domain, mediaId)
@@ -344,70 +526,186 @@ func PurgeRoomMedia(mxcs []string, beforeTs int64, ctx rcontext.RequestContext)
 			continue
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if record.CreationTs > beforeTs {
 			continue
 		}
 
-		err = doPurge(record, ctx)
+		protected, err := isProtected(record, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if protected {
+			ctx.Log.Info("Not purging protected media: " + mxc)
+			continue
+		}
+
+		err = doPurge(record, reclaimed, ctx)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		purged = append(purged, record)
 	}
 
-	return purged, nil
+	return purged, reclaimed, nil
 }
 
-func PurgeDomainMedia(serverName string, beforeTs int64, ctx rcontext.RequestContext) ([]*types.Media, error) {
+func PurgeDomainMedia(serverName string, beforeTs int64, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 	records, err := mediaDb.GetMediaByDomainBefore(serverName, beforeTs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	return purgeUnprotected(records, reclaimed, task, ctx)
+}
+
+// PurgeExpiredMedia purges media which was uploaded (or marked by an admin) to expire, once it has.
+// Protected media is purged as well, as the expiry was asked for specifically. Media which can't be
+// purged is left to be tried again next time.
+func PurgeExpiredMedia(ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	reclaimed := newReclaimedBytes()
+	attrsDb := storage.GetDatabase().GetMediaAttributesStore(ctx)
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+
+	expired, err := attrsDb.GetExpired(util.NowMillis())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	purged := make([]*types.Media, 0)
+	for _, attrs := range expired {
+		media, err := mediaDb.Get(attrs.Origin, attrs.MediaId)
+		if err != nil && err != sql.ErrNoRows {
+			ctx.Log.Warn("Error getting expired media " + attrs.Origin + "/" + attrs.MediaId + ": " + err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+
+		if err == nil {
+			err = doPurge(media, reclaimed, ctx)
+			if err != nil {
+				ctx.Log.Warn("Error purging expired media " + attrs.Origin + "/" + attrs.MediaId + ": " + err.Error())
+				sentry.CaptureException(err)
+				continue
+			}
+			purged = append(purged, media)
+		}
+
+		// The media is gone either way, so it shouldn't be picked up again
+		err = attrsDb.UpsertExpiry(attrs.Origin, attrs.MediaId, 0)
+		if err != nil {
+			ctx.Log.Warn("Error clearing expiry of " + attrs.Origin + "/" + attrs.MediaId + ": " + err.Error())
+			sentry.CaptureException(err)
+		}
+	}
+
+	return purged, reclaimed, nil
+}
+
+// isProtected returns whether the media's attributes exempt it from bulk purges. Purging a single
+// record, or purging quarantined media, ignores the protection.
+func isProtected(media *types.Media, ctx rcontext.RequestContext) (bool, error) {
+	return storage.GetDatabase().GetMediaAttributesStore(ctx).IsProtected(media.Origin, media.MediaId)
+}
+
+func purgeUnprotected(records []*types.Media, reclaimed *ReclaimedBytes, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	purged := make([]*types.Media, 0)
+	checkpoint := newTaskCheckpoint(task)
 	for _, r := range records {
-		err = doPurge(r, ctx)
+		if checkpoint.Stopped(ctx) {
+			ctx.Log.Info("Purge was cancelled")
+			break
+		}
+
+		protected, err := isProtected(r, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if protected {
+			ctx.Log.Info("Not purging protected media: " + r.Origin + "/" + r.MediaId)
+			continue
+		}
+
+		err = doPurge(r, reclaimed, ctx)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		purged = append(purged, r)
 	}
 
-	return records, nil
+	return purged, reclaimed, nil
 }
 
-func PurgeMedia(origin string, mediaId string, ctx rcontext.RequestContext) error {
-	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
-	if err != nil {
-		return err
+// purgeAll purges every record, protected or not.
+func purgeAll(records []*types.Media, reclaimed *ReclaimedBytes, task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error) {
+	purged := make([]*types.Media, 0)
+	checkpoint := newTaskCheckpoint(task)
+	for _, r := range records {
+		if checkpoint.Stopped(ctx) {
+			ctx.Log.Info("Purge was cancelled")
+			break
+		}
+
+		err := doPurge(r, reclaimed, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		purged = append(purged, r)
 	}
 
-	return doPurge(media, ctx)
+	return purged, reclaimed, nil
 }
 
-func doPurge(media *types.Media, ctx rcontext.RequestContext) error {
-	// Delete all the thumbnails first
-	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
-	thumbs, err := thumbsDb.GetAllForMedia(media.Origin, media.MediaId)
+func PurgeMedia(origin string, mediaId string, ctx rcontext.RequestContext) (*ReclaimedBytes, error) {
+	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, thumb := range thumbs {
-		ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
-		ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
+
+	reclaimed := newReclaimedBytes()
+	err = doPurge(media, reclaimed, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reclaimed, nil
+}
+
+// PurgeMediaList purges each of the given media, carrying on past any which fail. This isn't one
+// transaction: the files are gone as soon as each media is purged, so a later failure can't undo the
+// earlier purges. The returned map holds the error for every mxc URI which couldn't be purged.
+func PurgeMediaList(mxcs []string, ctx rcontext.RequestContext) (map[string]error, *ReclaimedBytes) {
+	failed := make(map[string]error)
+	reclaimed := newReclaimedBytes()
+	for _, mxc := range mxcs {
+		origin, mediaId, err := util.SplitMxc(mxc)
 		if err != nil {
-			return err
+			failed[mxc] = err
+			continue
 		}
 
-		err = ds.DeleteObject(thumb.Location)
+		media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
 		if err != nil {
-			return err
+			failed[mxc] = err
+			continue
+		}
+
+		err = doPurge(media, reclaimed, ctx)
+		if err != nil {
+			ctx.Log.Warn("Error purging " + mxc + ": " + err.Error())
+			failed[mxc] = err
 		}
 	}
-	err = thumbsDb.DeleteAllForMedia(media.Origin, media.MediaId)
+	return failed, reclaimed
+}
+
+func doPurge(media *types.Media, reclaimed *ReclaimedBytes, ctx rcontext.RequestContext) error {
+	// Delete all the thumbnails first
+	err := purgeThumbnails(media.Origin, media.MediaId, reclaimed, ctx)
 	if err != nil {
 		return err
 	}
@@ -418,25 +716,21 @@ func doPurge(media *types.Media, ctx rcontext.RequestContext) error {
 	}
 
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
-	similarMedia, err := mediaDb.GetByHash(media.Sha256Hash)
+	shared, err := isObjectShared(media.DatastoreId, media.Location, 1, ctx)
 	if err != nil {
 		return err
 	}
-	hasSimilar := false
-	for _, m := range similarMedia {
-		if m.Origin != media.Origin && m.MediaId != media.MediaId {
-			hasSimilar = true
-			break
-		}
-	}
 
-	if !hasSimilar || media.Quarantined {
+	if !shared || media.Quarantined {
 		err = ds.DeleteObject(media.Location)
 		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
+		if err == nil {
+			reclaimed.add(media.DatastoreId, media.Location, media.StoredSizeBytes)
+		}
 	} else {
-		ctx.Log.Warnf("Not deleting media from datastore: media is shared over %d objects", len(similarMedia))
+		ctx.Log.Warn("Not deleting media from datastore: object is shared with other media or thumbnails")
 	}
 
 	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
@@ -466,3 +760,60 @@ func doPurge(media *types.Media, ctx rcontext.RequestContext) error {
 
 	return nil
 }
+
+// purgeThumbnails deletes every thumbnail of the media, along with their files unless something else
+// still uses them.
+func purgeThumbnails(origin string, mediaId string, reclaimed *ReclaimedBytes, ctx rcontext.RequestContext) error {
+	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
+	thumbs, err := thumbsDb.GetAllForMedia(origin, mediaId)
+	if err != nil {
+		return err
+	}
+	err = thumbsDb.DeleteAllForMedia(origin, mediaId)
+	if err != nil {
+		return err
+	}
+	deletedThumbs := make(map[string]bool)
+	for _, thumb := range thumbs {
+		key := thumb.DatastoreId + "/" + thumb.Location
+		if deletedThumbs[key] {
+			continue
+		}
+		deletedThumbs[key] = true
+
+		// The thumbnail records are already gone, so any remaining reference belongs to someone else
+		shared, err := isObjectShared(thumb.DatastoreId, thumb.Location, 0, ctx)
+		if err != nil {
+			return err
+		}
+		if shared {
+			ctx.Log.Info("Not deleting thumbnail with hash ", thumb.Sha256Hash, ": object is still referenced")
+			continue
+		}
+
+		ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
+		ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
+		if err != nil {
+			return err
+		}
+
+		err = ds.DeleteObject(thumb.Location)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			reclaimed.add(thumb.DatastoreId, thumb.Location, thumb.SizeBytes)
+		}
+	}
+
+	return nil
+}
+
+// isObjectShared returns true if more than ownRefs media or thumbnail records point at the object.
+func isObjectShared(datastoreId string, location string, ownRefs int64, ctx rcontext.RequestContext) (bool, error) {
+	refs, err := storage.GetDatabase().GetMetadataStore(ctx).CountReferencesToObject(datastoreId, location)
+	if err != nil {
+		return false, err
+	}
+	return refs > ownRefs, nil
+}
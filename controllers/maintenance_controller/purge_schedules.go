@@ -0,0 +1,164 @@
+package maintenance_controller
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const (
+	PurgeScheduleRemote      = "remote"
+	PurgeScheduleOld         = "old"
+	PurgeScheduleUser        = "user"
+	PurgeScheduleServer      = "server"
+	PurgeScheduleQuarantined = "quarantined"
+)
+
+const day = 24 * time.Hour
+
+// ValidatePurgeSchedule checks that a schedule can be run, returning a description of the
+// problem if it can't.
+func ValidatePurgeSchedule(schedule *types.PurgeSchedule) error {
+	switch schedule.Kind {
+	case PurgeScheduleRemote, PurgeScheduleOld:
+		if schedule.Target != "" {
+			return fmt.Errorf("%s schedules don't have a target", schedule.Kind)
+		}
+	case PurgeScheduleUser, PurgeScheduleServer:
+		if schedule.Target == "" {
+			return fmt.Errorf("%s schedules need a target", schedule.Kind)
+		}
+	case PurgeScheduleQuarantined:
+		// The target is optional: it limits the purge to one server's media
+	default:
+		return errors.New("kind must be one of remote, old, user, server, or quarantined")
+	}
+
+	if schedule.IncludeLocal && schedule.Kind != PurgeScheduleOld {
+		return errors.New("include_local only applies to old schedules")
+	}
+	if schedule.Kind == PurgeScheduleQuarantined {
+		if schedule.OlderThanDays < 0 {
+			return errors.New("older_than_days must not be negative")
+		}
+	} else if schedule.OlderThanDays <= 0 {
+		// Zero would purge everything up to the moment the schedule runs
+		return errors.New("older_than_days must be a positive integer")
+	}
+	if schedule.IntervalDays <= 0 {
+		return errors.New("interval_days must be a positive integer")
+	}
+	if _, err := time.Parse("15:04", schedule.TimeOfDay); err != nil {
+		return errors.New("time_of_day must be a UTC time like 03:00")
+	}
+
+	return nil
+}
+
+// FirstPurgeScheduleRun returns when the schedule's time of day next comes around after the given
+// time.
+func FirstPurgeScheduleRun(schedule *types.PurgeSchedule, afterTs int64) (int64, error) {
+	tod, err := time.Parse("15:04", schedule.TimeOfDay)
+	if err != nil {
+		return 0, err
+	}
+
+	after := util.FromMillis(afterTs).UTC()
+	next := time.Date(after.Year(), after.Month(), after.Day(), tod.Hour(), tod.Minute(), 0, 0, time.UTC)
+	if !next.After(after) {
+		next = next.Add(day)
+	}
+	return util.TimeToMillis(next), nil
+}
+
+// RunPurgeSchedule does a single run of the schedule, returning how much media was purged.
+func RunPurgeSchedule(schedule *types.PurgeSchedule, ctx rcontext.RequestContext) (int, *ReclaimedBytes, error) {
+	beforeTs := util.NowMillis() - int64(schedule.OlderThanDays)*day.Milliseconds()
+
+	var purged []*types.Media
+	var reclaimed *ReclaimedBytes
+	var err error
+	switch schedule.Kind {
+	case PurgeScheduleRemote:
+		purged, reclaimed, err = PurgeRemoteMediaBefore(beforeTs, nil, ctx)
+	case PurgeScheduleOld:
+		purged, reclaimed, err = PurgeOldMedia(beforeTs, schedule.IncludeLocal, nil, ctx)
+	case PurgeScheduleUser:
+		purged, reclaimed, err = PurgeUserMedia(schedule.Target, beforeTs, nil, ctx)
+	case PurgeScheduleServer:
+		purged, reclaimed, err = PurgeDomainMedia(schedule.Target, beforeTs, nil, ctx)
+	case PurgeScheduleQuarantined:
+		if schedule.Target != "" {
+			purged, reclaimed, err = PurgeQuarantinedFor(schedule.Target, nil, ctx)
+		} else {
+			purged, reclaimed, err = PurgeQuarantined(nil, ctx)
+		}
+	default:
+		err = errors.New("unknown purge schedule kind: " + schedule.Kind)
+	}
+	return len(purged), reclaimed, err
+}
+
+// RunDuePurgeSchedules runs every schedule which is due, recording the outcome of each run.
+func RunDuePurgeSchedules(ctx rcontext.RequestContext) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+
+	schedules, err := db.GetDuePurgeSchedules(util.NowMillis())
+	if err != nil {
+		ctx.Log.Error("Error getting due purge schedules: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		sctx := ctx.LogWithFields(logrus.Fields{"scheduleId": schedule.ID, "kind": schedule.Kind})
+
+		// Missed runs (eg: while the media repo was down) are skipped rather than caught up on
+		nextTs, err := FirstPurgeScheduleRun(schedule, util.NowMillis())
+		if err != nil {
+			sctx.Log.Error("Error working out the next run: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		nextTs += int64(schedule.IntervalDays-1) * day.Milliseconds()
+
+		// Move the next run first so that other processes sharing the database don't also run it
+		claimed, err := db.ClaimPurgeScheduleRun(schedule.ID, schedule.NextRunTs, nextTs)
+		if err != nil {
+			sctx.Log.Error("Error claiming purge schedule: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		sctx.Log.Info("Running purge schedule")
+		run := &types.PurgeScheduleRun{ScheduleID: schedule.ID, StartTs: util.NowMillis()}
+		purged, reclaimed, err := RunPurgeSchedule(schedule, sctx)
+		run.EndTs = util.NowMillis()
+		run.Purged = purged
+		if reclaimed != nil {
+			run.BytesReclaimed = reclaimed.Total()
+		}
+		if err != nil {
+			sctx.Log.Error("Error running purge schedule: ", err)
+			sentry.CaptureException(err)
+			run.Error = err.Error()
+		}
+		sctx.Log.Infof("Purge schedule finished: %d media purged", purged)
+
+		err = db.InsertPurgeScheduleRun(run)
+		if err != nil {
+			sctx.Log.Error("Error recording purge schedule run: ", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
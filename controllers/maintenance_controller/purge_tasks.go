@@ -0,0 +1,78 @@
+package maintenance_controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// PurgeFunc does a purge as part of the given background task, stopping early if the task is cancelled.
+type PurgeFunc func(task *types.BackgroundTask, ctx rcontext.RequestContext) ([]*types.Media, *ReclaimedBytes, error)
+
+// StartPurge runs the purge as a background task with the given name and params. Once the purge is
+// done, the task's progress holds what was purged (or the error), and onFinished is called with the
+// purged media. Returns an error only if starting up the background task failed.
+func StartPurge(name string, params map[string]interface{}, purge PurgeFunc, onFinished func(purged []*types.Media, ctx rcontext.RequestContext), ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	task, err := db.CreateBackgroundTask(name, params)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		// The request will be finished long before the purge is
+		ctx.Context = context.Background()
+		doPurgeTask(task, purge, onFinished, ctx)
+	}()
+
+	return task, nil
+}
+
+func doPurgeTask(task *types.BackgroundTask, purge PurgeFunc, onFinished func(purged []*types.Media, ctx rcontext.RequestContext), ctx rcontext.RequestContext) {
+	ctx = ctx.LogWithFields(logrus.Fields{"taskId": task.ID, "taskName": task.Name})
+	ctx.Log.Info("Starting purge")
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	progress := make(map[string]interface{})
+	purged, reclaimed, err := purge(task, ctx)
+	if err != nil {
+		ctx.Log.Error("Error purging media: ", err)
+		sentry.CaptureException(err)
+		progress["error"] = err.Error()
+	} else {
+		mxcs := make([]string, 0)
+		for i, m := range purged {
+			if i >= maxReportedObjects {
+				break
+			}
+			mxcs = append(mxcs, m.MxcUri())
+		}
+		progress["total_purged"] = len(purged)
+		progress["affected"] = mxcs
+		progress["bytes_reclaimed"] = reclaimed.Total()
+		progress["bytes_reclaimed_by_datastore"] = reclaimed.ByDatastore
+		if isTaskCancelled(task, ctx) {
+			progress["cancelled"] = true
+		}
+		ctx.Log.Info(fmt.Sprintf("Purged %d media (%d bytes)", len(purged), reclaimed.Total()))
+
+		onFinished(purged, ctx)
+	}
+
+	err = db.SetBackgroundTaskProgress(task.ID, progress)
+	if err != nil {
+		ctx.Log.Error("Failed to record purge results: ", err)
+		sentry.CaptureException(err)
+	}
+	err = db.FinishedBackgroundTask(task.ID)
+	if err != nil {
+		ctx.Log.Error(err)
+		ctx.Log.Error("Failed to flag task as finished")
+		sentry.CaptureException(err)
+	}
+}
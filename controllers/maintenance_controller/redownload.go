@@ -0,0 +1,62 @@
+package maintenance_controller
+
+import (
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// RedownloadRemoteMedia throws away our copy of the remote media and its thumbnails, then downloads
+// it from the origin again. If the download fails, the old copy stays deleted so the media is
+// downloaded again the next time it is requested. The purged copy is returned along with the new
+// one, which is nil if the download failed.
+func RedownloadRemoteMedia(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, *types.Media, *ReclaimedBytes, error) {
+	if util.IsServerOurs(origin) {
+		return nil, nil, nil, common.ErrMediaNotRemote
+	}
+
+	old, err := storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Downloading quarantined media again would lift the quarantine
+	if old.Quarantined {
+		return nil, nil, nil, common.ErrMediaQuarantined
+	}
+
+	thumbs, err := storage.GetDatabase().GetThumbnailStore(ctx).GetAllForMedia(origin, mediaId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hashes := []string{old.Sha256Hash}
+	for _, t := range thumbs {
+		hashes = append(hashes, t.Sha256Hash)
+	}
+	for _, hash := range hashes {
+		err = internal_cache.Get().Evict(hash, ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	reclaimed := newReclaimedBytes()
+	err = doPurge(old, reclaimed, ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	download_controller.ForgetMediaRecord(origin, mediaId)
+
+	ctx.Log.Info("Downloading remote media again")
+	media, err := download_controller.FindMediaRecord(origin, mediaId, true, ctx)
+	if err != nil {
+		ctx.Log.Warn("Failed to download remote media again, it will be retried on the next request: ", err)
+		return old, nil, reclaimed, err
+	}
+
+	return old, media, reclaimed, nil
+}
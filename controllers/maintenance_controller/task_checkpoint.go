@@ -0,0 +1,61 @@
+package maintenance_controller
+
+import (
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// Background tasks save their progress and check whether they were cancelled every so many records,
+// or every few seconds, whichever comes first. Doing it for every record costs a database round trip
+// or two each time.
+const taskCheckpointRecords = 100
+const taskCheckpointInterval = 5 * time.Second
+
+// taskCheckpoint tracks when a background task next saves its progress and checks whether it was
+// cancelled. A nil checkpoint is work which isn't running as a task, so is never cancelled.
+type taskCheckpoint struct {
+	task      *types.BackgroundTask
+	records   int
+	lastTs    time.Time
+	cancelled bool
+}
+
+func newTaskCheckpoint(task *types.BackgroundTask) *taskCheckpoint {
+	if task == nil {
+		return nil
+	}
+	return &taskCheckpoint{task: task, lastTs: time.Now()}
+}
+
+// Tick counts a record, returning true at each checkpoint so the caller can save its progress. Whether
+// the task was cancelled is checked at the checkpoint too.
+func (c *taskCheckpoint) Tick(ctx rcontext.RequestContext) bool {
+	if c == nil {
+		return false
+	}
+	c.records++
+	if c.records < taskCheckpointRecords && time.Since(c.lastTs) < taskCheckpointInterval {
+		return false
+	}
+
+	c.records = 0
+	c.lastTs = time.Now()
+	if !c.cancelled {
+		c.cancelled = isTaskCancelled(c.task, ctx)
+	}
+	return true
+}
+
+// Stopped counts a record like Tick, returning true if the task was cancelled. For work which has no
+// progress to save along the way.
+func (c *taskCheckpoint) Stopped(ctx rcontext.RequestContext) bool {
+	c.Tick(ctx)
+	return c.Cancelled()
+}
+
+// Cancelled returns true if an admin had asked for the task to stop as of the last checkpoint.
+func (c *taskCheckpoint) Cancelled() bool {
+	return c != nil && c.cancelled
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
@@ -19,8 +22,17 @@ func GetSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 		realHost = addr
 	}
 
+	// Zone identifiers refer to the local machine's interfaces, which is never something we want
+	// to be connecting to.
+	if strings.Contains(realHost, "%") {
+		ctx.Log.Warn("Address contains a zone identifier - rejecting")
+		return nil, "", common.ErrInvalidHost
+	}
+
 	ipAddr := net.IPv4(127, 0, 0, 1)
-	if realHost != "localhost" {
+	if literalIp := parseIpLiteral(realHost); literalIp != nil {
+		ipAddr = literalIp
+	} else if realHost != "localhost" {
 		addrs, err := net.LookupIP(realHost)
 		if err != nil {
 			ctx.Log.Warn("Error looking up DNS record for preview - assuming invalid host:", err)
@@ -45,12 +57,142 @@ func GetSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 	deniedCidrs = append(deniedCidrs, "0.0.0.0/32")
 	deniedCidrs = append(deniedCidrs, "::/128")
 
+	// Check IPv4 addresses in their 4 byte form so IPv4-mapped IPv6 addresses match the IPv4 ranges
+	if ip4 := ipAddr.To4(); ip4 != nil {
+		ipAddr = ip4
+	}
+
+	if isException(realHost, ipAddr, ctx) {
+		if inRange(ipAddr, []string{"0.0.0.0/32", "::/128"}, ctx) {
+			return nil, "", common.ErrHostBlacklisted
+		}
+		ctx.Log.Info("Host allowed due to exception")
+		return ipAddr, p, nil
+	}
+
 	if !isAllowed(ipAddr, allowedCidrs, deniedCidrs, ctx) {
 		return nil, "", common.ErrHostBlacklisted
 	}
+
+	// Addresses which embed an IPv4 address (NAT64 and 6to4) must also be allowed to reach
+	// that address, otherwise they could be used to get around the IPv4 ranges.
+	if embedded := getEmbeddedIPv4(ipAddr); embedded != nil {
+		ctx.Log.Info("Checking IPv4 address embedded in IPv6 address: ", embedded)
+		if !isAllowed(embedded, allowedCidrs, deniedCidrs, ctx) {
+			return nil, "", common.ErrHostBlacklisted
+		}
+	}
+
 	return ipAddr, p, nil
 }
 
+// parseIpLiteral returns the IP address the host refers to if it is an IP literal, including
+// the numeric IPv4 forms accepted by inet_aton (eg: "2130706433", "0x7f.1", or "0177.0.0.1").
+// Returns nil if the host is not an IP literal.
+func parseIpLiteral(host string) net.IP {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		base := 10
+		if strings.HasPrefix(part, "0x") || strings.HasPrefix(part, "0X") {
+			base = 16
+			part = part[2:]
+		} else if len(part) > 1 && strings.HasPrefix(part, "0") {
+			base = 8
+			part = part[1:]
+		}
+		if part == "" {
+			return nil
+		}
+		val, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return nil
+		}
+		values[i] = val
+	}
+
+	// All but the last part are a single byte. The last part fills the remaining bytes.
+	var ip uint64
+	for i, val := range values {
+		if i < len(values)-1 {
+			if val > 0xFF {
+				return nil
+			}
+			ip |= val << (8 * uint(3-i))
+		} else {
+			if val >= 1<<(8*uint(4-i)) {
+				return nil
+			}
+			ip |= val
+		}
+	}
+
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
+}
+
+func getEmbeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+
+	// NAT64 (64:ff9b::/96) has the IPv4 address in the last 4 bytes
+	_, nat64, _ := net.ParseCIDR("64:ff9b::/96")
+	if nat64.Contains(ip) {
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	}
+
+	// 6to4 (2002::/16) has the IPv4 address in the 4 bytes after the prefix
+	_, sixToFour, _ := net.ParseCIDR("2002::/16")
+	if sixToFour.Contains(ip) {
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()
+	}
+
+	return nil
+}
+
+func isException(host string, ip net.IP, ctx rcontext.RequestContext) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, exception := range ctx.Config.UrlPreviews.AllowExceptions {
+		if _, network, err := net.ParseCIDR(exception); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if strings.ToLower(exception) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateUrlForPreview ensures the given URL is something the preview fetcher is permitted
+// to request. This is called for the initial URL and again for every redirect hop so that an
+// allowed URL can't be used to redirect the fetcher into a disallowed network.
+func ValidateUrlForPreview(u *url.URL, ctx rcontext.RequestContext) error {
+	port := u.Port()
+	if u.Scheme == "http" {
+		if port == "" {
+			port = "80"
+		}
+	} else if u.Scheme == "https" {
+		if port == "" {
+			port = "443"
+		}
+	} else {
+		return common.ErrInvalidHost
+	}
+
+	_, _, err := GetSafeAddress(net.JoinHostPort(u.Hostname(), port), ctx)
+	return err
+}
+
 func isAllowed(ip net.IP, allowed []string, disallowed []string, ctx rcontext.RequestContext) bool {
 	ctx = ctx.LogWithFields(logrus.Fields{
 		"checkHost":       ip,
@@ -4,20 +4,44 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/getsentry/sentry-go"
 	"net/url"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/globals"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/preview_types"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/stores"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// Stale previews being refreshed in the background, so each is only refreshed once at a time
+var refreshing = make(map[string]bool)
+var refreshingLock = &sync.Mutex{}
+
 func GetPreview(urlStr string, onHost string, forUserId string, atTs int64, languageHeader string, ctx rcontext.RequestContext) (*types.UrlPreview, error) {
+	// Requests for previews older than the maximum cache age are treated as requests for
+	// a fresh preview so we don't serve (or go looking for) ancient data.
+	maxAgeMs := int64(config.Get().UrlPreviews.MaxCacheAgeMinutes) * 60 * 1000
+	if maxAgeMs > 0 && (util.NowMillis()-atTs) > maxAgeMs {
+		atTs = util.NowMillis()
+	}
+
+	if ratelimit.IsUserRateLimited(ctx, forUserId, ratelimit.ActionPreview) {
+		ctx.Log.Warn("User has exceeded the URL preview rate limit")
+		return nil, common.ErrRateLimitExceeded
+	}
+
+	return getPreview(urlStr, onHost, forUserId, atTs, languageHeader, ctx)
+}
+
+func getPreview(urlStr string, onHost string, forUserId string, atTs int64, languageHeader string, ctx rcontext.RequestContext) (*types.UrlPreview, error) {
 	atTs = stores.GetBucketTs(atTs)
 	cacheKey := fmt.Sprintf("%d_%s/%s", atTs, onHost, urlStr)
 	v, _, err := globals.DefaultRequestGroup.DoWithoutPost(cacheKey, func() (interface{}, error) {
@@ -34,6 +58,15 @@ func GetPreview(urlStr string, onHost string, forUserId string, atTs int64, lang
 			return nil, err
 		}
 		if err != sql.ErrNoRows {
+			if cached.ErrorCode != "" {
+				// The last attempt to generate a preview failed, so try to serve the last good
+				// preview instead of the error.
+				stale := getStalePreview(urlStr, languageHeader, ctx)
+				if stale != nil {
+					ctx.Log.Info("Returning stale URL preview in place of cached error")
+					return stale, nil
+				}
+			}
 			ctx.Log.Info("Returning cached URL preview")
 			return cachedPreviewToReal(cached)
 		}
@@ -45,7 +78,7 @@ func GetPreview(urlStr string, onHost string, forUserId string, atTs int64, lang
 			// Because we don't have a cached preview, we'll use the current time as the preview time.
 			// We also give a 60 second buffer so we don't cause an infinite loop (considering we're
 			// calling ourselves), and to give a lenient opportunity for slow execution.
-			return GetPreview(urlStr, onHost, forUserId, now, languageHeader, ctx)
+			return getPreview(urlStr, onHost, forUserId, now, languageHeader, ctx)
 		}
 
 		parsedUrl, err := url.Parse(urlStr)
@@ -60,6 +93,18 @@ func GetPreview(urlStr string, onHost string, forUserId string, atTs int64, lang
 			ParsedUrl: parsedUrl,
 		}
 
+		stale := getStalePreview(urlStr, languageHeader, ctx)
+		if stale != nil {
+			ctx.Log.Info("Returning stale URL preview and refreshing in the background")
+			startRefreshingPreview(urlToPreview, forUserId, onHost, languageHeader, ctx.Config.UrlPreviews.OEmbed)
+			return stale, nil
+		}
+
+		if isHostRateLimited(parsedUrl.Hostname()) {
+			ctx.Log.Warn("Host being previewed has exceeded the URL preview rate limit")
+			return nil, common.ErrRateLimitExceeded
+		}
+
 		ctx.Log.Info("Preview not cached - fetching resource")
 
 		previewChan := getResourceHandler().GeneratePreview(urlToPreview, forUserId, onHost, languageHeader, ctx.Config.UrlPreviews.OEmbed)
@@ -77,6 +122,79 @@ func GetPreview(urlStr string, onHost string, forUserId string, atTs int64, lang
 	return value, err
 }
 
+func getStalePreview(urlStr string, languageHeader string, ctx rcontext.RequestContext) *types.UrlPreview {
+	if !config.Get().UrlPreviews.StaleWhileRevalidate {
+		return nil
+	}
+
+	db := storage.GetDatabase().GetUrlStore(ctx)
+	cached, err := db.GetLatestSuccessfulPreview(urlStr, languageHeader)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			ctx.Log.Warn("Non-fatal error getting stale URL preview: ", err.Error())
+			sentry.CaptureException(err)
+		}
+		return nil
+	}
+
+	maxAgeMs := int64(config.Get().UrlPreviews.MaxCacheAgeMinutes) * 60 * 1000
+	if maxAgeMs > 0 && (util.NowMillis()-cached.FetchedTs) > maxAgeMs {
+		return nil
+	}
+
+	return cached.Preview
+}
+
+// startRefreshingPreview refreshes the preview in the background, unless it is already being refreshed.
+func startRefreshingPreview(urlToPreview *preview_types.UrlPayload, forUserId string, onHost string, languageHeader string, allowOEmbed bool) {
+	key := onHost + "/" + languageHeader + "/" + urlToPreview.UrlString
+
+	refreshingLock.Lock()
+	defer refreshingLock.Unlock()
+	if refreshing[key] {
+		return
+	}
+	refreshing[key] = true
+
+	go func() {
+		defer func() {
+			refreshingLock.Lock()
+			defer refreshingLock.Unlock()
+			delete(refreshing, key)
+		}()
+		refreshPreview(urlToPreview, forUserId, onHost, languageHeader, allowOEmbed)
+	}()
+}
+
+func refreshPreview(urlToPreview *preview_types.UrlPayload, forUserId string, onHost string, languageHeader string, allowOEmbed bool) {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{
+		"preview_refresh_url": urlToPreview.UrlString,
+	})
+
+	if isHostRateLimited(urlToPreview.ParsedUrl.Hostname()) {
+		ctx.Log.Warn("Host being previewed has exceeded the URL preview rate limit - not refreshing preview")
+		return
+	}
+
+	previewChan := getResourceHandler().GeneratePreview(urlToPreview, forUserId, onHost, languageHeader, allowOEmbed)
+	defer close(previewChan)
+
+	result := <-previewChan
+	if result.err != nil {
+		ctx.Log.Warn("Error refreshing URL preview: ", result.err)
+	}
+}
+
+func IsOptedOut(onHost string, forUserId string, inRoomId string, ctx rcontext.RequestContext) (bool, error) {
+	entityIds := []string{forUserId}
+	if inRoomId != "" {
+		entityIds = append(entityIds, inRoomId)
+	}
+
+	db := storage.GetDatabase().GetUrlStore(ctx)
+	return db.IsOptedOut(onHost, entityIds)
+}
+
 func cachedPreviewToReal(cached *types.CachedUrlPreview) (*types.UrlPreview, error) {
 	if cached.ErrorCode == common.ErrCodeInvalidHost {
 		return nil, common.ErrInvalidHost
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"sync"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/sirupsen/logrus"
@@ -44,7 +45,8 @@ var resHandlerSingletonLock = &sync.Once{}
 func getResourceHandler() *urlResourceHandler {
 	if resHandlerInstance == nil {
 		resHandlerSingletonLock.Do(func() {
-			handler, err := resource_handler.New(config.Get().UrlPreviews.NumWorkers, func(r *resource_handler.WorkRequest) interface{} {
+			queueTimeout := time.Duration(config.Get().UrlPreviews.QueueTimeoutSeconds) * time.Second
+			handler, err := resource_handler.NewWithQueueLimits(config.Get().UrlPreviews.NumWorkers, config.Get().UrlPreviews.MaxQueueSize, queueTimeout, func(r *resource_handler.WorkRequest) interface{} {
 				return urlPreviewWorkFn(r)
 			})
 			if err != nil {
@@ -138,6 +140,12 @@ func urlPreviewWorkFn(request *resource_handler.WorkRequest) (resp *urlPreviewRe
 			ctx.Log.Warn("Non-fatal error storing preview thumbnail: " + err.Error())
 			sentry.CaptureException(err)
 		} else {
+			result.ImageMxc = media.MxcUri()
+			result.ImageType = media.ContentType
+			result.ImageSize = media.SizeBytes
+
+			// The dimensions are optional: if we can't decode the image then clients
+			// will still be able to show it, they just won't know how big it is.
 			mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
 			if err != nil {
 				ctx.Log.Warn("Non-fatal error streaming datastore file: " + err.Error())
@@ -147,11 +155,7 @@ func urlPreviewWorkFn(request *resource_handler.WorkRequest) (resp *urlPreviewRe
 				img, err := imaging.Decode(mediaStream)
 				if err != nil {
 					ctx.Log.Warn("Non-fatal error getting thumbnail dimensions: " + err.Error())
-					sentry.CaptureException(err)
 				} else {
-					result.ImageMxc = media.MxcUri()
-					result.ImageType = media.ContentType
-					result.ImageSize = media.SizeBytes
 					result.ImageWidth = img.Bounds().Max.X
 					result.ImageHeight = img.Bounds().Max.Y
 				}
@@ -189,6 +193,10 @@ func (h *urlResourceHandler) GeneratePreview(urlPayload *preview_types.UrlPayloa
 		})
 		defer close(c)
 		result := <-c
+		if err, ok := result.(error); ok {
+			resultChan <- &urlPreviewResponse{err: err}
+			return
+		}
 		resultChan <- result.(*urlPreviewResponse)
 	}()
 	return resultChan
@@ -2,6 +2,7 @@ package previewers
 
 import (
 	bytes2 "bytes"
+	"io/ioutil"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/ryanuber/go-glob"
@@ -9,7 +10,9 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/preview_types"
 	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/thumbnailing"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
 func GenerateCalculatedPreview(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (preview_types.PreviewResult, error) {
@@ -56,10 +59,50 @@ func GenerateCalculatedPreview(urlPayload *preview_types.UrlPayload, languageHea
 		SiteName:    "", // intentionally empty
 	}
 
-	if glob.Glob("image/*", img.ContentType) {
+	if glob.Glob("image/*", util.FixContentType(img.ContentType)) {
 		result.Image = img
+	} else if util.HasAnyPrefix(img.ContentType, []string{"video/", "audio/"}) {
+		// We can't use the file itself as the preview image, but we might be able to
+		// make a thumbnail for it instead.
+		result.Image = generateFileThumbnail(bytes, img.ContentType, ctx)
 	}
 
 	metrics.UrlPreviewsGenerated.With(prometheus.Labels{"type": "calculated"}).Inc()
 	return *result, nil
 }
+
+func generateFileThumbnail(b []byte, contentType string, ctx rcontext.RequestContext) *preview_types.PreviewImage {
+	contentType = util.FixContentType(contentType)
+	if !thumbnailing.IsSupported(contentType) || !util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) {
+		ctx.Log.Info("Cannot generate a preview image for " + contentType + " because thumbnails are not supported for it")
+		return nil
+	}
+
+	// Use the largest thumbnail size we're configured for so clients have something decent to show
+	width := 0
+	height := 0
+	for _, size := range ctx.Config.Thumbnails.Sizes {
+		width = util.MaxInt(width, size.Width)
+		height = util.MaxInt(height, size.Height)
+	}
+
+	thumb, err := thumbnailing.GenerateThumbnail(util.BufferToStream(bytes2.NewBuffer(b)), contentType, width, height, "scale", false, ctx)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error generating preview image for file: " + err.Error())
+		return nil
+	}
+
+	defer cleanup.DumpAndCloseStream(thumb.Reader)
+	thumbBytes, err := ioutil.ReadAll(thumb.Reader)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error reading generated preview image: " + err.Error())
+		return nil
+	}
+
+	return &preview_types.PreviewImage{
+		Data:          util.BufferToStream(bytes2.NewBuffer(thumbBytes)),
+		ContentType:   thumb.ContentType,
+		Filename:      "",
+		ContentLength: int64(len(thumbBytes)),
+	}
+}
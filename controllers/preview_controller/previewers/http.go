@@ -1,6 +1,7 @@
 package previewers
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -9,7 +10,9 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ryanuber/go-glob"
@@ -18,15 +21,52 @@ import (
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/acl"
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/preview_types"
 	"github.com/turt2live/matrix-media-repo/util"
-	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"golang.org/x/net/html"
 )
 
+var errTooManyRedirects = errors.New("too many redirects")
+
+// User agents of well-known crawlers, for urlPreviews.botIdentity
+var botUserAgents = map[string]string{
+	"facebook": "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+	"twitter":  "Twitterbot/1.0",
+	"slack":    "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+	"discord":  "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)",
+}
+
+// Headers which could identify the user who asked for the preview, or the network the media repo is on
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Real-IP", "Forwarded", "Via"}
+
+func getPreviewUserAgent(ctx rcontext.RequestContext) string {
+	if botIdentity := ctx.Config.UrlPreviews.BotIdentity; botIdentity != "" {
+		if userAgent, ok := botUserAgents[strings.ToLower(botIdentity)]; ok {
+			return userAgent
+		}
+		ctx.Log.Warn("Unknown urlPreviews.botIdentity, using the configured user agent instead: ", botIdentity)
+	}
+	if ctx.Config.UrlPreviews.UserAgent != "" {
+		return ctx.Config.UrlPreviews.UserAgent
+	}
+	return "matrix-media-repo"
+}
+
+// removeForwardedHeaders makes sure the request doesn't say who or what it is being made for. Nothing
+// sets these today, but redirects copy the headers of the request before them, so they are removed
+// from every request rather than relying on that.
+func removeForwardedHeaders(req *http.Request) {
+	for _, h := range forwardedHeaders {
+		req.Header.Del(h)
+	}
+}
+
 func doHttpGet(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*http.Response, error) {
-	var client *http.Client
+	return doHttpGetWithTimeout(urlPayload, languageHeader, time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews)*time.Second, ctx)
+}
 
+func doHttpGetWithTimeout(urlPayload *preview_types.UrlPayload, languageHeader string, timeout time.Duration, ctx rcontext.RequestContext) (*http.Response, error) {
 	dialer := &net.Dialer{
-		Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-		KeepAlive: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+		Timeout:   timeout,
+		KeepAlive: timeout,
 		DualStack: true,
 	}
 
@@ -35,129 +75,206 @@ func doHttpGet(urlPayload *preview_types.UrlPayload, languageHeader string, ctx
 			return nil, errors.New("invalid network: expected tcp")
 		}
 
+		// Every connection is checked against the ACL, including those made while following
+		// redirects. We dial the IP we validated rather than the hostname to ensure that the
+		// DNS record can't change between the check and the connection.
 		safeIp, safePort, err := acl.GetSafeAddress(addr, ctx)
 		if err != nil {
 			return nil, err
 		}
+		if safePort == "" {
+			return nil, errors.New("unexpected address: cannot determine port")
+		}
 
-		// Try and determine which port we're expecting a request to come in on. Because the
-		// http library follows redirects, we should also keep track of the alternate port
-		// so that redirects don't fail previews. We only support the alternate port if the
-		// default port for the scheme is used, however.
+		return dialer.DialContext(ctx2, network, net.JoinHostPort(safeIp.String(), safePort))
+	}
 
-		altPort := ""
-		if safePort == "" {
-			if urlPayload.ParsedUrl.Scheme == "http" {
-				safePort = "80"
-				altPort = "443"
-			} else if urlPayload.ParsedUrl.Scheme == "https" {
-				safePort = "443"
-				altPort = "80"
-			} else {
-				return nil, errors.New("unexpected scheme: cannot determine port")
-			}
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		if len(via) > ctx.Config.UrlPreviews.MaxRedirects {
+			ctx.Log.Warn("Too many redirects while fetching preview - giving up")
+			return errTooManyRedirects
 		}
 
-		safeIpStr := safeIp.String()
+		ctx.Log.Info("Following redirect to " + req.URL.String())
+		removeForwardedHeaders(req)
+		return acl.ValidateUrlForPreview(req.URL, ctx)
+	}
 
-		expectedAddr := net.JoinHostPort(urlPayload.ParsedUrl.Host, safePort)
-		altAddr := net.JoinHostPort(urlPayload.ParsedUrl.Host, altPort)
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext:       dialContext,
+	}
 
-		returnAddr := ""
-		if addr == expectedAddr {
-			returnAddr = net.JoinHostPort(safeIpStr, safePort)
-		} else if addr == altAddr && altPort != "" {
-			returnAddr = net.JoinHostPort(safeIpStr, altPort)
+	if ctx.Config.UrlPreviews.Proxy != "" {
+		proxyUrl, err := url.Parse(ctx.Config.UrlPreviews.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxyAddr, err := getProxyAddress(proxyUrl)
+		if err != nil {
+			return nil, err
 		}
 
-		if returnAddr != "" {
-			return dialer.DialContext(ctx, network, returnAddr)
+		// The proxy makes the connection on our behalf, so we have to check the target before
+		// handing it off. The proxy is expected to be on a private network, so connections
+		// to it are not subject to the ACL.
+		err = acl.ValidateUrlForPreview(urlPayload.ParsedUrl, ctx)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, errors.New("unexpected host: not safe to complete request")
+		ctx.Log.Info("Using proxy for preview request")
+		transport.Proxy = http.ProxyURL(proxyUrl)
+		transport.DialContext = func(ctx2 context.Context, network, addr string) (conn net.Conn, e error) {
+			if addr != proxyAddr {
+				return nil, errors.New("unexpected host: expected connection to proxy")
+			}
+			return dialer.DialContext(ctx2, network, addr)
+		}
 	}
 
 	if ctx.Config.UrlPreviews.UnsafeCertificates {
 		ctx.Log.Warn("Ignoring any certificate errors while making request")
-		tr := &http.Transport{
-			DisableKeepAlives: true,
-			DialContext:       dialContext,
-			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-			// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
-			DialTLS: func(network, addr string) (net.Conn, error) {
-				rawconn, err := net.Dial(network, addr)
-				if err != nil {
-					return nil, err
-				}
-				// Wrap a raw connection ourselves since tls.Dial defaults the SNI
-				conn := tls.Client(rawconn, &tls.Config{
-					ServerName:         "",
-					InsecureSkipVerify: true,
-				})
-				if err := conn.Handshake(); err != nil {
-					return nil, err
-				}
-				return conn, nil
-			},
-		}
-		client = &http.Client{
-			Transport: tr,
-			Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-		}
-	} else {
-		client = &http.Client{
-			Timeout: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-				DialContext:       dialContext,
-			},
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
+		// Note: the transport uses this for https:// proxies as well as for requests made without a
+		// proxy, so the connection is made the same way as plain connections: to the proxy if one is
+		// in use, or through the ACL otherwise.
+		rawDialContext := transport.DialContext
+		transport.DialTLSContext = func(ctx2 context.Context, network, addr string) (net.Conn, error) {
+			rawconn, err := rawDialContext(ctx2, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// Wrap a raw connection ourselves since tls.Dial defaults the SNI
+			conn := tls.Client(rawconn, &tls.Config{
+				ServerName:         "",
+				InsecureSkipVerify: true,
+			})
+			if err := conn.Handshake(); err != nil {
+				return nil, err
+			}
+			return conn, nil
 		}
 	}
 
+	client := &http.Client{
+		Timeout:       timeout,
+		CheckRedirect: checkRedirect,
+		Transport:     transport,
+	}
+
 	req, err := http.NewRequest("GET", urlPayload.ParsedUrl.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("User-Agent", getPreviewUserAgent(ctx))
+	if ctx.Config.UrlPreviews.FromAddress != "" {
+		req.Header.Set("From", ctx.Config.UrlPreviews.FromAddress)
+	}
 	req.Header.Set("Accept-Language", languageHeader)
+	removeForwardedHeaders(req)
 	return client.Do(req)
 }
 
+func getProxyAddress(proxyUrl *url.URL) (string, error) {
+	port := proxyUrl.Port()
+	if port == "" {
+		switch proxyUrl.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			return "", errors.New("unsupported proxy scheme: " + proxyUrl.Scheme)
+		}
+	}
+	return net.JoinHostPort(proxyUrl.Hostname(), port), nil
+}
+
+// DownloadMedia fetches a URL so it can be stored as media, using the same network ACL, proxy, and
+// redirect rules as URL previews. Returns the contents, filename (if the server gave one), and content
+// type. Content bigger than maxBytes is not downloaded, and returns common.ErrMediaTooLarge instead.
+func DownloadMedia(urlPayload *preview_types.UrlPayload, maxBytes int64, timeout time.Duration, ctx rcontext.RequestContext) ([]byte, string, string, error) {
+	ctx.Log.Info("Downloading " + urlPayload.ParsedUrl.String() + " for upload")
+	resp, err := doHttpGetWithTimeout(urlPayload, "", timeout, ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", "", common.ErrMediaNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
+		return nil, "", "", errors.New("error during transfer")
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, "", "", common.ErrMediaTooLarge
+	}
+
+	content, err := ioutil.ReadAll(newLimitedBody(resp.Body, maxBytes, 0))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	filename := ""
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil {
+		filename = params["filename"]
+	}
+
+	return content, filename, resp.Header.Get("Content-Type"), nil
+}
+
 func downloadRawContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) ([]byte, string, string, string, error) {
+	return downloadContent(urlPayload, supportedTypes, languageHeader, ioutil.ReadAll, ctx)
+}
+
+func downloadContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, readFn func(io.Reader) ([]byte, error), ctx rcontext.RequestContext) ([]byte, string, string, string, error) {
 	ctx.Log.Info("Fetching remote content...")
 	resp, err := doHttpGet(urlPayload, languageHeader, ctx)
 	if err != nil {
 		return nil, "", "", "", err
 	}
+	// We don't drain the body before closing it: keep-alives are disabled, and draining
+	// would mean downloading content we've decided not to process.
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
 		return nil, "", "", "", errors.New("error during transfer")
 	}
 
-	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength > ctx.Config.UrlPreviews.MaxPageSizeBytes {
+	// Check the content type before reading the body so we don't download files we
+	// won't be able to do anything with.
+	contentType := resp.Header.Get("Content-Type")
+	if !isContentTypeSupported(contentType, supportedTypes) {
+		return nil, "", "", "", preview_types.ErrPreviewUnsupported
+	}
+
+	maxBytes, timeout := getFetchLimits(contentType, ctx)
+	if maxBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength > maxBytes {
 		return nil, "", "", "", common.ErrMediaTooLarge
 	}
+	if timeout > 0 {
+		// Closing the body interrupts any read in progress
+		timer := time.AfterFunc(timeout, func() { resp.Body.Close() })
+		defer timer.Stop()
+	}
 
 	var reader io.Reader
 	reader = resp.Body
-	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 {
-		reader = io.LimitReader(resp.Body, ctx.Config.UrlPreviews.MaxPageSizeBytes)
+	if maxBytes > 0 {
+		reader = io.LimitReader(resp.Body, maxBytes)
 	}
 
-	bytes, err := ioutil.ReadAll(reader)
+	content, err := readFn(reader)
 	if err != nil {
 		return nil, "", "", "", err
 	}
 
-	defer cleanup.DumpAndCloseStream(resp.Body)
-
-	contentType := resp.Header.Get("Content-Type")
-	for _, supportedType := range supportedTypes {
-		if !glob.Glob(supportedType, contentType) {
-			return nil, "", "", "", preview_types.ErrPreviewUnsupported
-		}
-	}
-
 	disposition := resp.Header.Get("Content-Disposition")
 	_, params, _ := mime.ParseMediaType(disposition)
 	filename := ""
@@ -165,11 +282,11 @@ func downloadRawContent(urlPayload *preview_types.UrlPayload, supportedTypes []s
 		filename = params["filename"]
 	}
 
-	return bytes, filename, contentType, resp.Header.Get("Content-Length"), nil
+	return content, filename, contentType, resp.Header.Get("Content-Length"), nil
 }
 
 func downloadHtmlContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, error) {
-	raw, _, contentType, _, err := downloadRawContent(urlPayload, supportedTypes, languageHeader, ctx)
+	raw, _, contentType, _, err := downloadContent(urlPayload, supportedTypes, languageHeader, readHtmlHead, ctx)
 	html := ""
 	if raw != nil {
 		html = util.ToUtf8(string(raw), contentType)
@@ -184,13 +301,21 @@ func downloadImage(urlPayload *preview_types.UrlPayload, languageHeader string,
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
 		return nil, errors.New("error during transfer")
 	}
 
+	contentType := resp.Header.Get("Content-Type")
+	maxBytes, timeout := getFetchLimits(contentType, ctx)
+	if maxBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength > maxBytes {
+		resp.Body.Close()
+		return nil, common.ErrMediaTooLarge
+	}
+
 	image := &preview_types.PreviewImage{
-		ContentType:         resp.Header.Get("Content-Type"),
-		Data:                resp.Body,
+		ContentType:         contentType,
+		Data:                newLimitedBody(resp.Body, maxBytes, timeout),
 		ContentLength:       resp.ContentLength,
 		ContentLengthHeader: resp.Header.Get("Content-Length"),
 	}
@@ -202,3 +327,116 @@ func downloadImage(urlPayload *preview_types.UrlPayload, languageHeader string,
 
 	return image, nil
 }
+
+// readHtmlHead reads HTML until the page's OpenGraph title, description, and image have been
+// found in the <head>. If any of them are missing, the rest of the page is read so the
+// previewer can try to calculate them from the body instead.
+func readHtmlHead(r io.Reader) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	tokenizer := html.NewTokenizer(io.TeeReader(r, buf))
+	found := make(map[string]bool)
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return buf.Bytes(), nil
+			}
+			return buf.Bytes(), tokenizer.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if string(name) == "meta" && hasAttr {
+				for {
+					key, val, more := tokenizer.TagAttr()
+					if string(key) == "property" || string(key) == "name" {
+						found[strings.ToLower(string(val))] = true
+					}
+					if !more {
+						break
+					}
+				}
+			} else if string(name) == "body" && hasAllOpenGraphTags(found) {
+				return buf.Bytes(), nil
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "head" && hasAllOpenGraphTags(found) {
+				return buf.Bytes(), nil
+			}
+		}
+	}
+}
+
+func hasAllOpenGraphTags(found map[string]bool) bool {
+	return found["og:title"] && found["og:description"] && found["og:image"]
+}
+
+func isContentTypeSupported(contentType string, supportedTypes []string) bool {
+	contentType = util.FixContentType(contentType)
+	for _, supportedType := range supportedTypes {
+		if glob.Glob(supportedType, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// getFetchLimits returns the size and time limits for fetching the content type. Limits left out of
+// the matching fetchLimits entry fall back to the ones used when no entry matches.
+func getFetchLimits(contentType string, ctx rcontext.RequestContext) (int64, time.Duration) {
+	maxBytes := ctx.Config.UrlPreviews.MaxPageSizeBytes
+	timeout := time.Duration(0)
+	for _, limit := range ctx.Config.UrlPreviews.FetchLimits {
+		if isContentTypeSupported(contentType, limit.ContentTypes) {
+			if limit.MaxBytes > 0 {
+				maxBytes = limit.MaxBytes
+			}
+			if limit.TimeoutSeconds > 0 {
+				timeout = time.Duration(limit.TimeoutSeconds) * time.Second
+			}
+			break
+		}
+	}
+	return maxBytes, timeout
+}
+
+// limitedBody fails reads once more than maxBytes have been read or the timeout has passed,
+// rather than silently truncating the content like io.LimitReader.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	timer     *time.Timer
+}
+
+func newLimitedBody(body io.ReadCloser, maxBytes int64, timeout time.Duration) io.ReadCloser {
+	if maxBytes <= 0 && timeout <= 0 {
+		return body
+	}
+
+	r := &limitedBody{body: body, remaining: maxBytes}
+	if maxBytes <= 0 {
+		r.remaining = -1
+	}
+	if timeout > 0 {
+		r.timer = time.AfterFunc(timeout, func() { body.Close() })
+	}
+	return r
+}
+
+func (r *limitedBody) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if r.remaining >= 0 {
+		r.remaining -= int64(n)
+		if r.remaining < 0 {
+			return n, common.ErrMediaTooLarge
+		}
+	}
+	return n, err
+}
+
+func (r *limitedBody) Close() error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	return r.body.Close()
+}
@@ -5,7 +5,10 @@ import (
 	"github.com/getsentry/sentry-go"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/dyatlov/go-oembed/oembed"
 	"github.com/k3a/html2text"
@@ -18,29 +21,68 @@ import (
 )
 
 var oembedInstance *oembed.Oembed
+var oembedProvidersPath string
+var oembedProvidersModTime time.Time
+var oembedLock = &sync.Mutex{}
 
 func getOembed() *oembed.Oembed {
-	if oembedInstance != nil {
-		return oembedInstance
-	}
+	oembedLock.Lock()
+	defer oembedLock.Unlock()
 
-	oembedInstance = oembed.NewOembed()
+	providersPath := config.Get().UrlPreviews.OEmbedProvidersFile
+	if providersPath == "" {
+		providersPath = path.Join(config.Runtime.AssetsPath, "providers.json")
+	}
 
-	data, err := ioutil.ReadFile(path.Join(config.Runtime.AssetsPath, "providers.json"))
+	// Reload the providers if the file has changed so operators can update the list without
+	// restarting the media repo.
+	stat, err := os.Stat(providersPath)
 	if err != nil {
+		if oembedInstance == nil {
+			sentry.CaptureException(err)
+			logrus.Fatal(err)
+		}
+		logrus.Warn("Error checking oEmbed providers file - continuing with previous providers: ", err)
 		sentry.CaptureException(err)
-		logrus.Fatal(err)
+		return oembedInstance
+	}
+	if oembedInstance != nil && providersPath == oembedProvidersPath && stat.ModTime().Equal(oembedProvidersModTime) {
+		return oembedInstance
 	}
 
-	err = oembedInstance.ParseProviders(bytes.NewReader(data))
+	logrus.Info("Loading oEmbed providers from " + providersPath)
+	instance, err := loadOembedProviders(providersPath)
 	if err != nil {
+		if oembedInstance == nil {
+			sentry.CaptureException(err)
+			logrus.Fatal(err)
+		}
+		logrus.Warn("Error loading oEmbed providers - continuing with previous providers: ", err)
 		sentry.CaptureException(err)
-		logrus.Fatal(err)
+		return oembedInstance
 	}
 
+	oembedInstance = instance
+	oembedProvidersPath = providersPath
+	oembedProvidersModTime = stat.ModTime()
 	return oembedInstance
 }
 
+func loadOembedProviders(providersPath string) (*oembed.Oembed, error) {
+	data, err := ioutil.ReadFile(providersPath)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := oembed.NewOembed()
+	err = instance.ParseProviders(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return instance, nil
+}
+
 func GenerateOEmbedPreview(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (preview_types.PreviewResult, error) {
 	item := getOembed().FindItem(urlPayload.ParsedUrl.String())
 	if item == nil {
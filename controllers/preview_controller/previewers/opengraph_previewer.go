@@ -47,6 +47,9 @@ func GenerateOpenGraphPreview(urlPayload *preview_types.UrlPayload, languageHead
 	if len(og.Images) == 0 {
 		og.Images = calcImages(html)
 	}
+	if len(og.Images) == 0 && ctx.Config.UrlPreviews.FaviconFallback && (og.Title != "" || og.Description != "") {
+		og.Images = calcIcons(html)
+	}
 
 	// Be sure to trim the title and description
 	og.Title = summarize(og.Title, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength)
@@ -184,3 +187,21 @@ func calcImages(html string) []*opengraph.Image {
 	img := opengraph.Image{URL: imageSrc}
 	return []*opengraph.Image{&img}
 }
+
+func calcIcons(html string) []*opengraph.Image {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return []*opengraph.Image{}
+	}
+
+	// Prefer the touch icons as they tend to be larger than the regular favicon
+	for _, rel := range []string{"apple-touch-icon", "apple-touch-icon-precomposed", "icon", "shortcut icon"} {
+		href, exists := doc.Find("link[rel='" + rel + "']").First().Attr("href")
+		if exists && href != "" {
+			return []*opengraph.Image{{URL: href}}
+		}
+	}
+
+	// Most sites serve a favicon from the root even if they don't say so
+	return []*opengraph.Image{{URL: "/favicon.ico"}}
+}
@@ -0,0 +1,33 @@
+package preview_controller
+
+import (
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"golang.org/x/time/rate"
+)
+
+// Limiters are kept around for a while after their last use so that bursts are still limited,
+// but we don't hold on to one for every host we've ever seen. Per-user limits are handled by the
+// ratelimit package.
+var hostLimiters = cache.New(1*time.Hour, 2*time.Hour)
+
+func getLimiter(limiters *cache.Cache, key string, conf config.RateLimitBucketConfig) *rate.Limiter {
+	if l, ok := limiters.Get(key); ok {
+		limiters.SetDefault(key, l) // bump the expiration
+		return l.(*rate.Limiter)
+	}
+
+	l := rate.NewLimiter(rate.Limit(conf.RequestsPerSecond), conf.BurstCount)
+	limiters.SetDefault(key, l)
+	return l
+}
+
+func isHostRateLimited(host string) bool {
+	conf := config.Get().UrlPreviews.RateLimit
+	if !conf.Enabled || host == "" {
+		return false
+	}
+	return !getLimiter(hostLimiters, host, conf.PerHost).Allow()
+}
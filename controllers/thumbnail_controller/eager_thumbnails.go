@@ -0,0 +1,86 @@
+package thumbnail_controller
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type ThumbnailSize struct {
+	Width  int
+	Height int
+	Method string
+}
+
+// ParseThumbnailSizes parses a comma separated list of sizes in the form WIDTHxHEIGHT, optionally
+// followed by :crop or :scale. The method defaults to scale.
+func ParseThumbnailSizes(sizes string) ([]ThumbnailSize, error) {
+	parsed := make([]ThumbnailSize, 0)
+	for _, s := range strings.Split(sizes, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		method := "scale"
+		if i := strings.Index(s, ":"); i >= 0 {
+			method = s[i+1:]
+			s = s[:i]
+		}
+		if method != "crop" && method != "scale" {
+			return nil, errors.New("method must be crop or scale")
+		}
+
+		dimensions := strings.Split(s, "x")
+		if len(dimensions) != 2 {
+			return nil, errors.New("sizes must be in the form WIDTHxHEIGHT")
+		}
+		width, err := strconv.Atoi(dimensions[0])
+		if err != nil || width <= 0 {
+			return nil, errors.New("width must be a positive integer")
+		}
+		height, err := strconv.Atoi(dimensions[1])
+		if err != nil || height <= 0 {
+			return nil, errors.New("height must be a positive integer")
+		}
+
+		parsed = append(parsed, ThumbnailSize{Width: width, Height: height, Method: method})
+	}
+	return parsed, nil
+}
+
+// GenerateThumbnailsInBackground generates the thumbnails the uploader asked for, so the first person
+// to view the media doesn't have to wait for them. The sizes are picked the same way as when the
+// thumbnails are requested, so the stored thumbnails are the ones later requests will get.
+func GenerateThumbnailsInBackground(media *types.Media, sizes []ThumbnailSize, ctx rcontext.RequestContext) {
+	if len(sizes) == 0 {
+		return
+	}
+	animated := ctx.Config.Thumbnails.AllowAnimated && ctx.Config.Thumbnails.DefaultAnimated
+
+	go func() {
+		// The request will likely be finished before the thumbnails are
+		ctx.Context = context.Background()
+
+		for _, size := range sizes {
+			rctx := ctx.LogWithFields(logrus.Fields{
+				"eagerWidth":  size.Width,
+				"eagerHeight": size.Height,
+				"eagerMethod": size.Method,
+			})
+			thumbnail, err := GetThumbnail(media.Origin, media.MediaId, size.Width, size.Height, animated, size.Method, false, rctx)
+			if err != nil {
+				// Not fatal: the thumbnail will be generated when it is requested, if it can be
+				rctx.Log.Warn("Failed to generate thumbnail requested at upload: ", err)
+				continue
+			}
+			cleanup.DumpAndCloseStream(thumbnail.Stream)
+		}
+	}()
+}
@@ -32,7 +32,7 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 		return nil, err
 	}
 
-	mediaContentType := util.FixContentType(media.ContentType)
+	mediaContentType := util.FixContentType(media.EffectiveContentType(ctx.Config.Uploads.UseDetectedContentType))
 
 	if !thumbnailing.IsSupported(mediaContentType) {
 		ctx.Log.Warn("Cannot generate thumbnail for " + mediaContentType + " because it is not supported")
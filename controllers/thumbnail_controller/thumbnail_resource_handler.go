@@ -160,7 +160,7 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 		return nil, err
 	}
 
-	mediaContentType := util.FixContentType(media.ContentType)
+	mediaContentType := util.FixContentType(media.EffectiveContentType(ctx.Config.Uploads.UseDetectedContentType))
 
 	thumbImg, err := thumbnailing.GenerateThumbnail(mediaStream, mediaContentType, width, height, method, animated, ctx)
 	if err != nil {
@@ -0,0 +1,160 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"io"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+)
+
+// How long an upload to a pending media ID can take before another request may upload it instead.
+const pendingUploadClaimTimeout = 1 * time.Hour
+
+// CreateMedia hands out a media ID for the user to upload the contents of later (MSC2246). The ID is
+// forgotten if nothing is uploaded to it before the returned upload expires. Returns
+// common.ErrTooManyPendingUploads if the user already has as many media IDs waiting as they may have.
+func CreateMedia(userId string, origin string, ctx rcontext.RequestContext) (*types.PendingUpload, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	maxPending := ctx.Config.Features.MSC2246Async.MaxPendingPerUser
+	if maxPending > 0 {
+		pending, err := db.CountPendingUploadsForUser(userId, util.NowMillis())
+		if err != nil {
+			return nil, err
+		}
+		if pending >= int64(maxPending) {
+			return nil, common.ErrTooManyPendingUploads
+		}
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := util.NowMillis()
+	expiry := time.Duration(ctx.Config.Features.MSC2246Async.AsyncUploadExpirySecs) * time.Second
+	upload := &types.PendingUpload{
+		Origin:     origin,
+		MediaId:    mediaId,
+		UserId:     userId,
+		CreationTs: now,
+		ExpiresTs:  now + expiry.Milliseconds(),
+	}
+	err = db.InsertPendingUpload(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info("Created media ID ", mediaId, " for a later upload")
+	return upload, nil
+}
+
+// UploadPendingMedia stores the contents of media created with CreateMedia. Returns
+// common.ErrMediaNotFound if the media ID was never created or has expired,
+// common.ErrMediaAlreadyUploaded if the contents were already uploaded (or are being uploaded by another
+// request), and common.ErrNotMediaUploader if the media ID was created by someone else.
+func UploadPendingMedia(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	defer cleanup.DumpAndCloseStream(contents)
+	uploadStartTs := util.NowMillis()
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	upload, err := db.GetPendingUpload(origin, mediaId)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil {
+		_, err = storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+		if err == sql.ErrNoRows {
+			return nil, common.ErrMediaNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, common.ErrMediaAlreadyUploaded
+	}
+	if upload.ExpiresTs < util.NowMillis() {
+		return nil, common.ErrMediaNotFound
+	}
+	if upload.UserId != userId {
+		return nil, common.ErrNotMediaUploader
+	}
+
+	// Only one request gets to upload the contents
+	claimed, err := db.ClaimPendingUpload(origin, mediaId, util.NowMillis()-pendingUploadClaimTimeout.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, common.ErrMediaAlreadyUploaded
+	}
+
+	m, dataBytes, err := storePendingUpload(contents, contentLength, contentType, filename, userId, origin, mediaId, uploadStartTs, ctx)
+	if err != nil {
+		err2 := db.ReleasePendingUpload(origin, mediaId)
+		if err2 != nil {
+			// The claim goes stale eventually, after which the client can try again
+			ctx.Log.Error("Error releasing pending upload: ", err2)
+			sentry.CaptureException(err2)
+		}
+		return m, err
+	}
+
+	_, err = db.DeletePendingUpload(origin, mediaId)
+	if err != nil {
+		// The media exists regardless, and the pending upload will expire on its own
+		ctx.Log.Warn("Unexpected error removing pending upload: ", err)
+		sentry.CaptureException(err)
+	}
+
+	err = internal_cache.Get().UploadMedia(m.Sha256Hash, util_byte_seeker.NewByteSeeker(dataBytes), ctx)
+	if err != nil {
+		ctx.Log.Warn("Unexpected error trying to cache media: " + err.Error())
+	}
+	return m, nil
+}
+
+func storePendingUpload(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, mediaId string, uploadStartTs int64, ctx rcontext.RequestContext) (*types.Media, []byte, error) {
+	unsized := contentLength < 0
+	dataBytes, contentLength, originalSize, err := processUpload(contents, contentLength, contentType, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if unsized {
+		err = checkQuotaOfUnsizedUpload(dataBytes, userId, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Duplicates of the user's other uploads aren't returned as-is because the client has already been
+	// told which media ID to use.
+	m, err := StoreDirect(nil, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, false)
+	if err != nil {
+		return m, nil, err
+	}
+	recordOriginalSize(m, originalSize, uploadStartTs, ctx)
+	recordUploadAttribution(m, uploadStartTs, ctx)
+	return m, dataBytes, nil
+}
+
+// ExpirePendingUploads forgets media IDs which were created but never had anything uploaded to them.
+func ExpirePendingUploads(ctx rcontext.RequestContext) {
+	removed, err := storage.GetDatabase().GetMetadataStore(ctx).DeleteExpiredPendingUploads(util.NowMillis())
+	if err != nil {
+		ctx.Log.Error("Error removing expired pending uploads: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	if removed > 0 {
+		ctx.Log.Infof("Removed %d expired pending uploads", removed)
+	}
+}
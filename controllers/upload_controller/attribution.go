@@ -0,0 +1,62 @@
+package upload_controller
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// recordUploadAttribution keeps the IP address, user agent, and access token hash of the request which
+// uploaded the media. Media which existed before the upload is left alone, as it was uploaded by someone
+// else (or by the same user in another session).
+func recordUploadAttribution(media *types.Media, uploadStartTs int64, ctx rcontext.RequestContext) {
+	if !ctx.Config.Uploads.Attribution.Enabled || ctx.Request == nil || media.CreationTs < uploadStartTs {
+		return
+	}
+
+	tokenHash := ""
+	if accessToken := util.GetAccessTokenFromRequest(ctx.Request); accessToken != "" {
+		hash, err := util.GetSha256HashOfStream(util.BytesToStream([]byte(accessToken)))
+		if err != nil {
+			ctx.Log.Warn("Unexpected error hashing access token: ", err)
+		}
+		tokenHash = hash
+	}
+
+	err := storage.GetDatabase().GetMetadataStore(ctx).InsertUploadAttribution(&types.UploadAttribution{
+		Origin:     media.Origin,
+		MediaId:    media.MediaId,
+		IpAddress:  ctx.Request.RemoteAddr,
+		UserAgent:  ctx.Request.UserAgent(),
+		TokenHash:  tokenHash,
+		RecordedTs: util.NowMillis(),
+	})
+	if err != nil {
+		// The media is stored regardless
+		ctx.Log.Warn("Unexpected error recording who uploaded the media: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// ExpireUploadAttribution deletes records of who uploaded media once they are older than the configured
+// retention.
+func ExpireUploadAttribution(ctx rcontext.RequestContext) {
+	retention := time.Duration(ctx.Config.Uploads.Attribution.RetentionDays) * 24 * time.Hour
+	if retention <= 0 {
+		return
+	}
+
+	removed, err := storage.GetDatabase().GetMetadataStore(ctx).DeleteUploadAttributionBefore(util.NowMillis() - retention.Milliseconds())
+	if err != nil {
+		ctx.Log.Error("Error removing old upload attribution: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	if removed > 0 {
+		ctx.Log.Infof("Removed %d records of who uploaded media", removed)
+	}
+}
@@ -0,0 +1,104 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"io"
+	"regexp"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/stores"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+)
+
+var customMediaIdRegex = regexp.MustCompile("^[a-zA-Z0-9_-]{1,255}$")
+
+// IsValidCustomMediaId returns whether the media ID can be picked by the uploader. IDs are limited to
+// the characters generated IDs use, along with dashes and underscores.
+func IsValidCustomMediaId(mediaId string) bool {
+	return customMediaIdRegex.MatchString(mediaId)
+}
+
+// UploadMediaWithId stores media under a media ID picked by the uploader. Uploading the same contents to
+// the same ID again returns the existing media, so uploads can be safely retried. Returns
+// common.ErrMediaAlreadyUploaded if the ID is used by different media, or can't be used again.
+func UploadMediaWithId(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	defer cleanup.DumpAndCloseStream(contents)
+	uploadStartTs := util.NowMillis()
+
+	unsized := contentLength < 0
+	dataBytes, contentLength, originalSize, err := processUpload(contents, contentLength, contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if unsized {
+		err = checkQuotaOfUnsizedUpload(dataBytes, userId, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db := storage.GetDatabase().GetMediaStore(ctx)
+	existing, err := db.Get(origin, mediaId)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		return reuseExistingUpload(existing, dataBytes, userId, ctx)
+	}
+
+	// Purged media IDs stay reserved, and IDs handed out for async uploads belong to someone else
+	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+	reserved, err := metadataDb.IsReserved(origin, mediaId)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := metadataDb.GetPendingUpload(origin, mediaId)
+	if err != nil {
+		return nil, err
+	}
+	if reserved || pending != nil {
+		return nil, common.ErrMediaAlreadyUploaded
+	}
+
+	m, err := StoreDirect(nil, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, false)
+	if stores.IsUniqueViolation(err) {
+		// Another upload took the ID after it was checked, so treat this like a retry of that upload
+		existing, err = db.Get(origin, mediaId)
+		if err != nil {
+			return nil, err
+		}
+		return reuseExistingUpload(existing, dataBytes, userId, ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	recordOriginalSize(m, originalSize, uploadStartTs, ctx)
+	recordUploadAttribution(m, uploadStartTs, ctx)
+
+	err = internal_cache.Get().UploadMedia(m.Sha256Hash, util_byte_seeker.NewByteSeeker(dataBytes), ctx)
+	if err != nil {
+		ctx.Log.Warn("Unexpected error trying to cache media: " + err.Error())
+	}
+	return m, nil
+}
+
+// reuseExistingUpload returns the media already stored under the picked media ID if the upload is a
+// retry of it by the same user. Returns common.ErrMediaAlreadyUploaded otherwise.
+func reuseExistingUpload(existing *types.Media, dataBytes []byte, userId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	hash, err := util.GetSha256HashOfStream(util.BytesToStream(dataBytes))
+	if err != nil {
+		return nil, err
+	}
+	if existing.UserId != userId || existing.Sha256Hash != hash {
+		return nil, common.ErrMediaAlreadyUploaded
+	}
+	ctx.Log.Info("Media was already uploaded with this ID - returning unaltered media record")
+	trackUploadAsLastAccess(ctx, existing)
+	return existing, nil
+}
@@ -0,0 +1,219 @@
+package upload_controller
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+)
+
+// Clients have this long after their upload URL expires to say the upload is complete.
+const directUploadCompletionGrace = 1 * time.Hour
+
+// StartDirectUpload picks a datastore for an upload of the given size and returns where the client
+// can upload the file to without it passing through the media repo. Returns
+// datastore.ErrDirectUploadsUnsupported if the datastore picked for the upload doesn't allow this.
+func StartDirectUpload(contentType string, filename string, sizeBytes int64, userId string, origin string, ctx rcontext.RequestContext) (*types.DirectUpload, *datastore.DirectUploadTarget, error) {
+	ds, err := datastore.PickDatastoreForUpload(common.KindLocalMedia, &datastore.UploadDetails{
+		UserId:      userId,
+		Origin:      origin,
+		ContentType: contentType,
+		SizeBytes:   sizeBytes,
+	}, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The file can't be bigger than the size it was routed and checked against quota with
+	target, err := ds.PrepareDirectUpload(contentType, sizeBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploadId, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, nil, err
+	}
+	upload := &types.DirectUpload{
+		UploadId:    uploadId,
+		Origin:      origin,
+		UserId:      userId,
+		DatastoreId: ds.DatastoreId,
+		Location:    target.Location,
+		ContentType: contentType,
+		UploadName:  filename,
+		ExpiresTs:   target.ExpiresTs + directUploadCompletionGrace.Milliseconds(),
+		SizeBytes:   sizeBytes,
+	}
+	err = storage.GetDatabase().GetMetadataStore(ctx).InsertDirectUpload(upload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx.Log.Info("Started direct upload ", uploadId, " to datastore ", ds.DatastoreId)
+	return upload, target, nil
+}
+
+// CompleteDirectUpload turns a file the client has finished uploading to a datastore into media,
+// exactly as if it had been uploaded through the media repo. Returns common.ErrMediaNotFound if the
+// upload doesn't exist, has expired, or the file hasn't been uploaded, and common.ErrUploadSizeMismatch
+// if the file isn't the size the client said it would be.
+func CompleteDirectUpload(uploadId string, userId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	upload, err := db.GetDirectUpload(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil || upload.UserId != userId || upload.ExpiresTs < util.NowMillis() {
+		return nil, common.ErrMediaNotFound
+	}
+
+	ds, err := datastore.LocateDatastore(ctx, upload.DatastoreId)
+	if err != nil {
+		return nil, err
+	}
+	if !ds.ObjectExists(upload.Location) {
+		// The client can try again once the file is uploaded
+		return nil, common.ErrMediaNotFound
+	}
+
+	// Only one request gets to turn the file into media
+	deleted, err := db.DeleteDirectUpload(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, common.ErrMediaNotFound
+	}
+
+	info, err := ds.AdoptDirectUpload(upload.Location, upload.ContentType, ctx)
+	if err != nil {
+		ds.DeleteObject(upload.Location)
+		return nil, err
+	}
+	if upload.SizeBytes > 0 && info.SizeBytes != upload.SizeBytes {
+		// The size was what the upload was routed and checked against quota with
+		ds.DeleteObject(upload.Location)
+		return nil, common.ErrUploadSizeMismatch
+	}
+	if ctx.Config.Uploads.MaxSizeBytes > 0 && info.SizeBytes > ctx.Config.Uploads.MaxSizeBytes {
+		ds.DeleteObject(upload.Location)
+		return nil, common.ErrMediaTooLarge
+	}
+	if info.SizeBytes < ctx.Config.Uploads.MinSizeBytes {
+		ds.DeleteObject(upload.Location)
+		return nil, common.ErrMediaTooSmall
+	}
+
+	mediaId, err := generateMediaId(upload.Origin, ctx)
+	if err != nil {
+		ds.DeleteObject(upload.Location)
+		return nil, err
+	}
+
+	uploadStartTs := util.NowMillis()
+	var m *types.Media
+	var originalSize int64 = 0
+	if uploadProcessingEnabled(ctx) {
+		// The file never passed through the media repo, so it is read back to be processed like any other
+		// upload. Files which processing changes are stored again in place of the client's.
+		var dataBytes []byte
+		var contentLength int64
+		dataBytes, contentLength, originalSize, err = processDirectUpload(ds, info, upload.ContentType, ctx)
+		if err != nil {
+			ds.DeleteObject(upload.Location)
+			return nil, err
+		}
+		if dataBytes != nil {
+			m, err = StoreDirect(nil, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, upload.ContentType, upload.UploadName, userId, upload.Origin, mediaId, common.KindLocalMedia, ctx, true)
+			ds.DeleteObject(upload.Location)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m == nil {
+		existingFile := &AlreadyUploadedFile{
+			DS:         ds,
+			ObjectInfo: info,
+		}
+		m, err = StoreDirect(existingFile, nil, info.SizeBytes, upload.ContentType, upload.UploadName, userId, upload.Origin, mediaId, common.KindLocalMedia, ctx, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	recordOriginalSize(m, originalSize, uploadStartTs, ctx)
+	recordUploadAttribution(m, uploadStartTs, ctx)
+	return m, nil
+}
+
+// processDirectUpload runs a directly uploaded file through processUpload. The processed contents are
+// nil if processing left the file as it was.
+func processDirectUpload(ds *datastore.DatastoreRef, info *types.ObjectInfo, contentType string, ctx rcontext.RequestContext) ([]byte, int64, int64, error) {
+	stream, err := ds.DownloadFile(info.Location)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+
+	dataBytes, contentLength, originalSize, err := processUpload(stream, info.SizeBytes, contentType, ctx)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	hash, err := util.GetSha256HashOfStream(util.BytesToStream(dataBytes))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if hash == info.Sha256Hash {
+		return nil, 0, 0, nil
+	}
+	return dataBytes, contentLength, originalSize, nil
+}
+
+// ExpireDirectUploads deletes the files of direct uploads which were never completed.
+func ExpireDirectUploads(ctx rcontext.RequestContext) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	uploads, err := db.GetExpiredDirectUploads(util.NowMillis())
+	if err != nil {
+		ctx.Log.Error("Error getting expired direct uploads: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, upload := range uploads {
+		rctx := ctx.LogWithFields(logrus.Fields{"uploadId": upload.UploadId, "datastoreId": upload.DatastoreId})
+		ds, err := datastore.LocateDatastore(rctx, upload.DatastoreId)
+		if err != nil {
+			rctx.Log.Error("Error locating datastore for expired direct upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		deleted, err := db.DeleteDirectUpload(upload.UploadId)
+		if err != nil {
+			rctx.Log.Error("Error removing expired direct upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if !deleted {
+			// Completed at the last moment
+			continue
+		}
+
+		if ds.ObjectExists(upload.Location) {
+			rctx.Log.Info("Deleting file of expired direct upload")
+			err = ds.DeleteObject(upload.Location)
+			if err != nil {
+				rctx.Log.Warn("Error deleting file of expired direct upload: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package upload_controller
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/thumbnailing"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+var blocklistFiles = cache.New(1*time.Minute, 2*time.Minute)
+
+// NormalizeBlockedHash checks that the hash is a valid hash of the given type, returning it in lowercase.
+func NormalizeBlockedHash(hashType string, hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", errors.New("hash must be hex encoded")
+	}
+
+	switch hashType {
+	case types.HashTypeSha256:
+		if len(b) != 32 {
+			return "", errors.New("sha256 hashes must be 32 bytes")
+		}
+	case types.HashTypeDHash:
+		if len(b) != 8 {
+			return "", errors.New("dhash hashes must be 8 bytes")
+		}
+	default:
+		return "", errors.New("hash type must be sha256 or dhash")
+	}
+	return hash, nil
+}
+
+// checkHashBlocklist returns the blocklist entry the contents match, or nil if they aren't blocked. The
+// contents are matched by SHA-256 hash, and images by dHash if any dHashes are blocked.
+func checkHashBlocklist(contents []byte, sha256Hash string, ctx rcontext.RequestContext) (*types.BlockedHash, error) {
+	conf := config.Get().HashBlocklist
+	if !conf.Enabled {
+		return nil, nil
+	}
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	blocked, err := db.GetBlockedHash(types.HashTypeSha256, sha256Hash)
+	if err != nil || blocked != nil {
+		return blocked, err
+	}
+
+	fromFiles := readBlocklistFiles(conf, ctx)
+	dHashes := make([]*types.BlockedHash, 0)
+	for _, entry := range fromFiles {
+		if entry.HashType == types.HashTypeSha256 && entry.Hash == sha256Hash {
+			return entry, nil
+		}
+		if entry.HashType == types.HashTypeDHash {
+			dHashes = append(dHashes, entry)
+		}
+	}
+
+	fromDb, err := db.GetBlockedHashesOfType(types.HashTypeDHash)
+	if err != nil {
+		return nil, err
+	}
+	dHashes = append(dHashes, fromDb...)
+	if len(dHashes) == 0 {
+		return nil, nil
+	}
+
+	dHash, err := thumbnailing.DifferenceHash(contents, ctx.Config.Thumbnails.MaxPixels)
+	if err == thumbnailing.ErrUnsupported {
+		return nil, nil // not an image
+	}
+	if err == common.ErrMediaTooLarge {
+		ctx.Log.Warn("Image has too many pixels to calculate its dHash, only checking its SHA-256 hash")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range dHashes {
+		distance := thumbnailing.HashDistance(dHash, entry.Hash)
+		if distance >= 0 && distance <= conf.MaxDHashDistance {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func readBlocklistFiles(conf config.HashBlocklistConfig, ctx rcontext.RequestContext) []*types.BlockedHash {
+	entries := make([]*types.BlockedHash, 0)
+	for _, path := range conf.Files {
+		if cached, found := blocklistFiles.Get(path); found {
+			entries = append(entries, cached.([]*types.BlockedHash)...)
+			continue
+		}
+
+		fromFile, err := readBlocklistFile(path, conf.DefaultAction, ctx)
+		if err != nil {
+			// Carry on with the other lists rather than failing every upload
+			ctx.Log.Error("Error reading hash blocklist ", path, ": ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		blocklistFiles.Set(path, fromFile, cache.DefaultExpiration)
+		entries = append(entries, fromFile...)
+	}
+	return entries
+}
+
+func readBlocklistFile(path string, action string, ctx rcontext.RequestContext) ([]*types.BlockedHash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]*types.BlockedHash, 0)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash := line
+		reason := ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			hash = line[:i]
+			reason = strings.TrimSpace(line[i+1:])
+		}
+		hashType := types.HashTypeSha256
+		if i := strings.Index(hash, ":"); i >= 0 {
+			hashType = hash[:i]
+			hash = hash[i+1:]
+		}
+
+		hash, err = NormalizeBlockedHash(hashType, hash)
+		if err != nil {
+			ctx.Log.Warnf("Skipping line %d of hash blocklist %s: %s", lineNum, path, err.Error())
+			continue
+		}
+		entries = append(entries, &types.BlockedHash{
+			HashType: hashType,
+			Hash:     hash,
+			Action:   action,
+			Reason:   reason,
+			AddedBy:  path,
+		})
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,46 @@
+package upload_controller
+
+import (
+	"database/sql"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// RestrictMedia limits downloads of the media to people who can see the room, or the event in it if
+// eventId isn't empty (MSC3911). Only the uploader can restrict their media, and only to a room or event
+// they can see themselves, otherwise common.ErrEventNotFound is returned. Media can only be restricted
+// once: returns common.ErrMediaAlreadyRestricted after that.
+func RestrictMedia(origin string, mediaId string, roomId string, eventId string, userId string, accessToken string, appserviceUserId string, ipAddr string, ctx rcontext.RequestContext) error {
+	media, err := storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return common.ErrMediaNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if media.UserId != userId {
+		return common.ErrNotMediaUploader
+	}
+
+	canSee, err := matrix.CanSeeEvent(ctx, origin, accessToken, appserviceUserId, ipAddr, roomId, eventId)
+	if err != nil {
+		return err
+	}
+	if !canSee {
+		return common.ErrEventNotFound
+	}
+
+	restricted, err := storage.GetDatabase().GetMediaAttributesStore(ctx).UpsertRestriction(origin, mediaId, roomId, eventId)
+	if err != nil {
+		return err
+	}
+	if !restricted {
+		return common.ErrMediaAlreadyRestricted
+	}
+
+	ctx.Log.Info("Restricted media to room ", roomId, " (event: ", eventId, ")")
+	return nil
+}
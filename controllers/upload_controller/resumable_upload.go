@@ -0,0 +1,355 @@
+package upload_controller
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+)
+
+// Uploads which have been claimed for longer than this are assumed to have been abandoned by a
+// process which stopped part way through finishing them.
+const resumableUploadClaimTimeout = 10 * time.Minute
+
+// StartResumableUpload sets up an upload of the given size which the client can send in chunks. The
+// media ID the upload will become is picked now so it can be given to the client straight away.
+func StartResumableUpload(sizeBytes int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*types.ResumableUpload, error) {
+	ds, err := datastore.PickDatastoreForUpload(common.KindLocalMedia, &datastore.UploadDetails{
+		UserId:      userId,
+		Origin:      origin,
+		ContentType: contentType,
+		SizeBytes:   sizeBytes,
+	}, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+	uploadId, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &types.ResumableUpload{
+		UploadId:    uploadId,
+		Origin:      origin,
+		MediaId:     mediaId,
+		UserId:      userId,
+		DatastoreId: ds.DatastoreId,
+		ContentType: contentType,
+		UploadName:  filename,
+		SizeBytes:   sizeBytes,
+		OffsetBytes: 0,
+		ExpiresTs:   resumableUploadExpiry(ctx),
+	}
+	err = storage.GetDatabase().GetMetadataStore(ctx).InsertResumableUpload(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info("Started resumable upload ", uploadId, " for media ID ", mediaId)
+	return upload, nil
+}
+
+// GetResumableUpload returns the user's resumable upload, or common.ErrMediaNotFound if they don't have
+// one with that ID.
+func GetResumableUpload(uploadId string, userId string, ctx rcontext.RequestContext) (*types.ResumableUpload, error) {
+	upload, err := storage.GetDatabase().GetMetadataStore(ctx).GetResumableUpload(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil || upload.UserId != userId || upload.ExpiresTs < util.NowMillis() {
+		return nil, common.ErrMediaNotFound
+	}
+	return upload, nil
+}
+
+// AppendToResumableUpload stores the next chunk of an upload, which must start at the given offset. If
+// this completes the upload, it is turned into media and returned as well. An empty chunk at the end
+// of the upload tries turning it into media again, in case that failed the first time. Returns
+// common.ErrUploadOffsetMismatch if the upload isn't at that offset, and common.ErrMediaTooLarge if the
+// chunk goes past the size given when the upload was started.
+func AppendToResumableUpload(uploadId string, offset int64, contents io.Reader, userId string, ctx rcontext.RequestContext) (*types.ResumableUpload, *types.Media, error) {
+	upload, err := GetResumableUpload(uploadId, userId, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if upload.OffsetBytes != offset {
+		return nil, nil, common.ErrUploadOffsetMismatch
+	}
+
+	// Whatever arrived before the connection dropped is kept, so the client can resume from there
+	remaining := upload.SizeBytes - upload.OffsetBytes
+	chunk, readErr := ioutil.ReadAll(io.LimitReader(contents, remaining+1))
+	if int64(len(chunk)) > remaining {
+		return nil, nil, common.ErrMediaTooLarge
+	}
+	if readErr != nil {
+		ctx.Log.Warn("Error reading chunk, keeping the ", len(chunk), " bytes received: ", readErr)
+	}
+	if len(chunk) == 0 && readErr != nil {
+		return nil, nil, readErr
+	}
+	if len(chunk) > 0 {
+		err = storeResumableUploadChunk(upload, chunk, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if upload.OffsetBytes < upload.SizeBytes {
+		return upload, nil, nil
+	}
+
+	media, err := finishResumableUpload(upload, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return upload, media, nil
+}
+
+// storeResumableUploadChunk stores a chunk starting at the upload's current offset, then moves the
+// upload's offset past it.
+func storeResumableUploadChunk(upload *types.ResumableUpload, chunk []byte, ctx rcontext.RequestContext) error {
+	uploadId := upload.UploadId
+	offset := upload.OffsetBytes
+	ds, err := datastore.LocateDatastore(ctx, upload.DatastoreId)
+	if err != nil {
+		return err
+	}
+	info, err := ds.UploadFile(util.BytesToStream(chunk), int64(len(chunk)), ctx)
+	if err != nil {
+		return err
+	}
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	newOffset := offset + int64(len(chunk))
+	advanced, err := db.AdvanceResumableUpload(uploadId, offset, newOffset, resumableUploadExpiry(ctx))
+	if err != nil || !advanced {
+		ds.DeleteObject(info.Location)
+		if err == nil {
+			err = common.ErrUploadOffsetMismatch
+		}
+		return err
+	}
+	err = db.InsertResumableUploadChunk(&types.ResumableUploadChunk{
+		UploadId:    uploadId,
+		OffsetBytes: offset,
+		SizeBytes:   int64(len(chunk)),
+		DatastoreId: ds.DatastoreId,
+		Location:    info.Location,
+	})
+	if err != nil {
+		ds.DeleteObject(info.Location)
+		_, err2 := db.AdvanceResumableUpload(uploadId, newOffset, offset, upload.ExpiresTs)
+		if err2 != nil {
+			ctx.Log.Error("Error rolling back resumable upload offset: ", err2)
+			sentry.CaptureException(err2)
+		}
+		return err
+	}
+	upload.OffsetBytes = newOffset
+	return nil
+}
+
+// CancelResumableUpload deletes the upload and the chunks uploaded so far.
+func CancelResumableUpload(uploadId string, userId string, ctx rcontext.RequestContext) error {
+	upload, err := GetResumableUpload(uploadId, userId, ctx)
+	if err != nil {
+		return err
+	}
+
+	// Uploads which are being finished can't be cancelled
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	claimed, err := db.ClaimResumableUpload(upload.UploadId, util.NowMillis()-resumableUploadClaimTimeout.Milliseconds())
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return common.ErrMediaNotFound
+	}
+	deleted, err := db.DeleteResumableUpload(upload.UploadId)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return common.ErrMediaNotFound
+	}
+
+	ctx.Log.Info("Cancelled resumable upload ", upload.UploadId)
+	deleteResumableUploadChunks(upload.UploadId, ctx)
+	return nil
+}
+
+// ExpireResumableUploads deletes uploads which haven't received a chunk in a while.
+func ExpireResumableUploads(ctx rcontext.RequestContext) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	uploads, err := db.GetExpiredResumableUploads(util.NowMillis())
+	if err != nil {
+		ctx.Log.Error("Error getting expired resumable uploads: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, upload := range uploads {
+		rctx := ctx.LogWithFields(logrus.Fields{"uploadId": upload.UploadId})
+		claimed, err := db.ClaimResumableUpload(upload.UploadId, util.NowMillis()-resumableUploadClaimTimeout.Milliseconds())
+		if err != nil {
+			rctx.Log.Error("Error claiming expired resumable upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if !claimed {
+			// Being finished right now
+			continue
+		}
+		deleted, err := db.DeleteResumableUpload(upload.UploadId)
+		if err != nil {
+			rctx.Log.Error("Error removing expired resumable upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if !deleted {
+			// Finished at the last moment
+			continue
+		}
+
+		rctx.Log.Info("Deleting chunks of expired resumable upload")
+		deleteResumableUploadChunks(upload.UploadId, rctx)
+	}
+}
+
+// finishResumableUpload turns the chunks of a complete upload into media. The upload and its chunks are
+// only removed once the media is stored, so the client can try again if anything goes wrong. Returns
+// common.ErrUploadOffsetMismatch if another request is already finishing the upload.
+func finishResumableUpload(upload *types.ResumableUpload, ctx rcontext.RequestContext) (*types.Media, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+
+	// Only one request gets to turn the chunks into media
+	claimed, err := db.ClaimResumableUpload(upload.UploadId, util.NowMillis()-resumableUploadClaimTimeout.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, common.ErrUploadOffsetMismatch
+	}
+
+	m, err := storeResumableUpload(upload, ctx)
+	if err != nil {
+		err2 := db.ReleaseResumableUpload(upload.UploadId)
+		if err2 != nil {
+			// The claim goes stale eventually, after which the client can try again
+			ctx.Log.Error("Error releasing resumable upload: ", err2)
+			sentry.CaptureException(err2)
+		}
+		return nil, err
+	}
+
+	_, err = db.DeleteResumableUpload(upload.UploadId)
+	if err != nil {
+		// The media exists regardless, and the upload expires on its own
+		ctx.Log.Warn("Unexpected error removing finished resumable upload: ", err)
+		sentry.CaptureException(err)
+		return m, nil
+	}
+	deleteResumableUploadChunks(upload.UploadId, ctx)
+	return m, nil
+}
+
+func storeResumableUpload(upload *types.ResumableUpload, ctx rcontext.RequestContext) (*types.Media, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	chunks, err := db.GetResumableUploadChunks(upload.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := &bytes.Buffer{}
+	for _, chunk := range chunks {
+		ds, err := datastore.LocateDatastore(ctx, chunk.DatastoreId)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := ds.DownloadFile(chunk.Location)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(contents, stream)
+		stream.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if int64(contents.Len()) != upload.SizeBytes {
+		ctx.Log.Errorf("Resumable upload has %d bytes in its chunks but should have %d", contents.Len(), upload.SizeBytes)
+		return nil, common.ErrMediaNotFound
+	}
+
+	ctx.Log.Info("Finishing resumable upload ", upload.UploadId)
+	uploadStartTs := util.NowMillis()
+	dataBytes, sizeBytes, originalSize, err := processUpload(contents, upload.SizeBytes, upload.ContentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client was told the media ID when the upload started, so duplicates of the user's other
+	// uploads can't be returned instead.
+	m, err := StoreDirect(nil, util_byte_seeker.NewByteSeeker(dataBytes), sizeBytes, upload.ContentType, upload.UploadName, upload.UserId, upload.Origin, upload.MediaId, common.KindLocalMedia, ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	recordOriginalSize(m, originalSize, uploadStartTs, ctx)
+	recordUploadAttribution(m, uploadStartTs, ctx)
+
+	err = internal_cache.Get().UploadMedia(m.Sha256Hash, util_byte_seeker.NewByteSeeker(dataBytes), ctx)
+	if err != nil {
+		ctx.Log.Warn("Unexpected error trying to cache media: " + err.Error())
+	}
+	return m, nil
+}
+
+func deleteResumableUploadChunks(uploadId string, ctx rcontext.RequestContext) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	chunks, err := db.GetResumableUploadChunks(uploadId)
+	if err != nil {
+		ctx.Log.Error("Error getting chunks of resumable upload: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, chunk := range chunks {
+		ds, err := datastore.LocateDatastore(ctx, chunk.DatastoreId)
+		if err != nil {
+			ctx.Log.Warn("Error locating datastore for resumable upload chunk: ", err)
+			continue
+		}
+		err = ds.DeleteObject(chunk.Location)
+		if err != nil {
+			ctx.Log.Warn("Error deleting resumable upload chunk: ", err)
+		}
+	}
+
+	err = db.DeleteResumableUploadChunks(uploadId)
+	if err != nil {
+		ctx.Log.Error("Error removing chunks of resumable upload: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func resumableUploadExpiry(ctx rcontext.RequestContext) int64 {
+	expiry := time.Duration(ctx.Config.Uploads.Resumable.ExpirySeconds) * time.Second
+	return util.NowMillis() + expiry.Milliseconds()
+}
@@ -0,0 +1,119 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Uploads by other instances sharing the database may still be in progress, so only staged uploads
+// which have been around for longer than any upload should take are reconciled.
+const stagedUploadGracePeriod = 15 * time.Minute
+
+// stageUpload records that a file was written to the datastore for media which hasn't been stored yet,
+// so the file can be found again if the media repo stops before the upload is committed.
+func stageUpload(ds *datastore.DatastoreRef, location string, origin string, mediaId string, ctx rcontext.RequestContext) (*types.StagedUpload, error) {
+	staged := &types.StagedUpload{
+		DatastoreId: ds.DatastoreId,
+		Location:    location,
+		Origin:      origin,
+		MediaId:     mediaId,
+		CreationTs:  util.NowMillis(),
+	}
+	err := storage.GetDatabase().GetMetadataStore(ctx).InsertStagedUpload(staged)
+	if err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// finishStagedUpload forgets the staged upload once its file belongs to media or has been deleted.
+func finishStagedUpload(staged *types.StagedUpload, ctx rcontext.RequestContext) {
+	if staged == nil {
+		return
+	}
+	_, err := storage.GetDatabase().GetMetadataStore(ctx).DeleteStagedUpload(staged.DatastoreId, staged.Location)
+	if err != nil {
+		// Reconciliation will get to it eventually
+		ctx.Log.Warn("Unexpected error removing staged upload: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// ReconcileStagedUploads finishes uploads which were interrupted between their file being written and
+// their media being stored. Files which never became media are deleted, and media which was stored
+// before its file was moved into place gets the file it expects.
+func ReconcileStagedUploads(ctx rcontext.RequestContext) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	uploads, err := db.GetStagedUploadsBefore(util.NowMillis() - stagedUploadGracePeriod.Milliseconds())
+	if err != nil {
+		ctx.Log.Error("Error getting staged uploads: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, upload := range uploads {
+		rctx := ctx.LogWithFields(logrus.Fields{
+			"datastoreId": upload.DatastoreId,
+			"location":    upload.Location,
+			"origin":      upload.Origin,
+			"mediaId":     upload.MediaId,
+		})
+		err = reconcileStagedUpload(upload, rctx)
+		if err != nil {
+			rctx.Log.Error("Error reconciling interrupted upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		finishStagedUpload(upload, rctx)
+	}
+}
+
+func reconcileStagedUpload(upload *types.StagedUpload, ctx rcontext.RequestContext) error {
+	ds, err := datastore.LocateDatastore(ctx, upload.DatastoreId)
+	if err != nil {
+		return err
+	}
+
+	media, err := storage.GetDatabase().GetMediaStore(ctx).Get(upload.Origin, upload.MediaId)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	stored := err == nil
+	if stored && media.DatastoreId == upload.DatastoreId && media.Location == upload.Location {
+		ctx.Log.Info("Interrupted upload was already stored as media")
+		return nil
+	}
+	if !ds.ObjectExists(upload.Location) {
+		ctx.Log.Info("Interrupted upload has no file to clean up")
+		return nil
+	}
+
+	if stored {
+		target, err := datastore.LocateDatastore(ctx, media.DatastoreId)
+		if err != nil {
+			return err
+		}
+		if !target.ObjectExists(media.Location) {
+			ctx.Log.Info("Completing interrupted upload by moving its file to where the media expects it")
+			stream, err := ds.DownloadFile(upload.Location)
+			if err != nil {
+				return err
+			}
+			err = target.OverwriteObject(media.Location, stream, ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ctx.Log.Info("Deleting file of interrupted upload")
+	return ds.DeleteObject(upload.Location)
+}
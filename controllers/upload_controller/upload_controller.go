@@ -10,17 +10,23 @@ import (
 
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/ryanuber/go-glob"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/plugins"
+	"github.com/turt2live/matrix-media-repo/quota"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_ipfs"
+	"github.com/turt2live/matrix-media-repo/thumbnailing"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+	"github.com/turt2live/matrix-media-repo/util/util_exif"
 )
 
 const NoApplicableUploadUser = ""
@@ -74,6 +80,23 @@ func IsRequestTooSmall(contentLength int64, contentLengthHeader string, ctx rcon
 	return false // We can only assume
 }
 
+// IsUserBannedFromUploading returns whether the user matches one of the upload bans. Banned users
+// keep their existing media.
+func IsUserBannedFromUploading(userId string, ctx rcontext.RequestContext) (bool, error) {
+	bans, err := storage.GetDatabase().GetMetadataStore(ctx).GetUploadBans()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ban := range bans {
+		if glob.Glob(ban.Pattern, userId) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func EstimateContentLength(contentLength int64, contentLengthHeader string) int64 {
 	if contentLength >= 0 {
 		return contentLength
@@ -94,37 +117,264 @@ func EstimateContentLength(contentLength int64, contentLengthHeader string) int6
 
 func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*types.Media, error) {
 	defer cleanup.DumpAndCloseStream(contents)
+	uploadStartTs := util.NowMillis()
+
+	unsized := contentLength < 0
+	dataBytes, contentLength, originalSize, err := processUpload(contents, contentLength, contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if unsized {
+		err = checkQuotaOfUnsizedUpload(dataBytes, userId, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var existingFile *AlreadyUploadedFile = nil
+	ds, err := datastore.PickDatastoreForUpload(common.KindLocalMedia, &datastore.UploadDetails{
+		UserId:      userId,
+		Origin:      origin,
+		ContentType: contentType,
+		SizeBytes:   int64(len(dataBytes)),
+	}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ds.Type == "ipfs" {
+		// Do the upload now so we can pick the media ID to point to IPFS
+		info, err := ds.UploadFile(util_byte_seeker.NewByteSeeker(dataBytes), contentLength, ctx)
+		if err != nil {
+			return nil, err
+		}
+		existingFile = &AlreadyUploadedFile{
+			DS:         ds,
+			ObjectInfo: info,
+		}
+		cid, err := ds_ipfs.CidFromLocation(info.Location)
+		if err != nil {
+			return nil, err
+		}
+		mediaId = fmt.Sprintf("ipfs:%s", cid)
+	}
+
+	m, err := StoreDirect(existingFile, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, true)
+	if err != nil {
+		return m, err
+	}
+	if m != nil {
+		recordOriginalSize(m, originalSize, uploadStartTs, ctx)
+		recordUploadAttribution(m, uploadStartTs, ctx)
+		err = internal_cache.Get().UploadMedia(m.Sha256Hash, util_byte_seeker.NewByteSeeker(dataBytes), ctx)
+		if err != nil {
+			ctx.Log.Warn("Unexpected error trying to cache media: " + err.Error())
+		}
+	}
+	return m, err
+}
+
+// processUpload reads an upload into memory and applies the server's image limits, recompression, and
+// metadata stripping to it. Returns the contents to store, their length, and the size of the original
+// upload for recordOriginalSize. Every way of uploading media goes through this. The limits go by what
+// the contents look like rather than the content type the uploader gave, which they can pick freely.
+func processUpload(contents io.Reader, contentLength int64, contentType string, ctx rcontext.RequestContext) ([]byte, int64, int64, error) {
+	dataBytes, err := readUploadContents(contents, ctx)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if detected := util.DetectContentType(dataBytes); detected != "" {
+		contentType = detected
+	}
+	err = checkImageDimensions(dataBytes, contentType, ctx)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	dataBytes, contentLength, originalSize := recompressImage(dataBytes, contentLength, contentType, ctx)
+	dataBytes, contentLength = stripMetadata(dataBytes, contentLength, ctx)
+	return dataBytes, contentLength, originalSize, nil
+}
+
+// checkQuotaOfUnsizedUpload returns common.ErrQuotaExceeded if an upload which didn't give its size up
+// front takes the user over their quota. Such uploads are only checked against what the user had
+// already uploaded before they were read.
+func checkQuotaOfUnsizedUpload(contents []byte, userId string, ctx rcontext.RequestContext) error {
+	if userId == NoApplicableUploadUser {
+		return nil
+	}
+	inQuota, err := quota.IsUserWithinQuota(ctx, userId, int64(len(contents)))
+	if err != nil {
+		return err
+	}
+	if !inQuota {
+		ctx.Log.Warnf("Upload of %d bytes would exceed the user's quota", len(contents))
+		return common.ErrQuotaExceeded
+	}
+	return nil
+}
 
-	var data io.ReadCloser
-	if ctx.Config.Uploads.MaxSizeBytes > 0 {
-		data = ioutil.NopCloser(io.LimitReader(contents, ctx.Config.Uploads.MaxSizeBytes))
-	} else {
-		data = contents
+// uploadProcessingEnabled returns whether processUpload could change or reject an upload. Uploads
+// which never pass through the media repo only need to be read back when this is the case.
+func uploadProcessingEnabled(ctx rcontext.RequestContext) bool {
+	limits := ctx.Config.Uploads.Images
+	hasLimits := limits.MaxWidth > 0 || limits.MaxHeight > 0 || limits.MaxPixels > 0
+	return hasLimits || ctx.Config.Uploads.Recompress.Enabled || ctx.Config.Uploads.StripMetadata
+}
+
+// readUploadContents reads an upload into memory. Returns common.ErrMediaTooLarge if it is bigger than
+// uploads are allowed to be, rather than storing only part of it. The whole upload has to be read for
+// any digest the client gave to be checked, too.
+func readUploadContents(contents io.Reader, ctx rcontext.RequestContext) ([]byte, error) {
+	maxBytes := ctx.Config.Uploads.MaxSizeBytes
+	if maxBytes <= 0 {
+		return ioutil.ReadAll(contents)
 	}
 
-	dataBytes, err := ioutil.ReadAll(data)
+	b, err := ioutil.ReadAll(io.LimitReader(contents, maxBytes+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(b)) > maxBytes {
+		return nil, common.ErrMediaTooLarge
+	}
+	return b, nil
+}
+
+// SetUploadExpiry marks media uploaded at or after uploadStartTs to be purged once expiresTs has passed.
+// Media which already existed is left alone, such as when the user uploads the same file again, so an
+// earlier upload isn't purged along with the new one.
+func SetUploadExpiry(media *types.Media, expiresTs int64, uploadStartTs int64, ctx rcontext.RequestContext) error {
+	if media.CreationTs < uploadStartTs {
+		ctx.Log.Info("Not setting an expiry on media which existed before the upload")
+		return nil
+	}
+
+	ctx.Log.Infof("Media expires at %d", expiresTs)
+	return storage.GetDatabase().GetMediaAttributesStore(ctx).UpsertExpiry(media.Origin, media.MediaId, expiresTs)
+}
+
+// checkImageDimensions returns common.ErrMediaTooLarge if the upload is an image which is wider, taller,
+// or has more pixels than the server allows. Only the image's header is read, so images which would
+// take too much memory to decode are caught before anything tries to.
+func checkImageDimensions(contents []byte, contentType string, ctx rcontext.RequestContext) error {
+	limits := ctx.Config.Uploads.Images
+	if limits.MaxWidth <= 0 && limits.MaxHeight <= 0 && limits.MaxPixels <= 0 {
+		return nil
+	}
+
+	dimensional, width, height, err := thumbnailing.GetImageDimensions(contents, contentType, ctx)
+	if err != nil {
+		// Not an image we understand, so it can't be thumbnailed either
+		ctx.Log.Warn("Unable to read image dimensions of upload: ", err)
+		return nil
+	}
+	if !dimensional {
+		return nil
+	}
+	if thumbnailing.ExceedsDimensions(width, height, limits.MaxWidth, limits.MaxHeight) || (limits.MaxPixels > 0 && width*height > limits.MaxPixels) {
+		ctx.Log.Warnf("Image is %dx%d, which is larger than allowed", width, height)
+		return common.ErrMediaTooLarge
+	}
+	return nil
+}
+
+// recompressImage re-encodes large images if the server is configured to, returning the contents to
+// store, their length, and the size of the original upload. The original size is zero if the upload
+// is stored as it is, which includes images that would come out bigger than they went in.
+func recompressImage(contents []byte, contentLength int64, contentType string, ctx rcontext.RequestContext) ([]byte, int64, int64) {
+	conf := ctx.Config.Uploads.Recompress
+	if !conf.Enabled {
+		return contents, contentLength, 0
+	}
+
+	tooBig := conf.MinSizeBytes > 0 && int64(len(contents)) > conf.MinSizeBytes
+	if !tooBig {
+		dimensional, width, height, err := thumbnailing.GetImageDimensions(contents, contentType, ctx)
+		if err != nil || !dimensional || !thumbnailing.ExceedsDimensions(width, height, conf.MaxWidth, conf.MaxHeight) {
+			return contents, contentLength, 0
+		}
+	}
+
+	maxPixels := ctx.Config.Thumbnails.MaxPixels
+	recompressed, err := thumbnailing.RecompressImage(contents, contentType, conf.MaxWidth, conf.MaxHeight, maxPixels, conf.JpegQuality)
+	if err == thumbnailing.ErrUnsupported {
+		return contents, contentLength, 0
+	}
+	if err == common.ErrMediaTooLarge {
+		ctx.Log.Infof("Upload has more than %d pixels, storing it without recompressing", maxPixels)
+		return contents, contentLength, 0
+	}
+	if err != nil {
+		ctx.Log.Warn("Unable to recompress upload, storing it unchanged: ", err)
+		return contents, contentLength, 0
+	}
+	if len(recompressed) >= len(contents) {
+		ctx.Log.Info("Recompressing upload did not make it smaller, storing it unchanged")
+		return contents, contentLength, 0
+	}
 
+	ctx.Log.Infof("Recompressed upload from %d bytes to %d bytes", len(contents), len(recompressed))
+	return recompressed, int64(len(recompressed)), int64(len(contents))
+}
+
+// recordOriginalSize keeps the size of a recompressed upload in the media's attributes. Media which
+// existed before the upload is left alone, as its contents didn't come from this upload.
+func recordOriginalSize(media *types.Media, originalSize int64, uploadStartTs int64, ctx rcontext.RequestContext) {
+	if originalSize <= 0 || media.CreationTs < uploadStartTs {
+		return
+	}
+
+	err := storage.GetDatabase().GetMediaAttributesStore(ctx).UpsertOriginalSize(media.Origin, media.MediaId, originalSize)
+	if err != nil {
+		// The media is stored regardless
+		ctx.Log.Warn("Unexpected error recording the original size of recompressed media: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// stripMetadata removes metadata from uploaded images if the server is configured to, returning the
+// contents to store and their length. Images which can't be stripped are stored as they are.
+func stripMetadata(contents []byte, contentLength int64, ctx rcontext.RequestContext) ([]byte, int64) {
+	if !ctx.Config.Uploads.StripMetadata {
+		return contents, contentLength
+	}
+
+	stripped, err := util_exif.StripMetadata(contents)
+	if err != nil {
+		ctx.Log.Warn("Unable to strip metadata from upload, storing it unchanged: ", err)
+		return contents, contentLength
+	}
+	if len(stripped) == len(contents) {
+		return stripped, contentLength
+	}
+	ctx.Log.Infof("Stripped %d bytes of metadata from upload", len(contents)-len(stripped))
+	return stripped, int64(len(stripped))
+}
+
+func generateMediaId(origin string, ctx rcontext.RequestContext) (string, error) {
 	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
 
+	var err error
 	mediaTaken := true
 	var mediaId string
 	attempts := 0
 	for mediaTaken {
 		attempts += 1
 		if attempts > 10 {
-			return nil, errors.New("failed to generate a media ID after 10 rounds")
+			return "", errors.New("failed to generate a media ID after 10 rounds")
 		}
 
 		mediaId, err = util.GenerateRandomString(64)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		mediaId, err = util.GetSha1OfString(mediaId + strconv.FormatInt(util.NowMillis(), 10))
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 
 		// Because we use the current time in the media ID, we don't need to worry about
@@ -136,61 +386,68 @@ func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string
 
 		mediaTaken, err = metadataDb.IsReserved(origin, mediaId)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 	}
 
 	_ = recentMediaIds.Add(mediaId, true, cache.DefaultExpiration)
+	return mediaId, nil
+}
 
-	var existingFile *AlreadyUploadedFile = nil
-	ds, err := datastore.PickDatastore(common.KindLocalMedia, ctx)
+func trackUploadAsLastAccess(ctx rcontext.RequestContext, media *types.Media) {
+	err := storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
 	if err != nil {
-		return nil, err
-	}
-	if ds.Type == "ipfs" {
-		// Do the upload now so we can pick the media ID to point to IPFS
-		info, err := ds.UploadFile(util_byte_seeker.NewByteSeeker(dataBytes), contentLength, ctx)
-		if err != nil {
-			return nil, err
-		}
-		existingFile = &AlreadyUploadedFile{
-			DS:         ds,
-			ObjectInfo: info,
-		}
-		mediaId = fmt.Sprintf("ipfs:%s", info.Location[len("ipfs/"):])
+		logrus.Warn("Failed to upsert the last access time: ", err)
 	}
+}
 
-	m, err := StoreDirect(existingFile, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, true)
+// checkBlockedHash checks the media against the hash blocklist. Returns common.ErrMediaQuarantined if it
+// is rejected, or true if it should be stored as quarantined media.
+func checkBlockedHash(contents []byte, sha256Hash string, ctx rcontext.RequestContext) (bool, error) {
+	blocked, err := checkHashBlocklist(contents, sha256Hash, ctx)
 	if err != nil {
-		return m, err
-	}
-	if m != nil {
-		err = internal_cache.Get().UploadMedia(m.Sha256Hash, util_byte_seeker.NewByteSeeker(dataBytes), ctx)
-		if err != nil {
-			ctx.Log.Warn("Unexpected error trying to cache media: " + err.Error())
+		ctx.Log.Warn("Error checking hash blocklist - assuming not blocked: " + err.Error())
+		sentry.CaptureException(err)
+	} else if blocked != nil {
+		if blocked.Action == types.BlockActionQuarantine {
+			ctx.Log.Warnf("Media matches blocked %s hash %s - quarantining: %s", blocked.HashType, blocked.Hash, blocked.Reason)
+			return true, nil
 		}
+		ctx.Log.Warnf("Media matches blocked %s hash %s - rejecting: %s", blocked.HashType, blocked.Hash, blocked.Reason)
+		return false, common.ErrMediaQuarantined
 	}
-	return m, err
+	return false, nil
 }
 
-func trackUploadAsLastAccess(ctx rcontext.RequestContext, media *types.Media) {
-	err := storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
-	if err != nil {
-		logrus.Warn("Failed to upsert the last access time: ", err)
+// checkSpam checks the media against the hash blocklist, then asks the spam checkers whether it can be
+// stored. Returns common.ErrMediaQuarantined if it is rejected, or true if it should be stored as
+// quarantined media.
+func checkSpam(contents []byte, sha256Hash string, filename string, contentType string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext) (bool, error) {
+	quarantine, err := checkBlockedHash(contents, sha256Hash, ctx)
+	if err != nil || quarantine {
+		return quarantine, err
 	}
-}
 
-func checkSpam(contents []byte, filename string, contentType string, userId string, origin string, mediaId string) error {
-	spam, err := plugins.CheckForSpam(contents, filename, contentType, userId, origin, mediaId)
+	action, reason, err := plugins.CheckUpload(ctx, contents, sha256Hash, filename, contentType, userId, origin, mediaId, kind)
 	if err != nil {
-		logrus.Warn("Error checking spam - assuming not spam: " + err.Error())
 		sentry.CaptureException(err)
-		return nil
+		if config.Get().SpamChecker.FailClosed {
+			ctx.Log.Warn("Error checking spam - rejecting upload: " + err.Error())
+			return false, common.ErrMediaQuarantined
+		}
+		ctx.Log.Warn("Error checking spam - assuming not spam: " + err.Error())
+		return false, nil
 	}
-	if spam {
-		return common.ErrMediaQuarantined
+
+	switch action {
+	case plugins.SpamActionReject:
+		ctx.Log.Warn("Spam checker rejected upload: ", reason)
+		return false, common.ErrMediaQuarantined
+	case plugins.SpamActionQuarantine:
+		ctx.Log.Warn("Spam checker quarantined upload: ", reason)
+		return true, nil
 	}
-	return nil
+	return false, nil
 }
 
 func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool) (*types.Media, error) {
@@ -198,24 +455,48 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 	var ds *datastore.DatastoreRef
 	var info *types.ObjectInfo
 	var contentBytes []byte
+	var staged *types.StagedUpload
+	reusedFile := false
+	filename = util.SanitizeFilename(filename, ctx.Config.Uploads.Filenames)
 	if f == nil {
-		dsPicked, err := datastore.PickDatastore(kind, ctx)
+		contentBytes, err = ioutil.ReadAll(contents)
 		if err != nil {
 			return nil, err
 		}
-		ds = dsPicked
 
-		contentBytes, err = ioutil.ReadAll(contents)
+		if ctx.Config.Uploads.Deduplication.SkipExistingFiles {
+			ds, info, err = findExistingObject(contentBytes, ctx)
+			if err != nil {
+				return nil, err
+			}
+			reusedFile = ds != nil
+		}
+	}
+	if f == nil && !reusedFile {
+		dsPicked, err := datastore.PickDatastoreForUpload(kind, &datastore.UploadDetails{
+			UserId:      userId,
+			Origin:      origin,
+			ContentType: contentType,
+			SizeBytes:   int64(len(contentBytes)),
+		}, ctx)
 		if err != nil {
 			return nil, err
 		}
+		ds = dsPicked
 
-		fInfo, err := ds.UploadFile(util.BytesToStream(contentBytes), expectedSize, ctx)
+		fInfo, err := ds.UploadFileOfType(util.BytesToStream(contentBytes), expectedSize, contentType, ctx)
 		if err != nil {
 			return nil, err
 		}
 		info = fInfo
-	} else {
+
+		// The file is only committed once the media is stored below
+		staged, err = stageUpload(ds, info.Location, origin, mediaId, ctx)
+		if err != nil {
+			ds.DeleteObject(info.Location)
+			return nil, err
+		}
+	} else if f != nil {
 		ds = f.DS
 		info = f.ObjectInfo
 
@@ -230,10 +511,23 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		}
 	}
 
+	// A file which was already stored belongs to other media, so mustn't be deleted along with the upload
+	deleteTemp := func() {
+		if !reusedFile {
+			err := ds.DeleteObject(info.Location)
+			if err != nil {
+				// Leave it staged so it is cleaned up later
+				ctx.Log.Warn("Unexpected error deleting uploaded file: ", err)
+				return
+			}
+		}
+		finishStagedUpload(staged, ctx)
+	}
+
 	db := storage.GetDatabase().GetMediaStore(ctx)
 	records, err := db.GetByHash(info.Sha256Hash)
 	if err != nil {
-		ds.DeleteObject(info.Location) // delete temp object
+		deleteTemp()
 		return nil, err
 	}
 
@@ -243,31 +537,39 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		// If the user is a real user (ie: actually uploaded media), then we'll see if there's
 		// an exact duplicate that we can return. Otherwise we'll just pick the first record and
 		// clone that.
-		if filterUserDuplicates && userId != NoApplicableUploadUser {
+		if filterUserDuplicates && userId != NoApplicableUploadUser && ctx.Config.Uploads.Deduplication.ReturnExistingMedia {
+			// The hash may have been blocked since the user last uploaded it
+			blockedForQuarantine, err := checkBlockedHash(contentBytes, info.Sha256Hash, ctx)
+			if err != nil {
+				deleteTemp()
+				return nil, err
+			}
+
 			for _, record := range records {
 				if record.Quarantined {
 					ctx.Log.Warn("User attempted to upload quarantined content - rejecting")
+					deleteTemp()
 					return nil, common.ErrMediaQuarantined
 				}
-				if record.UserId == userId && record.Origin == origin && record.ContentType == contentType {
+				if !blockedForQuarantine && record.UserId == userId && record.Origin == origin && record.ContentType == contentType {
 					ctx.Log.Info("User has already uploaded this media before - returning unaltered media record")
-					ds.DeleteObject(info.Location) // delete temp object
+					deleteTemp()
 					trackUploadAsLastAccess(ctx, record)
 					return record, nil
 				}
 			}
 		}
 
-		err = checkSpam(contentBytes, filename, contentType, userId, origin, mediaId)
+		quarantine, err := checkSpam(contentBytes, info.Sha256Hash, filename, contentType, userId, origin, mediaId, kind, ctx)
 		if err != nil {
-			ds.DeleteObject(info.Location) // delete temp object
+			deleteTemp()
 			return nil, err
 		}
 
 		// We'll use the location from the first record
 		record := records[0]
 		if record.Quarantined {
-			ds.DeleteObject(info.Location) // delete temp object
+			deleteTemp()
 			ctx.Log.Warn("User attempted to upload quarantined content - rejecting")
 			return nil, common.ErrMediaQuarantined
 		}
@@ -276,32 +578,41 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		for _, knownRecord := range records {
 			if knownRecord.Origin == origin && knownRecord.MediaId == mediaId {
 				ctx.Log.Info("Duplicate media record found - returning unaltered record")
-				ds.DeleteObject(info.Location) // delete temp object
+				deleteTemp()
 				trackUploadAsLastAccess(ctx, knownRecord)
 				return knownRecord, nil
 			}
 		}
 
 		media := record
+		if reusedFile {
+			media.DatastoreId = ds.DatastoreId
+			media.Location = info.Location
+			media.StoredSizeBytes = info.StoredSizeBytes
+			media.Compressed = info.Compressed
+		}
 		media.Origin = origin
 		media.MediaId = mediaId
 		media.UserId = userId
 		media.UploadName = filename
 		media.ContentType = contentType
+		media.DetectedContentType = util.DetectContentType(contentBytes)
 		media.CreationTs = util.NowMillis()
+		media.Quarantined = quarantine
 
 		err = db.Insert(media)
 		if err != nil {
-			ds.DeleteObject(info.Location) // delete temp object
+			deleteTemp()
 			return nil, err
 		}
 
 		// If the media's file exists, we'll delete the temp file
 		// If the media's file doesn't exist, we'll move the temp file to where the media expects it to be
-		if media.DatastoreId != ds.DatastoreId && media.Location != info.Location {
+		if media.DatastoreId != ds.DatastoreId || media.Location != info.Location {
+			// The media is already stored, so the file stays staged until the media's file is in place. If
+			// that fails, the file is moved when the staged upload is reconciled.
 			ds2, err := datastore.LocateDatastore(ctx, media.DatastoreId)
 			if err != nil {
-				ds.DeleteObject(info.Location) // delete temp object
 				return nil, err
 			}
 			if !ds2.ObjectExists(media.Location) {
@@ -310,11 +621,14 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 					return nil, err
 				}
 
-				ds2.OverwriteObject(media.Location, stream, ctx)
-				ds.DeleteObject(info.Location)
-			} else {
-				ds.DeleteObject(info.Location)
+				err = ds2.OverwriteObject(media.Location, stream, ctx)
+				if err != nil {
+					return nil, err
+				}
 			}
+			deleteTemp()
+		} else {
+			finishStagedUpload(staged, ctx)
 		}
 
 		trackUploadAsLastAccess(ctx, media)
@@ -324,13 +638,13 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 	// The media doesn't already exist - save it as new
 
 	if info.SizeBytes <= 0 {
-		ds.DeleteObject(info.Location)
+		deleteTemp()
 		return nil, errors.New("file has no contents")
 	}
 
-	err = checkSpam(contentBytes, filename, contentType, userId, origin, mediaId)
+	quarantine, err := checkSpam(contentBytes, info.Sha256Hash, filename, contentType, userId, origin, mediaId, kind, ctx)
 	if err != nil {
-		ds.DeleteObject(info.Location) // delete temp object
+		deleteTemp()
 		return nil, err
 	}
 
@@ -347,14 +661,62 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		DatastoreId: ds.DatastoreId,
 		Location:    info.Location,
 		CreationTs:  util.NowMillis(),
+		Quarantined: quarantine,
+
+		StoredSizeBytes:     info.StoredSizeBytes,
+		DetectedContentType: util.DetectContentType(contentBytes),
+		Compressed:          info.Compressed,
+	}
+	if media.DetectedContentType != "" && media.DetectedContentType != util.FixContentType(contentType) {
+		ctx.Log.Infof("Media was uploaded as %s but looks like %s", contentType, media.DetectedContentType)
 	}
 
 	err = db.Insert(media)
 	if err != nil {
-		ds.DeleteObject(info.Location) // delete temp object
+		deleteTemp()
 		return nil, err
 	}
+	finishStagedUpload(staged, ctx)
 
 	trackUploadAsLastAccess(ctx, media)
 	return media, nil
 }
+
+// findExistingObject looks for a file with the same contents which is already stored, so an upload
+// can point at it instead of being written again. A nil datastore is returned if there isn't one.
+func findExistingObject(contents []byte, ctx rcontext.RequestContext) (*datastore.DatastoreRef, *types.ObjectInfo, error) {
+	hash, err := util.GetSha256HashOfStream(util.BytesToStream(contents))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, err := storage.GetDatabase().GetMediaStore(ctx).GetByHash(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		if record.Quarantined {
+			// Let the upload be rejected the usual way
+			return nil, nil, nil
+		}
+
+		ds, err := datastore.LocateDatastore(ctx, record.DatastoreId)
+		if err != nil {
+			ctx.Log.Warn("Error locating datastore for duplicate media: ", err)
+			continue
+		}
+		if !ds.ObjectExists(record.Location) {
+			continue
+		}
+
+		ctx.Log.Info("Reusing the file of ", record.Origin, "/", record.MediaId, " instead of storing the upload again")
+		return ds, &types.ObjectInfo{
+			Location:        record.Location,
+			Sha256Hash:      hash,
+			SizeBytes:       record.SizeBytes,
+			StoredSizeBytes: record.StoredSizeBytes,
+			Compressed:      record.Compressed,
+		}, nil
+	}
+	return nil, nil, nil
+}
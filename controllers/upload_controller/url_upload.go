@@ -0,0 +1,62 @@
+package upload_controller
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/preview_types"
+	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/previewers"
+)
+
+// FetchedUrl is the contents of a URL which are about to be uploaded as media.
+type FetchedUrl struct {
+	Contents    []byte
+	ContentType string
+	Filename    string
+}
+
+// FetchUrlForUpload downloads a URL on behalf of a user, through the same network ACL as URL previews.
+// Returns common.ErrInvalidHost or common.ErrHostBlacklisted if the URL can't be fetched from, and
+// common.ErrMediaTooLarge if it is bigger than uploads are allowed to be.
+func FetchUrlForUpload(urlStr string, ctx rcontext.RequestContext) (*FetchedUrl, error) {
+	parsedUrl, err := url.Parse(urlStr)
+	if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+		return nil, common.ErrInvalidHost
+	}
+	parsedUrl.Fragment = ""
+
+	timeout := time.Duration(ctx.Config.Uploads.FromUrl.TimeoutSeconds) * time.Second
+	contents, filename, contentType, err := previewers.DownloadMedia(&preview_types.UrlPayload{
+		UrlString: urlStr,
+		ParsedUrl: parsedUrl,
+	}, ctx.Config.Uploads.MaxSizeBytes, timeout, ctx)
+	if err != nil {
+		// Errors from the ACL come back wrapped by the HTTP client
+		for _, known := range []error{common.ErrInvalidHost, common.ErrHostBlacklisted, common.ErrHostNotFound, common.ErrMediaTooLarge} {
+			if errors.Is(err, known) {
+				return nil, known
+			}
+		}
+		return nil, err
+	}
+
+	if filename == "" {
+		filename = path.Base(parsedUrl.Path)
+		if filename == "/" || filename == "." {
+			filename = ""
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return &FetchedUrl{
+		Contents:    contents,
+		ContentType: contentType,
+		Filename:    filename,
+	}, nil
+}
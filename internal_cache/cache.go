@@ -1,6 +1,7 @@
 package internal_cache
 
 import (
+	"errors"
 	"io"
 
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
@@ -10,6 +11,16 @@ type CachedContent struct {
 	Contents io.ReadSeeker
 }
 
+// ErrNotSupported is returned when the cache can't perform the requested operation, such as
+// listing the entries of a cache shared with other services.
+var ErrNotSupported = errors.New("not supported by this cache")
+
+type CacheEntry struct {
+	Sha256Hash string
+	SizeBytes  int64
+	Downloads  int
+}
+
 type FetchFunction func() (io.ReadCloser, error)
 
 type ContentCache interface {
@@ -18,4 +29,7 @@ type ContentCache interface {
 	MarkDownload(fileHash string)
 	GetMedia(sha256hash string, contents FetchFunction, ctx rcontext.RequestContext) (*CachedContent, error)
 	UploadMedia(sha256hash string, content io.ReadCloser, ctx rcontext.RequestContext) error
+	Entries() ([]*CacheEntry, error)
+	Evict(sha256hash string, ctx rcontext.RequestContext) error
+	Flush() error
 }
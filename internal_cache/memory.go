@@ -94,6 +94,45 @@ func (c *MemoryCache) UploadMedia(sha256hash string, content io.ReadCloser, ctx
 	return nil
 }
 
+func (c *MemoryCache) Entries() ([]*CacheEntry, error) {
+	// Counting downloads trims the tracker, so this needs the write lock
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+
+	entries := make([]*CacheEntry, 0)
+	for k, item := range c.cache.Items() {
+		b := item.Object.([]byte)
+		entries = append(entries, &CacheEntry{
+			Sha256Hash: k,
+			SizeBytes:  int64(len(b)),
+			Downloads:  c.tracker.NumDownloads(k),
+		})
+	}
+	return entries, nil
+}
+
+func (c *MemoryCache) Evict(sha256hash string, ctx rcontext.RequestContext) error {
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+
+	if _, found := c.cache.Get(sha256hash); !found {
+		return nil
+	}
+
+	// No cooldown is set so the media can be cached again straight away, as the entry is
+	// usually evicted because it was bad rather than to make room.
+	ctx.Log.Info("Evicting " + sha256hash + " from the cache")
+	c.cache.Delete(sha256hash)
+	c.cooldownCache.Delete(sha256hash)
+	metrics.CacheEvictions.With(prometheus.Labels{"cache": "media", "reason": "admin"}).Inc()
+	return nil
+}
+
+func (c *MemoryCache) Flush() error {
+	c.Reset()
+	return nil
+}
+
 func (c *MemoryCache) getUnderlyingUsedBytes() int64 {
 	var size int64 = 0
 	for _, entry := range c.cache.Items() {
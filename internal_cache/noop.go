@@ -35,3 +35,17 @@ func (n *NoopCache) UploadMedia(sha256hash string, content io.ReadCloser, ctx rc
 	// do nothing
 	return nil
 }
+
+func (n *NoopCache) Entries() ([]*CacheEntry, error) {
+	return make([]*CacheEntry, 0), nil
+}
+
+func (n *NoopCache) Evict(sha256hash string, ctx rcontext.RequestContext) error {
+	// do nothing
+	return nil
+}
+
+func (n *NoopCache) Flush() error {
+	// do nothing
+	return nil
+}
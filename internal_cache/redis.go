@@ -62,6 +62,23 @@ func (c *RedisCache) updateItemInCache(sha256hash string, fetchFn FetchFunction,
 	return &CachedContent{Contents: util_byte_seeker.NewByteSeeker(b)}, nil
 }
 
+func (c *RedisCache) Entries() ([]*CacheEntry, error) {
+	// Redis may be shared with other services, so we can't tell which keys are ours
+	return nil, ErrNotSupported
+}
+
+func (c *RedisCache) Evict(sha256hash string, ctx rcontext.RequestContext) error {
+	err := c.redis.Delete(ctx, sha256hash)
+	if err == nil {
+		metrics.CacheEvictions.With(prometheus.Labels{"cache": "media", "reason": "admin"}).Inc()
+	}
+	return err
+}
+
+func (c *RedisCache) Flush() error {
+	return ErrNotSupported
+}
+
 func (c *RedisCache) UploadMedia(sha256hash string, content io.ReadCloser, ctx rcontext.RequestContext) error {
 	defer content.Close()
 	return c.redis.SetStream(ctx, sha256hash, content)
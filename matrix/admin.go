@@ -3,6 +3,7 @@ package matrix
 import (
 	"time"
 
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/util"
 )
@@ -34,6 +35,14 @@ func IsUserAdmin(ctx rcontext.RequestContext, serverName string, accessToken str
 	return isAdmin, replyError
 }
 
+// PingHomeserver checks that the homeserver's client-server API can be reached. The circuit breaker
+// is skipped so the result reflects the homeserver right now.
+func PingHomeserver(ctx rcontext.RequestContext, serverName string) error {
+	hs := config.GetDomain(serverName)
+	url := util.MakeUrl(hs.ClientServerApi, "/_matrix/client/versions")
+	return doRequest(ctx, "GET", url, nil, nil, "", "")
+}
+
 func ListMedia(ctx rcontext.RequestContext, serverName string, accessToken string, roomId string, ipAddr string) (*mediaListResponse, error) {
 	hs, cb := getBreakerAndConfig(serverName)
 
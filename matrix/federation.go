@@ -55,6 +55,13 @@ func getFederationBreaker(hostname string) *circuit.Breaker {
 	return cb
 }
 
+// ForgetServerApiUrl drops the cached API URL for the server, so the next lookup does the full
+// discovery process again.
+func ForgetServerApiUrl(hostname string) {
+	setupCache()
+	apiUrlCacheInstance.Delete(hostname)
+}
+
 // Note: URL lookups are not covered by the breaker because otherwise it might never close.
 func GetServerApiUrl(hostname string) (string, string, error) {
 	logrus.Info("Getting server API URL for " + hostname)
@@ -0,0 +1,57 @@
+package matrix
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// CanSeeEvent asks the homeserver whether the user can see the event. If eventId is empty, this checks
+// whether the user can see the room's state instead.
+func CanSeeEvent(ctx rcontext.RequestContext, serverName string, accessToken string, appserviceUserId string, ipAddr string, roomId string, eventId string) (bool, error) {
+	if accessToken == "" {
+		return false, ErrInvalidToken
+	}
+
+	hs, cb := getBreakerAndConfig(serverName)
+
+	path := util.MakeUrl(hs.ClientServerApi, "/_matrix/client/r0/rooms/", url.PathEscape(roomId), "/event/", url.PathEscape(eventId))
+	if eventId == "" {
+		path = util.MakeUrl(hs.ClientServerApi, "/_matrix/client/r0/rooms/", url.PathEscape(roomId), "/state/m.room.create/")
+	}
+	target, err := url.Parse(path)
+	if err != nil {
+		return false, err
+	}
+	if appserviceUserId != "" {
+		q := target.Query()
+		q.Set("user_id", appserviceUserId)
+		target.RawQuery = q.Encode()
+	}
+
+	canSee := false
+	var replyError error
+	var authError error
+	replyError = cb.CallContext(ctx, func() error {
+		err := doRequest(ctx, "GET", target.String(), nil, nil, accessToken, ipAddr)
+		if err != nil {
+			// Being told no is still an answer, and shouldn't trip the breaker
+			if mtxErr, ok := err.(*errorResponse); ok && (mtxErr.ErrorCode == common.ErrCodeForbidden || mtxErr.ErrorCode == common.ErrCodeNotFound) {
+				return nil
+			}
+			ctx.Log.Warn("Error from homeserver: ", err)
+			err, authError = filterError(err)
+			return err
+		}
+		canSee = true
+		return nil
+	}, 1*time.Minute)
+
+	if authError != nil {
+		return false, authError
+	}
+	return canSee, replyError
+}
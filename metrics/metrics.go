@@ -43,6 +43,18 @@ var MediaDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
 var UrlPreviewsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_url_previews_generated_total",
 }, []string{"type"})
+var IntegrityChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_integrity_checks_total",
+}, []string{"result"})
+var DatastoreHealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_datastore_health_checks_total",
+}, []string{"datastoreId", "result"})
+var DatastoreHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_datastore_healthy",
+}, []string{"datastoreId"})
+var DatastoreOverCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_datastore_over_capacity",
+}, []string{"datastoreId"})
 
 func init() {
 	prometheus.MustRegister(HttpRequests)
@@ -58,4 +70,8 @@ func init() {
 	prometheus.MustRegister(ThumbnailsGenerated)
 	prometheus.MustRegister(MediaDownloaded)
 	prometheus.MustRegister(UrlPreviewsGenerated)
+	prometheus.MustRegister(IntegrityChecks)
+	prometheus.MustRegister(DatastoreHealthChecks)
+	prometheus.MustRegister(DatastoreHealthy)
+	prometheus.MustRegister(DatastoreOverCapacity)
 }
@@ -0,0 +1,2 @@
+DROP INDEX idx_url_preview_opt_outs;
+DROP TABLE url_preview_opt_outs;
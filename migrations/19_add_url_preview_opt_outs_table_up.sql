@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS url_preview_opt_outs (
+	origin TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	created_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_url_preview_opt_outs ON url_preview_opt_outs (origin, entity_id);
@@ -0,0 +1 @@
+ALTER TABLE media DROP COLUMN IF EXISTS stored_size_bytes;
@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS stored_size_bytes BIGINT NULL;
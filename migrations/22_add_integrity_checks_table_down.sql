@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_integrity_checks_last_check_ts;
+DROP TABLE IF EXISTS integrity_checks;
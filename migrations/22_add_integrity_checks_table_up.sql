@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS integrity_checks (
+	sha256_hash TEXT PRIMARY KEY NOT NULL,
+	last_check_ts BIGINT NOT NULL,
+	corrupted BOOL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_integrity_checks_last_check_ts ON integrity_checks (last_check_ts);
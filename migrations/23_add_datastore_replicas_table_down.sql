@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_datastore_replicas_replica;
+DROP INDEX IF EXISTS idx_datastore_replicas;
+DROP TABLE IF EXISTS datastore_replicas;
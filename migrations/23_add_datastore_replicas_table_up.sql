@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS datastore_replicas (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	replica_datastore_id TEXT NOT NULL,
+	replica_location TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_datastore_replicas ON datastore_replicas (datastore_id, location, replica_datastore_id);
+CREATE INDEX IF NOT EXISTS idx_datastore_replicas_replica ON datastore_replicas (replica_datastore_id, replica_location);
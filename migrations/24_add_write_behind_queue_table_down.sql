@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_write_behind_queue_next_attempt_ts;
+DROP TABLE IF EXISTS write_behind_queue;
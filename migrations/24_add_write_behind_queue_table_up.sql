@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS write_behind_queue (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt_ts BIGINT NOT NULL,
+	last_error TEXT NOT NULL,
+	creation_ts BIGINT NOT NULL,
+	PRIMARY KEY (datastore_id, location)
+);
+CREATE INDEX IF NOT EXISTS idx_write_behind_queue_next_attempt_ts ON write_behind_queue (next_attempt_ts);
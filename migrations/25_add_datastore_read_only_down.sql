@@ -0,0 +1 @@
+ALTER TABLE datastores DROP COLUMN IF EXISTS read_only;
@@ -0,0 +1 @@
+ALTER TABLE datastores ADD COLUMN IF NOT EXISTS read_only BOOLEAN NOT NULL DEFAULT FALSE;
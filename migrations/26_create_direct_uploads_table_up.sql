@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS direct_uploads (
+	upload_id TEXT PRIMARY KEY NOT NULL,
+	origin TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	upload_name TEXT NOT NULL,
+	expires_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_direct_uploads_expires_ts ON direct_uploads (expires_ts);
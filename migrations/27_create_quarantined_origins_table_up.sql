@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS quarantined_origins (
+	origin TEXT PRIMARY KEY NOT NULL,
+	quarantined_by TEXT NOT NULL,
+	quarantined_ts BIGINT NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_quotas (
+	user_id TEXT PRIMARY KEY NOT NULL,
+	max_bytes BIGINT NOT NULL,
+	max_files BIGINT NOT NULL,
+	updated_ts BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE media_attributes DROP COLUMN IF EXISTS protected;
@@ -0,0 +1 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS protected BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_admin_audit_log_action;
+DROP INDEX IF EXISTS idx_admin_audit_log_user_id;
+DROP TABLE IF EXISTS admin_audit_log;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+	id SERIAL PRIMARY KEY,
+	ts BIGINT NOT NULL,
+	user_id TEXT NOT NULL,
+	host TEXT NOT NULL,
+	action TEXT NOT NULL,
+	params JSON NOT NULL,
+	affected_mxcs TEXT[] NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_user_id ON admin_audit_log (user_id);
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_action ON admin_audit_log (action);
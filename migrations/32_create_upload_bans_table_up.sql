@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS upload_bans (
+	pattern TEXT PRIMARY KEY NOT NULL,
+	banned_by TEXT NOT NULL,
+	banned_ts BIGINT NOT NULL
+);
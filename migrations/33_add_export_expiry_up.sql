@@ -0,0 +1 @@
+ALTER TABLE exports ADD COLUMN IF NOT EXISTS expires_ts BIGINT NOT NULL DEFAULT 0;
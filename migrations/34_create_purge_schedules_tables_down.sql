@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_purge_schedule_runs_schedule_id;
+DROP TABLE IF EXISTS purge_schedule_runs;
+DROP TABLE IF EXISTS purge_schedules;
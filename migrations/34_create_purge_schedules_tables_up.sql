@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS purge_schedules (
+	id SERIAL PRIMARY KEY,
+	kind TEXT NOT NULL,
+	target TEXT NOT NULL,
+	include_local BOOLEAN NOT NULL,
+	older_than_days INT NOT NULL,
+	time_of_day TEXT NOT NULL,
+	interval_days INT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_ts BIGINT NOT NULL,
+	next_run_ts BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS purge_schedule_runs (
+	id SERIAL PRIMARY KEY,
+	schedule_id INT NOT NULL,
+	start_ts BIGINT NOT NULL,
+	end_ts BIGINT NOT NULL,
+	purged INT NOT NULL,
+	bytes_reclaimed BIGINT NOT NULL,
+	error TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_purge_schedule_runs_schedule_id ON purge_schedule_runs (schedule_id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_rate_limits (
+	user_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	requests_per_second DOUBLE PRECISION NOT NULL,
+	burst INT NOT NULL,
+	updated_ts BIGINT NOT NULL,
+	PRIMARY KEY (user_id, action)
+);
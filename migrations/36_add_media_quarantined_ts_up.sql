@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS quarantined_ts BIGINT;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS admin_tokens (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL,
+	created_by TEXT NOT NULL,
+	created_ts BIGINT NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_pending_uploads_expires_ts;
+DROP TABLE IF EXISTS pending_uploads;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS pending_uploads (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	creation_ts BIGINT NOT NULL,
+	expires_ts BIGINT NOT NULL,
+	PRIMARY KEY (origin, media_id)
+);
+CREATE INDEX IF NOT EXISTS idx_pending_uploads_expires_ts ON pending_uploads (expires_ts);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS resumable_upload_chunks;
+DROP INDEX IF EXISTS idx_resumable_uploads_expires_ts;
+DROP TABLE IF EXISTS resumable_uploads;
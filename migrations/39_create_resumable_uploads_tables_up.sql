@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS resumable_uploads (
+	upload_id TEXT PRIMARY KEY NOT NULL,
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	datastore_id TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	upload_name TEXT NOT NULL,
+	size_bytes BIGINT NOT NULL,
+	offset_bytes BIGINT NOT NULL,
+	expires_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_resumable_uploads_expires_ts ON resumable_uploads (expires_ts);
+CREATE TABLE IF NOT EXISTS resumable_upload_chunks (
+	upload_id TEXT NOT NULL,
+	offset_bytes BIGINT NOT NULL,
+	size_bytes BIGINT NOT NULL,
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	PRIMARY KEY (upload_id, offset_bytes)
+);
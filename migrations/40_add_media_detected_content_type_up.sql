@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS detected_content_type TEXT NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_media_attributes_expires_ts;
+ALTER TABLE media_attributes DROP COLUMN IF EXISTS expires_ts;
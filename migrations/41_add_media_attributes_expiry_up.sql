@@ -0,0 +1,2 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS expires_ts BIGINT NULL;
+CREATE INDEX IF NOT EXISTS idx_media_attributes_expires_ts ON media_attributes (expires_ts);
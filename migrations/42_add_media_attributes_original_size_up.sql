@@ -0,0 +1 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS original_size_bytes BIGINT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE media_attributes DROP COLUMN IF EXISTS restricted_event_id;
+ALTER TABLE media_attributes DROP COLUMN IF EXISTS restricted_room_id;
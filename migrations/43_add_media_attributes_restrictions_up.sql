@@ -0,0 +1,2 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS restricted_room_id TEXT NULL;
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS restricted_event_id TEXT NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS blocked_hashes (
+	hash_type TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	action TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	added_by TEXT NOT NULL,
+	added_ts BIGINT NOT NULL,
+	PRIMARY KEY (hash_type, hash)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS media_upload_attribution (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	ip_address TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	recorded_ts BIGINT NOT NULL,
+	PRIMARY KEY (origin, media_id)
+);
+CREATE INDEX IF NOT EXISTS idx_media_upload_attribution_recorded_ts ON media_upload_attribution(recorded_ts);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_media_upload_staging_creation_ts;
+DROP TABLE IF EXISTS media_upload_staging;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS media_upload_staging (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	creation_ts BIGINT NOT NULL,
+	PRIMARY KEY (datastore_id, location)
+);
+CREATE INDEX IF NOT EXISTS idx_media_upload_staging_creation_ts ON media_upload_staging(creation_ts);
@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS compressed BOOLEAN NOT NULL DEFAULT FALSE;
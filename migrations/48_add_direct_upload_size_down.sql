@@ -0,0 +1 @@
+ALTER TABLE direct_uploads DROP COLUMN IF EXISTS size_bytes;
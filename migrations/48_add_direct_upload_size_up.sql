@@ -0,0 +1 @@
+ALTER TABLE direct_uploads ADD COLUMN IF NOT EXISTS size_bytes BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE resumable_uploads DROP COLUMN IF EXISTS finishing_ts;
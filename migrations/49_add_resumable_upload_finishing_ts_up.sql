@@ -0,0 +1 @@
+ALTER TABLE resumable_uploads ADD COLUMN IF NOT EXISTS finishing_ts BIGINT NULL;
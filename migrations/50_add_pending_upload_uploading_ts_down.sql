@@ -0,0 +1 @@
+ALTER TABLE pending_uploads DROP COLUMN IF EXISTS uploading_ts;
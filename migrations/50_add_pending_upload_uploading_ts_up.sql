@@ -0,0 +1 @@
+ALTER TABLE pending_uploads ADD COLUMN IF NOT EXISTS uploading_ts BIGINT NULL;
@@ -0,0 +1,113 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const (
+	SpamActionAccept     = "accept"
+	SpamActionReject     = "reject"
+	SpamActionQuarantine = "quarantine"
+)
+
+type spamCheckRequest struct {
+	Origin      string `json:"origin"`
+	MediaId     string `json:"media_id"`
+	UserId      string `json:"user_id"`
+	Kind        string `json:"kind"`
+	ContentType string `json:"content_type"`
+	UploadName  string `json:"upload_name"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Sha256Hash  string `json:"sha256"`
+	Content     string `json:"content,omitempty"`
+}
+
+type spamCheckResponse struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// CheckUpload decides what happens to media before it is stored: the antispam plugins are asked first,
+// followed by the spam checker callback if one is configured. Returns one of the SpamAction constants
+// along with the reason the callback gave, if any.
+func CheckUpload(ctx rcontext.RequestContext, contents []byte, sha256Hash string, filename string, contentType string, userId string, origin string, mediaId string, kind string) (string, string, error) {
+	spam, err := CheckForSpam(contents, filename, contentType, userId, origin, mediaId)
+	if err != nil {
+		return SpamActionAccept, "", err
+	}
+	if spam {
+		return SpamActionReject, "antispam plugin", nil
+	}
+
+	conf := config.Get().SpamChecker
+	if conf.Url == "" {
+		return SpamActionAccept, "", nil
+	}
+
+	body := &spamCheckRequest{
+		Origin:      origin,
+		MediaId:     mediaId,
+		UserId:      userId,
+		Kind:        kind,
+		ContentType: contentType,
+		UploadName:  filename,
+		SizeBytes:   int64(len(contents)),
+		Sha256Hash:  sha256Hash,
+	}
+	if conf.MaxContentBytes > 0 && int64(len(contents)) <= conf.MaxContentBytes {
+		body.Content = base64.StdEncoding.EncodeToString(contents)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return SpamActionAccept, "", err
+	}
+
+	req, err := http.NewRequest("POST", conf.Url, bytes.NewReader(b))
+	if err != nil {
+		return SpamActionAccept, "", err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if conf.SharedSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.SharedSecret)
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return SpamActionAccept, "", err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return SpamActionAccept, "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return SpamActionAccept, "", fmt.Errorf("spam checker returned status %d: %s", res.StatusCode, string(resBody))
+	}
+
+	result := &spamCheckResponse{}
+	err = json.Unmarshal(resBody, result)
+	if err != nil {
+		return SpamActionAccept, "", err
+	}
+	switch result.Action {
+	case SpamActionAccept, SpamActionReject, SpamActionQuarantine:
+		return result.Action, result.Reason, nil
+	}
+	return SpamActionAccept, "", errors.New("spam checker returned an unknown action: " + result.Action)
+}
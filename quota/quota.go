@@ -6,30 +6,75 @@ import (
 	"github.com/ryanuber/go-glob"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
 )
 
-func IsUserWithinQuota(ctx rcontext.RequestContext, userId string) (bool, error) {
-	if !ctx.Config.Uploads.Quota.Enabled {
-		return true, nil
+// IsUserWithinQuota returns false if storing an upload of the given size would take the user over
+// their quota. Uploads of unknown size (negative) only fail once the user is already at their quota.
+func IsUserWithinQuota(ctx rcontext.RequestContext, userId string, uploadSizeBytes int64) (bool, error) {
+	if uploadSizeBytes < 0 {
+		uploadSizeBytes = 0
 	}
 
 	db := storage.GetDatabase().GetMetadataStore(ctx)
-	stat, err := db.GetUserStats(userId)
+
+	// A quota set through the admin API overrides the config, even when quotas are disabled there
+	userQuota, err := db.GetUserQuota(userId)
 	if err == sql.ErrNoRows {
-		return true, nil // no stats == within quota
+		userQuota = nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if userQuota == nil && !ctx.Config.Uploads.Quota.Enabled {
+		return true, nil
 	}
-	if err != nil {
+
+	stat, err := db.GetUserStats(userId)
+	if err == sql.ErrNoRows {
+		// No stats yet means nothing uploaded, which still has to fit the upload
+		stat = &types.UserStats{UserId: userId}
+	} else if err != nil {
 		return false, err
 	}
 
+	if userQuota != nil {
+		return isWithinUserQuota(ctx, userQuota, stat, uploadSizeBytes)
+	}
+
 	for _, q := range ctx.Config.Uploads.Quota.UserQuotas {
 		if glob.Glob(q.Glob, userId) {
 			if q.MaxBytes == 0 {
 				return true, nil // infinite quota
 			}
-			return stat.UploadedBytes < q.MaxBytes, nil
+			return isWithinBytes(stat.UploadedBytes, uploadSizeBytes, q.MaxBytes), nil
 		}
 	}
 
 	return true, nil // no rules == no quota
 }
+
+func isWithinBytes(uploadedBytes int64, uploadSizeBytes int64, maxBytes int64) bool {
+	if uploadSizeBytes == 0 {
+		return uploadedBytes < maxBytes
+	}
+	return uploadedBytes+uploadSizeBytes <= maxBytes
+}
+
+func isWithinUserQuota(ctx rcontext.RequestContext, q *types.UserQuota, stat *types.UserStats, uploadSizeBytes int64) (bool, error) {
+	if q.MaxBytes > 0 && !isWithinBytes(stat.UploadedBytes, uploadSizeBytes, q.MaxBytes) {
+		return false, nil
+	}
+
+	if q.MaxFiles > 0 {
+		count, err := storage.GetDatabase().GetMediaStore(ctx).GetMediaCountByUser(q.UserId)
+		if err != nil {
+			return false, err
+		}
+		if count >= q.MaxFiles {
+			return false, nil
+		}
+	}
+
+	return true, nil // zero limits are infinite
+}
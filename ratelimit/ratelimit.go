@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"golang.org/x/time/rate"
+)
+
+const (
+	ActionUpload   = "upload"
+	ActionDownload = "download"
+	ActionPreview  = "preview"
+)
+
+var Actions = []string{ActionUpload, ActionDownload, ActionPreview}
+
+// Limiters are kept around for a while after their last use so that bursts are still limited,
+// but we don't hold on to one for every user we've ever seen.
+var limiters = cache.New(1*time.Hour, 2*time.Hour)
+
+// Overrides are looked up on every request, so keep them for a short while rather than hitting
+// the database each time. ForgetUser clears them when an admin changes them.
+var overrides = cache.New(1*time.Minute, 2*time.Minute)
+
+// IsUserRateLimited returns true if the user has made too many requests for the action. Requests
+// without a user are never limited here.
+func IsUserRateLimited(ctx rcontext.RequestContext, userId string, action string) bool {
+	if userId == "" {
+		return false
+	}
+
+	conf, limited := getBucketConfig(ctx, userId, action)
+	if !limited {
+		return false
+	}
+
+	return !getLimiter(userKey(userId, action, conf), conf).Allow()
+}
+
+// GetUploadRetryAfter returns how long the user must wait before uploading again, considering both
+// their own limit and the limit of the IP address they are uploading from. Zero means the upload can
+// go ahead, and counts towards both limits.
+func GetUploadRetryAfter(ctx rcontext.RequestContext, userId string, ip string) time.Duration {
+	buckets := make([]*rate.Limiter, 0)
+	if userId != "" {
+		if conf, limited := getBucketConfig(ctx, userId, ActionUpload); limited {
+			buckets = append(buckets, getLimiter(userKey(userId, ActionUpload, conf), conf))
+		}
+	}
+	if conf := config.Get().RateLimit.PerIp.Uploads; ip != "" && conf.RequestsPerSecond > 0 {
+		key := fmt.Sprintf("%s|ip:%s|%f|%d", ActionUpload, ip, conf.RequestsPerSecond, conf.BurstCount)
+		buckets = append(buckets, getLimiter(key, conf))
+	}
+
+	var wait time.Duration
+	reservations := make([]*rate.Reservation, 0, len(buckets))
+	for _, l := range buckets {
+		r := l.Reserve()
+		reservations = append(reservations, r)
+		if !r.OK() {
+			// The burst is too small to ever allow a request, so there's no real answer
+			wait = maxDuration(wait, time.Duration(float64(time.Second)/float64(l.Limit())))
+			continue
+		}
+		wait = maxDuration(wait, r.Delay())
+	}
+
+	// Requests which are turned away don't use up what's left of the other limit
+	if wait > 0 {
+		for _, r := range reservations {
+			r.Cancel()
+		}
+	}
+	return wait
+}
+
+// HasOverrides returns true if the user has their own rate limit for any action.
+func HasOverrides(ctx rcontext.RequestContext, userId string) bool {
+	return len(getOverrides(ctx, userId)) > 0
+}
+
+// ForgetUser drops the cached rate limit overrides for the user, so changes take effect immediately
+// in this process. Other processes pick them up within a minute.
+func ForgetUser(userId string) {
+	overrides.Delete(userId)
+}
+
+// userKey identifies the user's limiter. It is recreated whenever the user's limit changes.
+func userKey(userId string, action string, conf config.RateLimitBucketConfig) string {
+	return fmt.Sprintf("%s|%s|%f|%d", action, userId, conf.RequestsPerSecond, conf.BurstCount)
+}
+
+func getLimiter(key string, conf config.RateLimitBucketConfig) *rate.Limiter {
+	if l, ok := limiters.Get(key); ok {
+		limiters.SetDefault(key, l) // bump the expiration
+		return l.(*rate.Limiter)
+	}
+
+	l := rate.NewLimiter(rate.Limit(conf.RequestsPerSecond), conf.BurstCount)
+	limiters.SetDefault(key, l)
+	return l
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func getBucketConfig(ctx rcontext.RequestContext, userId string, action string) (config.RateLimitBucketConfig, bool) {
+	for _, o := range getOverrides(ctx, userId) {
+		if o.Action == action {
+			return config.RateLimitBucketConfig{RequestsPerSecond: o.RequestsPerSecond, BurstCount: o.Burst}, o.RequestsPerSecond > 0
+		}
+	}
+
+	var conf config.RateLimitBucketConfig
+	switch action {
+	case ActionUpload:
+		conf = config.Get().RateLimit.PerUser.Uploads
+	case ActionDownload:
+		conf = config.Get().RateLimit.PerUser.Downloads
+	case ActionPreview:
+		if !config.Get().UrlPreviews.RateLimit.Enabled {
+			return conf, false
+		}
+		conf = config.Get().UrlPreviews.RateLimit.PerUser
+	}
+	return conf, conf.RequestsPerSecond > 0
+}
+
+func getOverrides(ctx rcontext.RequestContext, userId string) []*types.UserRateLimit {
+	if o, ok := overrides.Get(userId); ok {
+		return o.([]*types.UserRateLimit)
+	}
+
+	o, err := storage.GetDatabase().GetMetadataStore(ctx).GetUserRateLimits(userId)
+	if err != nil {
+		// Fall back to the configured limits rather than failing the request
+		ctx.Log.Error("Error getting rate limit overrides: ", err)
+		sentry.CaptureException(err)
+		return nil
+	}
+	overrides.SetDefault(userId, o)
+	return o
+}
@@ -77,6 +77,18 @@ func (c *RedisCache) SetBytes(ctx rcontext.RequestContext, key string, b []byte)
 	return err
 }
 
+func (c *RedisCache) Delete(ctx rcontext.RequestContext, key string) error {
+	if c.ring.PoolStats().TotalConns == 0 {
+		return ErrCacheDown
+	}
+	_, err := c.ring.Del(ctx.Context, key).Result()
+	if err != nil && c.ring.PoolStats().TotalConns == 0 {
+		ctx.Log.Error(err)
+		return ErrCacheDown
+	}
+	return err
+}
+
 func (c *RedisCache) GetBytes(ctx rcontext.RequestContext, key string) ([]byte, error) {
 	if c.ring.PoolStats().TotalConns == 0 {
 		return nil, ErrCacheDown
@@ -0,0 +1,49 @@
+package datastore
+
+import (
+	"context"
+	"io"
+
+	"github.com/turt2live/matrix-media-repo/util"
+	"golang.org/x/time/rate"
+)
+
+// throttleReads limits how fast the stream, read from the datastore, can be consumed.
+func (d *DatastoreRef) throttleReads(stream io.ReadCloser) io.ReadCloser {
+	return throttle(stream, util.GetBandwidthLimiter(d.DatastoreId+"/read", d.config.MaxReadBytesPerSecond))
+}
+
+// throttleWrites limits how fast the stream can be written to the datastore.
+func (d *DatastoreRef) throttleWrites(stream io.ReadCloser) io.ReadCloser {
+	return throttle(stream, util.GetBandwidthLimiter(d.DatastoreId+"/write", d.config.MaxWriteBytesPerSecond))
+}
+
+func throttle(stream io.ReadCloser, limiter *rate.Limiter) io.ReadCloser {
+	if limiter == nil {
+		// Left as-is so datastores can still use optimisations for files and other seekable streams
+		return stream
+	}
+	return &throttledReader{stream: stream, limiter: limiter}
+}
+
+type throttledReader struct {
+	stream  io.ReadCloser
+	limiter *rate.Limiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.stream.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(context.Background(), n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.stream.Close()
+}
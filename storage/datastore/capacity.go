@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// Datastores which were over capacity when last checked, so the warning is only raised once.
+var overCapacity = make(map[string]bool)
+var overCapacityLock = &sync.Mutex{}
+
+// Every upload picking a datastore checks the capacity, so each datastore's usage is only summed up
+// from the database this often.
+var datastoreUsage = cache.New(30*time.Second, 1*time.Minute)
+
+// isOverCapacity returns true if the datastore has a maxBytes budget and has used all of it.
+func isOverCapacity(ds *types.Datastore, dsConf config.DatastoreConfig, ctx rcontext.RequestContext) bool {
+	if dsConf.MaxSizeBytes <= 0 {
+		return false
+	}
+
+	var size int64
+	if cached, found := datastoreUsage.Get(ds.DatastoreId); found {
+		size = cached.(int64)
+	} else {
+		var err error
+		size, err = estimatedDatastoreSize(ds, ctx)
+		if err != nil {
+			ctx.Log.Error("Error estimating datastore size for ", ds.DatastoreId, ": ", err.Error())
+			sentry.CaptureException(err)
+			return false
+		}
+		datastoreUsage.Set(ds.DatastoreId, size, cache.DefaultExpiration)
+	}
+	full := size >= dsConf.MaxSizeBytes
+
+	overCapacityLock.Lock()
+	defer overCapacityLock.Unlock()
+
+	if full && !overCapacity[ds.DatastoreId] {
+		msg := fmt.Sprintf("Datastore %s is over capacity (%d of %d bytes used) - new uploads will go to other datastores", ds.Uri, size, dsConf.MaxSizeBytes)
+		ctx.Log.Warn(msg)
+		sentry.CaptureMessage(msg)
+	} else if !full && overCapacity[ds.DatastoreId] {
+		ctx.Log.Info("Datastore ", ds.Uri, " is no longer over capacity")
+	}
+	overCapacity[ds.DatastoreId] = full
+
+	value := 0.0
+	if full {
+		value = 1
+	}
+	metrics.DatastoreOverCapacity.With(prometheus.Labels{"datastoreId": ds.DatastoreId}).Set(value)
+
+	return full
+}
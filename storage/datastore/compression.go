@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util/util_encryption"
+)
+
+// Compressed objects start with this header so they can be told apart from everything else on read.
+// Uncompressed content which happens to start with the header is always compressed to keep this
+// unambiguous.
+var compressionMagic = []byte("MMRZSTD\x01")
+
+func shouldCompress(contentType string) bool {
+	conf := config.Get().Compression
+	if !conf.Enabled || contentType == "" {
+		return false
+	}
+	for _, compressibleType := range conf.ContentTypes {
+		if glob.Glob(compressibleType, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressForStorage returns the stream to store for the content, and whether it was compressed.
+func compressForStorage(file io.ReadCloser, contentType string) (io.ReadCloser, bool) {
+	reader := bufio.NewReader(file)
+	if !shouldCompress(contentType) {
+		header, _ := reader.Peek(len(compressionMagic))
+		if !bytes.Equal(header, compressionMagic) {
+			return &bufferedReadCloser{reader: reader, source: file}, false
+		}
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer file.Close()
+
+		_, err := w.Write(compressionMagic)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+
+		encoder, err := zstd.NewWriter(w)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(encoder, reader)
+		if err != nil {
+			encoder.Close()
+			w.CloseWithError(err)
+			return
+		}
+		w.CloseWithError(encoder.Close())
+	}()
+	return r, true
+}
+
+// IsObjectCompressed returns whether an object was compressed when it was stored. Media records
+// already say this for objects the media repo stored, so this is only needed for objects it didn't,
+// such as imported ones.
+func (d *DatastoreRef) IsObjectCompressed(location string) (bool, error) {
+	key, err := getEncryptionKey(d.DatastoreId, d.config)
+	if err != nil {
+		return false, err
+	}
+
+	stream, err := d.downloadFile(location)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+	if key != nil {
+		stream, err = util_encryption.NewDecryptingReader(key, stream)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	header := make([]byte, len(compressionMagic))
+	_, err = io.ReadFull(stream, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Too small to have the header
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(header, compressionMagic), nil
+}
+
+// decompressFromStorage undoes compressForStorage, passing uncompressed objects through unaltered.
+func decompressFromStorage(stream io.ReadCloser) (io.ReadCloser, error) {
+	reader := bufio.NewReader(stream)
+	header, _ := reader.Peek(len(compressionMagic))
+	if !bytes.Equal(header, compressionMagic) {
+		return &bufferedReadCloser{reader: reader, source: stream}, nil
+	}
+
+	_, err := reader.Discard(len(compressionMagic))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressingReadCloser{decoder: decoder, source: stream}, nil
+}
+
+type bufferedReadCloser struct {
+	reader *bufio.Reader
+	source io.ReadCloser
+}
+
+func (r *bufferedReadCloser) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func (r *bufferedReadCloser) Close() error {
+	return r.source.Close()
+}
+
+type decompressingReadCloser struct {
+	decoder *zstd.Decoder
+	source  io.ReadCloser
+}
+
+func (r *decompressingReadCloser) Read(p []byte) (int, error) {
+	return r.decoder.Read(p)
+}
+
+func (r *decompressingReadCloser) Close() error {
+	r.decoder.Close()
+	return r.source.Close()
+}
@@ -87,6 +87,28 @@ func GetUriForDatastore(dsConf config.DatastoreConfig) string {
 		} else {
 			return fmt.Sprintf("s3://%s/%s", endpoint, bucket)
 		}
+	} else if dsConf.Type == "azure" {
+		account, accountFound := dsConf.Options["accountName"]
+		container, containerFound := dsConf.Options["containerName"]
+		if !accountFound || !containerFound {
+			sentry.CaptureException(errors.New("Missing 'accountName' or 'containerName' on azure datastore"))
+			logrus.Fatal("Missing 'accountName' or 'containerName' on azure datastore")
+		}
+		return fmt.Sprintf("azure://%s/%s", account, container)
+	} else if dsConf.Type == "gcs" {
+		bucket, bucketFound := dsConf.Options["bucketName"]
+		if !bucketFound {
+			sentry.CaptureException(errors.New("Missing 'bucketName' on gcs datastore"))
+			logrus.Fatal("Missing 'bucketName' on gcs datastore")
+		}
+		return fmt.Sprintf("gcs://%s", bucket)
+	} else if dsConf.Type == "webdav" {
+		baseUrl, urlFound := dsConf.Options["baseUrl"]
+		if !urlFound {
+			sentry.CaptureException(errors.New("Missing 'baseUrl' on webdav datastore"))
+			logrus.Fatal("Missing 'baseUrl' on webdav datastore")
+		}
+		return baseUrl
 	} else if dsConf.Type == "ipfs" {
 		return "ipfs://localhost"
 	} else {
@@ -119,6 +141,22 @@ func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef,
 		possibleDatastores = append(possibleDatastores, dsConf)
 	}
 
+	possibleDatastores = withoutReadOnly(possibleDatastores, ctx)
+	if len(possibleDatastores) == 0 {
+		return nil, errors.New("failed to pick a datastore: all suitable datastores are read-only")
+	}
+
+	// Datastores which have used up their budget overflow into the others, including cold ones
+	possibleDatastores = withoutFull(possibleDatastores, ctx)
+	if len(possibleDatastores) == 0 {
+		return nil, errors.New("failed to pick a datastore: all suitable datastores are over capacity")
+	}
+
+	// New media always goes to the hot tier when there is one: cold datastores only receive
+	// media through tiering.
+	possibleDatastores = withoutColdTier(possibleDatastores)
+	possibleDatastores = withoutUnhealthy(possibleDatastores, ctx)
+
 	var targetDs *types.Datastore
 	var targetDsConf config.DatastoreConfig
 	var dsSize int64
@@ -157,6 +195,52 @@ func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef,
 	return nil, errors.New("failed to pick a datastore: none available")
 }
 
+func withoutColdTier(datastores []config.DatastoreConfig) []config.DatastoreConfig {
+	filtered := make([]config.DatastoreConfig, 0)
+	for _, dsConf := range datastores {
+		if dsConf.Tier != common.TierCold {
+			filtered = append(filtered, dsConf)
+		}
+	}
+	if len(filtered) == 0 {
+		return datastores
+	}
+	return filtered
+}
+
+func withoutFull(datastores []config.DatastoreConfig, ctx rcontext.RequestContext) []config.DatastoreConfig {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	filtered := make([]config.DatastoreConfig, 0)
+	for _, dsConf := range datastores {
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err == nil && isOverCapacity(ds, dsConf, ctx) {
+			continue
+		}
+		filtered = append(filtered, dsConf)
+	}
+	return filtered
+}
+
+// withoutUnhealthy drops datastores which failed their last health check, unless that would leave
+// nothing to pick from, in which case the health checks are as likely to be wrong as the datastores.
+func withoutUnhealthy(datastores []config.DatastoreConfig, ctx rcontext.RequestContext) []config.DatastoreConfig {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	filtered := make([]config.DatastoreConfig, 0)
+	for _, dsConf := range datastores {
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err == nil && !IsHealthy(ds.DatastoreId) {
+			ctx.Log.Warn("Skipping unhealthy datastore ", ds.Uri)
+			continue
+		}
+		filtered = append(filtered, dsConf)
+	}
+	if len(filtered) == 0 {
+		ctx.Log.Warn("Every suitable datastore is unhealthy - picking from them anyway")
+		return datastores
+	}
+	return filtered
+}
+
 func estimatedDatastoreSize(ds *types.Datastore, ctx rcontext.RequestContext) (int64, error) {
 	return storage.GetDatabase().GetMetadataStore(ctx).GetEstimatedSizeOfDatastore(ds.DatastoreId)
 }
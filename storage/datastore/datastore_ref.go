@@ -7,13 +7,18 @@ import (
 	"path"
 
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
 	config2 "github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_azure"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_gcs"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_ipfs"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_webdav"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/util_encryption"
 )
 
 type DatastoreRef struct {
@@ -24,6 +29,10 @@ type DatastoreRef struct {
 
 	datastore *types.Datastore
 	config    config2.DatastoreConfig
+
+	// Set by routing rules for the uploads they match
+	storageClass string
+	objectTags   map[string]string
 }
 
 func newDatastoreRef(ds *types.Datastore, config config2.DatastoreConfig) *DatastoreRef {
@@ -37,16 +46,98 @@ func newDatastoreRef(ds *types.Datastore, config config2.DatastoreConfig) *Datas
 }
 
 func (d *DatastoreRef) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return d.UploadFileOfType(file, expectedLength, "", ctx)
+}
+
+// UploadFileOfType uploads the file like UploadFile, compressing it first if the content type is
+// configured to be compressed. The returned hash and size are always of the original content, with
+// the size of what was actually stored in StoredSizeBytes. The file is also copied to any replicas.
+func (d *DatastoreRef) UploadFileOfType(file io.ReadCloser, expectedLength int64, contentType string, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	ctx = ctx.LogWithFields(logrus.Fields{"datastoreId": d.DatastoreId, "datastoreUri": d.Uri})
 
+	info, err := d.storeObject(file, expectedLength, contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.replicate(info.Location, contentType, ctx)
+	return info, nil
+}
+
+func (d *DatastoreRef) storeObject(file io.ReadCloser, expectedLength int64, contentType string, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	key, err := getEncryptionKey(d.DatastoreId, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := newPlainCounter(file)
+	stored, compressed := compressForStorage(plain, contentType)
+	if compressed {
+		ctx.Log.Info("Compressing file before upload")
+		expectedLength = -1
+	}
+	if key != nil {
+		stored, err = util_encryption.NewEncryptingReader(key, stored)
+		if err != nil {
+			return nil, err
+		}
+		if expectedLength > 0 {
+			expectedLength = util_encryption.EncryptedSize(expectedLength)
+		}
+	}
+
+	var info *types.ObjectInfo
+	if d.config.WriteBehind {
+		info, err = d.stageObject(stored, ctx)
+	} else {
+		info, err = d.uploadFile(stored, expectedLength, ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The rest of the media repo deals in the original content, so describe that instead of what was stored
+	info.StoredSizeBytes = info.SizeBytes
+	info.Sha256Hash = plain.Sha256Hash()
+	info.SizeBytes = plain.size
+	info.Compressed = compressed
+	return info, nil
+}
+
+func (d *DatastoreRef) uploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	file = d.throttleWrites(file)
 	if d.Type == "file" {
-		return ds_file.PersistFile(d.Uri, file, ctx)
+		layout, err := ds_file.LayoutFromOptions(d.config.Options)
+		if err != nil {
+			return nil, err
+		}
+		return ds_file.PersistFile(d.Uri, layout, file, ctx)
 	} else if d.Type == "s3" {
 		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
 		if err != nil {
 			return nil, err
 		}
-		return s3.UploadFile(file, expectedLength, ctx)
+		return s3.UploadFile(file, expectedLength, &ds_s3.ObjectOptions{
+			StorageClass: d.storageClass,
+			Tags:         d.objectTags,
+		}, ctx)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return azure.UploadFile(file, expectedLength, ctx)
+	} else if d.Type == "gcs" {
+		gcs, err := ds_gcs.GetOrCreateGcsDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return gcs.UploadFile(file, expectedLength, ctx)
+	} else if d.Type == "webdav" {
+		webdav, err := ds_webdav.GetOrCreateWebDavDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return webdav.UploadFile(file, expectedLength, ctx)
 	} else if d.Type == "ipfs" {
 		return ds_ipfs.UploadFile(file, ctx)
 	} else {
@@ -54,7 +145,24 @@ func (d *DatastoreRef) UploadFile(file io.ReadCloser, expectedLength int64, ctx
 	}
 }
 
+// DeleteObject deletes the object and any replicas of it.
 func (d *DatastoreRef) DeleteObject(location string) error {
+	err := d.deleteObject(location)
+	if err != nil {
+		return err
+	}
+	return d.deleteReplicas(location, rcontext.Initial())
+}
+
+func (d *DatastoreRef) deleteObject(location string) error {
+	neverWritten, err := d.unstage(location, rcontext.Initial())
+	if err != nil {
+		return err
+	}
+	if neverWritten {
+		return nil
+	}
+
 	if d.Type == "file" {
 		return ds_file.DeletePersistedFile(d.Uri, location)
 	} else if d.Type == "s3" {
@@ -63,6 +171,24 @@ func (d *DatastoreRef) DeleteObject(location string) error {
 			return err
 		}
 		return s3.DeleteObject(location)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return azure.DeleteObject(location)
+	} else if d.Type == "gcs" {
+		gcs, err := ds_gcs.GetOrCreateGcsDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return gcs.DeleteObject(location)
+	} else if d.Type == "webdav" {
+		webdav, err := ds_webdav.GetOrCreateWebDavDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return webdav.DeleteObject(location)
 	} else if d.Type == "ipfs" {
 		// TODO: Support deleting from IPFS - will need a "delete reason" to avoid deleting duplicates
 		logrus.Warn("Unsupported operation: deleting from IPFS datastore")
@@ -72,7 +198,54 @@ func (d *DatastoreRef) DeleteObject(location string) error {
 	}
 }
 
+// DownloadFile returns the contents of the object, falling back to its replicas if it can't be read.
 func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
+	stream, err := d.readObject(location)
+	if err != nil {
+		ctx := rcontext.Initial().LogWithFields(logrus.Fields{"datastoreId": d.DatastoreId, "location": location})
+		replicaStream, replicaErr := d.readFromReplicas(location, ctx)
+		if replicaErr != nil {
+			return nil, err
+		}
+		return replicaStream, nil
+	}
+	return stream, nil
+}
+
+func (d *DatastoreRef) readObject(location string) (io.ReadCloser, error) {
+	key, err := getEncryptionKey(d.DatastoreId, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := d.openStaged(location)
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil {
+		stream, err = d.downloadFile(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key != nil {
+		stream, err = util_encryption.NewDecryptingReader(key, stream)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decompressFromStorage(stream)
+}
+
+func (d *DatastoreRef) downloadFile(location string) (io.ReadCloser, error) {
+	stream, err := d.openObject(location)
+	if err != nil {
+		return nil, err
+	}
+	return d.throttleReads(stream), nil
+}
+
+func (d *DatastoreRef) openObject(location string) (io.ReadCloser, error) {
 	if d.Type == "file" {
 		return os.Open(path.Join(d.Uri, location))
 	} else if d.Type == "s3" {
@@ -81,6 +254,24 @@ func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
 			return nil, err
 		}
 		return s3.DownloadObject(location)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return azure.DownloadObject(location)
+	} else if d.Type == "gcs" {
+		gcs, err := ds_gcs.GetOrCreateGcsDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return gcs.DownloadObject(location)
+	} else if d.Type == "webdav" {
+		webdav, err := ds_webdav.GetOrCreateWebDavDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return webdav.DownloadObject(location)
 	} else if d.Type == "ipfs" {
 		return ds_ipfs.DownloadFile(location)
 	} else {
@@ -89,6 +280,11 @@ func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
 }
 
 func (d *DatastoreRef) ObjectExists(location string) bool {
+	if staged, err := d.openStaged(location); err == nil && staged != nil {
+		staged.Close()
+		return true
+	}
+
 	if d.Type == "file" {
 		ok, err := util.FileExists(path.Join(d.Uri, location))
 		if err != nil {
@@ -101,18 +297,106 @@ func (d *DatastoreRef) ObjectExists(location string) bool {
 			return false
 		}
 		return s3.ObjectExists(location)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return false
+		}
+		return azure.ObjectExists(location)
+	} else if d.Type == "gcs" {
+		gcs, err := ds_gcs.GetOrCreateGcsDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return false
+		}
+		return gcs.ObjectExists(location)
+	} else if d.Type == "webdav" {
+		webdav, err := ds_webdav.GetOrCreateWebDavDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return false
+		}
+		return webdav.ObjectExists(location)
 	} else if d.Type == "ipfs" {
-		// TODO: Support checking file existence in IPFS
-		logrus.Warn("Unsupported operation: existence in IPFS datastore")
-		return false
+		return ds_ipfs.ObjectExists(location)
 	} else {
 		panic("unknown datastore type")
 	}
 }
 
+// ListObjects returns everything stored in the datastore, whether or not the media repo knows about it.
+func (d *DatastoreRef) ListObjects() ([]*types.ObjectListing, error) {
+	if d.Type == "file" {
+		return ds_file.ListPersistedFiles(d.Uri)
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return s3.ListObjects()
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return azure.ListObjects()
+	} else if d.Type == "gcs" {
+		gcs, err := ds_gcs.GetOrCreateGcsDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return gcs.ListObjects()
+	} else if d.Type == "webdav" {
+		webdav, err := ds_webdav.GetOrCreateWebDavDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return webdav.ListObjects()
+	} else if d.Type == "ipfs" {
+		return nil, errors.New("unsupported operation: listing objects in IPFS datastore")
+	} else {
+		return nil, errors.New("unknown datastore type")
+	}
+}
+
+// IsOwnObjectName returns whether the location is named like the objects the media repo writes: a 40
+// character hex ID, which file datastores split into directories. Anything else in a datastore was
+// put there by something other than the media repo.
+func IsOwnObjectName(location string) bool {
+	fileId := ds_file.FileIdOfLocation(location)
+	if len(fileId) != 40 {
+		return false
+	}
+	for _, c := range fileId {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) error {
+	key, err := getEncryptionKey(d.DatastoreId, d.config)
+	if err != nil {
+		return err
+	}
+	stream, _ = compressForStorage(stream, "")
+	if key != nil {
+		stream, err = util_encryption.NewEncryptingReader(key, stream)
+		if err != nil {
+			return err
+		}
+	}
+	return d.overwriteObject(location, stream, ctx)
+}
+
+func (d *DatastoreRef) overwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) error {
+	stream = d.throttleWrites(stream)
 	if d.Type == "file" {
-		_, _, err := ds_file.PersistFileAtLocation(path.Join(d.Uri, location), stream, ctx)
+		target := path.Join(d.Uri, location)
+		err := os.MkdirAll(path.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		_, _, err = ds_file.PersistFileAtLocation(target, stream, ctx)
 		return err
 	} else if d.Type == "s3" {
 		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
@@ -120,6 +404,24 @@ func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ct
 			return err
 		}
 		return s3.OverwriteObject(location, stream)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return azure.OverwriteObject(location, stream)
+	} else if d.Type == "gcs" {
+		gcs, err := ds_gcs.GetOrCreateGcsDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return gcs.OverwriteObject(location, stream)
+	} else if d.Type == "webdav" {
+		webdav, err := ds_webdav.GetOrCreateWebDavDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return webdav.OverwriteObject(location, stream)
 	} else if d.Type == "ipfs" {
 		// TODO: Support overwriting in IPFS
 		logrus.Warn("Unsupported operation: overwriting file in IPFS datastore")
@@ -128,3 +430,8 @@ func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ct
 		return errors.New("unknown datastore type")
 	}
 }
+
+// IsCold returns true if the datastore is in the cold storage tier.
+func (d *DatastoreRef) IsCold() bool {
+	return d.config.Tier == common.TierCold
+}
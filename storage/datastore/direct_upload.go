@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const defaultDirectUploadExpirySeconds = 3600
+
+var ErrDirectUploadsUnsupported = errors.New("datastore does not accept direct uploads")
+
+// DirectUploadTarget is where a client can upload a file without it passing through the media repo.
+type DirectUploadTarget struct {
+	Location   string
+	Url        string
+	FormFields map[string]string
+	ExpiresTs  int64
+}
+
+// SupportsDirectUploads returns true if clients can upload files straight to the datastore. Only S3
+// datastores with directUploads enabled do, and only when the media repo doesn't need to encrypt or
+// stage what is written to them.
+func (d *DatastoreRef) SupportsDirectUploads() bool {
+	if d.Type != "s3" || d.config.WriteBehind {
+		return false
+	}
+	if enabled, _ := strconv.ParseBool(d.config.Options["directUploads"]); !enabled {
+		return false
+	}
+	key, err := getEncryptionKey(d.DatastoreId, d.config)
+	return err == nil && key == nil
+}
+
+// PrepareDirectUpload reserves a location in the datastore for a client to upload a file of the given
+// content type to. The datastore rejects files larger than sizeBytes.
+func (d *DatastoreRef) PrepareDirectUpload(contentType string, sizeBytes int64) (*DirectUploadTarget, error) {
+	if !d.SupportsDirectUploads() {
+		return nil, ErrDirectUploadsUnsupported
+	}
+
+	expirySeconds := defaultDirectUploadExpirySeconds
+	if val, ok := d.config.Options["directUploadExpirySeconds"]; ok && val != "" {
+		var err error
+		expirySeconds, err = strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	expiry := time.Duration(expirySeconds) * time.Second
+
+	s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+	if err != nil {
+		return nil, err
+	}
+	location, err := util.GenerateRandomString(512)
+	if err != nil {
+		return nil, err
+	}
+	url, fields, err := s3.PresignedUploadPolicy(location, contentType, sizeBytes, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirectUploadTarget{
+		Location:   location,
+		Url:        url,
+		FormFields: fields,
+		ExpiresTs:  util.NowMillis() + expiry.Milliseconds(),
+	}, nil
+}
+
+// AdoptDirectUpload takes ownership of a file a client uploaded straight to the datastore, returning
+// its details like UploadFileOfType would have. The file is copied to any replicas.
+func (d *DatastoreRef) AdoptDirectUpload(location string, contentType string, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	stream, err := d.downloadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+
+	// Reads would mistake an upload starting with the compression header for a compressed object
+	reader := bufio.NewReader(stream)
+	header, _ := reader.Peek(len(compressionMagic))
+	if bytes.Equal(header, compressionMagic) {
+		return nil, errors.New("uploaded file cannot be stored as-is")
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &types.ObjectInfo{
+		Location:        location,
+		Sha256Hash:      hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes:       size,
+		StoredSizeBytes: size,
+	}
+	d.replicate(location, contentType, ctx)
+	return info, nil
+}
@@ -0,0 +1,405 @@
+package ds_azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
+)
+
+const apiVersion = "2020-04-08"
+
+// Requests give up if azure doesn't connect or start responding within this long. Responses aren't
+// limited as a whole because large blobs can take much longer than this to stream.
+const requestTimeout = 30 * time.Second
+
+var stores = make(map[string]*azureDatastore)
+
+type azureDatastore struct {
+	conf       config.DatastoreConfig
+	dsId       string
+	client     *http.Client
+	endpoint   string
+	account    string
+	container  string
+	accountKey []byte
+	sasToken   url.Values
+	tempPath   string
+}
+
+func GetOrCreateAzureDatastore(dsId string, conf config.DatastoreConfig) (*azureDatastore, error) {
+	if s, ok := stores[dsId]; ok {
+		return s, nil
+	}
+
+	account, accountFound := conf.Options["accountName"]
+	container, containerFound := conf.Options["containerName"]
+	accountKey, keyFound := conf.Options["accountKey"]
+	sasToken, sasFound := conf.Options["sasToken"]
+	endpoint, epFound := conf.Options["endpoint"]
+	tempPath, tempPathFound := conf.Options["tempPath"]
+	if !accountFound || !containerFound {
+		return nil, errors.New("invalid configuration: missing azure options")
+	}
+	if (!keyFound || accountKey == "") && (!sasFound || sasToken == "") {
+		return nil, errors.New("invalid configuration: azure datastores need either an accountKey or sasToken")
+	}
+	if !tempPathFound {
+		logrus.Warn("Datastore ", dsId, " (azure) does not have a tempPath set - this could lead to excessive memory usage by the media repo")
+	}
+	if !epFound || endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+
+	azds := &azureDatastore{
+		conf:      conf,
+		dsId:      dsId,
+		client:    newClient(),
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		account:   account,
+		container: container,
+		tempPath:  tempPath,
+	}
+
+	if sasFound && sasToken != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid configuration: cannot parse sasToken")
+		}
+		azds.sasToken = values
+	} else {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid configuration: cannot decode accountKey")
+		}
+		azds.accountKey = key
+	}
+
+	stores[dsId] = azds
+	return azds, nil
+}
+
+func newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: requestTimeout}).DialContext
+	transport.TLSHandshakeTimeout = requestTimeout
+	transport.ResponseHeaderTimeout = requestTimeout
+	return &http.Client{Transport: transport}
+}
+
+func (s *azureDatastore) EnsureContainerExists() error {
+	req, err := s.newRequest("GET", "", url.Values{"restype": []string{"container"}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *azureDatastore) EnsureTempPathExists() error {
+	err := os.MkdirAll(s.tempPath, os.ModePerm)
+	if err != os.ErrExist && err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *azureDatastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	defer cleanup.DumpAndCloseStream(file)
+
+	objectName, err := util.GenerateRandomString(512)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	var reader io.Reader = io.TeeReader(file, hasher)
+
+	// Azure needs to know the size of the blob up front
+	if expectedLength <= 0 {
+		if s.tempPath != "" {
+			ctx.Log.Info("Buffering file to temp path due to unknown file size")
+			f, err := ioutil.TempFile(s.tempPath, scratch.DatastoreTempPattern)
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(f.Name())
+			defer cleanup.DumpAndCloseStream(f)
+			expectedLength, err = io.Copy(f, reader)
+			if err != nil {
+				return nil, err
+			}
+			_, err = f.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			reader = f
+		} else {
+			ctx.Log.Warn("Uploading content of unknown length to azure - this could result in high memory usage")
+			b, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			expectedLength = int64(len(b))
+			reader = bytes.NewReader(b)
+		}
+	}
+
+	ctx.Log.Info("Uploading file...")
+	err = s.putBlob(objectName, reader, expectedLength)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Uploaded ", expectedLength, " bytes to azure")
+
+	return &types.ObjectInfo{
+		Location:   objectName,
+		Sha256Hash: hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes:  expectedLength,
+	}, nil
+}
+
+func (s *azureDatastore) DeleteObject(location string) error {
+	logrus.Info("Deleting object from container ", s.container, ": ", location)
+	req, err := s.newRequest("DELETE", location, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *azureDatastore) DownloadObject(location string) (io.ReadCloser, error) {
+	logrus.Info("Downloading object from container ", s.container, ": ", location)
+	req, err := s.newRequest("GET", location, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *azureDatastore) ObjectExists(location string) bool {
+	req, err := s.newRequest("HEAD", location, nil, nil, 0)
+	if err != nil {
+		return false
+	}
+	res, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return false
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return true
+}
+
+func (s *azureDatastore) OverwriteObject(location string, stream io.ReadCloser) error {
+	defer cleanup.DumpAndCloseStream(stream)
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	return s.putBlob(location, bytes.NewReader(b), int64(len(b)))
+}
+
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/list-blobs
+type blobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *azureDatastore) ListObjects() ([]*types.ObjectListing, error) {
+	objects := make([]*types.ObjectListing, 0)
+	marker := ""
+	for {
+		query := url.Values{
+			"restype": []string{"container"},
+			"comp":    []string{"list"},
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		req, err := s.newRequest("GET", "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		list := &blobList{}
+		err = xml.NewDecoder(res.Body).Decode(list)
+		cleanup.DumpAndCloseStream(res.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range list.Blobs {
+			modified, _ := http.ParseTime(blob.Properties.LastModified)
+			objects = append(objects, &types.ObjectListing{
+				Location:       blob.Name,
+				SizeBytes:      blob.Properties.ContentLength,
+				LastModifiedTs: util.TimeToMillis(modified),
+			})
+		}
+
+		if list.NextMarker == "" {
+			return objects, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+func (s *azureDatastore) putBlob(location string, body io.Reader, length int64) error {
+	req, err := s.newRequest("PUT", location, nil, body, length)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	s.sign(req)
+	res, err := s.do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *azureDatastore) newRequest(method string, location string, query url.Values, body io.Reader, length int64) (*http.Request, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	for k, v := range s.sasToken {
+		query[k] = v
+	}
+
+	u := fmt.Sprintf("%s/%s", s.endpoint, url.PathEscape(s.container))
+	if location != "" {
+		u = fmt.Sprintf("%s/%s", u, url.PathEscape(location))
+	}
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	s.sign(req)
+	return req, nil
+}
+
+func (s *azureDatastore) do(req *http.Request, expectedStatus int) (*http.Response, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != expectedStatus {
+		cleanup.DumpAndCloseStream(res.Body)
+		return nil, errors.New("unexpected status code from azure: " + strconv.Itoa(res.StatusCode))
+	}
+	return res, nil
+}
+
+// sign adds a Shared Key authorization header to the request if an account key is in use. SAS
+// tokens are already part of the request URL.
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (s *azureDatastore) sign(req *http.Request) {
+	if s.accountKey == nil {
+		return
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	msHeaders := make([]string, 0)
+	for k := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k)
+		}
+	}
+	sort.Strings(msHeaders)
+	canonicalHeaders := ""
+	for _, k := range msHeaders {
+		canonicalHeaders += k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n"
+	}
+
+	canonicalResource := "/" + s.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	for _, k := range queryKeys {
+		values := query[k]
+		sort.Strings(values)
+		canonicalResource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date - we use x-ms-date instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders + canonicalResource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, s.accountKey)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", s.account, signature))
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
@@ -13,14 +14,11 @@ import (
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
-func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+func PersistFile(basePath string, layout Layout, file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	defer cleanup.DumpAndCloseStream(file)
 
 	exists := true
-	var primaryContainer string
-	var secondaryContainer string
-	var fileName string
-	var targetDir string
+	var locationPath string
 	var targetFile string
 	attempts := 0
 	for exists {
@@ -29,11 +27,8 @@ func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContex
 			return nil, err
 		}
 
-		primaryContainer = fileId[0:2]
-		secondaryContainer = fileId[2:4]
-		fileName = fileId[4:]
-		targetDir = path.Join(basePath, primaryContainer, secondaryContainer)
-		targetFile = path.Join(targetDir, fileName)
+		locationPath = layout.Location(fileId)
+		targetFile = path.Join(basePath, locationPath)
 
 		ctx.Log.Info("Checking if file exists: " + targetFile)
 
@@ -50,7 +45,7 @@ func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContex
 		}
 	}
 
-	err := os.MkdirAll(targetDir, 0755)
+	err := os.MkdirAll(path.Dir(targetFile), 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +55,6 @@ func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContex
 		return nil, err
 	}
 
-	locationPath := path.Join(primaryContainer, secondaryContainer, fileName)
 	return &types.ObjectInfo{
 		Location:   locationPath,
 		Sha256Hash: hash,
@@ -122,3 +116,27 @@ func PersistFileAtLocation(targetFile string, file io.ReadCloser, ctx rcontext.R
 func DeletePersistedFile(basePath string, location string) error {
 	return os.Remove(path.Join(basePath, location))
 }
+
+func ListPersistedFiles(basePath string) ([]*types.ObjectListing, error) {
+	objects := make([]*types.ObjectListing, 0)
+	err := filepath.Walk(basePath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		location, err := filepath.Rel(basePath, filePath)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &types.ObjectListing{
+			Location:       filepath.ToSlash(location),
+			SizeBytes:      info.Size(),
+			LastModifiedTs: util.TimeToMillis(info.ModTime()),
+		})
+		return nil
+	})
+	return objects, err
+}
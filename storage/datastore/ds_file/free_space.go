@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package ds_file
+
+import (
+	"syscall"
+)
+
+// FreeBytes returns the space available to the media repo on the filesystem holding the path.
+func FreeBytes(basePath string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(basePath, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,10 @@
+package ds_file
+
+import (
+	"errors"
+)
+
+// FreeBytes is not supported on Windows.
+func FreeBytes(basePath string) (int64, error) {
+	return 0, errors.New("free space cannot be checked on this platform")
+}
@@ -0,0 +1,63 @@
+package ds_file
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Layout is how files are spread over directories in a file datastore: each file is nested Depth
+// directories deep, with each directory named after the next Width characters of the file's ID. The
+// default of 2 levels of 2 hex characters gives 65536 directories.
+type Layout struct {
+	Depth int
+	Width int
+}
+
+var DefaultLayout = Layout{Depth: 2, Width: 2}
+
+// File IDs are 40 characters, so the directories can't use all of it.
+const maxShardChars = 16
+
+// LayoutFromOptions reads the shardDepth and shardWidth datastore options.
+func LayoutFromOptions(opts map[string]string) (Layout, error) {
+	layout := DefaultLayout
+	var err error
+
+	if v, ok := opts["shardDepth"]; ok && v != "" {
+		layout.Depth, err = strconv.Atoi(v)
+		if err != nil {
+			return layout, errors.New("shardDepth must be a number")
+		}
+	}
+	if v, ok := opts["shardWidth"]; ok && v != "" {
+		layout.Width, err = strconv.Atoi(v)
+		if err != nil {
+			return layout, errors.New("shardWidth must be a number")
+		}
+	}
+
+	if layout.Depth < 0 || layout.Width < 1 {
+		return layout, errors.New("shardDepth cannot be negative and shardWidth must be at least 1")
+	}
+	if layout.Depth*layout.Width > maxShardChars {
+		return layout, errors.New("shardDepth multiplied by shardWidth cannot be more than " + strconv.Itoa(maxShardChars))
+	}
+	return layout, nil
+}
+
+// Location returns where the file with the given ID belongs.
+func (l Layout) Location(fileId string) string {
+	parts := make([]string, 0)
+	for i := 0; i < l.Depth; i++ {
+		parts = append(parts, fileId[i*l.Width:(i+1)*l.Width])
+	}
+	parts = append(parts, fileId[l.Depth*l.Width:])
+	return path.Join(parts...)
+}
+
+// FileIdOfLocation undoes Location, for any layout.
+func FileIdOfLocation(location string) string {
+	return strings.ReplaceAll(location, "/", "")
+}
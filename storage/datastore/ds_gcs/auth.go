@@ -0,0 +1,164 @@
+package ds_gcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+const defaultTokenUri = "https://oauth2.googleapis.com/token"
+
+type serviceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+type accessToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+
+	expiresAt time.Time
+}
+
+func readServiceAccount(file string) (*serviceAccount, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &serviceAccount{}
+	err = json.Unmarshal(b, account)
+	if err != nil {
+		return nil, err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("credentials file is not a service account key")
+	}
+	if account.TokenUri == "" {
+		account.TokenUri = defaultTokenUri
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("cannot decode service account private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+	account.key = rsaKey
+
+	return account, nil
+}
+
+// getAccessToken returns an OAuth access token for the service account, exchanging a signed JWT
+// for a new one when the current token is close to expiring.
+// See https://developers.google.com/identity/protocols/oauth2/service-account#httprest
+func (s *gcsDatastore) getAccessToken() (string, error) {
+	s.tokenLock.Lock()
+	token := s.token
+	s.tokenLock.Unlock()
+
+	if token != nil && time.Now().Before(token.expiresAt) {
+		return token.AccessToken, nil
+	}
+
+	// The lock isn't held while refreshing so a slow token endpoint doesn't hold up requests which
+	// could have used the old token. Requests which find it expired may refresh it at the same time,
+	// which is harmless.
+	token, err := s.refreshAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.tokenLock.Lock()
+	s.token = token
+	s.tokenLock.Unlock()
+	return token.AccessToken, nil
+}
+
+func (s *gcsDatastore) refreshAccessToken() (*accessToken, error) {
+	assertion, err := s.credentials.signJwt()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: s.client.Transport, Timeout: requestTimeout}
+	res, err := client.PostForm(s.credentials.TokenUri, url.Values{
+		"grant_type": []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  []string{assertion},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status code while getting gcs access token: " + res.Status)
+	}
+
+	token := &accessToken{}
+	err = json.NewDecoder(res.Body).Decode(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh a minute early so requests in flight don't use an expired token
+	token.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return token, nil
+}
+
+func (a *serviceAccount) signJwt() (string, error) {
+	now := time.Now().Unix()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": a.PrivateKeyId,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   a.ClientEmail,
+		"scope": storageScope,
+		"aud":   a.TokenUri,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(claims),
+	}, ".")
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
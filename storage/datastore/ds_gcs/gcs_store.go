@@ -0,0 +1,253 @@
+package ds_gcs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const apiUrl = "https://storage.googleapis.com/storage/v1"
+const uploadUrl = "https://storage.googleapis.com/upload/storage/v1"
+
+// How long to wait for gcs to accept a connection and start responding. Transfers themselves aren't
+// limited, as large objects can take a while.
+const requestTimeout = 30 * time.Second
+
+var stores = make(map[string]*gcsDatastore)
+
+type gcsDatastore struct {
+	conf        config.DatastoreConfig
+	dsId        string
+	client      *http.Client
+	bucket      string
+	credentials *serviceAccount
+	tokenLock   *sync.Mutex
+	token       *accessToken
+}
+
+type gcsObject struct {
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	Updated string `json:"updated"`
+}
+
+type gcsObjectList struct {
+	Items         []*gcsObject `json:"items"`
+	NextPageToken string       `json:"nextPageToken"`
+}
+
+func GetOrCreateGcsDatastore(dsId string, conf config.DatastoreConfig) (*gcsDatastore, error) {
+	if s, ok := stores[dsId]; ok {
+		return s, nil
+	}
+
+	bucket, bucketFound := conf.Options["bucketName"]
+	credentialsFile, credentialsFound := conf.Options["credentialsFile"]
+	if !bucketFound || !credentialsFound {
+		return nil, errors.New("invalid configuration: missing gcs options")
+	}
+
+	credentials, err := readServiceAccount(credentialsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid configuration: cannot read gcs credentials")
+	}
+
+	gcsds := &gcsDatastore{
+		conf:        conf,
+		dsId:        dsId,
+		client:      newClient(),
+		bucket:      bucket,
+		credentials: credentials,
+		tokenLock:   &sync.Mutex{},
+	}
+	stores[dsId] = gcsds
+	return gcsds, nil
+}
+
+func newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: requestTimeout}).DialContext
+	transport.TLSHandshakeTimeout = requestTimeout
+	transport.ResponseHeaderTimeout = requestTimeout
+	return &http.Client{Transport: transport}
+}
+
+func (s *gcsDatastore) EnsureBucketExists() error {
+	res, err := s.do("GET", fmt.Sprintf("%s/b/%s", apiUrl, url.PathEscape(s.bucket)), nil, 0, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *gcsDatastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	defer cleanup.DumpAndCloseStream(file)
+
+	objectName, err := util.GenerateRandomString(512)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	reader := io.TeeReader(file, hasher)
+
+	if expectedLength <= 0 {
+		// GCS accepts chunked uploads, so we don't need to know the size up front
+		expectedLength = -1
+	}
+
+	ctx.Log.Info("Uploading file...")
+	sizeBytes, err := s.putObject(objectName, reader, expectedLength)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Uploaded ", sizeBytes, " bytes to gcs")
+
+	return &types.ObjectInfo{
+		Location:   objectName,
+		Sha256Hash: hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes:  sizeBytes,
+	}, nil
+}
+
+func (s *gcsDatastore) DeleteObject(location string) error {
+	logrus.Info("Deleting object from bucket ", s.bucket, ": ", location)
+	res, err := s.do("DELETE", s.objectUrl(location), nil, 0, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *gcsDatastore) DownloadObject(location string) (io.ReadCloser, error) {
+	logrus.Info("Downloading object from bucket ", s.bucket, ": ", location)
+	res, err := s.do("GET", s.objectUrl(location)+"?alt=media", nil, 0, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *gcsDatastore) ObjectExists(location string) bool {
+	res, err := s.send("GET", s.objectUrl(location)+"?fields=name", nil, 0)
+	if err != nil {
+		return false
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return res.StatusCode == http.StatusOK
+}
+
+func (s *gcsDatastore) OverwriteObject(location string, stream io.ReadCloser) error {
+	defer cleanup.DumpAndCloseStream(stream)
+	_, err := s.putObject(location, stream, -1)
+	return err
+}
+
+func (s *gcsDatastore) ListObjects() ([]*types.ObjectListing, error) {
+	objects := make([]*types.ObjectListing, 0)
+	pageToken := ""
+	for {
+		u := fmt.Sprintf("%s/b/%s/o?fields=items(name,size,updated),nextPageToken", apiUrl, url.PathEscape(s.bucket))
+		if pageToken != "" {
+			u = u + "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		res, err := s.do("GET", u, nil, 0, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		list := &gcsObjectList{}
+		err = json.NewDecoder(res.Body).Decode(list)
+		cleanup.DumpAndCloseStream(res.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range list.Items {
+			size, _ := strconv.ParseInt(obj.Size, 10, 64)
+			updated, _ := time.Parse(time.RFC3339, obj.Updated)
+			objects = append(objects, &types.ObjectListing{
+				Location:       obj.Name,
+				SizeBytes:      size,
+				LastModifiedTs: util.TimeToMillis(updated),
+			})
+		}
+
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (s *gcsDatastore) putObject(location string, body io.Reader, length int64) (int64, error) {
+	u := fmt.Sprintf("%s/b/%s/o?uploadType=media&name=%s", uploadUrl, url.PathEscape(s.bucket), url.QueryEscape(location))
+	res, err := s.do("POST", u, body, length, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+
+	obj := &gcsObject{}
+	err = json.NewDecoder(res.Body).Decode(obj)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(obj.Size, 10, 64)
+}
+
+func (s *gcsDatastore) objectUrl(location string) string {
+	return fmt.Sprintf("%s/b/%s/o/%s", apiUrl, url.PathEscape(s.bucket), url.PathEscape(location))
+}
+
+func (s *gcsDatastore) do(method string, u string, body io.Reader, length int64, expectedStatus int) (*http.Response, error) {
+	res, err := s.send(method, u, body, length)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != expectedStatus {
+		b, _ := ioutil.ReadAll(res.Body)
+		cleanup.DumpAndCloseStream(res.Body)
+		return nil, errors.New(fmt.Sprintf("unexpected status code from gcs: %d %s", res.StatusCode, string(b)))
+	}
+	return res, nil
+}
+
+// send makes an authenticated request to gcs, returning the response whatever its status code.
+func (s *gcsDatastore) send(method string, u string, body io.Reader, length int64) (*http.Response, error) {
+	token, err := s.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return s.client.Do(req)
+}
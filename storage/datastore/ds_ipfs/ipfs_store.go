@@ -2,8 +2,10 @@ package ds_ipfs
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/ipfs_proxy"
@@ -12,6 +14,17 @@ import (
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
+const locationPrefix = "ipfs/"
+
+// CidFromLocation returns the IPFS content ID of an object stored at the location, or an error if the
+// location isn't one of an IPFS object.
+func CidFromLocation(location string) (string, error) {
+	if !strings.HasPrefix(location, locationPrefix) || len(location) == len(locationPrefix) {
+		return "", errors.New("not an ipfs location: " + location)
+	}
+	return location[len(locationPrefix):], nil
+}
+
 func UploadFile(file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	defer cleanup.DumpAndCloseStream(file)
 
@@ -54,14 +67,17 @@ func UploadFile(file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectI
 	}
 
 	return &types.ObjectInfo{
-		Location:   "ipfs/" + cid,
+		Location:   locationPrefix + cid,
 		Sha256Hash: hash,
 		SizeBytes:  int64(len(b)),
 	}, nil
 }
 
 func DownloadFile(location string) (io.ReadCloser, error) {
-	cid := location[len("ipfs/"):]
+	cid, err := CidFromLocation(location)
+	if err != nil {
+		return nil, err
+	}
 	ctx := rcontext.Initial()
 
 	obj, err := ipfs_proxy.GetObject(cid, ctx)
@@ -71,3 +87,19 @@ func DownloadFile(location string) (io.ReadCloser, error) {
 
 	return obj.Data, nil
 }
+
+func ObjectExists(location string) bool {
+	cid, err := CidFromLocation(location)
+	if err != nil {
+		return false
+	}
+	ctx := rcontext.Initial()
+
+	obj, err := ipfs_proxy.GetObject(cid, ctx)
+	if err != nil {
+		return false
+	}
+	cleanup.DumpAndCloseStream(obj.Data)
+
+	return obj.SizeBytes > 0
+}
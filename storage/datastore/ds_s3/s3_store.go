@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v6"
 	"github.com/pkg/errors"
@@ -16,17 +18,33 @@ import (
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
 )
 
+// S3 doesn't accept multipart uploads with parts outside of these sizes (except the last part).
+const minPartSizeBytes = 5 * 1024 * 1024
+const maxPartSizeBytes = 5 * 1024 * 1024 * 1024
+
 var stores = make(map[string]*s3Datastore)
 
+// ObjectOptions override how an object is stored in the bucket. Tags are added to the datastore's
+// own tags, replacing any with the same key.
+type ObjectOptions struct {
+	StorageClass string
+	Tags         map[string]string
+}
+
 type s3Datastore struct {
-	conf     config.DatastoreConfig
-	dsId     string
-	client   *minio.Client
-	bucket   string
-	region string
-	tempPath string
+	conf         config.DatastoreConfig
+	dsId         string
+	client       *minio.Client
+	bucket       string
+	region       string
+	tempPath     string
+	partSize     uint64
+	threads      uint
+	storageClass string
+	tags         map[string]string
 }
 
 func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datastore, error) {
@@ -53,6 +71,41 @@ func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datast
 		useSsl, _ = strconv.ParseBool(useSslStr)
 	}
 
+	var partSize uint64
+	partSizeStr, partSizeFound := conf.Options["partSizeBytes"]
+	if partSizeFound && partSizeStr != "" {
+		var err error
+		partSize, err = strconv.ParseUint(partSizeStr, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid configuration: partSizeBytes")
+		}
+		if partSize < minPartSizeBytes || partSize > maxPartSizeBytes {
+			return nil, fmt.Errorf("invalid configuration: partSizeBytes must be between %d and %d", minPartSizeBytes, maxPartSizeBytes)
+		}
+	}
+
+	var threads uint
+	threadsStr, threadsFound := conf.Options["uploadThreads"]
+	if threadsFound && threadsStr != "" {
+		parsed, err := strconv.ParseUint(threadsStr, 10, 32)
+		if err != nil || parsed == 0 {
+			return nil, errors.New("invalid configuration: uploadThreads must be a positive number")
+		}
+		threads = uint(parsed)
+	}
+
+	tags := make(map[string]string)
+	tagsStr, tagsFound := conf.Options["objectTags"]
+	if tagsFound && tagsStr != "" {
+		parsed, err := url.ParseQuery(tagsStr)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid configuration: objectTags")
+		}
+		for k := range parsed {
+			tags[k] = parsed.Get(k)
+		}
+	}
+
 	var s3client *minio.Client
 	var err error
 
@@ -66,12 +119,16 @@ func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datast
 	}
 
 	s3ds := &s3Datastore{
-		conf:     conf,
-		dsId:     dsId,
-		client:   s3client,
-		bucket:   bucket,
-		region: region,
-		tempPath: tempPath,
+		conf:         conf,
+		dsId:         dsId,
+		client:       s3client,
+		bucket:       bucket,
+		region:       region,
+		tempPath:     tempPath,
+		partSize:     partSize,
+		threads:      threads,
+		storageClass: conf.Options["storageClass"],
+		tags:         tags,
 	}
 	stores[dsId] = s3ds
 	return s3ds, nil
@@ -121,7 +178,7 @@ func (s *s3Datastore) EnsureTempPathExists() error {
 	return nil
 }
 
-func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, opts *ObjectOptions, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	defer cleanup.DumpAndCloseStream(file)
 
 	objectName, err := util.GenerateRandomString(512)
@@ -155,7 +212,7 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 			if s.tempPath != "" {
 				ctx.Log.Info("Buffering file to temp path due to unknown file size")
 				var f *os.File
-				f, uploadErr = ioutil.TempFile(s.tempPath, "mr*")
+				f, uploadErr = ioutil.TempFile(s.tempPath, scratch.DatastoreTempPattern)
 				if uploadErr != nil {
 					io.Copy(ioutil.Discard, rs3)
 					done <- true
@@ -177,8 +234,12 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 			}
 		}
 		ctx.Log.Info("Uploading file...")
-		sizeBytes, uploadErr = s.client.PutObjectWithContext(ctx, s.bucket, objectName, rs3, expectedLength, minio.PutObjectOptions{})
-		ctx.Log.Info("Uploaded ", sizeBytes, " bytes to s3")
+		sizeBytes, uploadErr = s.client.PutObjectWithContext(ctx, s.bucket, objectName, rs3, expectedLength, s.putObjectOptions(opts))
+		if uploadErr != nil {
+			s.abortMultipartUpload(objectName)
+		} else {
+			ctx.Log.Info("Uploaded ", sizeBytes, " bytes to s3")
+		}
 		done <- true
 	}()
 
@@ -224,6 +285,106 @@ func (s *s3Datastore) ObjectExists(location string) bool {
 
 func (s *s3Datastore) OverwriteObject(location string, stream io.ReadCloser) error {
 	defer cleanup.DumpAndCloseStream(stream)
-	_, err := s.client.PutObject(s.bucket, location, stream, -1, minio.PutObjectOptions{})
+	_, err := s.client.PutObject(s.bucket, location, stream, -1, s.putObjectOptions(nil))
+	if err != nil {
+		s.abortMultipartUpload(location)
+	}
 	return err
 }
+
+// putObjectOptions returns the options for uploading objects, applying any overrides. Objects larger
+// than the part size are uploaded in parts, each of which is retried on its own, so only the parts
+// being uploaded are held in memory. Parts are uploaded in parallel when the file was buffered to the
+// temp path.
+func (s *s3Datastore) putObjectOptions(overrides *ObjectOptions) minio.PutObjectOptions {
+	storageClass := s.storageClass
+	tags := make(map[string]string)
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	if overrides != nil {
+		if overrides.StorageClass != "" {
+			storageClass = overrides.StorageClass
+		}
+		for k, v := range overrides.Tags {
+			tags[k] = v
+		}
+	}
+
+	return minio.PutObjectOptions{
+		PartSize:     s.partSize,
+		NumThreads:   s.threads,
+		StorageClass: storageClass,
+		UserTags:     tags,
+	}
+}
+
+// abortMultipartUpload removes the parts of a failed upload, which S3 would otherwise keep (and bill
+// for) indefinitely.
+func (s *s3Datastore) abortMultipartUpload(location string) {
+	err := s.client.RemoveIncompleteUpload(s.bucket, location)
+	if err != nil {
+		logrus.Warn("Error removing incomplete upload from bucket ", s.bucket, ": ", err)
+	}
+}
+
+func (s *s3Datastore) ListObjects() ([]*types.ObjectListing, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	objects := make([]*types.ObjectListing, 0)
+	for obj := range s.client.ListObjectsV2(s.bucket, "", true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, &types.ObjectListing{
+			Location:       obj.Key,
+			SizeBytes:      obj.Size,
+			LastModifiedTs: util.TimeToMillis(obj.LastModified),
+		})
+	}
+	return objects, nil
+}
+
+// PresignedDownloadUrl returns a URL which can be used to download the object without credentials
+// until it expires. The content type and disposition are sent by S3 as response headers.
+func (s *s3Datastore) PresignedDownloadUrl(location string, expiry time.Duration, contentType string, disposition string) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-type", contentType)
+	params.Set("response-content-disposition", disposition)
+	u, err := s.client.PresignedGetObject(s.bucket, location, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// PresignedUploadPolicy returns a URL and form fields which can be used to upload an object to the
+// location with a multipart POST request until the policy expires. If maxBytes is more than zero, S3
+// rejects larger uploads.
+func (s *s3Datastore) PresignedUploadPolicy(location string, contentType string, maxBytes int64, expiry time.Duration) (string, map[string]string, error) {
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(s.bucket); err != nil {
+		return "", nil, err
+	}
+	if err := policy.SetKey(location); err != nil {
+		return "", nil, err
+	}
+	if err := policy.SetExpires(time.Now().UTC().Add(expiry)); err != nil {
+		return "", nil, err
+	}
+	if err := policy.SetContentType(contentType); err != nil {
+		return "", nil, err
+	}
+	if maxBytes > 0 {
+		if err := policy.SetContentLengthRange(1, maxBytes); err != nil {
+			return "", nil, err
+		}
+	}
+
+	u, fields, err := s.client.PresignedPostPolicy(policy)
+	if err != nil {
+		return "", nil, err
+	}
+	return u.String(), fields, nil
+}
@@ -0,0 +1,328 @@
+package ds_webdav
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
+)
+
+var stores = make(map[string]*webdavDatastore)
+
+// How long to wait for the server to accept a connection and start responding. Transfers themselves
+// aren't limited, as large files can take a while.
+const requestTimeout = 30 * time.Second
+
+type webdavDatastore struct {
+	conf        config.DatastoreConfig
+	dsId        string
+	client      *http.Client
+	baseUrl     string
+	username    string
+	password    string
+	bearerToken string
+	tempPath    string
+}
+
+func GetOrCreateWebDavDatastore(dsId string, conf config.DatastoreConfig) (*webdavDatastore, error) {
+	if s, ok := stores[dsId]; ok {
+		return s, nil
+	}
+
+	baseUrl, urlFound := conf.Options["baseUrl"]
+	if !urlFound || baseUrl == "" {
+		return nil, errors.New("invalid configuration: missing webdav options")
+	}
+	if _, err := url.Parse(baseUrl); err != nil {
+		return nil, errors.Wrap(err, "invalid configuration: cannot parse baseUrl")
+	}
+	tempPath, tempPathFound := conf.Options["tempPath"]
+	if !tempPathFound {
+		logrus.Warn("Datastore ", dsId, " (webdav) does not have a tempPath set - this could lead to excessive memory usage by the media repo")
+	}
+
+	davds := &webdavDatastore{
+		conf:        conf,
+		dsId:        dsId,
+		client:      newClient(),
+		baseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		username:    conf.Options["username"],
+		password:    conf.Options["password"],
+		bearerToken: conf.Options["bearerToken"],
+		tempPath:    tempPath,
+	}
+	stores[dsId] = davds
+	return davds, nil
+}
+
+func newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: requestTimeout}).DialContext
+	transport.TLSHandshakeTimeout = requestTimeout
+	transport.ResponseHeaderTimeout = requestTimeout
+	return &http.Client{Transport: transport}
+}
+
+func (s *webdavDatastore) EnsureCollectionExists() error {
+	req, err := s.newRequest("OPTIONS", "", nil, 0)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *webdavDatastore) EnsureTempPathExists() error {
+	err := os.MkdirAll(s.tempPath, os.ModePerm)
+	if err != os.ErrExist && err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *webdavDatastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	defer cleanup.DumpAndCloseStream(file)
+
+	objectName, err := util.GenerateRandomString(512)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	var reader io.Reader = io.TeeReader(file, hasher)
+
+	// Many WebDAV servers don't support chunked uploads, so we need to know the size up front
+	if expectedLength <= 0 {
+		if s.tempPath != "" {
+			ctx.Log.Info("Buffering file to temp path due to unknown file size")
+			f, err := ioutil.TempFile(s.tempPath, scratch.DatastoreTempPattern)
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(f.Name())
+			defer cleanup.DumpAndCloseStream(f)
+			expectedLength, err = io.Copy(f, reader)
+			if err != nil {
+				return nil, err
+			}
+			_, err = f.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			reader = f
+		} else {
+			ctx.Log.Warn("Uploading content of unknown length to webdav - this could result in high memory usage")
+			b, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			expectedLength = int64(len(b))
+			reader = bytes.NewReader(b)
+		}
+	}
+
+	ctx.Log.Info("Uploading file...")
+	err = s.put(objectName, reader, expectedLength)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Uploaded ", expectedLength, " bytes to webdav")
+
+	return &types.ObjectInfo{
+		Location:   objectName,
+		Sha256Hash: hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes:  expectedLength,
+	}, nil
+}
+
+func (s *webdavDatastore) DeleteObject(location string) error {
+	logrus.Info("Deleting object from webdav: ", location)
+	req, err := s.newRequest("DELETE", location, nil, 0)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, http.StatusOK, http.StatusNoContent, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *webdavDatastore) DownloadObject(location string) (io.ReadCloser, error) {
+	logrus.Info("Downloading object from webdav: ", location)
+	req, err := s.newRequest("GET", location, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *webdavDatastore) ObjectExists(location string) bool {
+	req, err := s.newRequest("HEAD", location, nil, 0)
+	if err != nil {
+		return false
+	}
+	// Empty files still exist, so only the status matters
+	res, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return false
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return true
+}
+
+func (s *webdavDatastore) OverwriteObject(location string, stream io.ReadCloser) error {
+	defer cleanup.DumpAndCloseStream(stream)
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	return s.put(location, bytes.NewReader(b), int64(len(b)))
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// See http://www.webdav.org/specs/rfc4918.html#METHOD_PROPFIND
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (s *webdavDatastore) ListObjects() ([]*types.ObjectListing, error) {
+	req, err := s.newRequest("PROPFIND", "", strings.NewReader(propfindBody), int64(len(propfindBody)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	res, err := s.do(req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+
+	multistatus := &davMultistatus{}
+	err = xml.NewDecoder(res.Body).Decode(multistatus)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*types.ObjectListing, 0)
+	for _, r := range multistatus.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		// Objects are all stored directly in the collection, which is also listed here
+		location := path.Base(href.Path)
+		if strings.HasSuffix(href.Path, "/") || location == "" {
+			continue
+		}
+
+		listing := &types.ObjectListing{Location: location}
+		isCollection := false
+		for _, propstat := range r.Propstat {
+			if propstat.Prop.ResourceType.Collection != nil {
+				isCollection = true
+			}
+			if propstat.Prop.ContentLength != "" {
+				listing.SizeBytes, _ = strconv.ParseInt(propstat.Prop.ContentLength, 10, 64)
+			}
+			if propstat.Prop.LastModified != "" {
+				modified, _ := http.ParseTime(propstat.Prop.LastModified)
+				listing.LastModifiedTs = util.TimeToMillis(modified)
+			}
+		}
+		if !isCollection {
+			objects = append(objects, listing)
+		}
+	}
+	return objects, nil
+}
+
+func (s *webdavDatastore) put(location string, body io.Reader, length int64) error {
+	req, err := s.newRequest("PUT", location, body, length)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := s.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil
+}
+
+func (s *webdavDatastore) newRequest(method string, location string, body io.Reader, length int64) (*http.Request, error) {
+	u := s.baseUrl + "/"
+	if location != "" {
+		u = u + url.PathEscape(location)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return req, nil
+}
+
+func (s *webdavDatastore) do(req *http.Request, expectedStatuses ...int) (*http.Response, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expectedStatuses {
+		if res.StatusCode == status {
+			return res, nil
+		}
+	}
+	cleanup.DumpAndCloseStream(res.Body)
+	return nil, errors.New("unexpected status code from webdav: " + strconv.Itoa(res.StatusCode))
+}
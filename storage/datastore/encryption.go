@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	config2 "github.com/turt2live/matrix-media-repo/common/config"
+)
+
+var encryptionKeys = make(map[string][]byte)
+var encryptionKeysLock = &sync.Mutex{}
+
+// getEncryptionKey returns the key configured for the datastore, or nil if the datastore is not
+// encrypted. The key is either given inline as encryptionKey, or read from encryptionKeyFile (such
+// as a file written by a KMS or secrets agent). Both are base64 encoded 32 byte keys.
+func getEncryptionKey(datastoreId string, conf config2.DatastoreConfig) ([]byte, error) {
+	encryptionKeysLock.Lock()
+	defer encryptionKeysLock.Unlock()
+
+	if key, ok := encryptionKeys[datastoreId]; ok {
+		return key, nil
+	}
+
+	encoded := conf.Options["encryptionKey"]
+	if keyFile, ok := conf.Options["encryptionKeyFile"]; ok && keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read encryptionKeyFile")
+		}
+		encoded = string(b)
+	}
+	encoded = strings.TrimSpace(encoded)
+
+	var key []byte
+	if encoded != "" {
+		var err error
+		key, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode encryption key")
+		}
+		if len(key) != 32 {
+			return nil, errors.New("encryption key must be 32 bytes once decoded")
+		}
+	}
+
+	encryptionKeys[datastoreId] = key
+	return key, nil
+}
+
+// IsEncrypted returns true if the datastore encrypts its contents, or an error if the key is invalid.
+func IsEncrypted(datastoreId string, conf config2.DatastoreConfig) (bool, error) {
+	key, err := getEncryptionKey(datastoreId, conf)
+	return key != nil, err
+}
+
+// plainCounter records the hash and size of the plaintext passing through it, as the datastore only
+// sees the encrypted form.
+type plainCounter struct {
+	source io.ReadCloser
+	hasher hash.Hash
+	size   int64
+}
+
+func newPlainCounter(source io.ReadCloser) *plainCounter {
+	return &plainCounter{source: source, hasher: sha256.New()}
+}
+
+func (c *plainCounter) Read(p []byte) (int, error) {
+	n, err := c.source.Read(p)
+	c.hasher.Write(p[:n])
+	c.size += int64(n)
+	return n, err
+}
+
+func (c *plainCounter) Close() error {
+	return c.source.Close()
+}
+
+func (c *plainCounter) Sha256Hash() string {
+	return hex.EncodeToString(c.hasher.Sum(nil))
+}
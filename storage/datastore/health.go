@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type HealthStatus struct {
+	Healthy     bool   `json:"healthy"`
+	LastCheckTs int64  `json:"last_check_ts"`
+	Error       string `json:"-"`
+}
+
+var healthStatuses = make(map[string]*HealthStatus)
+var healthLock = &sync.RWMutex{}
+
+// IsHealthy returns false if the datastore failed its last health check. Datastores which haven't
+// been checked are assumed to be healthy.
+func IsHealthy(datastoreId string) bool {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+
+	status, ok := healthStatuses[datastoreId]
+	return !ok || status.Healthy
+}
+
+// GetHealthStatuses returns the result of the last health check of each datastore, by datastore ID.
+func GetHealthStatuses() map[string]HealthStatus {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+
+	statuses := make(map[string]HealthStatus)
+	for id, status := range healthStatuses {
+		statuses[id] = *status
+	}
+	return statuses
+}
+
+// HasWritableDatastore returns whether a datastore which passed its last health check can take new
+// media of the given kind.
+func HasWritableDatastore(forKind string, ctx rcontext.RequestContext) bool {
+	candidates := make([]config.DatastoreConfig, 0)
+	for _, dsConf := range ctx.Config.DataStores {
+		if dsConf.Enabled && common.HasKind(dsConf.MediaKinds, forKind) {
+			candidates = append(candidates, dsConf)
+		}
+	}
+
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	for _, dsConf := range withoutReadOnly(candidates, ctx) {
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err == nil && IsHealthy(ds.DatastoreId) {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetHealth drops the datastore's last health check, such as when it stops being checked.
+func forgetHealth(datastoreId string) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	delete(healthStatuses, datastoreId)
+	metrics.DatastoreHealthy.Delete(prometheus.Labels{"datastoreId": datastoreId})
+}
+
+func setHealth(datastoreId string, err error) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	status := &HealthStatus{Healthy: err == nil, LastCheckTs: util.NowMillis()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	healthStatuses[datastoreId] = status
+
+	result := "ok"
+	healthy := 1.0
+	if err != nil {
+		result = "failed"
+		healthy = 0
+	}
+	metrics.DatastoreHealthChecks.With(prometheus.Labels{"datastoreId": datastoreId, "result": result}).Inc()
+	metrics.DatastoreHealthy.With(prometheus.Labels{"datastoreId": datastoreId}).Set(healthy)
+}
+
+// CheckAllDatastoreHealth probes every enabled datastore by writing, reading back, and deleting a
+// small canary object. Datastores which fail are no longer picked for new uploads until they pass
+// again. Read-only datastores aren't probed, as they aren't written to.
+func CheckAllDatastoreHealth(ctx rcontext.RequestContext) {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	timeout := time.Duration(config.Get().DatastoreHealth.TimeoutSeconds) * time.Second
+
+	for _, dsConf := range config.UniqueDatastores() {
+		if !dsConf.Enabled || dsConf.Type == "ipfs" {
+			// IPFS can't delete objects, so probing it would leave canaries behind forever
+			continue
+		}
+
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err != nil {
+			ctx.Log.Error("Error getting datastore: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		ref := newDatastoreRef(ds, dsConf)
+		rctx := ctx.LogWithFields(logrus.Fields{"datastoreId": ref.DatastoreId, "datastoreUri": ref.Uri})
+
+		if ref.IsReadOnly(rctx) {
+			forgetHealth(ref.DatastoreId)
+			continue
+		}
+
+		wasHealthy := IsHealthy(ref.DatastoreId)
+		err = ref.probeWithTimeout(timeout, rctx)
+		setHealth(ref.DatastoreId, err)
+
+		if err != nil && wasHealthy {
+			rctx.Log.Error("Datastore failed its health check and will not receive new uploads: ", err)
+			sentry.CaptureException(err)
+		} else if err != nil {
+			rctx.Log.Warn("Datastore is still unhealthy: ", err)
+		} else if !wasHealthy {
+			rctx.Log.Info("Datastore is healthy again")
+		}
+	}
+}
+
+func (d *DatastoreRef) probeWithTimeout(timeout time.Duration, ctx rcontext.RequestContext) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- d.probe(ctx)
+	}()
+
+	if timeout <= 0 {
+		return <-result
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("health check did not finish within %s", timeout)
+	}
+}
+
+func (d *DatastoreRef) probe(ctx rcontext.RequestContext) error {
+	canary := []byte(fmt.Sprintf("matrix-media-repo health check %d", util.NowMillis()))
+
+	// Talk to the datastore directly: the canary shouldn't be replicated or staged for write-behind
+	info, err := d.uploadFile(util.BytesToStream(canary), int64(len(canary)), ctx)
+	if err != nil {
+		return err
+	}
+
+	stream, err := d.downloadFile(info.Location)
+	if err == nil {
+		var contents []byte
+		contents, err = ioutil.ReadAll(stream)
+		stream.Close()
+		if err == nil && !bytes.Equal(contents, canary) {
+			err = errors.New("canary object was read back with different contents")
+		}
+	}
+
+	deleteErr := d.deleteObject(info.Location)
+	if err != nil {
+		return err
+	}
+	return deleteErr
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// IsReadOnly returns true if the datastore is marked read-only in the config or through the admin
+// API. Media in read-only datastores is still served and can be deleted, but nothing new is written
+// to them.
+func (d *DatastoreRef) IsReadOnly(ctx rcontext.RequestContext) bool {
+	if d.config.ReadOnly {
+		return true
+	}
+	readOnlyIds, err := storage.GetDatabase().GetMediaStore(ctx).GetReadOnlyDatastoreIds()
+	if err != nil {
+		ctx.Log.Error("Error checking if datastore is read-only: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+	return util.ArrayContains(readOnlyIds, d.DatastoreId)
+}
+
+// SetReadOnly marks the datastore as read-only (or not) until changed again. Datastores which are
+// read-only in the config stay that way regardless.
+func (d *DatastoreRef) SetReadOnly(readOnly bool, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMediaStore(ctx).SetDatastoreReadOnly(d.DatastoreId, readOnly)
+}
+
+func withoutReadOnly(datastores []config.DatastoreConfig, ctx rcontext.RequestContext) []config.DatastoreConfig {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	readOnlyIds, err := mediaStore.GetReadOnlyDatastoreIds()
+	if err != nil {
+		ctx.Log.Error("Error getting read-only datastores: ", err)
+		sentry.CaptureException(err)
+		readOnlyIds = make([]string, 0)
+	}
+
+	filtered := make([]config.DatastoreConfig, 0)
+	for _, dsConf := range datastores {
+		if dsConf.ReadOnly {
+			continue
+		}
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err == nil && util.ArrayContains(readOnlyIds, ds.DatastoreId) {
+			continue
+		}
+		filtered = append(filtered, dsConf)
+	}
+	return filtered
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+const defaultRedirectExpirySeconds = 300
+
+// CanRedirectDownload returns whether downloads of the media can be redirected to its datastore
+// rather than served by the media repo. Only S3 datastores with redirectDownloads enabled are
+// redirected to, and only when the stored object is exactly the original content: encrypted,
+// compressed, and not yet written objects are always proxied. This is decided from the media record
+// alone so the object doesn't have to be opened.
+func CanRedirectDownload(media *types.Media, ctx rcontext.RequestContext) (bool, error) {
+	if media == nil || media.Quarantined || media.Compressed || media.DatastoreId == "" {
+		return false, nil
+	}
+
+	ds, err := LocateDatastore(ctx, media.DatastoreId)
+	if err != nil {
+		return false, err
+	}
+	if ds.Type != "s3" {
+		return false, nil
+	}
+	if enabled, _ := strconv.ParseBool(ds.config.Options["redirectDownloads"]); !enabled {
+		return false, nil
+	}
+	if !IsHealthy(ds.DatastoreId) {
+		// The replicas might still have it
+		return false, nil
+	}
+
+	key, err := getEncryptionKey(ds.DatastoreId, ds.config)
+	if err != nil {
+		return false, err
+	}
+	if key != nil {
+		return false, nil
+	}
+	staged, err := ds.openStaged(media.Location)
+	if err != nil {
+		return false, err
+	}
+	if staged != nil {
+		staged.Close()
+		return false, nil
+	}
+	return true, nil
+}
+
+// DownloadRedirectUrl returns a short-lived URL which serves the media straight from its datastore.
+// CanRedirectDownload must have already said the media can be redirected to.
+func DownloadRedirectUrl(media *types.Media, contentType string, disposition string, ctx rcontext.RequestContext) (string, error) {
+	ds, err := LocateDatastore(ctx, media.DatastoreId)
+	if err != nil {
+		return "", err
+	}
+	s3, err := ds_s3.GetOrCreateS3Datastore(ds.DatastoreId, ds.config)
+	if err != nil {
+		return "", err
+	}
+
+	expirySeconds := defaultRedirectExpirySeconds
+	if val, ok := ds.config.Options["redirectExpirySeconds"]; ok && val != "" {
+		expirySeconds, err = strconv.Atoi(val)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return s3.PresignedDownloadUrl(media.Location, time.Duration(expirySeconds)*time.Second, contentType, disposition)
+}
@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// replicaTargets returns the datastores which should hold a copy of everything written to this one:
+// the datastores it is configured to mirror to, followed by other enabled datastores until the
+// replication factor is met.
+func (d *DatastoreRef) replicaTargets(ctx rcontext.RequestContext) []*DatastoreRef {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+
+	type candidate struct {
+		ds   *types.Datastore
+		conf config.DatastoreConfig
+	}
+	candidates := make([]candidate, 0)
+	for _, dsConf := range config.UniqueDatastores() {
+		if !dsConf.Enabled {
+			continue
+		}
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err != nil {
+			ctx.Log.Warn("Error getting datastore for replication: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if ds.DatastoreId == d.DatastoreId {
+			continue
+		}
+		if !IsHealthy(ds.DatastoreId) {
+			ctx.Log.Warn("Not replicating to unhealthy datastore ", ds.Uri)
+			continue
+		}
+		if isOverCapacity(ds, dsConf, ctx) {
+			continue
+		}
+		if newDatastoreRef(ds, dsConf).IsReadOnly(ctx) {
+			continue
+		}
+		candidates = append(candidates, candidate{ds: ds, conf: dsConf})
+	}
+
+	targets := make([]*DatastoreRef, 0)
+	used := make(map[string]bool)
+	for _, mirror := range d.config.MirrorTo {
+		found := false
+		for _, c := range candidates {
+			if c.ds.DatastoreId == mirror || c.ds.Uri == mirror {
+				found = true
+				if !used[c.ds.DatastoreId] {
+					used[c.ds.DatastoreId] = true
+					targets = append(targets, newDatastoreRef(c.ds, c.conf))
+				}
+				break
+			}
+		}
+		if !found {
+			ctx.Log.Warn("Cannot mirror to ", mirror, ": no enabled datastore has that ID or URI")
+		}
+	}
+
+	wanted := config.Get().Replication.Factor - 1
+	for _, c := range candidates {
+		if len(targets) >= wanted {
+			break
+		}
+		if used[c.ds.DatastoreId] {
+			continue
+		}
+		used[c.ds.DatastoreId] = true
+		targets = append(targets, newDatastoreRef(c.ds, c.conf))
+	}
+
+	return targets
+}
+
+// replicate copies a newly written object to each of the datastore's replica targets. Failing to
+// write a replica doesn't fail the upload as the object is safely stored in this datastore.
+func (d *DatastoreRef) replicate(location string, contentType string, ctx rcontext.RequestContext) {
+	targets := d.replicaTargets(ctx)
+	if len(targets) == 0 {
+		return
+	}
+
+	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+	for _, target := range targets {
+		rctx := ctx.LogWithFields(logrus.Fields{"replicaDatastoreId": target.DatastoreId})
+
+		stream, err := d.readObject(location)
+		if err != nil {
+			rctx.Log.Error("Error reading object to replicate: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+
+		rctx.Log.Info("Replicating object ", location)
+		info, err := target.storeObject(stream, -1, contentType, rctx)
+		if err != nil {
+			rctx.Log.Error("Error writing replica: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		err = metadataDb.InsertObjectReplica(&types.ObjectReplica{
+			DatastoreId:        d.DatastoreId,
+			Location:           location,
+			ReplicaDatastoreId: target.DatastoreId,
+			ReplicaLocation:    info.Location,
+		})
+		if err != nil {
+			rctx.Log.Error("Error recording replica: ", err)
+			sentry.CaptureException(err)
+			// Don't leave an unrecorded copy lying around for the garbage collector to find
+			_ = target.deleteObject(info.Location)
+		}
+	}
+}
+
+// readFromReplicas returns the contents of an object from the first of its replicas which can be
+// read, for when the object can't be read from this datastore.
+func (d *DatastoreRef) readFromReplicas(location string, ctx rcontext.RequestContext) (io.ReadCloser, error) {
+	replicas, err := storage.GetDatabase().GetMetadataStore(ctx).GetObjectReplicas(d.DatastoreId, location)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := errors.New("object has no replicas")
+	for _, replica := range replicas {
+		ref, err := LocateDatastore(ctx, replica.ReplicaDatastoreId)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		stream, err := ref.readObject(replica.ReplicaLocation)
+		if err != nil {
+			ctx.Log.Warn("Error reading replica in ", replica.ReplicaDatastoreId, ": ", err)
+			lastErr = err
+			continue
+		}
+		ctx.Log.Warn("Read ", location, " from its replica in ", replica.ReplicaDatastoreId)
+		return stream, nil
+	}
+	return nil, lastErr
+}
+
+// deleteReplicas deletes every copy of an object which was written to other datastores.
+func (d *DatastoreRef) deleteReplicas(location string, ctx rcontext.RequestContext) error {
+	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+	replicas, err := metadataDb.GetObjectReplicas(d.DatastoreId, location)
+	if err != nil {
+		return err
+	}
+
+	for _, replica := range replicas {
+		ref, err := LocateDatastore(ctx, replica.ReplicaDatastoreId)
+		if err != nil {
+			return err
+		}
+		err = ref.deleteObject(replica.ReplicaLocation)
+		if err != nil {
+			return err
+		}
+	}
+	return metadataDb.DeleteObjectReplicas(d.DatastoreId, location)
+}
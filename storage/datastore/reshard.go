@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Reshard moves every known file in a file datastore to where its configured layout says it belongs,
+// updating the records which point at it. The media repo must not be running while this happens.
+// Runs which were interrupted can be resumed by running this again. Returns the number of files moved.
+func (d *DatastoreRef) Reshard(dryRun bool, ctx rcontext.RequestContext) (int, error) {
+	if d.Type != "file" {
+		return 0, errors.New("only file datastores can be resharded")
+	}
+	layout, err := ds_file.LayoutFromOptions(d.config.Options)
+	if err != nil {
+		return 0, err
+	}
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	refs, err := db.GetObjectReferencesInDatastore(d.DatastoreId)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool)
+	moved := 0
+	for _, ref := range refs {
+		if seen[ref.Location] {
+			continue
+		}
+		seen[ref.Location] = true
+
+		newLocation := layout.Location(ds_file.FileIdOfLocation(ref.Location))
+		if newLocation == ref.Location {
+			continue
+		}
+		if staged, err := d.openStaged(ref.Location); err == nil && staged != nil {
+			staged.Close()
+			ctx.Log.Warn("Skipping ", ref.Location, " as it hasn't been written from the staging area yet")
+			continue
+		}
+
+		ctx.Log.Info("Moving ", ref.Location, " to ", newLocation)
+		if dryRun {
+			moved++
+			continue
+		}
+
+		oldPath := path.Join(d.Uri, ref.Location)
+		newPath := path.Join(d.Uri, newLocation)
+		oldExists, err := util.FileExists(oldPath)
+		if err != nil {
+			return moved, err
+		}
+		newExists, err := util.FileExists(newPath)
+		if err != nil {
+			return moved, err
+		}
+
+		if !oldExists && !newExists {
+			ctx.Log.Warn("Skipping ", ref.Location, " as the file is missing")
+			continue
+		}
+		if oldExists {
+			// Otherwise the file was moved by a previous run which was interrupted before it could
+			// update the records.
+			err = os.MkdirAll(path.Dir(newPath), 0755)
+			if err != nil {
+				return moved, err
+			}
+			err = os.Rename(oldPath, newPath)
+			if err != nil {
+				return moved, err
+			}
+		}
+
+		err = db.ChangeLocationOfObject(d.DatastoreId, ref.Location, newLocation)
+		if err != nil {
+			ctx.Log.Error("Error updating records for ", ref.Location, " - moving the file back")
+			_ = os.Rename(newPath, oldPath)
+			return moved, err
+		}
+		moved++
+	}
+
+	return moved, nil
+}
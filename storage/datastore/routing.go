@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// UploadDetails describes the file being stored, for matching it against the routing rules.
+type UploadDetails struct {
+	UserId      string
+	Origin      string
+	ContentType string
+	SizeBytes   int64
+}
+
+// PickDatastoreForUpload picks the datastore named by the first routing rule which matches the
+// upload, falling back to PickDatastore when no rule matches. Files uploaded to the returned datastore
+// use the storage class and object tags of the rule, if any.
+func PickDatastoreForUpload(forKind string, upload *UploadDetails, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+	for i, rule := range config.Get().DatastoreRouting {
+		if !ruleMatches(rule, upload) {
+			continue
+		}
+
+		ds := routedDatastore(rule.Datastore, forKind, ctx)
+		if ds == nil {
+			ctx.Log.Warn("Routing rule ", i, " matched but its datastore ", rule.Datastore, " can't currently store ", forKind)
+			continue
+		}
+
+		ctx.Log.Info("Using ", ds.Uri, " as routed by rule ", i)
+		ds.storageClass = rule.StorageClass
+		ds.objectTags = rule.ObjectTags
+		return ds, nil
+	}
+
+	return PickDatastore(forKind, ctx)
+}
+
+func ruleMatches(rule config.DatastoreRoutingRule, upload *UploadDetails) bool {
+	if !matchesAnyGlob(rule.Origins, upload.Origin) {
+		return false
+	}
+	if !matchesAnyGlob(rule.UserIds, upload.UserId) {
+		return false
+	}
+	if !matchesAnyGlob(rule.ContentTypes, upload.ContentType) {
+		return false
+	}
+	if rule.MinSizeBytes > 0 && upload.SizeBytes < rule.MinSizeBytes {
+		return false
+	}
+	if rule.MaxSizeBytes > 0 && upload.SizeBytes > rule.MaxSizeBytes {
+		return false
+	}
+	return true
+}
+
+// matchesAnyGlob returns true if the value matches one of the patterns, or there are no patterns.
+func matchesAnyGlob(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if glob.Glob(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// routedDatastore finds the datastore with the given ID or URI, so long as it is healthy, has space,
+// is writable, and is enabled for the requested kind of media on this domain.
+func routedDatastore(idOrUri string, forKind string, ctx rcontext.RequestContext) *DatastoreRef {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	for _, dsConf := range ctx.Config.DataStores {
+		if !dsConf.Enabled || !common.HasKind(dsConf.MediaKinds, forKind) {
+			continue
+		}
+
+		ds, err := mediaStore.GetDatastoreByUri(GetUriForDatastore(dsConf))
+		if err != nil {
+			ctx.Log.Error("Error getting datastore: ", err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+		if ds.DatastoreId == idOrUri || ds.Uri == idOrUri {
+			if !IsHealthy(ds.DatastoreId) {
+				ctx.Log.Warn("Not routing to unhealthy datastore ", ds.Uri)
+				return nil
+			}
+			if isOverCapacity(ds, dsConf, ctx) {
+				return nil
+			}
+			ref := newDatastoreRef(ds, dsConf)
+			if ref.IsReadOnly(ctx) {
+				ctx.Log.Warn("Not routing to read-only datastore ", ds.Uri)
+				return nil
+			}
+			return ref
+		}
+	}
+	return nil
+}
+
+// PickHotDatastore returns the first hot tier datastore which can currently store the kind of media,
+// or nil if there isn't one.
+func PickHotDatastore(forKind string, ctx rcontext.RequestContext) *DatastoreRef {
+	for _, dsConf := range ctx.Config.DataStores {
+		if dsConf.Tier != common.TierHot {
+			continue
+		}
+		if ds := routedDatastore(GetUriForDatastore(dsConf), forKind, ctx); ds != nil {
+			return ds
+		}
+	}
+	return nil
+}
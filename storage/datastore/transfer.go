@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// TransferObject copies an object to the target datastore, verifies the copy, repoints every media
+// and thumbnail record with the hash at it, and only then deletes the source copy. If anything goes
+// wrong before the records are updated, the source copy is left in place and an error is returned.
+func TransferObject(sha256Hash string, location string, sizeBytes int64, sourceDs *DatastoreRef, targetDs *DatastoreRef, ctx rcontext.RequestContext) error {
+	sourceStream, err := sourceDs.DownloadFile(location)
+	if err != nil {
+		return errors.Wrap(err, "failed to start download from source datastore")
+	}
+
+	newLocation, err := targetDs.UploadFile(sourceStream, sizeBytes, ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to upload file to target datastore")
+	}
+
+	if newLocation.Sha256Hash != sha256Hash || newLocation.SizeBytes != sizeBytes || !targetDs.ObjectExists(newLocation.Location) {
+		err = targetDs.DeleteObject(newLocation.Location)
+		if err != nil {
+			ctx.Log.Warn("Failed to remove mismatched copy from target datastore: ", err)
+		}
+		return errors.New("copy in target datastore does not match the source")
+	}
+
+	ctx.Log.Info("Updating media records...")
+	err = storage.GetDatabase().GetMetadataStore(ctx).ChangeDatastoreOfHash(targetDs.DatastoreId, newLocation.Location, sha256Hash, newLocation.StoredSizeBytes, newLocation.Compressed)
+	if err != nil {
+		return errors.Wrap(err, "failed to update database records")
+	}
+
+	ctx.Log.Info("Deleting media from old datastore")
+	err = sourceDs.DeleteObject(location)
+	if err != nil {
+		// The records already point at the new copy, so the media has still been moved
+		ctx.Log.Error("Failed to delete old media: ", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Failed writes are retried with exponential backoff, up to this long between attempts.
+const maxWriteBehindBackoff = 1 * time.Hour
+
+// The number of queued objects to look at each time the queue is processed.
+const writeBehindBatchSize = 100
+
+// Objects which are currently being written, so the queue and the write started straight after an
+// upload don't both try to write the same object.
+var writesInFlight = make(map[string]bool)
+var writesInFlightLock = &sync.Mutex{}
+
+func (d *DatastoreRef) stagedPath(location string) string {
+	return path.Join(config.Get().WriteBehind.StagingPath, d.DatastoreId, location)
+}
+
+// openStaged returns the staged copy of an object which hasn't been written to the datastore yet,
+// or nil if there is no staged copy.
+func (d *DatastoreRef) openStaged(location string) (io.ReadCloser, error) {
+	// Objects can still be staged after write-behind is turned off for the datastore, so check
+	// whenever there's a staging area.
+	if config.Get().WriteBehind.StagingPath == "" {
+		return nil, nil
+	}
+	f, err := os.Open(d.stagedPath(location))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// stageObject writes an already compressed and encrypted object to the staging area, queueing it to
+// be written to the datastore in the background. The object gets the location it will have in the
+// datastore.
+func (d *DatastoreRef) stageObject(stored io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	location, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, err
+	}
+	if d.Type == "file" {
+		// Match the directory layout of files which were written directly
+		layout, err := ds_file.LayoutFromOptions(d.config.Options)
+		if err != nil {
+			return nil, err
+		}
+		location = layout.Location(location)
+	}
+
+	stagedPath := d.stagedPath(location)
+	err = os.MkdirAll(path.Dir(stagedPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	sizeBytes, hash, err := ds_file.PersistFileAtLocation(stagedPath, stored, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = storage.GetDatabase().GetMetadataStore(ctx).InsertWriteBehindEntry(d.DatastoreId, location)
+	if err != nil {
+		_ = os.Remove(stagedPath)
+		return nil, err
+	}
+
+	ctx.Log.Info("Staged object ", location, " to be written to the datastore in the background")
+	go d.writeStaged(location, 0, rcontext.Initial().LogWithFields(logrus.Fields{"datastoreId": d.DatastoreId, "location": location}))
+
+	return &types.ObjectInfo{
+		Location:   location,
+		Sha256Hash: hash,
+		SizeBytes:  sizeBytes,
+	}, nil
+}
+
+// unstage removes the staged copy of an object, returning true if the object was never written to
+// the datastore.
+func (d *DatastoreRef) unstage(location string, ctx rcontext.RequestContext) (bool, error) {
+	if config.Get().WriteBehind.StagingPath == "" {
+		return false, nil
+	}
+
+	err := os.Remove(d.stagedPath(location))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// If the object is being written right now we can't be sure it didn't make it to the datastore
+	writesInFlightLock.Lock()
+	inFlight := writesInFlight[d.DatastoreId+"/"+location]
+	writesInFlightLock.Unlock()
+
+	return !inFlight, storage.GetDatabase().GetMetadataStore(ctx).DeleteWriteBehindEntry(d.DatastoreId, location)
+}
+
+func (d *DatastoreRef) writeStaged(location string, attempts int, ctx rcontext.RequestContext) {
+	key := d.DatastoreId + "/" + location
+	writesInFlightLock.Lock()
+	if writesInFlight[key] {
+		writesInFlightLock.Unlock()
+		return
+	}
+	writesInFlight[key] = true
+	writesInFlightLock.Unlock()
+	defer func() {
+		writesInFlightLock.Lock()
+		delete(writesInFlight, key)
+		writesInFlightLock.Unlock()
+	}()
+
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	f, err := os.Open(d.stagedPath(location))
+	if os.IsNotExist(err) {
+		// Written by another worker or deleted before it could be written
+		err = db.DeleteWriteBehindEntry(d.DatastoreId, location)
+		if err != nil {
+			ctx.Log.Warn("Error removing stale write-behind entry: ", err)
+		}
+		return
+	} else if err != nil {
+		ctx.Log.Error("Error opening staged object: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	err = d.overwriteObject(location, f, ctx)
+	if err != nil {
+		ctx.Log.Warn("Error writing staged object to the datastore: ", err)
+		d.recordFailedWrite(location, attempts, err, ctx)
+		return
+	}
+
+	err = db.DeleteWriteBehindEntry(d.DatastoreId, location)
+	if err != nil {
+		ctx.Log.Error("Error removing write-behind entry: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	err = os.Remove(d.stagedPath(location))
+	if err != nil {
+		ctx.Log.Warn("Error removing staged object: ", err)
+	}
+	ctx.Log.Info("Wrote staged object to the datastore")
+}
+
+func (d *DatastoreRef) recordFailedWrite(location string, attempts int, writeErr error, ctx rcontext.RequestContext) {
+	entry := &types.WriteBehindEntry{
+		DatastoreId: d.DatastoreId,
+		Location:    location,
+		Attempts:    attempts,
+	}
+	entry.Attempts++
+	entry.LastError = writeErr.Error()
+	backoff := time.Duration(config.Get().WriteBehind.RetryIntervalSeconds) * time.Second
+	for i := 1; i < entry.Attempts && backoff < maxWriteBehindBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWriteBehindBackoff {
+		backoff = maxWriteBehindBackoff
+	}
+	entry.NextAttemptTs = util.NowMillis() + backoff.Milliseconds()
+
+	err := storage.GetDatabase().GetMetadataStore(ctx).UpdateWriteBehindAttempt(entry)
+	if err != nil {
+		ctx.Log.Error("Error recording failed write: ", err)
+		sentry.CaptureException(err)
+	}
+	if entry.Attempts%10 == 0 {
+		sentry.CaptureException(fmt.Errorf("staged object %s has failed to write %d times: %s", location, entry.Attempts, entry.LastError))
+	}
+}
+
+// ProcessWriteBehindQueue writes staged objects which are due to their datastores, including any
+// which were staged before a restart.
+func ProcessWriteBehindQueue(ctx rcontext.RequestContext) {
+	entries, err := storage.GetDatabase().GetMetadataStore(ctx).GetDueWriteBehindEntries(util.NowMillis(), writeBehindBatchSize)
+	if err != nil {
+		ctx.Log.Error("Error getting write-behind queue: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, entry := range entries {
+		ref, err := LocateDatastore(ctx, entry.DatastoreId)
+		if err != nil {
+			ctx.Log.Error("Error locating datastore for staged object: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		ref.writeStaged(entry.Location, entry.Attempts, ctx.LogWithFields(logrus.Fields{
+			"datastoreId": entry.DatastoreId,
+			"location":    entry.Location,
+			"attempts":    entry.Attempts,
+		}))
+	}
+}
@@ -116,6 +116,11 @@ func OpenDatabase(connectionString string, maxConns int, maxIdleConns int) error
 	return nil
 }
 
+// Ping checks that the database can still be reached.
+func (d *Database) Ping(ctx rcontext.RequestContext) error {
+	return d.db.PingContext(ctx)
+}
+
 func (d *Database) GetMediaStore(ctx rcontext.RequestContext) *stores.MediaStore {
 	return d.repos.mediaStore.Create(ctx)
 }
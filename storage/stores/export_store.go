@@ -7,22 +7,24 @@ import (
 	"github.com/turt2live/matrix-media-repo/types"
 )
 
-const insertExportMetadata = "INSERT INTO exports (export_id, entity) VALUES ($1, $2);"
+const insertExportMetadata = "INSERT INTO exports (export_id, entity, expires_ts) VALUES ($1, $2, $3);"
 const insertExportPart = "INSERT INTO export_parts (export_id, index, size_bytes, file_name, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6);"
-const selectExportMetadata = "SELECT export_id, entity FROM exports WHERE export_id = $1;"
+const selectExportMetadata = "SELECT export_id, entity, expires_ts FROM exports WHERE export_id = $1;"
+const selectExpiredExportIds = "SELECT export_id FROM exports WHERE expires_ts > 0 AND expires_ts <= $1;"
 const selectExportParts = "SELECT export_id, index, size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1;"
 const selectExportPart = "SELECT export_id, index, size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1 AND index = $2;"
 const deleteExportParts = "DELETE FROM export_parts WHERE export_id = $1;"
 const deleteExport = "DELETE FROM exports WHERE export_id = $1;"
 
 type exportStoreStatements struct {
-	insertExportMetadata *sql.Stmt
-	insertExportPart     *sql.Stmt
-	selectExportMetadata *sql.Stmt
-	selectExportParts    *sql.Stmt
-	selectExportPart     *sql.Stmt
-	deleteExportParts    *sql.Stmt
-	deleteExport         *sql.Stmt
+	insertExportMetadata   *sql.Stmt
+	insertExportPart       *sql.Stmt
+	selectExportMetadata   *sql.Stmt
+	selectExpiredExportIds *sql.Stmt
+	selectExportParts      *sql.Stmt
+	selectExportPart       *sql.Stmt
+	deleteExportParts      *sql.Stmt
+	deleteExport           *sql.Stmt
 }
 
 type ExportStoreFactory struct {
@@ -51,6 +53,9 @@ func InitExportStore(sqlDb *sql.DB) (*ExportStoreFactory, error) {
 	if store.stmts.selectExportMetadata, err = store.sqlDb.Prepare(selectExportMetadata); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectExpiredExportIds, err = store.sqlDb.Prepare(selectExpiredExportIds); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectExportParts, err = store.sqlDb.Prepare(selectExportParts); err != nil {
 		return nil, err
 	}
@@ -75,8 +80,8 @@ func (f *ExportStoreFactory) Create(ctx rcontext.RequestContext) *ExportStore {
 	}
 }
 
-func (s *ExportStore) InsertExport(exportId string, entity string) error {
-	_, err := s.statements.insertExportMetadata.ExecContext(s.ctx, exportId, entity)
+func (s *ExportStore) InsertExport(exportId string, entity string, expiresTs int64) error {
+	_, err := s.statements.insertExportMetadata.ExecContext(s.ctx, exportId, entity, expiresTs)
 	return err
 }
 
@@ -90,10 +95,30 @@ func (s *ExportStore) GetExportMetadata(exportId string) (*types.ExportMetadata,
 	err := s.statements.selectExportMetadata.QueryRowContext(s.ctx, exportId).Scan(
 		&m.ExportID,
 		&m.Entity,
+		&m.ExpiresTs,
 	)
 	return m, err
 }
 
+func (s *ExportStore) GetExpiredExportIds(beforeTs int64) ([]string, error) {
+	rows, err := s.statements.selectExpiredExportIds.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []string
+	for rows.Next() {
+		var exportId string
+		err = rows.Scan(&exportId)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, exportId)
+	}
+
+	return results, nil
+}
+
 func (s *ExportStore) GetExportParts(exportId string) ([]*types.ExportPart, error) {
 	rows, err := s.statements.selectExportParts.QueryContext(s.ctx, exportId)
 	if err != nil {
@@ -7,12 +7,23 @@ import (
 	"github.com/turt2live/matrix-media-repo/types"
 )
 
-const selectMediaAttributes = "SELECT origin, media_id, purpose FROM media_attributes WHERE origin = $1 AND media_id = $2;"
+const selectMediaAttributes = "SELECT origin, media_id, purpose, protected, COALESCE(expires_ts, 0), COALESCE(original_size_bytes, 0), COALESCE(restricted_room_id, ''), COALESCE(restricted_event_id, '') FROM media_attributes WHERE origin = $1 AND media_id = $2;"
 const upsertMediaPurpose = "INSERT INTO media_attributes (origin, media_id, purpose) VALUES ($1, $2, $3) ON CONFLICT (origin, media_id) DO UPDATE SET purpose = $3;"
+const upsertMediaProtected = "INSERT INTO media_attributes (origin, media_id, purpose, protected) VALUES ($1, $2, 'none', $3) ON CONFLICT (origin, media_id) DO UPDATE SET protected = $3;"
+const upsertMediaExpiry = "INSERT INTO media_attributes (origin, media_id, purpose, expires_ts) VALUES ($1, $2, 'none', NULLIF($3::BIGINT, 0)) ON CONFLICT (origin, media_id) DO UPDATE SET expires_ts = NULLIF($3::BIGINT, 0);"
+const upsertMediaOriginalSize = "INSERT INTO media_attributes (origin, media_id, purpose, original_size_bytes) VALUES ($1, $2, 'none', $3) ON CONFLICT (origin, media_id) DO UPDATE SET original_size_bytes = $3;"
+const upsertMediaRestriction = "INSERT INTO media_attributes (origin, media_id, purpose, restricted_room_id, restricted_event_id) VALUES ($1, $2, 'none', $3, NULLIF($4::TEXT, '')) ON CONFLICT (origin, media_id) DO UPDATE SET restricted_room_id = $3, restricted_event_id = NULLIF($4::TEXT, '') WHERE media_attributes.restricted_room_id IS NULL;"
+const selectExpiredMediaAttributes = "SELECT origin, media_id, purpose, protected, expires_ts, COALESCE(original_size_bytes, 0), COALESCE(restricted_room_id, ''), COALESCE(restricted_event_id, '') FROM media_attributes WHERE expires_ts <= $1;"
 
 type mediaAttributesStoreStatements struct {
-	selectMediaAttributes *sql.Stmt
-	upsertMediaPurpose    *sql.Stmt
+	selectMediaAttributes   *sql.Stmt
+	upsertMediaPurpose      *sql.Stmt
+	upsertMediaProtected    *sql.Stmt
+	upsertMediaExpiry       *sql.Stmt
+	upsertMediaOriginalSize *sql.Stmt
+	upsertMediaRestriction  *sql.Stmt
+
+	selectExpiredMediaAttributes *sql.Stmt
 }
 
 type MediaAttributesStoreFactory struct {
@@ -38,6 +49,21 @@ func InitMediaAttributesStore(sqlDb *sql.DB) (*MediaAttributesStoreFactory, erro
 	if store.stmts.upsertMediaPurpose, err = store.sqlDb.Prepare(upsertMediaPurpose); err != nil {
 		return nil, err
 	}
+	if store.stmts.upsertMediaProtected, err = store.sqlDb.Prepare(upsertMediaProtected); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertMediaExpiry, err = store.sqlDb.Prepare(upsertMediaExpiry); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertMediaOriginalSize, err = store.sqlDb.Prepare(upsertMediaOriginalSize); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertMediaRestriction, err = store.sqlDb.Prepare(upsertMediaRestriction); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectExpiredMediaAttributes, err = store.sqlDb.Prepare(selectExpiredMediaAttributes); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -57,6 +83,11 @@ func (s *MediaAttributesStore) GetAttributes(origin string, mediaId string) (*ty
 		&obj.Origin,
 		&obj.MediaId,
 		&obj.Purpose,
+		&obj.Protected,
+		&obj.ExpiresTs,
+		&obj.OriginalSizeBytes,
+		&obj.RestrictedRoomId,
+		&obj.RestrictedEventId,
 	)
 	return obj, err
 }
@@ -77,3 +108,72 @@ func (s *MediaAttributesStore) UpsertPurpose(origin string, mediaId string, purp
 	_, err := s.statements.upsertMediaPurpose.ExecContext(s.ctx, origin, mediaId, purpose)
 	return err
 }
+
+func (s *MediaAttributesStore) UpsertProtected(origin string, mediaId string, protected bool) error {
+	_, err := s.statements.upsertMediaProtected.ExecContext(s.ctx, origin, mediaId, protected)
+	return err
+}
+
+// IsProtected returns whether the media is exempt from bulk purges. Media without attributes is not protected.
+func (s *MediaAttributesStore) IsProtected(origin string, mediaId string) (bool, error) {
+	attr, err := s.GetAttributesDefaulted(origin, mediaId)
+	if err != nil {
+		return false, err
+	}
+	return attr.Protected, nil
+}
+
+// UpsertExpiry sets when the media is purged. An expiresTs of zero means the media doesn't expire.
+func (s *MediaAttributesStore) UpsertExpiry(origin string, mediaId string, expiresTs int64) error {
+	_, err := s.statements.upsertMediaExpiry.ExecContext(s.ctx, origin, mediaId, expiresTs)
+	return err
+}
+
+// UpsertOriginalSize records the size of the media's upload before it was recompressed.
+func (s *MediaAttributesStore) UpsertOriginalSize(origin string, mediaId string, sizeBytes int64) error {
+	_, err := s.statements.upsertMediaOriginalSize.ExecContext(s.ctx, origin, mediaId, sizeBytes)
+	return err
+}
+
+// UpsertRestriction limits the media to people who can see the given room, or event in the room if eventId
+// isn't empty. Returns false if the media was already restricted, in which case it is left as it was.
+func (s *MediaAttributesStore) UpsertRestriction(origin string, mediaId string, roomId string, eventId string) (bool, error) {
+	res, err := s.statements.upsertMediaRestriction.ExecContext(s.ctx, origin, mediaId, roomId, eventId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// GetExpired returns the attributes of media which expired at or before the given time.
+func (s *MediaAttributesStore) GetExpired(beforeTs int64) ([]*types.MediaAttributes, error) {
+	rows, err := s.statements.selectExpiredMediaAttributes.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.MediaAttributes, 0)
+	for rows.Next() {
+		obj := &types.MediaAttributes{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.Purpose,
+			&obj.Protected,
+			&obj.ExpiresTs,
+			&obj.OriginalSizeBytes,
+			&obj.RestrictedRoomId,
+			&obj.RestrictedEventId,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
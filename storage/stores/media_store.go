@@ -2,36 +2,50 @@ package stores
 
 import (
 	"database/sql"
+	"strings"
 	"sync"
 
 	"github.com/lib/pq"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
-const selectMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 and media_id = $2;"
-const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE sha256_hash = $1;"
-const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
-const selectOldMedia = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, quarantined FROM media AS m WHERE m.origin <> ANY($1) AND m.creation_ts < $2 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
+const selectMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE origin = $1 and media_id = $2;"
+const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE sha256_hash = $1;"
+const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, stored_size_bytes, detected_content_type, compressed) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12::BIGINT, 0), NULLIF($13, ''), $14);"
+const selectOldMedia = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media AS m WHERE m.origin <> ANY($1) AND m.creation_ts < $2 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
 const selectOrigins = "SELECT DISTINCT origin FROM media;"
 const deleteMedia = "DELETE FROM media WHERE origin = $1 AND media_id = $2;"
-const updateQuarantined = "UPDATE media SET quarantined = $3 WHERE origin = $1 AND media_id = $2;"
+const updateQuarantined = "UPDATE media SET quarantined = $3, quarantined_ts = CASE WHEN $3 THEN COALESCE(quarantined_ts, $4) ELSE NULL END WHERE origin = $1 AND media_id = $2;"
 const selectDatastore = "SELECT datastore_id, ds_type, uri FROM datastores WHERE datastore_id = $1;"
 const selectDatastoreByUri = "SELECT datastore_id, ds_type, uri FROM datastores WHERE uri = $1;"
 const insertDatastore = "INSERT INTO datastores (datastore_id, ds_type, uri) VALUES ($1, $2, $3);"
-const selectMediaWithoutDatastore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE datastore_id IS NULL OR datastore_id = '';"
+const selectMediaWithoutDatastore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE datastore_id IS NULL OR datastore_id = '';"
 const updateMediaDatastoreAndLocation = "UPDATE media SET location = $4, datastore_id = $3 WHERE origin = $1 AND media_id = $2;"
 const selectAllDatastores = "SELECT datastore_id, ds_type, uri FROM datastores;"
-const selectAllMediaForServer = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1"
-const selectAllMediaForServerUsers = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND user_id = ANY($2)"
-const selectAllMediaForServerIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND media_id = ANY($2)"
-const selectQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE quarantined = true;"
-const selectServerQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE quarantined = true AND origin = $1;"
-const selectMediaByUser = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE user_id = $1"
-const selectMediaByUserBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE user_id = $1 AND creation_ts <= $2"
-const selectMediaByDomainBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND creation_ts <= $2"
-const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE datastore_id = $1 AND location = $2"
+const selectAllMediaForServer = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE origin = $1"
+const selectAllMediaForServerUsers = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE origin = $1 AND user_id = ANY($2)"
+const selectAllMediaForServerIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE origin = $1 AND media_id = ANY($2)"
+const selectQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE quarantined = true;"
+const selectQuarantinedMediaPaginated = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed, COALESCE(quarantined_ts, 0) FROM media WHERE quarantined = true AND ($1 = '' OR origin = $1) ORDER BY quarantined_ts DESC NULLS LAST, origin, media_id LIMIT $2 OFFSET $3;"
+const selectQuarantinedMediaCount = "SELECT COUNT(*) FROM media WHERE quarantined = true AND ($1 = '' OR origin = $1);"
+const selectServerQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE quarantined = true AND origin = $1;"
+const selectMediaByUser = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE user_id = $1"
+const selectMediaByUserBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE user_id = $1 AND creation_ts <= $2"
+const selectMediaByUserPaginated = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE user_id = $1 ORDER BY creation_ts DESC, origin, media_id LIMIT $2 OFFSET $3;"
+const selectMediaCountByUser = "SELECT COUNT(*) FROM media WHERE user_id = $1;"
+const selectMediaSearch = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE ($1 = '' OR origin = $1) AND ($2 = '' OR user_id = $2) AND ($3 = '' OR content_type LIKE $3) AND ($4::BIGINT IS NULL OR size_bytes >= $4) AND ($5::BIGINT IS NULL OR size_bytes <= $5) AND ($6::BIGINT IS NULL OR creation_ts >= $6) AND ($7::BIGINT IS NULL OR creation_ts <= $7) AND ($8::BOOLEAN IS NULL OR quarantined = $8) ORDER BY creation_ts DESC, origin, media_id LIMIT $9 OFFSET $10;"
+const selectMediaByDomainBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE origin = $1 AND creation_ts <= $2"
+const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE datastore_id = $1 AND location = $2"
+const selectMediaInDatastore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, COALESCE(stored_size_bytes, size_bytes), COALESCE(detected_content_type, ''), compressed FROM media WHERE datastore_id = $1"
 const selectIfQuarantined = "SELECT 1 FROM media WHERE sha256_hash = $1 AND quarantined = $2 LIMIT 1;"
+const selectReadOnlyDatastoreIds = "SELECT datastore_id FROM datastores WHERE read_only = true;"
+const updateDatastoreReadOnly = "UPDATE datastores SET read_only = $2 WHERE datastore_id = $1;"
+const insertQuarantinedOrigin = "INSERT INTO quarantined_origins (origin, quarantined_by, quarantined_ts) VALUES ($1, $2, $3) ON CONFLICT (origin) DO NOTHING;"
+const deleteQuarantinedOrigin = "DELETE FROM quarantined_origins WHERE origin = $1;"
+const selectQuarantinedOrigin = "SELECT 1 FROM quarantined_origins WHERE origin = $1;"
+const selectQuarantinedOrigins = "SELECT origin, quarantined_by, quarantined_ts FROM quarantined_origins;"
 
 var dsCacheByPath = sync.Map{} // [string] => Datastore
 var dsCacheById = sync.Map{}   // [string] => Datastore
@@ -55,12 +69,24 @@ type mediaStoreStatements struct {
 	selectAllMediaForServerUsers    *sql.Stmt
 	selectAllMediaForServerIds      *sql.Stmt
 	selectQuarantinedMedia          *sql.Stmt
+	selectQuarantinedMediaPaginated *sql.Stmt
+	selectQuarantinedMediaCount     *sql.Stmt
 	selectServerQuarantinedMedia    *sql.Stmt
 	selectMediaByUser               *sql.Stmt
 	selectMediaByUserBefore         *sql.Stmt
+	selectMediaByUserPaginated      *sql.Stmt
+	selectMediaCountByUser          *sql.Stmt
+	selectMediaSearch               *sql.Stmt
 	selectMediaByDomainBefore       *sql.Stmt
 	selectMediaByLocation           *sql.Stmt
+	selectMediaInDatastore          *sql.Stmt
 	selectIfQuarantined             *sql.Stmt
+	selectReadOnlyDatastoreIds      *sql.Stmt
+	updateDatastoreReadOnly         *sql.Stmt
+	insertQuarantinedOrigin         *sql.Stmt
+	deleteQuarantinedOrigin         *sql.Stmt
+	selectQuarantinedOrigin         *sql.Stmt
+	selectQuarantinedOrigins        *sql.Stmt
 }
 
 type MediaStoreFactory struct {
@@ -131,6 +157,12 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.selectQuarantinedMedia, err = store.sqlDb.Prepare(selectQuarantinedMedia); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectQuarantinedMediaPaginated, err = store.sqlDb.Prepare(selectQuarantinedMediaPaginated); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectQuarantinedMediaCount, err = store.sqlDb.Prepare(selectQuarantinedMediaCount); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectServerQuarantinedMedia, err = store.sqlDb.Prepare(selectServerQuarantinedMedia); err != nil {
 		return nil, err
 	}
@@ -140,15 +172,45 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.selectMediaByUserBefore, err = store.sqlDb.Prepare(selectMediaByUserBefore); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectMediaByUserPaginated, err = store.sqlDb.Prepare(selectMediaByUserPaginated); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaCountByUser, err = store.sqlDb.Prepare(selectMediaCountByUser); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaSearch, err = store.sqlDb.Prepare(selectMediaSearch); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectMediaByDomainBefore, err = store.sqlDb.Prepare(selectMediaByDomainBefore); err != nil {
 		return nil, err
 	}
 	if store.stmts.selectMediaByLocation, err = store.sqlDb.Prepare(selectMediaByLocation); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectMediaInDatastore, err = store.sqlDb.Prepare(selectMediaInDatastore); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectIfQuarantined, err = store.sqlDb.Prepare(selectIfQuarantined); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectReadOnlyDatastoreIds, err = store.sqlDb.Prepare(selectReadOnlyDatastoreIds); err != nil {
+		return nil, err
+	}
+	if store.stmts.updateDatastoreReadOnly, err = store.sqlDb.Prepare(updateDatastoreReadOnly); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertQuarantinedOrigin, err = store.sqlDb.Prepare(insertQuarantinedOrigin); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteQuarantinedOrigin, err = store.sqlDb.Prepare(deleteQuarantinedOrigin); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectQuarantinedOrigin, err = store.sqlDb.Prepare(selectQuarantinedOrigin); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectQuarantinedOrigins, err = store.sqlDb.Prepare(selectQuarantinedOrigins); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -161,6 +223,12 @@ func (f *MediaStoreFactory) Create(ctx rcontext.RequestContext) *MediaStore {
 	}
 }
 
+// IsUniqueViolation returns whether the error came from inserting a row which already exists.
+func IsUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code.Name() == "unique_violation"
+}
+
 func (s *MediaStore) Insert(media *types.Media) error {
 	_, err := s.statements.insertMedia.ExecContext(
 		s.ctx,
@@ -175,6 +243,9 @@ func (s *MediaStore) Insert(media *types.Media) error {
 		media.Location,
 		media.CreationTs,
 		media.Quarantined,
+		media.StoredSizeBytes,
+		media.DetectedContentType,
+		media.Compressed,
 	)
 	return err
 }
@@ -200,6 +271,9 @@ func (s *MediaStore) GetByHash(hash string) ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -224,6 +298,9 @@ func (s *MediaStore) Get(origin string, mediaId string) (*types.Media, error) {
 		&m.Location,
 		&m.CreationTs,
 		&m.Quarantined,
+		&m.StoredSizeBytes,
+		&m.DetectedContentType,
+		&m.Compressed,
 	)
 	return m, err
 }
@@ -249,6 +326,9 @@ func (s *MediaStore) GetOldMedia(exceptOrigins []string, beforeTs int64) ([]*typ
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -284,7 +364,7 @@ func (s *MediaStore) Delete(origin string, mediaId string) error {
 }
 
 func (s *MediaStore) SetQuarantined(origin string, mediaId string, isQuarantined bool) error {
-	_, err := s.statements.updateQuarantined.ExecContext(s.ctx, origin, mediaId, isQuarantined)
+	_, err := s.statements.updateQuarantined.ExecContext(s.ctx, origin, mediaId, isQuarantined, util.NowMillis())
 	return err
 }
 
@@ -396,6 +476,9 @@ func (s *MediaStore) GetAllWithoutDatastore() ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -450,6 +533,9 @@ func (s *MediaStore) GetAllMediaForServer(serverName string) ([]*types.Media, er
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -481,6 +567,9 @@ func (s *MediaStore) GetAllMediaForServerUsers(serverName string, userIds []stri
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -512,6 +601,9 @@ func (s *MediaStore) GetAllMediaInIds(serverName string, mediaIds []string) ([]*
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -543,6 +635,47 @@ func (s *MediaStore) GetAllQuarantinedMedia() ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetQuarantinedMediaPaginated returns a page of quarantined media, most recently quarantined first.
+// Media quarantined before the time was recorded comes last, with a QuarantinedTs of zero. An empty
+// origin matches every server.
+func (s *MediaStore) GetQuarantinedMediaPaginated(origin string, limit int64, offset int64) ([]*types.QuarantinedMedia, error) {
+	rows, err := s.statements.selectQuarantinedMediaPaginated.QueryContext(s.ctx, origin, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.QuarantinedMedia
+	for rows.Next() {
+		obj := &types.QuarantinedMedia{Media: &types.Media{}}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
+			&obj.QuarantinedTs,
 		)
 		if err != nil {
 			return nil, err
@@ -553,6 +686,12 @@ func (s *MediaStore) GetAllQuarantinedMedia() ([]*types.Media, error) {
 	return results, nil
 }
 
+func (s *MediaStore) GetQuarantinedMediaCount(origin string) (int64, error) {
+	count := int64(0)
+	err := s.statements.selectQuarantinedMediaCount.QueryRowContext(s.ctx, origin).Scan(&count)
+	return count, err
+}
+
 func (s *MediaStore) GetQuarantinedMediaFor(serverName string) ([]*types.Media, error) {
 	rows, err := s.statements.selectServerQuarantinedMedia.QueryContext(s.ctx, serverName)
 	if err != nil {
@@ -574,6 +713,9 @@ func (s *MediaStore) GetQuarantinedMediaFor(serverName string) ([]*types.Media,
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -605,6 +747,9 @@ func (s *MediaStore) GetMediaByUser(userId string) ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -636,6 +781,44 @@ func (s *MediaStore) GetMediaByUserBefore(userId string, beforeTs int64) ([]*typ
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetMediaByUserPaginated returns a page of the user's media, newest first.
+func (s *MediaStore) GetMediaByUserPaginated(userId string, limit int64, offset int64) ([]*types.Media, error) {
+	rows, err := s.statements.selectMediaByUserPaginated.QueryContext(s.ctx, userId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Media
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -646,6 +829,88 @@ func (s *MediaStore) GetMediaByUserBefore(userId string, beforeTs int64) ([]*typ
 	return results, nil
 }
 
+func (s *MediaStore) GetMediaCountByUser(userId string) (int64, error) {
+	row := s.statements.selectMediaCountByUser.QueryRowContext(s.ctx, userId)
+
+	count := int64(0)
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// SearchMedia returns a page of the media matching every filter which is set, newest first.
+func (s *MediaStore) SearchMedia(filter *types.MediaSearchFilter, limit int64, offset int64) ([]*types.Media, error) {
+	contentType := ""
+	if filter.ContentType != "" {
+		// The content type may end with a * to match a prefix, like image/*
+		escaper := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+		contentType = escaper.Replace(filter.ContentType)
+		if strings.HasSuffix(contentType, "*") {
+			contentType = contentType[:len(contentType)-1] + "%"
+		}
+	}
+
+	rows, err := s.statements.selectMediaSearch.QueryContext(s.ctx,
+		filter.Origin,
+		filter.UserId,
+		contentType,
+		nullableInt64(filter.MinSizeBytes),
+		nullableInt64(filter.MaxSizeBytes),
+		nullableInt64(filter.AfterTs),
+		nullableInt64(filter.BeforeTs),
+		nullableBool(filter.Quarantined),
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Media
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func nullableInt64(v *int64) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *v, Valid: true}
+}
+
+func nullableBool(v *bool) sql.NullBool {
+	if v == nil {
+		return sql.NullBool{}
+	}
+	return sql.NullBool{Bool: *v, Valid: true}
+}
+
 func (s *MediaStore) GetMediaByDomainBefore(serverName string, beforeTs int64) ([]*types.Media, error) {
 	rows, err := s.statements.selectMediaByDomainBefore.QueryContext(s.ctx, serverName, beforeTs)
 	if err != nil {
@@ -667,6 +932,9 @@ func (s *MediaStore) GetMediaByDomainBefore(serverName string, beforeTs int64) (
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -698,6 +966,43 @@ func (s *MediaStore) GetMediaByLocation(datastoreId string, location string) ([]
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MediaStore) GetAllMediaInDatastore(datastoreId string) ([]*types.Media, error) {
+	rows, err := s.statements.selectMediaInDatastore.QueryContext(s.ctx, datastoreId)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Media
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.StoredSizeBytes,
+			&obj.DetectedContentType,
+			&obj.Compressed,
 		)
 		if err != nil {
 			return nil, err
@@ -719,3 +1024,76 @@ func (s *MediaStore) IsQuarantined(sha256hash string) (bool, error) {
 	}
 	return true, nil
 }
+
+func (s *MediaStore) GetReadOnlyDatastoreIds() ([]string, error) {
+	rows, err := s.statements.selectReadOnlyDatastoreIds.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]string, 0)
+	for rows.Next() {
+		var datastoreId string
+		err = rows.Scan(&datastoreId)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, datastoreId)
+	}
+
+	return results, nil
+}
+
+func (s *MediaStore) SetDatastoreReadOnly(datastoreId string, readOnly bool) error {
+	_, err := s.statements.updateDatastoreReadOnly.ExecContext(s.ctx, datastoreId, readOnly)
+	return err
+}
+
+func (s *MediaStore) InsertQuarantinedOrigin(origin string, quarantinedBy string, quarantinedTs int64) error {
+	_, err := s.statements.insertQuarantinedOrigin.ExecContext(s.ctx, origin, quarantinedBy, quarantinedTs)
+	return err
+}
+
+func (s *MediaStore) DeleteQuarantinedOrigin(origin string) (bool, error) {
+	res, err := s.statements.deleteQuarantinedOrigin.ExecContext(s.ctx, origin)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *MediaStore) IsOriginQuarantined(origin string) (bool, error) {
+	r := s.statements.selectQuarantinedOrigin.QueryRowContext(s.ctx, origin)
+	var i int
+	err := r.Scan(&i)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MediaStore) GetQuarantinedOrigins() ([]*types.QuarantinedOrigin, error) {
+	rows, err := s.statements.selectQuarantinedOrigins.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.QuarantinedOrigin, 0)
+	for rows.Next() {
+		obj := &types.QuarantinedOrigin{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.QuarantinedBy,
+			&obj.QuarantinedTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
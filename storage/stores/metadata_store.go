@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 
+	"github.com/lib/pq"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
@@ -15,29 +16,111 @@ type folderSize struct {
 
 const selectSizeOfDatastore = "SELECT COALESCE(SUM(size_bytes), 0) + COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE datastore_id = $1), 0) AS size_total FROM media WHERE datastore_id = $1;"
 const upsertLastAccessed = "INSERT INTO last_access (sha256_hash, last_access_ts) VALUES ($1, $2) ON CONFLICT (sha256_hash) DO UPDATE SET last_access_ts = $2"
-const selectMediaLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2"
-const selectThumbnailsLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM thumbnails AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2"
-const changeDatastoreOfMediaHash = "UPDATE media SET datastore_id = $1, location = $2 WHERE sha256_hash = $3"
+const selectMediaLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2 AND ($3 = '' OR m.origin = $3) AND ($4 = '' OR m.user_id = $4)"
+const selectThumbnailsLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM thumbnails AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2 AND ($3 = '' OR m.origin = $3) AND ($4 = '' OR EXISTS (SELECT 1 FROM media AS o WHERE o.origin = m.origin AND o.media_id = m.media_id AND o.user_id = $4))"
+const selectReferencesToObject = "SELECT (SELECT COUNT(*) FROM media WHERE datastore_id = $1 AND location = $2) + (SELECT COUNT(*) FROM thumbnails WHERE datastore_id = $1 AND location = $2) + (SELECT COUNT(*) FROM export_parts WHERE datastore_id = $1 AND location = $2) + (SELECT COUNT(*) FROM datastore_replicas WHERE replica_datastore_id = $1 AND replica_location = $2) + (SELECT COUNT(*) FROM direct_uploads WHERE datastore_id = $1 AND location = $2) + (SELECT COUNT(*) FROM resumable_upload_chunks WHERE datastore_id = $1 AND location = $2) AS refs"
+const selectObjectReferencesInDatastore = "SELECT 'media', origin || '/' || media_id, location FROM media WHERE datastore_id = $1 UNION ALL SELECT 'thumbnail', origin || '/' || media_id || '?width=' || width || '&height=' || height || '&method=' || method || '&animated=' || animated, location FROM thumbnails WHERE datastore_id = $1 UNION ALL SELECT 'export', export_id || '/' || index, location FROM export_parts WHERE datastore_id = $1 UNION ALL SELECT 'replica', datastore_id || '/' || location, replica_location FROM datastore_replicas WHERE replica_datastore_id = $1 UNION ALL SELECT 'direct_upload', upload_id, location FROM direct_uploads WHERE datastore_id = $1 UNION ALL SELECT 'resumable_upload', upload_id || '/' || offset_bytes, location FROM resumable_upload_chunks WHERE datastore_id = $1"
+const changeDatastoreOfMediaHash = "UPDATE media SET datastore_id = $1, location = $2, stored_size_bytes = NULLIF($4::BIGINT, 0), compressed = $5 WHERE sha256_hash = $3"
 const changeDatastoreOfThumbnailHash = "UPDATE thumbnails SET datastore_id = $1, location = $2 WHERE sha256_hash = $3"
 const selectUploadCountsForServer = "SELECT COALESCE((SELECT COUNT(origin) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT COUNT(origin) FROM thumbnails WHERE origin = $1), 0) AS thumbnails"
 const selectUploadSizesForServer = "SELECT COALESCE((SELECT SUM(size_bytes) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE origin = $1), 0) AS thumbnails"
 const selectUsersForServer = "SELECT DISTINCT user_id FROM media WHERE origin = $1 AND user_id IS NOT NULL AND LENGTH(user_id) > 0"
 const insertNewBackgroundTask = "INSERT INTO background_tasks (task, params, start_ts) VALUES ($1, $2, $3) RETURNING id;"
-const selectBackgroundTask = "SELECT id, task, params, start_ts, end_ts FROM background_tasks WHERE id = $1"
+const selectBackgroundTask = "SELECT id, task, params, start_ts, end_ts, progress, cancelled FROM background_tasks WHERE id = $1"
 const updateBackgroundTask = "UPDATE background_tasks SET end_ts = $2 WHERE id = $1"
-const selectAllBackgroundTasks = "SELECT id, task, params, start_ts, end_ts FROM background_tasks"
+const updateBackgroundTaskProgress = "UPDATE background_tasks SET progress = $2 WHERE id = $1"
+const selectAllBackgroundTasks = "SELECT id, task, params, start_ts, end_ts, progress, cancelled FROM background_tasks"
+const updateBackgroundTaskCancelled = "UPDATE background_tasks SET cancelled = true WHERE id = $1 AND end_ts IS NULL"
+const selectBackgroundTaskCancelled = "SELECT cancelled FROM background_tasks WHERE id = $1"
 const insertReservation = "INSERT INTO reserved_media (origin, media_id, reason) VALUES ($1, $2, $3);"
 const selectReservation = "SELECT origin, media_id, reason FROM reserved_media WHERE origin = $1 AND media_id = $2;"
 const selectMediaLastAccessed = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1;"
 const insertBlurhash = "INSERT INTO blurhashes (sha256_hash, blurhash) VALUES ($1, $2);"
 const selectBlurhash = "SELECT blurhash FROM blurhashes WHERE sha256_hash = $1;"
+const selectMediaForIntegrityCheck = "SELECT r.sha256_hash, r.size_bytes, r.datastore_id, r.location, r.creation_ts, COALESCE(r.last_check_ts, 0) FROM (SELECT DISTINCT ON (m.sha256_hash) m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, c.last_check_ts FROM media AS m LEFT JOIN integrity_checks AS c ON c.sha256_hash = m.sha256_hash WHERE m.quarantined = false ORDER BY m.sha256_hash) AS r ORDER BY r.last_check_ts ASC NULLS FIRST LIMIT $1"
+const upsertIntegrityCheck = "INSERT INTO integrity_checks (sha256_hash, last_check_ts, corrupted) VALUES ($1, $2, $3) ON CONFLICT (sha256_hash) DO UPDATE SET last_check_ts = $2, corrupted = $3"
+const insertObjectReplica = "INSERT INTO datastore_replicas (datastore_id, location, replica_datastore_id, replica_location) VALUES ($1, $2, $3, $4) ON CONFLICT (datastore_id, location, replica_datastore_id) DO UPDATE SET replica_location = $4"
+const selectObjectReplicas = "SELECT datastore_id, location, replica_datastore_id, replica_location FROM datastore_replicas WHERE datastore_id = $1 AND location = $2"
+const deleteObjectReplicas = "DELETE FROM datastore_replicas WHERE datastore_id = $1 AND location = $2"
+const insertWriteBehindEntry = "INSERT INTO write_behind_queue (datastore_id, location, attempts, next_attempt_ts, last_error, creation_ts) VALUES ($1, $2, 0, $3, '', $3)"
+const selectDueWriteBehindEntries = "SELECT datastore_id, location, attempts, next_attempt_ts, last_error, creation_ts FROM write_behind_queue WHERE next_attempt_ts <= $1 ORDER BY next_attempt_ts ASC LIMIT $2"
+const updateWriteBehindAttempt = "UPDATE write_behind_queue SET attempts = $3, next_attempt_ts = $4, last_error = $5 WHERE datastore_id = $1 AND location = $2"
+const deleteWriteBehindEntry = "DELETE FROM write_behind_queue WHERE datastore_id = $1 AND location = $2"
+const changeLocationOfMediaObject = "UPDATE media SET location = $3 WHERE datastore_id = $1 AND location = $2"
+const changeLocationOfThumbnailObject = "UPDATE thumbnails SET location = $3 WHERE datastore_id = $1 AND location = $2"
+const changeLocationOfExportObject = "UPDATE export_parts SET location = $3 WHERE datastore_id = $1 AND location = $2"
+const changeLocationOfReplicatedObject = "UPDATE datastore_replicas SET location = $3 WHERE datastore_id = $1 AND location = $2"
+const changeLocationOfReplicaObject = "UPDATE datastore_replicas SET replica_location = $3 WHERE replica_datastore_id = $1 AND replica_location = $2"
+const changeLocationOfDirectUploadObject = "UPDATE direct_uploads SET location = $3 WHERE datastore_id = $1 AND location = $2"
+const changeLocationOfResumableUploadChunkObject = "UPDATE resumable_upload_chunks SET location = $3 WHERE datastore_id = $1 AND location = $2"
+const selectDatastoreUsage = "SELECT COUNT(*), COALESCE(SUM(o.size_bytes), 0), COUNT(*) FILTER (WHERE o.creation_ts >= $2), COALESCE(SUM(o.size_bytes) FILTER (WHERE o.creation_ts >= $2), 0), COUNT(*) FILTER (WHERE o.creation_ts >= $3), COALESCE(SUM(o.size_bytes) FILTER (WHERE o.creation_ts >= $3), 0) FROM (SELECT location, MAX(COALESCE(stored_size_bytes, size_bytes)) AS size_bytes, MIN(creation_ts) AS creation_ts FROM media WHERE datastore_id = $1 GROUP BY location UNION ALL SELECT location, MAX(size_bytes), MIN(creation_ts) FROM thumbnails WHERE datastore_id = $1 GROUP BY location UNION ALL SELECT location, MAX(size_bytes), 0 FROM export_parts WHERE datastore_id = $1 GROUP BY location UNION ALL SELECT r.replica_location, COALESCE(MAX(c.size_bytes), 0), COALESCE(MIN(c.creation_ts), 0) FROM datastore_replicas AS r LEFT JOIN (SELECT datastore_id, location, COALESCE(stored_size_bytes, size_bytes) AS size_bytes, creation_ts FROM media UNION ALL SELECT datastore_id, location, size_bytes, creation_ts FROM thumbnails) AS c ON c.datastore_id = r.datastore_id AND c.location = r.location WHERE r.replica_datastore_id = $1 GROUP BY r.replica_location) AS o"
+const insertDirectUpload = "INSERT INTO direct_uploads (upload_id, origin, user_id, datastore_id, location, content_type, upload_name, expires_ts, size_bytes) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+const selectDirectUpload = "SELECT upload_id, origin, user_id, datastore_id, location, content_type, upload_name, expires_ts, size_bytes FROM direct_uploads WHERE upload_id = $1"
+const selectExpiredDirectUploads = "SELECT upload_id, origin, user_id, datastore_id, location, content_type, upload_name, expires_ts, size_bytes FROM direct_uploads WHERE expires_ts < $1"
+const deleteDirectUpload = "DELETE FROM direct_uploads WHERE upload_id = $1"
+const insertPendingUpload = "INSERT INTO pending_uploads (origin, media_id, user_id, creation_ts, expires_ts) VALUES ($1, $2, $3, $4, $5)"
+const selectPendingUpload = "SELECT origin, media_id, user_id, creation_ts, expires_ts FROM pending_uploads WHERE origin = $1 AND media_id = $2"
+const deletePendingUpload = "DELETE FROM pending_uploads WHERE origin = $1 AND media_id = $2"
+const deleteExpiredPendingUploads = "DELETE FROM pending_uploads WHERE expires_ts < $1"
+const claimPendingUpload = "UPDATE pending_uploads SET uploading_ts = $3 WHERE origin = $1 AND media_id = $2 AND (uploading_ts IS NULL OR uploading_ts < $4)"
+const releasePendingUpload = "UPDATE pending_uploads SET uploading_ts = NULL WHERE origin = $1 AND media_id = $2"
+const countPendingUploadsForUser = "SELECT COUNT(*) FROM pending_uploads WHERE user_id = $1 AND expires_ts >= $2"
+const insertResumableUpload = "INSERT INTO resumable_uploads (upload_id, origin, media_id, user_id, datastore_id, content_type, upload_name, size_bytes, offset_bytes, expires_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+const selectResumableUpload = "SELECT upload_id, origin, media_id, user_id, datastore_id, content_type, upload_name, size_bytes, offset_bytes, expires_ts FROM resumable_uploads WHERE upload_id = $1"
+const selectExpiredResumableUploads = "SELECT upload_id, origin, media_id, user_id, datastore_id, content_type, upload_name, size_bytes, offset_bytes, expires_ts FROM resumable_uploads WHERE expires_ts < $1"
+const updateResumableUploadOffset = "UPDATE resumable_uploads SET offset_bytes = $3, expires_ts = $4 WHERE upload_id = $1 AND offset_bytes = $2"
+const deleteResumableUpload = "DELETE FROM resumable_uploads WHERE upload_id = $1"
+const claimResumableUpload = "UPDATE resumable_uploads SET finishing_ts = $2 WHERE upload_id = $1 AND (finishing_ts IS NULL OR finishing_ts < $3)"
+const releaseResumableUpload = "UPDATE resumable_uploads SET finishing_ts = NULL WHERE upload_id = $1"
+const insertResumableUploadChunk = "INSERT INTO resumable_upload_chunks (upload_id, offset_bytes, size_bytes, datastore_id, location) VALUES ($1, $2, $3, $4, $5)"
+const selectResumableUploadChunks = "SELECT upload_id, offset_bytes, size_bytes, datastore_id, location FROM resumable_upload_chunks WHERE upload_id = $1 ORDER BY offset_bytes"
+const deleteResumableUploadChunks = "DELETE FROM resumable_upload_chunks WHERE upload_id = $1"
+const insertUploadAttribution = "INSERT INTO media_upload_attribution (origin, media_id, ip_address, user_agent, token_hash, recorded_ts) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (origin, media_id) DO NOTHING"
+const selectUploadAttribution = "SELECT origin, media_id, ip_address, user_agent, token_hash, recorded_ts FROM media_upload_attribution WHERE origin = $1 AND media_id = $2"
+const deleteUploadAttributionBefore = "DELETE FROM media_upload_attribution WHERE recorded_ts < $1"
+const insertStagedUpload = "INSERT INTO media_upload_staging (datastore_id, location, origin, media_id, creation_ts) VALUES ($1, $2, $3, $4, $5)"
+const selectStagedUploadsBefore = "SELECT datastore_id, location, origin, media_id, creation_ts FROM media_upload_staging WHERE creation_ts < $1"
+const deleteStagedUpload = "DELETE FROM media_upload_staging WHERE datastore_id = $1 AND location = $2"
+const selectOriginUsage = "SELECT m.origin, COUNT(*) AS media, COALESCE(SUM(m.size_bytes), 0) AS bytes, COALESCE(MAX(a.last_access_ts), 0) AS last_access_ts FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE m.origin <> ALL($1) GROUP BY m.origin ORDER BY CASE $2 WHEN 'media' THEN COUNT(*) WHEN 'last_access' THEN COALESCE(MAX(a.last_access_ts), 0) ELSE COALESCE(SUM(m.size_bytes), 0) END DESC, m.origin LIMIT $3"
+const selectUserStorageUsage = "SELECT user_id, COALESCE(SUM(size_bytes), 0) AS bytes, COUNT(*) AS media, MAX(creation_ts) AS last_upload_ts FROM media WHERE origin = $1 AND user_id IS NOT NULL AND LENGTH(user_id) > 0 GROUP BY user_id ORDER BY CASE $2 WHEN 'media' THEN COUNT(*) WHEN 'last_upload' THEN MAX(creation_ts) ELSE COALESCE(SUM(size_bytes), 0) END DESC, user_id LIMIT $3"
 const selectUserStats = "SELECT user_id, uploaded_bytes FROM user_stats WHERE user_id = $1;"
+const selectUserQuota = "SELECT user_id, max_bytes, max_files, updated_ts FROM user_quotas WHERE user_id = $1;"
+const upsertUserQuota = "INSERT INTO user_quotas (user_id, max_bytes, max_files, updated_ts) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO UPDATE SET max_bytes = $2, max_files = $3, updated_ts = $4;"
+const deleteUserQuota = "DELETE FROM user_quotas WHERE user_id = $1;"
+const selectUserRateLimits = "SELECT user_id, action, requests_per_second, burst, updated_ts FROM user_rate_limits WHERE user_id = $1;"
+const upsertUserRateLimit = "INSERT INTO user_rate_limits (user_id, action, requests_per_second, burst, updated_ts) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id, action) DO UPDATE SET requests_per_second = $3, burst = $4, updated_ts = $5;"
+const deleteUserRateLimit = "DELETE FROM user_rate_limits WHERE user_id = $1 AND ($2 = '' OR action = $2);"
+const insertAdminToken = "INSERT INTO admin_tokens (name, token_hash, scopes, created_by, created_ts) VALUES ($1, $2, $3, $4, $5) RETURNING id;"
+const selectAdminTokens = "SELECT id, name, token_hash, scopes, created_by, created_ts FROM admin_tokens ORDER BY id;"
+const selectAdminTokenByHash = "SELECT id, name, token_hash, scopes, created_by, created_ts FROM admin_tokens WHERE token_hash = $1;"
+const deleteAdminToken = "DELETE FROM admin_tokens WHERE id = $1 RETURNING token_hash;"
+const insertUploadBan = "INSERT INTO upload_bans (pattern, banned_by, banned_ts) VALUES ($1, $2, $3) ON CONFLICT (pattern) DO NOTHING;"
+const deleteUploadBan = "DELETE FROM upload_bans WHERE pattern = $1;"
+const selectUploadBans = "SELECT pattern, banned_by, banned_ts FROM upload_bans;"
+const upsertBlockedHash = "INSERT INTO blocked_hashes (hash_type, hash, action, reason, added_by, added_ts) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (hash_type, hash) DO UPDATE SET action = $3, reason = $4, added_by = $5, added_ts = $6;"
+const deleteBlockedHash = "DELETE FROM blocked_hashes WHERE hash_type = $1 AND hash = $2;"
+const selectBlockedHash = "SELECT hash_type, hash, action, reason, added_by, added_ts FROM blocked_hashes WHERE hash_type = $1 AND hash = $2;"
+const selectBlockedHashesOfType = "SELECT hash_type, hash, action, reason, added_by, added_ts FROM blocked_hashes WHERE hash_type = $1;"
+const selectBlockedHashes = "SELECT hash_type, hash, action, reason, added_by, added_ts FROM blocked_hashes ORDER BY added_ts;"
+const insertAuditLogEntry = "INSERT INTO admin_audit_log (ts, user_id, host, action, params, affected_mxcs) VALUES ($1, $2, $3, $4, $5, $6);"
+const insertPurgeSchedule = "INSERT INTO purge_schedules (kind, target, include_local, older_than_days, time_of_day, interval_days, created_by, created_ts, next_run_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;"
+const selectPurgeSchedules = "SELECT id, kind, target, include_local, older_than_days, time_of_day, interval_days, created_by, created_ts, next_run_ts FROM purge_schedules ORDER BY id;"
+const selectPurgeSchedule = "SELECT id, kind, target, include_local, older_than_days, time_of_day, interval_days, created_by, created_ts, next_run_ts FROM purge_schedules WHERE id = $1;"
+const selectDuePurgeSchedules = "SELECT id, kind, target, include_local, older_than_days, time_of_day, interval_days, created_by, created_ts, next_run_ts FROM purge_schedules WHERE next_run_ts <= $1;"
+const updatePurgeScheduleNextRun = "UPDATE purge_schedules SET next_run_ts = $3 WHERE id = $1 AND next_run_ts = $2;"
+const deletePurgeSchedule = "DELETE FROM purge_schedules WHERE id = $1;"
+const deletePurgeScheduleRuns = "DELETE FROM purge_schedule_runs WHERE schedule_id = $1;"
+const insertPurgeScheduleRun = "INSERT INTO purge_schedule_runs (schedule_id, start_ts, end_ts, purged, bytes_reclaimed, error) VALUES ($1, $2, $3, $4, $5, $6);"
+const selectPurgeScheduleRuns = "SELECT id, schedule_id, start_ts, end_ts, purged, bytes_reclaimed, error FROM purge_schedule_runs WHERE schedule_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3;"
+const selectAuditLog = "SELECT id, ts, user_id, host, action, params, affected_mxcs FROM admin_audit_log WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR action = $2) AND ($3 = '' OR $3 = ANY(affected_mxcs)) AND id < $4 ORDER BY id DESC LIMIT $5;"
 
 type metadataStoreStatements struct {
 	upsertLastAccessed                            *sql.Stmt
 	selectSizeOfDatastore                         *sql.Stmt
 	selectMediaLastAccessedBeforeInDatastore      *sql.Stmt
 	selectThumbnailsLastAccessedBeforeInDatastore *sql.Stmt
+	selectReferencesToObject                      *sql.Stmt
+	selectObjectReferencesInDatastore             *sql.Stmt
 	changeDatastoreOfMediaHash                    *sql.Stmt
 	changeDatastoreOfThumbnailHash                *sql.Stmt
 	selectUploadCountsForServer                   *sql.Stmt
@@ -46,13 +129,91 @@ type metadataStoreStatements struct {
 	insertNewBackgroundTask                       *sql.Stmt
 	selectBackgroundTask                          *sql.Stmt
 	updateBackgroundTask                          *sql.Stmt
+	updateBackgroundTaskProgress                  *sql.Stmt
 	selectAllBackgroundTasks                      *sql.Stmt
+	updateBackgroundTaskCancelled                 *sql.Stmt
+	selectBackgroundTaskCancelled                 *sql.Stmt
 	insertReservation                             *sql.Stmt
 	selectReservation                             *sql.Stmt
 	selectMediaLastAccessed                       *sql.Stmt
 	insertBlurhash                                *sql.Stmt
 	selectBlurhash                                *sql.Stmt
 	selectUserStats                               *sql.Stmt
+	selectUserQuota                               *sql.Stmt
+	upsertUserQuota                               *sql.Stmt
+	deleteUserQuota                               *sql.Stmt
+	selectUserRateLimits                          *sql.Stmt
+	upsertUserRateLimit                           *sql.Stmt
+	deleteUserRateLimit                           *sql.Stmt
+	insertAdminToken                              *sql.Stmt
+	selectAdminTokens                             *sql.Stmt
+	selectAdminTokenByHash                        *sql.Stmt
+	deleteAdminToken                              *sql.Stmt
+	insertUploadBan                               *sql.Stmt
+	deleteUploadBan                               *sql.Stmt
+	selectUploadBans                              *sql.Stmt
+	upsertBlockedHash                             *sql.Stmt
+	deleteBlockedHash                             *sql.Stmt
+	selectBlockedHash                             *sql.Stmt
+	selectBlockedHashesOfType                     *sql.Stmt
+	selectBlockedHashes                           *sql.Stmt
+	insertAuditLogEntry                           *sql.Stmt
+	selectAuditLog                                *sql.Stmt
+	insertPurgeSchedule                           *sql.Stmt
+	selectPurgeSchedules                          *sql.Stmt
+	selectPurgeSchedule                           *sql.Stmt
+	selectDuePurgeSchedules                       *sql.Stmt
+	updatePurgeScheduleNextRun                    *sql.Stmt
+	deletePurgeSchedule                           *sql.Stmt
+	deletePurgeScheduleRuns                       *sql.Stmt
+	insertPurgeScheduleRun                        *sql.Stmt
+	selectPurgeScheduleRuns                       *sql.Stmt
+	selectMediaForIntegrityCheck                  *sql.Stmt
+	upsertIntegrityCheck                          *sql.Stmt
+	insertObjectReplica                           *sql.Stmt
+	selectObjectReplicas                          *sql.Stmt
+	deleteObjectReplicas                          *sql.Stmt
+	insertWriteBehindEntry                        *sql.Stmt
+	selectDueWriteBehindEntries                   *sql.Stmt
+	updateWriteBehindAttempt                      *sql.Stmt
+	deleteWriteBehindEntry                        *sql.Stmt
+	changeLocationOfMediaObject                   *sql.Stmt
+	changeLocationOfThumbnailObject               *sql.Stmt
+	changeLocationOfExportObject                  *sql.Stmt
+	changeLocationOfReplicatedObject              *sql.Stmt
+	changeLocationOfReplicaObject                 *sql.Stmt
+	changeLocationOfDirectUploadObject            *sql.Stmt
+	changeLocationOfResumableUploadChunkObject    *sql.Stmt
+	selectDatastoreUsage                          *sql.Stmt
+	insertDirectUpload                            *sql.Stmt
+	selectDirectUpload                            *sql.Stmt
+	selectExpiredDirectUploads                    *sql.Stmt
+	deleteDirectUpload                            *sql.Stmt
+	insertPendingUpload                           *sql.Stmt
+	selectPendingUpload                           *sql.Stmt
+	deletePendingUpload                           *sql.Stmt
+	deleteExpiredPendingUploads                   *sql.Stmt
+	claimPendingUpload                            *sql.Stmt
+	releasePendingUpload                          *sql.Stmt
+	countPendingUploadsForUser                    *sql.Stmt
+	insertResumableUpload                         *sql.Stmt
+	selectResumableUpload                         *sql.Stmt
+	selectExpiredResumableUploads                 *sql.Stmt
+	updateResumableUploadOffset                   *sql.Stmt
+	deleteResumableUpload                         *sql.Stmt
+	claimResumableUpload                          *sql.Stmt
+	releaseResumableUpload                        *sql.Stmt
+	insertResumableUploadChunk                    *sql.Stmt
+	selectResumableUploadChunks                   *sql.Stmt
+	deleteResumableUploadChunks                   *sql.Stmt
+	selectUserStorageUsage                        *sql.Stmt
+	selectOriginUsage                             *sql.Stmt
+	insertUploadAttribution                       *sql.Stmt
+	selectUploadAttribution                       *sql.Stmt
+	deleteUploadAttributionBefore                 *sql.Stmt
+	insertStagedUpload                            *sql.Stmt
+	selectStagedUploadsBefore                     *sql.Stmt
+	deleteStagedUpload                            *sql.Stmt
 }
 
 type MetadataStoreFactory struct {
@@ -84,6 +245,12 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectThumbnailsLastAccessedBeforeInDatastore, err = store.sqlDb.Prepare(selectThumbnailsLastAccessedBeforeInDatastore); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectReferencesToObject, err = store.sqlDb.Prepare(selectReferencesToObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectObjectReferencesInDatastore, err = store.sqlDb.Prepare(selectObjectReferencesInDatastore); err != nil {
+		return nil, err
+	}
 	if store.stmts.changeDatastoreOfMediaHash, err = store.sqlDb.Prepare(changeDatastoreOfMediaHash); err != nil {
 		return nil, err
 	}
@@ -108,9 +275,18 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.updateBackgroundTask, err = store.sqlDb.Prepare(updateBackgroundTask); err != nil {
 		return nil, err
 	}
+	if store.stmts.updateBackgroundTaskProgress, err = store.sqlDb.Prepare(updateBackgroundTaskProgress); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectAllBackgroundTasks, err = store.sqlDb.Prepare(selectAllBackgroundTasks); err != nil {
 		return nil, err
 	}
+	if store.stmts.updateBackgroundTaskCancelled, err = store.sqlDb.Prepare(updateBackgroundTaskCancelled); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectBackgroundTaskCancelled, err = store.sqlDb.Prepare(selectBackgroundTaskCancelled); err != nil {
+		return nil, err
+	}
 	if store.stmts.insertReservation, err = store.sqlDb.Prepare(insertReservation); err != nil {
 		return nil, err
 	}
@@ -129,6 +305,231 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectUserStats, err = store.sqlDb.Prepare(selectUserStats); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectUserQuota, err = store.sqlDb.Prepare(selectUserQuota); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertUserQuota, err = store.sqlDb.Prepare(upsertUserQuota); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteUserQuota, err = store.sqlDb.Prepare(deleteUserQuota); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUserRateLimits, err = store.sqlDb.Prepare(selectUserRateLimits); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertUserRateLimit, err = store.sqlDb.Prepare(upsertUserRateLimit); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteUserRateLimit, err = store.sqlDb.Prepare(deleteUserRateLimit); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertAdminToken, err = store.sqlDb.Prepare(insertAdminToken); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectAdminTokens, err = store.sqlDb.Prepare(selectAdminTokens); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectAdminTokenByHash, err = store.sqlDb.Prepare(selectAdminTokenByHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteAdminToken, err = store.sqlDb.Prepare(deleteAdminToken); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertUploadBan, err = store.sqlDb.Prepare(insertUploadBan); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteUploadBan, err = store.sqlDb.Prepare(deleteUploadBan); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUploadBans, err = store.sqlDb.Prepare(selectUploadBans); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertBlockedHash, err = store.sqlDb.Prepare(upsertBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteBlockedHash, err = store.sqlDb.Prepare(deleteBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectBlockedHash, err = store.sqlDb.Prepare(selectBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectBlockedHashesOfType, err = store.sqlDb.Prepare(selectBlockedHashesOfType); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectBlockedHashes, err = store.sqlDb.Prepare(selectBlockedHashes); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertAuditLogEntry, err = store.sqlDb.Prepare(insertAuditLogEntry); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectAuditLog, err = store.sqlDb.Prepare(selectAuditLog); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertPurgeSchedule, err = store.sqlDb.Prepare(insertPurgeSchedule); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPurgeSchedules, err = store.sqlDb.Prepare(selectPurgeSchedules); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPurgeSchedule, err = store.sqlDb.Prepare(selectPurgeSchedule); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectDuePurgeSchedules, err = store.sqlDb.Prepare(selectDuePurgeSchedules); err != nil {
+		return nil, err
+	}
+	if store.stmts.updatePurgeScheduleNextRun, err = store.sqlDb.Prepare(updatePurgeScheduleNextRun); err != nil {
+		return nil, err
+	}
+	if store.stmts.deletePurgeSchedule, err = store.sqlDb.Prepare(deletePurgeSchedule); err != nil {
+		return nil, err
+	}
+	if store.stmts.deletePurgeScheduleRuns, err = store.sqlDb.Prepare(deletePurgeScheduleRuns); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertPurgeScheduleRun, err = store.sqlDb.Prepare(insertPurgeScheduleRun); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPurgeScheduleRuns, err = store.sqlDb.Prepare(selectPurgeScheduleRuns); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaForIntegrityCheck, err = store.sqlDb.Prepare(selectMediaForIntegrityCheck); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertIntegrityCheck, err = store.sqlDb.Prepare(upsertIntegrityCheck); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertObjectReplica, err = store.sqlDb.Prepare(insertObjectReplica); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectObjectReplicas, err = store.sqlDb.Prepare(selectObjectReplicas); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteObjectReplicas, err = store.sqlDb.Prepare(deleteObjectReplicas); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertWriteBehindEntry, err = store.sqlDb.Prepare(insertWriteBehindEntry); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectDueWriteBehindEntries, err = store.sqlDb.Prepare(selectDueWriteBehindEntries); err != nil {
+		return nil, err
+	}
+	if store.stmts.updateWriteBehindAttempt, err = store.sqlDb.Prepare(updateWriteBehindAttempt); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteWriteBehindEntry, err = store.sqlDb.Prepare(deleteWriteBehindEntry); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfMediaObject, err = store.sqlDb.Prepare(changeLocationOfMediaObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfThumbnailObject, err = store.sqlDb.Prepare(changeLocationOfThumbnailObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfExportObject, err = store.sqlDb.Prepare(changeLocationOfExportObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfReplicatedObject, err = store.sqlDb.Prepare(changeLocationOfReplicatedObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfReplicaObject, err = store.sqlDb.Prepare(changeLocationOfReplicaObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfDirectUploadObject, err = store.sqlDb.Prepare(changeLocationOfDirectUploadObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeLocationOfResumableUploadChunkObject, err = store.sqlDb.Prepare(changeLocationOfResumableUploadChunkObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectDatastoreUsage, err = store.sqlDb.Prepare(selectDatastoreUsage); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertDirectUpload, err = store.sqlDb.Prepare(insertDirectUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectDirectUpload, err = store.sqlDb.Prepare(selectDirectUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectExpiredDirectUploads, err = store.sqlDb.Prepare(selectExpiredDirectUploads); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteDirectUpload, err = store.sqlDb.Prepare(deleteDirectUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertPendingUpload, err = store.sqlDb.Prepare(insertPendingUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPendingUpload, err = store.sqlDb.Prepare(selectPendingUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.deletePendingUpload, err = store.sqlDb.Prepare(deletePendingUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteExpiredPendingUploads, err = store.sqlDb.Prepare(deleteExpiredPendingUploads); err != nil {
+		return nil, err
+	}
+	if store.stmts.claimPendingUpload, err = store.sqlDb.Prepare(claimPendingUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.releasePendingUpload, err = store.sqlDb.Prepare(releasePendingUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.countPendingUploadsForUser, err = store.sqlDb.Prepare(countPendingUploadsForUser); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertResumableUpload, err = store.sqlDb.Prepare(insertResumableUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectResumableUpload, err = store.sqlDb.Prepare(selectResumableUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectExpiredResumableUploads, err = store.sqlDb.Prepare(selectExpiredResumableUploads); err != nil {
+		return nil, err
+	}
+	if store.stmts.updateResumableUploadOffset, err = store.sqlDb.Prepare(updateResumableUploadOffset); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteResumableUpload, err = store.sqlDb.Prepare(deleteResumableUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.claimResumableUpload, err = store.sqlDb.Prepare(claimResumableUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.releaseResumableUpload, err = store.sqlDb.Prepare(releaseResumableUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertResumableUploadChunk, err = store.sqlDb.Prepare(insertResumableUploadChunk); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectResumableUploadChunks, err = store.sqlDb.Prepare(selectResumableUploadChunks); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteResumableUploadChunks, err = store.sqlDb.Prepare(deleteResumableUploadChunks); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUserStorageUsage, err = store.sqlDb.Prepare(selectUserStorageUsage); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectOriginUsage, err = store.sqlDb.Prepare(selectOriginUsage); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertUploadAttribution, err = store.sqlDb.Prepare(insertUploadAttribution); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUploadAttribution, err = store.sqlDb.Prepare(selectUploadAttribution); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteUploadAttributionBefore, err = store.sqlDb.Prepare(deleteUploadAttributionBefore); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertStagedUpload, err = store.sqlDb.Prepare(insertStagedUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectStagedUploadsBefore, err = store.sqlDb.Prepare(selectStagedUploadsBefore); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteStagedUpload, err = store.sqlDb.Prepare(deleteStagedUpload); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -146,8 +547,8 @@ func (s *MetadataStore) UpsertLastAccess(sha256Hash string, timestamp int64) err
 	return err
 }
 
-func (s *MetadataStore) ChangeDatastoreOfHash(datastoreId string, location string, sha256hash string) error {
-	_, err1 := s.statements.changeDatastoreOfMediaHash.ExecContext(s.ctx, datastoreId, location, sha256hash)
+func (s *MetadataStore) ChangeDatastoreOfHash(datastoreId string, location string, sha256hash string, storedSizeBytes int64, compressed bool) error {
+	_, err1 := s.statements.changeDatastoreOfMediaHash.ExecContext(s.ctx, datastoreId, location, sha256hash, storedSizeBytes, compressed)
 	if err1 != nil {
 		return err1
 	}
@@ -158,6 +559,60 @@ func (s *MetadataStore) ChangeDatastoreOfHash(datastoreId string, location strin
 	return nil
 }
 
+// ChangeLocationOfObject updates every record which points at an object after it has been moved
+// within its datastore. The records are all updated or, on error, none are.
+func (s *MetadataStore) ChangeLocationOfObject(datastoreId string, oldLocation string, newLocation string) error {
+	stmts := []*sql.Stmt{
+		s.statements.changeLocationOfMediaObject,
+		s.statements.changeLocationOfThumbnailObject,
+		s.statements.changeLocationOfExportObject,
+		s.statements.changeLocationOfReplicatedObject,
+		s.statements.changeLocationOfReplicaObject,
+		s.statements.changeLocationOfDirectUploadObject,
+		s.statements.changeLocationOfResumableUploadChunkObject,
+	}
+	tx, err := s.factory.sqlDb.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		_, err = tx.StmtContext(s.ctx, stmt).ExecContext(s.ctx, datastoreId, oldLocation, newLocation)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CountReferencesToObject returns how many media, thumbnail, export, replica, pending direct upload, and
+// resumable upload chunk records point at the given object.
+func (s *MetadataStore) CountReferencesToObject(datastoreId string, location string) (int64, error) {
+	var refs int64
+	err := s.statements.selectReferencesToObject.QueryRowContext(s.ctx, datastoreId, location).Scan(&refs)
+	return refs, err
+}
+
+// GetObjectReferencesInDatastore returns every record which points at an object in the datastore.
+func (s *MetadataStore) GetObjectReferencesInDatastore(datastoreId string) ([]*types.ObjectReference, error) {
+	rows, err := s.statements.selectObjectReferencesInDatastore.QueryContext(s.ctx, datastoreId)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.ObjectReference, 0)
+	for rows.Next() {
+		obj := &types.ObjectReference{}
+		err = rows.Scan(&obj.Kind, &obj.Id, &obj.Location)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
 func (s *MetadataStore) GetEstimatedSizeOfDatastore(datastoreId string) (int64, error) {
 	r := &folderSize{}
 	err := s.statements.selectSizeOfDatastore.QueryRowContext(s.ctx, datastoreId).Scan(&r.Size)
@@ -190,8 +645,10 @@ func (s *MetadataStore) GetOldMedia(beforeTs int64) ([]*types.MinimalMediaMetada
 	return results, nil
 }
 
-func (s *MetadataStore) GetOldMediaInDatastore(datastoreId string, beforeTs int64) ([]*types.MinimalMediaMetadata, error) {
-	rows, err := s.statements.selectMediaLastAccessedBeforeInDatastore.QueryContext(s.ctx, beforeTs, datastoreId)
+// GetOldMediaInDatastore returns the media in the datastore which was last accessed before beforeTs. An
+// empty origin or userId matches all media.
+func (s *MetadataStore) GetOldMediaInDatastore(datastoreId string, beforeTs int64, origin string, userId string) ([]*types.MinimalMediaMetadata, error) {
+	rows, err := s.statements.selectMediaLastAccessedBeforeInDatastore.QueryContext(s.ctx, beforeTs, datastoreId, origin, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -216,8 +673,10 @@ func (s *MetadataStore) GetOldMediaInDatastore(datastoreId string, beforeTs int6
 	return results, nil
 }
 
-func (s *MetadataStore) GetOldThumbnailsInDatastore(datastoreId string, beforeTs int64) ([]*types.MinimalMediaMetadata, error) {
-	rows, err := s.statements.selectThumbnailsLastAccessedBeforeInDatastore.QueryContext(s.ctx, beforeTs, datastoreId)
+// GetOldThumbnailsInDatastore is the thumbnail equivalent of GetOldMediaInDatastore. The userId is
+// matched against the uploader of the media the thumbnail belongs to.
+func (s *MetadataStore) GetOldThumbnailsInDatastore(datastoreId string, beforeTs int64, origin string, userId string) ([]*types.MinimalMediaMetadata, error) {
+	rows, err := s.statements.selectThumbnailsLastAccessedBeforeInDatastore.QueryContext(s.ctx, beforeTs, datastoreId, origin, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -313,13 +772,40 @@ func (s *MetadataStore) FinishedBackgroundTask(id int) error {
 	return err
 }
 
+func (s *MetadataStore) SetBackgroundTaskProgress(id int, progress map[string]interface{}) error {
+	b, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = s.statements.updateBackgroundTaskProgress.ExecContext(s.ctx, id, string(b))
+	return err
+}
+
+// CancelBackgroundTask asks the task to stop, returning false if it has already finished. The task
+// stops the next time it checks IsBackgroundTaskCancelled.
+func (s *MetadataStore) CancelBackgroundTask(id int) (bool, error) {
+	res, err := s.statements.updateBackgroundTaskCancelled.ExecContext(s.ctx, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *MetadataStore) IsBackgroundTaskCancelled(id int) (bool, error) {
+	cancelled := false
+	err := s.statements.selectBackgroundTaskCancelled.QueryRowContext(s.ctx, id).Scan(&cancelled)
+	return cancelled, err
+}
+
 func (s *MetadataStore) GetBackgroundTask(id int) (*types.BackgroundTask, error) {
 	r := s.statements.selectBackgroundTask.QueryRowContext(s.ctx, id)
 	task := &types.BackgroundTask{}
 	var paramsStr string
 	var endTs sql.NullInt64
+	var progressStr sql.NullString
 
-	err := r.Scan(&task.ID, &task.Name, &paramsStr, &task.StartTs, &endTs)
+	err := r.Scan(&task.ID, &task.Name, &paramsStr, &task.StartTs, &endTs, &progressStr, &task.Cancelled)
 	if err != nil {
 		return nil, err
 	}
@@ -329,6 +815,13 @@ func (s *MetadataStore) GetBackgroundTask(id int) (*types.BackgroundTask, error)
 		return nil, err
 	}
 
+	if progressStr.Valid {
+		err = json.Unmarshal([]byte(progressStr.String), &task.Progress)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if endTs.Valid {
 		task.EndTs = endTs.Int64
 	}
@@ -347,8 +840,9 @@ func (s *MetadataStore) GetAllBackgroundTasks() ([]*types.BackgroundTask, error)
 		task := &types.BackgroundTask{}
 		var paramsStr string
 		var endTs sql.NullInt64
+		var progressStr sql.NullString
 
-		err := rows.Scan(&task.ID, &task.Name, &paramsStr, &task.StartTs, &endTs)
+		err := rows.Scan(&task.ID, &task.Name, &paramsStr, &task.StartTs, &endTs, &progressStr, &task.Cancelled)
 		if err != nil {
 			return nil, err
 		}
@@ -358,6 +852,13 @@ func (s *MetadataStore) GetAllBackgroundTasks() ([]*types.BackgroundTask, error)
 			return nil, err
 		}
 
+		if progressStr.Valid {
+			err = json.Unmarshal([]byte(progressStr.String), &task.Progress)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		if endTs.Valid {
 			task.EndTs = endTs.Int64
 		}
@@ -427,3 +928,853 @@ func (s *MetadataStore) GetUserStats(userId string) (*types.UserStats, error) {
 	}
 	return stat, nil
 }
+
+// GetUserQuota returns the quota set for the user, or sql.ErrNoRows if there isn't one.
+func (s *MetadataStore) GetUserQuota(userId string) (*types.UserQuota, error) {
+	r := s.statements.selectUserQuota.QueryRowContext(s.ctx, userId)
+
+	q := &types.UserQuota{}
+	err := r.Scan(
+		&q.UserId,
+		&q.MaxBytes,
+		&q.MaxFiles,
+		&q.UpdatedTs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (s *MetadataStore) SetUserQuota(userId string, maxBytes int64, maxFiles int64) (*types.UserQuota, error) {
+	q := &types.UserQuota{
+		UserId:    userId,
+		MaxBytes:  maxBytes,
+		MaxFiles:  maxFiles,
+		UpdatedTs: util.NowMillis(),
+	}
+	_, err := s.statements.upsertUserQuota.ExecContext(s.ctx, q.UserId, q.MaxBytes, q.MaxFiles, q.UpdatedTs)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (s *MetadataStore) DeleteUserQuota(userId string) error {
+	_, err := s.statements.deleteUserQuota.ExecContext(s.ctx, userId)
+	return err
+}
+
+func (s *MetadataStore) GetUserRateLimits(userId string) ([]*types.UserRateLimit, error) {
+	rows, err := s.statements.selectUserRateLimits.QueryContext(s.ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.UserRateLimit, 0)
+	for rows.Next() {
+		obj := &types.UserRateLimit{}
+		err = rows.Scan(
+			&obj.UserId,
+			&obj.Action,
+			&obj.RequestsPerSecond,
+			&obj.Burst,
+			&obj.UpdatedTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) SetUserRateLimit(userId string, action string, requestsPerSecond float64, burst int) (*types.UserRateLimit, error) {
+	l := &types.UserRateLimit{
+		UserId:            userId,
+		Action:            action,
+		RequestsPerSecond: requestsPerSecond,
+		Burst:             burst,
+		UpdatedTs:         util.NowMillis(),
+	}
+	_, err := s.statements.upsertUserRateLimit.ExecContext(s.ctx, l.UserId, l.Action, l.RequestsPerSecond, l.Burst, l.UpdatedTs)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// DeleteUserRateLimit deletes the user's rate limit for the action, or all of their rate limits if
+// the action is empty.
+func (s *MetadataStore) DeleteUserRateLimit(userId string, action string) error {
+	_, err := s.statements.deleteUserRateLimit.ExecContext(s.ctx, userId, action)
+	return err
+}
+
+func (s *MetadataStore) InsertAdminToken(token *types.AdminToken) error {
+	return s.statements.insertAdminToken.QueryRowContext(s.ctx,
+		token.Name,
+		token.TokenHash,
+		pq.Array(token.Scopes),
+		token.CreatedBy,
+		token.CreatedTs,
+	).Scan(&token.ID)
+}
+
+func (s *MetadataStore) GetAdminTokens() ([]*types.AdminToken, error) {
+	rows, err := s.statements.selectAdminTokens.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.AdminToken, 0)
+	for rows.Next() {
+		obj := &types.AdminToken{}
+		err = rows.Scan(&obj.ID, &obj.Name, &obj.TokenHash, pq.Array(&obj.Scopes), &obj.CreatedBy, &obj.CreatedTs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) GetAdminTokenByHash(tokenHash string) (*types.AdminToken, error) {
+	obj := &types.AdminToken{}
+	err := s.statements.selectAdminTokenByHash.QueryRowContext(s.ctx, tokenHash).Scan(&obj.ID, &obj.Name, &obj.TokenHash, pq.Array(&obj.Scopes), &obj.CreatedBy, &obj.CreatedTs)
+	return obj, err
+}
+
+// DeleteAdminToken revokes the token, returning its hash. sql.ErrNoRows is returned if there was
+// no such token.
+func (s *MetadataStore) DeleteAdminToken(id int64) (string, error) {
+	tokenHash := ""
+	err := s.statements.deleteAdminToken.QueryRowContext(s.ctx, id).Scan(&tokenHash)
+	return tokenHash, err
+}
+
+func (s *MetadataStore) InsertUploadBan(pattern string, bannedBy string, bannedTs int64) error {
+	_, err := s.statements.insertUploadBan.ExecContext(s.ctx, pattern, bannedBy, bannedTs)
+	return err
+}
+
+func (s *MetadataStore) DeleteUploadBan(pattern string) (bool, error) {
+	res, err := s.statements.deleteUploadBan.ExecContext(s.ctx, pattern)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *MetadataStore) GetUploadBans() ([]*types.UploadBan, error) {
+	rows, err := s.statements.selectUploadBans.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.UploadBan, 0)
+	for rows.Next() {
+		obj := &types.UploadBan{}
+		err = rows.Scan(
+			&obj.Pattern,
+			&obj.BannedBy,
+			&obj.BannedTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) UpsertBlockedHash(hash *types.BlockedHash) error {
+	_, err := s.statements.upsertBlockedHash.ExecContext(s.ctx, hash.HashType, hash.Hash, hash.Action, hash.Reason, hash.AddedBy, hash.AddedTs)
+	return err
+}
+
+func (s *MetadataStore) DeleteBlockedHash(hashType string, hash string) (bool, error) {
+	res, err := s.statements.deleteBlockedHash.ExecContext(s.ctx, hashType, hash)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// GetBlockedHash returns the blocklist entry for the hash, or nil if it isn't blocked.
+func (s *MetadataStore) GetBlockedHash(hashType string, hash string) (*types.BlockedHash, error) {
+	obj := &types.BlockedHash{}
+	err := s.statements.selectBlockedHash.QueryRowContext(s.ctx, hashType, hash).Scan(
+		&obj.HashType,
+		&obj.Hash,
+		&obj.Action,
+		&obj.Reason,
+		&obj.AddedBy,
+		&obj.AddedTs,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *MetadataStore) GetBlockedHashesOfType(hashType string) ([]*types.BlockedHash, error) {
+	rows, err := s.statements.selectBlockedHashesOfType.QueryContext(s.ctx, hashType)
+	if err != nil {
+		return nil, err
+	}
+	return scanBlockedHashes(rows)
+}
+
+func (s *MetadataStore) GetBlockedHashes() ([]*types.BlockedHash, error) {
+	rows, err := s.statements.selectBlockedHashes.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scanBlockedHashes(rows)
+}
+
+func scanBlockedHashes(rows *sql.Rows) ([]*types.BlockedHash, error) {
+	results := make([]*types.BlockedHash, 0)
+	for rows.Next() {
+		obj := &types.BlockedHash{}
+		err := rows.Scan(
+			&obj.HashType,
+			&obj.Hash,
+			&obj.Action,
+			&obj.Reason,
+			&obj.AddedBy,
+			&obj.AddedTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) InsertAuditLogEntry(entry *types.AuditLogEntry) error {
+	b, err := json.Marshal(entry.Params)
+	if err != nil {
+		return err
+	}
+	affected := entry.AffectedMxcs
+	if affected == nil {
+		affected = make([]string, 0)
+	}
+	_, err = s.statements.insertAuditLogEntry.ExecContext(s.ctx, entry.Ts, entry.UserId, entry.Host, entry.Action, string(b), pq.Array(affected))
+	return err
+}
+
+// GetAuditLog returns up to limit entries with an ID lower than beforeId, newest first. Empty
+// filters match every entry.
+func (s *MetadataStore) GetAuditLog(userId string, action string, mxc string, beforeId int64, limit int64) ([]*types.AuditLogEntry, error) {
+	rows, err := s.statements.selectAuditLog.QueryContext(s.ctx, userId, action, mxc, beforeId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.AuditLogEntry, 0)
+	for rows.Next() {
+		entry := &types.AuditLogEntry{}
+		var paramsStr string
+		err = rows.Scan(
+			&entry.ID,
+			&entry.Ts,
+			&entry.UserId,
+			&entry.Host,
+			&entry.Action,
+			&paramsStr,
+			pq.Array(&entry.AffectedMxcs),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(paramsStr), &entry.Params)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, entry)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) InsertPurgeSchedule(schedule *types.PurgeSchedule) error {
+	return s.statements.insertPurgeSchedule.QueryRowContext(s.ctx,
+		schedule.Kind,
+		schedule.Target,
+		schedule.IncludeLocal,
+		schedule.OlderThanDays,
+		schedule.TimeOfDay,
+		schedule.IntervalDays,
+		schedule.CreatedBy,
+		schedule.CreatedTs,
+		schedule.NextRunTs,
+	).Scan(&schedule.ID)
+}
+
+func (s *MetadataStore) GetPurgeSchedules() ([]*types.PurgeSchedule, error) {
+	rows, err := s.statements.selectPurgeSchedules.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scanPurgeSchedules(rows)
+}
+
+// GetDuePurgeSchedules returns the schedules which should have run by the given time.
+func (s *MetadataStore) GetDuePurgeSchedules(nowTs int64) ([]*types.PurgeSchedule, error) {
+	rows, err := s.statements.selectDuePurgeSchedules.QueryContext(s.ctx, nowTs)
+	if err != nil {
+		return nil, err
+	}
+	return scanPurgeSchedules(rows)
+}
+
+func scanPurgeSchedules(rows *sql.Rows) ([]*types.PurgeSchedule, error) {
+	results := make([]*types.PurgeSchedule, 0)
+	for rows.Next() {
+		obj := &types.PurgeSchedule{}
+		err := rows.Scan(
+			&obj.ID,
+			&obj.Kind,
+			&obj.Target,
+			&obj.IncludeLocal,
+			&obj.OlderThanDays,
+			&obj.TimeOfDay,
+			&obj.IntervalDays,
+			&obj.CreatedBy,
+			&obj.CreatedTs,
+			&obj.NextRunTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) GetPurgeSchedule(id int64) (*types.PurgeSchedule, error) {
+	obj := &types.PurgeSchedule{}
+	err := s.statements.selectPurgeSchedule.QueryRowContext(s.ctx, id).Scan(
+		&obj.ID,
+		&obj.Kind,
+		&obj.Target,
+		&obj.IncludeLocal,
+		&obj.OlderThanDays,
+		&obj.TimeOfDay,
+		&obj.IntervalDays,
+		&obj.CreatedBy,
+		&obj.CreatedTs,
+		&obj.NextRunTs,
+	)
+	return obj, err
+}
+
+// ClaimPurgeScheduleRun moves the schedule's next run from previousTs to nextTs, returning false if
+// something else (like another process) already did.
+func (s *MetadataStore) ClaimPurgeScheduleRun(id int64, previousTs int64, nextTs int64) (bool, error) {
+	res, err := s.statements.updatePurgeScheduleNextRun.ExecContext(s.ctx, id, previousTs, nextTs)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// DeletePurgeSchedule deletes the schedule and its run history, returning false if it didn't exist.
+func (s *MetadataStore) DeletePurgeSchedule(id int64) (bool, error) {
+	_, err := s.statements.deletePurgeScheduleRuns.ExecContext(s.ctx, id)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.statements.deletePurgeSchedule.ExecContext(s.ctx, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *MetadataStore) InsertPurgeScheduleRun(run *types.PurgeScheduleRun) error {
+	_, err := s.statements.insertPurgeScheduleRun.ExecContext(s.ctx, run.ScheduleID, run.StartTs, run.EndTs, run.Purged, run.BytesReclaimed, run.Error)
+	return err
+}
+
+// GetPurgeScheduleRuns returns up to limit of the schedule's runs, newest first, skipping the offset
+// most recent ones.
+func (s *MetadataStore) GetPurgeScheduleRuns(scheduleId int64, limit int64, offset int64) ([]*types.PurgeScheduleRun, error) {
+	rows, err := s.statements.selectPurgeScheduleRuns.QueryContext(s.ctx, scheduleId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.PurgeScheduleRun, 0)
+	for rows.Next() {
+		obj := &types.PurgeScheduleRun{}
+		err = rows.Scan(
+			&obj.ID,
+			&obj.ScheduleID,
+			&obj.StartTs,
+			&obj.EndTs,
+			&obj.Purged,
+			&obj.BytesReclaimed,
+			&obj.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetMediaForIntegrityCheck returns up to limit unquarantined media, one per hash, starting with the
+// media which was checked the longest time ago (or never). The LastAccessTs is the last check time.
+func (s *MetadataStore) GetMediaForIntegrityCheck(limit int) ([]*types.MinimalMediaMetadata, error) {
+	rows, err := s.statements.selectMediaForIntegrityCheck.QueryContext(s.ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.MinimalMediaMetadata
+	for rows.Next() {
+		obj := &types.MinimalMediaMetadata{}
+		err = rows.Scan(
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.LastAccessTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) UpsertIntegrityCheck(sha256Hash string, timestamp int64, corrupted bool) error {
+	_, err := s.statements.upsertIntegrityCheck.ExecContext(s.ctx, sha256Hash, timestamp, corrupted)
+	return err
+}
+
+func (s *MetadataStore) InsertObjectReplica(replica *types.ObjectReplica) error {
+	_, err := s.statements.insertObjectReplica.ExecContext(s.ctx, replica.DatastoreId, replica.Location, replica.ReplicaDatastoreId, replica.ReplicaLocation)
+	return err
+}
+
+// GetObjectReplicas returns the copies of an object which were written to other datastores.
+func (s *MetadataStore) GetObjectReplicas(datastoreId string, location string) ([]*types.ObjectReplica, error) {
+	rows, err := s.statements.selectObjectReplicas.QueryContext(s.ctx, datastoreId, location)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.ObjectReplica, 0)
+	for rows.Next() {
+		obj := &types.ObjectReplica{}
+		err = rows.Scan(&obj.DatastoreId, &obj.Location, &obj.ReplicaDatastoreId, &obj.ReplicaLocation)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) DeleteObjectReplicas(datastoreId string, location string) error {
+	_, err := s.statements.deleteObjectReplicas.ExecContext(s.ctx, datastoreId, location)
+	return err
+}
+
+func (s *MetadataStore) InsertWriteBehindEntry(datastoreId string, location string) error {
+	_, err := s.statements.insertWriteBehindEntry.ExecContext(s.ctx, datastoreId, location, util.NowMillis())
+	return err
+}
+
+// GetDueWriteBehindEntries returns up to limit queued objects which are due to be written to their datastores.
+func (s *MetadataStore) GetDueWriteBehindEntries(beforeTs int64, limit int) ([]*types.WriteBehindEntry, error) {
+	rows, err := s.statements.selectDueWriteBehindEntries.QueryContext(s.ctx, beforeTs, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.WriteBehindEntry, 0)
+	for rows.Next() {
+		obj := &types.WriteBehindEntry{}
+		err = rows.Scan(&obj.DatastoreId, &obj.Location, &obj.Attempts, &obj.NextAttemptTs, &obj.LastError, &obj.CreationTs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) UpdateWriteBehindAttempt(entry *types.WriteBehindEntry) error {
+	_, err := s.statements.updateWriteBehindAttempt.ExecContext(s.ctx, entry.DatastoreId, entry.Location, entry.Attempts, entry.NextAttemptTs, entry.LastError)
+	return err
+}
+
+func (s *MetadataStore) DeleteWriteBehindEntry(datastoreId string, location string) error {
+	_, err := s.statements.deleteWriteBehindEntry.ExecContext(s.ctx, datastoreId, location)
+	return err
+}
+
+// GetDatastoreUsage counts the objects recorded in the datastore and their stored size, including
+// how much of that was written since each of the given timestamps.
+func (s *MetadataStore) GetDatastoreUsage(datastoreId string, dayAgoTs int64, weekAgoTs int64) (*types.DatastoreUsage, error) {
+	u := &types.DatastoreUsage{}
+	err := s.statements.selectDatastoreUsage.QueryRowContext(s.ctx, datastoreId, dayAgoTs, weekAgoTs).Scan(
+		&u.Objects,
+		&u.Bytes,
+		&u.ObjectsLastDay,
+		&u.BytesLastDay,
+		&u.ObjectsLastWeek,
+		&u.BytesLastWeek,
+	)
+	return u, err
+}
+
+func (s *MetadataStore) InsertDirectUpload(upload *types.DirectUpload) error {
+	_, err := s.statements.insertDirectUpload.ExecContext(s.ctx, upload.UploadId, upload.Origin, upload.UserId, upload.DatastoreId, upload.Location, upload.ContentType, upload.UploadName, upload.ExpiresTs, upload.SizeBytes)
+	return err
+}
+
+// GetDirectUpload returns the direct upload with the given ID, or nil if there isn't one.
+func (s *MetadataStore) GetDirectUpload(uploadId string) (*types.DirectUpload, error) {
+	obj := &types.DirectUpload{}
+	err := s.statements.selectDirectUpload.QueryRowContext(s.ctx, uploadId).Scan(&obj.UploadId, &obj.Origin, &obj.UserId, &obj.DatastoreId, &obj.Location, &obj.ContentType, &obj.UploadName, &obj.ExpiresTs, &obj.SizeBytes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return obj, err
+}
+
+func (s *MetadataStore) GetExpiredDirectUploads(beforeTs int64) ([]*types.DirectUpload, error) {
+	rows, err := s.statements.selectExpiredDirectUploads.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.DirectUpload, 0)
+	for rows.Next() {
+		obj := &types.DirectUpload{}
+		err = rows.Scan(&obj.UploadId, &obj.Origin, &obj.UserId, &obj.DatastoreId, &obj.Location, &obj.ContentType, &obj.UploadName, &obj.ExpiresTs, &obj.SizeBytes)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// DeleteDirectUpload removes the direct upload, returning false if it was already removed.
+func (s *MetadataStore) DeleteDirectUpload(uploadId string) (bool, error) {
+	res, err := s.statements.deleteDirectUpload.ExecContext(s.ctx, uploadId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *MetadataStore) InsertPendingUpload(upload *types.PendingUpload) error {
+	_, err := s.statements.insertPendingUpload.ExecContext(s.ctx, upload.Origin, upload.MediaId, upload.UserId, upload.CreationTs, upload.ExpiresTs)
+	return err
+}
+
+// GetPendingUpload returns the pending upload for the media, or nil if there isn't one.
+func (s *MetadataStore) GetPendingUpload(origin string, mediaId string) (*types.PendingUpload, error) {
+	obj := &types.PendingUpload{}
+	err := s.statements.selectPendingUpload.QueryRowContext(s.ctx, origin, mediaId).Scan(&obj.Origin, &obj.MediaId, &obj.UserId, &obj.CreationTs, &obj.ExpiresTs)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return obj, err
+}
+
+// DeletePendingUpload removes the pending upload, returning false if it was already removed.
+func (s *MetadataStore) DeletePendingUpload(origin string, mediaId string) (bool, error) {
+	res, err := s.statements.deletePendingUpload.ExecContext(s.ctx, origin, mediaId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteExpiredPendingUploads removes pending uploads which expired before the given time, returning
+// how many were removed.
+func (s *MetadataStore) DeleteExpiredPendingUploads(beforeTs int64) (int64, error) {
+	res, err := s.statements.deleteExpiredPendingUploads.ExecContext(s.ctx, beforeTs)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ClaimPendingUpload marks the pending upload as having its contents uploaded, returning false if
+// another request already has it. Claims made before staleBeforeTs are assumed to have been abandoned
+// and are taken over.
+func (s *MetadataStore) ClaimPendingUpload(origin string, mediaId string, staleBeforeTs int64) (bool, error) {
+	res, err := s.statements.claimPendingUpload.ExecContext(s.ctx, origin, mediaId, util.NowMillis(), staleBeforeTs)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// ReleasePendingUpload undoes ClaimPendingUpload so the contents can be uploaded again.
+func (s *MetadataStore) ReleasePendingUpload(origin string, mediaId string) error {
+	_, err := s.statements.releasePendingUpload.ExecContext(s.ctx, origin, mediaId)
+	return err
+}
+
+// CountPendingUploadsForUser returns how many of the user's pending uploads haven't expired as of nowTs.
+func (s *MetadataStore) CountPendingUploadsForUser(userId string, nowTs int64) (int64, error) {
+	var count int64
+	err := s.statements.countPendingUploadsForUser.QueryRowContext(s.ctx, userId, nowTs).Scan(&count)
+	return count, err
+}
+
+func (s *MetadataStore) InsertResumableUpload(upload *types.ResumableUpload) error {
+	_, err := s.statements.insertResumableUpload.ExecContext(s.ctx, upload.UploadId, upload.Origin, upload.MediaId, upload.UserId, upload.DatastoreId, upload.ContentType, upload.UploadName, upload.SizeBytes, upload.OffsetBytes, upload.ExpiresTs)
+	return err
+}
+
+// GetResumableUpload returns the resumable upload with the given ID, or nil if there isn't one.
+func (s *MetadataStore) GetResumableUpload(uploadId string) (*types.ResumableUpload, error) {
+	obj := &types.ResumableUpload{}
+	err := s.statements.selectResumableUpload.QueryRowContext(s.ctx, uploadId).Scan(&obj.UploadId, &obj.Origin, &obj.MediaId, &obj.UserId, &obj.DatastoreId, &obj.ContentType, &obj.UploadName, &obj.SizeBytes, &obj.OffsetBytes, &obj.ExpiresTs)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return obj, err
+}
+
+func (s *MetadataStore) GetExpiredResumableUploads(beforeTs int64) ([]*types.ResumableUpload, error) {
+	rows, err := s.statements.selectExpiredResumableUploads.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.ResumableUpload, 0)
+	for rows.Next() {
+		obj := &types.ResumableUpload{}
+		err = rows.Scan(&obj.UploadId, &obj.Origin, &obj.MediaId, &obj.UserId, &obj.DatastoreId, &obj.ContentType, &obj.UploadName, &obj.SizeBytes, &obj.OffsetBytes, &obj.ExpiresTs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// AdvanceResumableUpload moves the offset of the upload forward, returning false if the upload is no
+// longer at fromOffset (another request got there first).
+func (s *MetadataStore) AdvanceResumableUpload(uploadId string, fromOffset int64, toOffset int64, expiresTs int64) (bool, error) {
+	res, err := s.statements.updateResumableUploadOffset.ExecContext(s.ctx, uploadId, fromOffset, toOffset, expiresTs)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteResumableUpload removes the resumable upload, returning false if it was already removed. The
+// upload's chunks are left alone.
+func (s *MetadataStore) DeleteResumableUpload(uploadId string) (bool, error) {
+	res, err := s.statements.deleteResumableUpload.ExecContext(s.ctx, uploadId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// ClaimResumableUpload marks the upload as being finished or removed, returning false if something else
+// already has it. Claims made before staleBeforeTs are assumed to have been abandoned and are taken over.
+func (s *MetadataStore) ClaimResumableUpload(uploadId string, staleBeforeTs int64) (bool, error) {
+	res, err := s.statements.claimResumableUpload.ExecContext(s.ctx, uploadId, util.NowMillis(), staleBeforeTs)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// ReleaseResumableUpload undoes ClaimResumableUpload so the upload can be finished again.
+func (s *MetadataStore) ReleaseResumableUpload(uploadId string) error {
+	_, err := s.statements.releaseResumableUpload.ExecContext(s.ctx, uploadId)
+	return err
+}
+
+func (s *MetadataStore) InsertResumableUploadChunk(chunk *types.ResumableUploadChunk) error {
+	_, err := s.statements.insertResumableUploadChunk.ExecContext(s.ctx, chunk.UploadId, chunk.OffsetBytes, chunk.SizeBytes, chunk.DatastoreId, chunk.Location)
+	return err
+}
+
+// GetResumableUploadChunks returns the chunks of the upload in the order they were uploaded.
+func (s *MetadataStore) GetResumableUploadChunks(uploadId string) ([]*types.ResumableUploadChunk, error) {
+	rows, err := s.statements.selectResumableUploadChunks.QueryContext(s.ctx, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.ResumableUploadChunk, 0)
+	for rows.Next() {
+		obj := &types.ResumableUploadChunk{}
+		err = rows.Scan(&obj.UploadId, &obj.OffsetBytes, &obj.SizeBytes, &obj.DatastoreId, &obj.Location)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) DeleteResumableUploadChunks(uploadId string) error {
+	_, err := s.statements.deleteResumableUploadChunks.ExecContext(s.ctx, uploadId)
+	return err
+}
+
+// GetUserStorageUsage returns how much each of the server's users has uploaded, ordered by the largest
+// "bytes", "media", or "last_upload" first.
+func (s *MetadataStore) GetUserStorageUsage(serverName string, orderBy string, limit int64) ([]*types.UserStorageUsage, error) {
+	rows, err := s.statements.selectUserStorageUsage.QueryContext(s.ctx, serverName, orderBy, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.UserStorageUsage, 0)
+	for rows.Next() {
+		obj := &types.UserStorageUsage{}
+		err = rows.Scan(&obj.UserId, &obj.Bytes, &obj.Media, &obj.LastUploadTs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetOriginUsage returns how much media is cached from each origin, ordered by the largest "bytes",
+// "media", or "last_access" first. Media from the excluded origins isn't counted.
+func (s *MetadataStore) GetOriginUsage(excludeOrigins []string, orderBy string, limit int64) ([]*types.OriginUsage, error) {
+	if excludeOrigins == nil {
+		excludeOrigins = make([]string, 0) // a NULL array would exclude everything
+	}
+	rows, err := s.statements.selectOriginUsage.QueryContext(s.ctx, pq.Array(excludeOrigins), orderBy, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.OriginUsage, 0)
+	for rows.Next() {
+		obj := &types.OriginUsage{}
+		err = rows.Scan(&obj.Origin, &obj.Media, &obj.Bytes, &obj.LastAccessTs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// InsertUploadAttribution records who uploaded the media. Media which already has its uploader recorded
+// keeps the original record.
+func (s *MetadataStore) InsertUploadAttribution(attribution *types.UploadAttribution) error {
+	_, err := s.statements.insertUploadAttribution.ExecContext(s.ctx, attribution.Origin, attribution.MediaId, attribution.IpAddress, attribution.UserAgent, attribution.TokenHash, attribution.RecordedTs)
+	return err
+}
+
+// GetUploadAttribution returns who uploaded the media, or nil if it wasn't recorded (or has since been
+// deleted).
+func (s *MetadataStore) GetUploadAttribution(origin string, mediaId string) (*types.UploadAttribution, error) {
+	obj := &types.UploadAttribution{}
+	err := s.statements.selectUploadAttribution.QueryRowContext(s.ctx, origin, mediaId).Scan(
+		&obj.Origin,
+		&obj.MediaId,
+		&obj.IpAddress,
+		&obj.UserAgent,
+		&obj.TokenHash,
+		&obj.RecordedTs,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *MetadataStore) DeleteUploadAttributionBefore(beforeTs int64) (int64, error) {
+	res, err := s.statements.deleteUploadAttributionBefore.ExecContext(s.ctx, beforeTs)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *MetadataStore) InsertStagedUpload(upload *types.StagedUpload) error {
+	_, err := s.statements.insertStagedUpload.ExecContext(s.ctx, upload.DatastoreId, upload.Location, upload.Origin, upload.MediaId, upload.CreationTs)
+	return err
+}
+
+func (s *MetadataStore) GetStagedUploadsBefore(beforeTs int64) ([]*types.StagedUpload, error) {
+	rows, err := s.statements.selectStagedUploadsBefore.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.StagedUpload, 0)
+	for rows.Next() {
+		obj := &types.StagedUpload{}
+		err = rows.Scan(&obj.DatastoreId, &obj.Location, &obj.Origin, &obj.MediaId, &obj.CreationTs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// DeleteStagedUpload forgets the staged upload, returning false if it was already forgotten.
+func (s *MetadataStore) DeleteStagedUpload(datastoreId string, location string) (bool, error) {
+	res, err := s.statements.deleteStagedUpload.ExecContext(s.ctx, datastoreId, location)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
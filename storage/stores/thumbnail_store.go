@@ -17,6 +17,7 @@ const selectThumbnailsForMedia = "SELECT origin, media_id, width, height, method
 const deleteThumbnailsForMedia = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2;"
 const selectThumbnailsCreatedBefore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE creation_ts < $1;"
 const deleteThumbnailsWithHash = "DELETE FROM thumbnails WHERE sha256_hash = $1;"
+const selectThumbnailsInDatastore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE datastore_id = $1;"
 
 type thumbnailStatements struct {
 	selectThumbnail                     *sql.Stmt
@@ -29,6 +30,7 @@ type thumbnailStatements struct {
 	deleteThumbnailsForMedia            *sql.Stmt
 	selectThumbnailsCreatedBefore       *sql.Stmt
 	deleteThumbnailsWithHash            *sql.Stmt
+	selectThumbnailsInDatastore         *sql.Stmt
 }
 
 type ThumbnailStoreFactory struct {
@@ -78,6 +80,9 @@ func InitThumbnailStore(sqlDb *sql.DB) (*ThumbnailStoreFactory, error) {
 	if store.stmts.deleteThumbnailsWithHash, err = store.sqlDb.Prepare(deleteThumbnailsWithHash); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectThumbnailsInDatastore, err = store.sqlDb.Prepare(selectThumbnailsInDatastore); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -256,6 +261,38 @@ func (s *ThumbnailStore) GetAllForMedia(origin string, mediaId string) ([]*types
 	return results, nil
 }
 
+func (s *ThumbnailStore) GetAllInDatastore(datastoreId string) ([]*types.Thumbnail, error) {
+	rows, err := s.statements.selectThumbnailsInDatastore.QueryContext(s.ctx, datastoreId)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Thumbnail
+	for rows.Next() {
+		obj := &types.Thumbnail{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.Width,
+			&obj.Height,
+			&obj.Method,
+			&obj.Animated,
+			&obj.ContentType,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Sha256Hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
 func (s *ThumbnailStore) DeleteAllForMedia(origin string, mediaId string) error {
 	_, err := s.statements.deleteThumbnailsForMedia.ExecContext(s.ctx, origin, mediaId)
 	if err != nil {
@@ -3,19 +3,29 @@ package stores
 import (
 	"database/sql"
 
+	"github.com/lib/pq"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
 const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header FROM url_previews WHERE url = $1 AND bucket_ts = $2 AND language_header = $3;"
+const selectLatestUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header FROM url_previews WHERE url = $1 AND language_header = $2 AND error_code = '' ORDER BY bucket_ts DESC LIMIT 1;"
 const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);"
 const deletePreviewsOlderThan = "DELETE FROM url_previews WHERE bucket_ts <= $1;"
+const selectOptOutCount = "SELECT COUNT(*) FROM url_preview_opt_outs WHERE origin = $1 AND entity_id = ANY($2);"
+const insertOptOut = "INSERT INTO url_preview_opt_outs (origin, entity_id, created_ts) VALUES ($1, $2, $3) ON CONFLICT (origin, entity_id) DO NOTHING;"
+const deleteOptOut = "DELETE FROM url_preview_opt_outs WHERE origin = $1 AND entity_id = $2;"
 
 type urlStatements struct {
 	selectUrlPreview        *sql.Stmt
+	selectLatestUrlPreview  *sql.Stmt
 	insertUrlPreview        *sql.Stmt
 	deletePreviewsOlderThan *sql.Stmt
+	selectOptOutCount       *sql.Stmt
+	insertOptOut            *sql.Stmt
+	deleteOptOut            *sql.Stmt
 }
 
 type UrlStoreFactory struct {
@@ -38,12 +48,24 @@ func InitUrlStore(sqlDb *sql.DB) (*UrlStoreFactory, error) {
 	if store.stmts.selectUrlPreview, err = store.sqlDb.Prepare(selectUrlPreview); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectLatestUrlPreview, err = store.sqlDb.Prepare(selectLatestUrlPreview); err != nil {
+		return nil, err
+	}
 	if store.stmts.insertUrlPreview, err = store.sqlDb.Prepare(insertUrlPreview); err != nil {
 		return nil, err
 	}
 	if store.stmts.deletePreviewsOlderThan, err = store.sqlDb.Prepare(deletePreviewsOlderThan); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectOptOutCount, err = store.sqlDb.Prepare(selectOptOutCount); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertOptOut, err = store.sqlDb.Prepare(insertOptOut); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteOptOut, err = store.sqlDb.Prepare(deleteOptOut); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -80,6 +102,30 @@ func (s *UrlStore) GetPreview(url string, ts int64, languageHeader string) (*typ
 	return r, err
 }
 
+func (s *UrlStore) GetLatestSuccessfulPreview(url string, languageHeader string) (*types.CachedUrlPreview, error) {
+	r := &types.CachedUrlPreview{
+		Preview: &types.UrlPreview{},
+	}
+	err := s.statements.selectLatestUrlPreview.QueryRowContext(s.ctx, url, languageHeader).Scan(
+		&r.SearchUrl,
+		&r.ErrorCode,
+		&r.FetchedTs,
+		&r.Preview.Url,
+		&r.Preview.SiteName,
+		&r.Preview.Type,
+		&r.Preview.Description,
+		&r.Preview.Title,
+		&r.Preview.ImageMxc,
+		&r.Preview.ImageType,
+		&r.Preview.ImageSize,
+		&r.Preview.ImageWidth,
+		&r.Preview.ImageHeight,
+		&r.Preview.LanguageHeader,
+	)
+
+	return r, err
+}
+
 func (s *UrlStore) InsertPreview(record *types.CachedUrlPreview) error {
 	_, err := s.statements.insertUrlPreview.ExecContext(
 		s.ctx,
@@ -116,7 +162,27 @@ func (s *UrlStore) DeleteOlderThan(beforeTs int64) error {
 	return err
 }
 
+func (s *UrlStore) IsOptedOut(origin string, entityIds []string) (bool, error) {
+	var count int64
+	err := s.statements.selectOptOutCount.QueryRowContext(s.ctx, origin, pq.Array(entityIds)).Scan(&count)
+	return count > 0, err
+}
+
+func (s *UrlStore) SetOptedOut(origin string, entityId string, optedOut bool) error {
+	var err error
+	if optedOut {
+		_, err = s.statements.insertOptOut.ExecContext(s.ctx, origin, entityId, util.NowMillis())
+	} else {
+		_, err = s.statements.deleteOptOut.ExecContext(s.ctx, origin, entityId)
+	}
+	return err
+}
+
 func GetBucketTs(ts int64) int64 {
-	// 1 hour buckets
-	return (ts / 3600000) * 3600000
+	bucketMinutes := int64(config.Get().UrlPreviews.CacheBucketMinutes)
+	if bucketMinutes <= 0 {
+		bucketMinutes = 60 // 1 hour buckets by default
+	}
+	bucketMs := bucketMinutes * 60 * 1000
+	return (ts / bucketMs) * bucketMs
 }
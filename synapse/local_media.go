@@ -1,5 +1,9 @@
 package synapse
 
+import (
+	"path"
+)
+
 type LocalMedia struct {
 	MediaId     string
 	ContentType string
@@ -9,3 +13,20 @@ type LocalMedia struct {
 	UserId      string
 	UrlCache    string
 }
+
+// FilePath returns where Synapse keeps the media's file, relative to its media_store_path. URL
+// preview downloads are kept apart from uploads. Returns an empty string for media IDs which
+// Synapse couldn't have stored.
+func (m *LocalMedia) FilePath() string {
+	if len(m.MediaId) < 5 {
+		return ""
+	}
+	if m.UrlCache != "" {
+		// Newer media IDs are prefixed with the date, which Synapse uses as the directory
+		if len(m.MediaId) > 11 && m.MediaId[10] == '_' {
+			return path.Join("url_cache", m.MediaId[:10], m.MediaId[11:])
+		}
+		return path.Join("url_cache", m.MediaId[0:2], m.MediaId[2:4], m.MediaId[4:])
+	}
+	return path.Join("local_content", m.MediaId[0:2], m.MediaId[2:4], m.MediaId[4:])
+}
@@ -2,12 +2,28 @@ package tasks
 
 func StartAll() {
 	StartRemoteMediaPurgeRecurring()
+	StartExpiredMediaPurgeRecurring()
 	StartThumbnailPurgeRecurring()
 	StartPreviewsPurgeRecurring()
+	StartExportsPurgeRecurring()
+	StartPurgeSchedulesRecurring()
+	StartStorageTieringRecurring()
+	StartIntegrityScrubRecurring()
+	StartDatastoreHealthRecurring()
+	StartWriteBehindRecurring()
+	StartTempCleanupRecurring()
 }
 
 func StopAll() {
 	StopRemoteMediaPurgeRecurring()
+	StopExpiredMediaPurgeRecurring()
 	StopThumbnailPurgeRecurring()
 	StopPreviewsPurgeRecurring()
+	StopExportsPurgeRecurring()
+	StopPurgeSchedulesRecurring()
+	StopStorageTieringRecurring()
+	StopIntegrityScrubRecurring()
+	StopDatastoreHealthRecurring()
+	StopWriteBehindRecurring()
+	StopTempCleanupRecurring()
 }
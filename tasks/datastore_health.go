@@ -0,0 +1,47 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+var datastoreHealthDone chan bool
+
+func StartDatastoreHealthRecurring() {
+	interval := time.Duration(config.Get().DatastoreHealth.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 1 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	datastoreHealthDone = make(chan bool)
+
+	go func() {
+		defer close(datastoreHealthDone)
+		for {
+			select {
+			case <-datastoreHealthDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if !config.Get().DatastoreHealth.Enabled {
+					continue
+				}
+
+				doRecurringDatastoreHealthCheck()
+			}
+		}
+	}()
+}
+
+func StopDatastoreHealthRecurring() {
+	datastoreHealthDone <- true
+}
+
+func doRecurringDatastoreHealthCheck() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_datastore_health"})
+	datastore.CheckAllDatastoreHealth(ctx)
+}
@@ -0,0 +1,69 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+var integrityScrubDone chan bool
+
+// The last scrub's task, so a slow scrub isn't joined by another
+var integrityScrubTaskId = 0
+
+func StartIntegrityScrubRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	integrityScrubDone = make(chan bool)
+
+	go func() {
+		defer close(integrityScrubDone)
+		for {
+			select {
+			case <-integrityScrubDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if !config.Get().IntegrityScrub.Enabled || config.Get().IntegrityScrub.FilesPerRun <= 0 {
+					continue
+				}
+
+				doRecurringIntegrityScrub()
+			}
+		}
+	}()
+}
+
+func StopIntegrityScrubRecurring() {
+	integrityScrubDone <- true
+}
+
+func doRecurringIntegrityScrub() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_integrity_scrub"})
+	ctx.Log.Info("Starting integrity scrub task")
+
+	if integrityScrubTaskId > 0 {
+		task, err := storage.GetDatabase().GetMetadataStore(ctx).GetBackgroundTask(integrityScrubTaskId)
+		if err == nil && task.EndTs <= 0 {
+			ctx.Log.Info("The last integrity scrub is still running - skipping")
+			return
+		}
+	}
+
+	conf := config.Get().IntegrityScrub
+	task, err := maintenance_controller.StartIntegrityScrub(conf.FilesPerRun, conf.QuarantineCorrupted, ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
+	integrityScrubTaskId = task.ID
+
+	ctx.Log.Infof("Integrity scrub is running as task %d", task.ID)
+}
@@ -0,0 +1,48 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+)
+
+var expiredMediaPurgeDone chan bool
+
+func StartExpiredMediaPurgeRecurring() {
+	ticker := time.NewTicker(5 * time.Minute)
+	expiredMediaPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(expiredMediaPurgeDone)
+		for {
+			select {
+			case <-expiredMediaPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringExpiredMediaPurge()
+			}
+		}
+	}()
+}
+
+func StopExpiredMediaPurgeRecurring() {
+	expiredMediaPurgeDone <- true
+}
+
+func doRecurringExpiredMediaPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_expired_media"})
+
+	purged, reclaimed, err := maintenance_controller.PurgeExpiredMedia(ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
+	if len(purged) > 0 {
+		ctx.Log.Infof("Purged %d expired media, freeing %d bytes", len(purged), reclaimed.Total())
+	}
+}
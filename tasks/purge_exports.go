@@ -0,0 +1,50 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/data_controller"
+)
+
+var exportsPurgeDone chan bool
+
+func StartExportsPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	exportsPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(exportsPurgeDone)
+		for {
+			select {
+			case <-exportsPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringExportsPurge()
+			}
+		}
+	}()
+}
+
+func StopExportsPurgeRecurring() {
+	exportsPurgeDone <- true
+}
+
+func doRecurringExportsPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_exports"})
+	ctx.Log.Info("Starting export purge task")
+
+	// The expiry is stored with each export when it is created, so changing the config doesn't
+	// affect exports which already exist.
+	deleted, err := data_controller.PurgeExpiredExports(ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+	}
+	ctx.Log.Infof("Purge task completed: %d expired exports deleted", deleted)
+}
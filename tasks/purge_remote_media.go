@@ -48,7 +48,7 @@ func doRecurringRemoteMediaPurge() {
 	// We get media that is N days old to make sure it gets cleared safely.
 	beforeTs := util.NowMillis() - int64(config.Get().Downloads.ExpireDays*24*60*60*1000)
 
-	_, err := maintenance_controller.PurgeRemoteMediaBefore(beforeTs, ctx)
+	_, _, err := maintenance_controller.PurgeRemoteMediaBefore(beforeTs, nil, ctx)
 	if err != nil {
 		ctx.Log.Error(err)
 		sentry.CaptureException(err)
@@ -0,0 +1,34 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+)
+
+var purgeSchedulesDone chan bool
+
+func StartPurgeSchedulesRecurring() {
+	ticker := time.NewTicker(1 * time.Minute)
+	purgeSchedulesDone = make(chan bool)
+
+	go func() {
+		defer close(purgeSchedulesDone)
+		for {
+			select {
+			case <-purgeSchedulesDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "purge_schedules"})
+				maintenance_controller.RunDuePurgeSchedules(ctx)
+			}
+		}
+	}()
+}
+
+func StopPurgeSchedulesRecurring() {
+	purgeSchedulesDone <- true
+}
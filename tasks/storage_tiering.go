@@ -0,0 +1,95 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var storageTieringDone chan bool
+
+func StartStorageTieringRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	storageTieringDone = make(chan bool)
+
+	go func() {
+		defer close(storageTieringDone)
+		for {
+			select {
+			case <-storageTieringDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if !config.Get().StorageTiering.Enabled || config.Get().StorageTiering.MoveAfterDays <= 0 {
+					continue
+				}
+
+				doRecurringStorageTiering()
+			}
+		}
+	}()
+}
+
+func StopStorageTieringRecurring() {
+	storageTieringDone <- true
+}
+
+func doRecurringStorageTiering() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_storage_tiering"})
+	ctx.Log.Info("Starting storage tiering task")
+
+	var coldDs *datastore.DatastoreRef
+	hotDatastores := make([]*datastore.DatastoreRef, 0)
+	for _, dsConf := range config.UniqueDatastores() {
+		if !dsConf.Enabled || (dsConf.Tier != common.TierHot && dsConf.Tier != common.TierCold) {
+			continue
+		}
+
+		ds, err := storage.GetDatabase().GetMediaStore(ctx).GetDatastoreByUri(datastore.GetUriForDatastore(dsConf))
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			continue
+		}
+		ref, err := datastore.LocateDatastore(ctx, ds.DatastoreId)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		if dsConf.Tier == common.TierHot {
+			hotDatastores = append(hotDatastores, ref)
+		} else if coldDs == nil && !ref.IsReadOnly(ctx) {
+			coldDs = ref
+		}
+	}
+
+	if coldDs == nil {
+		ctx.Log.Warn("No writable cold datastore is configured - skipping storage tiering")
+		return
+	}
+
+	// We move media which hasn't been accessed in N days
+	beforeTs := util.NowMillis() - int64(config.Get().StorageTiering.MoveAfterDays*24*60*60*1000)
+
+	for _, hotDs := range hotDatastores {
+		ctx.Log.Infof("Moving media from %s to %s", hotDs.DatastoreId, coldDs.DatastoreId)
+		err := maintenance_controller.RunStorageTiering(hotDs, coldDs, beforeTs, ctx)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+		}
+	}
+	ctx.Log.Info("Storage tiering task completed")
+}
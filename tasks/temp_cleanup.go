@@ -0,0 +1,62 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
+)
+
+var tempCleanupDone chan bool
+
+func StartTempCleanupRecurring() {
+	interval := time.Duration(config.Get().Temp.CleanupIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = 30 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	tempCleanupDone = make(chan bool)
+
+	go func() {
+		defer close(tempCleanupDone)
+		for {
+			select {
+			case <-tempCleanupDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringTempCleanup()
+			}
+		}
+	}()
+}
+
+func StopTempCleanupRecurring() {
+	tempCleanupDone <- true
+}
+
+func doRecurringTempCleanup() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_temp_cleanup"})
+	removed := scratch.CleanupStale(ctx.Log)
+	if removed > 0 {
+		ctx.Log.Infof("Removed %d stale temporary files", removed)
+	}
+
+	// Files uploaded straight to a datastore are just as temporary until the upload is completed
+	upload_controller.ExpireDirectUploads(ctx)
+
+	// Media IDs handed out for async uploads are freed up if nothing was uploaded to them
+	upload_controller.ExpirePendingUploads(ctx)
+
+	// Chunks of resumable uploads which were abandoned part way through
+	upload_controller.ExpireResumableUploads(ctx)
+
+	// Files written for uploads which were interrupted before becoming media
+	upload_controller.ReconcileStagedUploads(ctx)
+
+	// Records of who uploaded media are only kept for as long as the config allows
+	upload_controller.ExpireUploadAttribution(ctx)
+}
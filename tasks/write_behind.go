@@ -0,0 +1,45 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+var writeBehindDone chan bool
+
+func StartWriteBehindRecurring() {
+	interval := time.Duration(config.Get().WriteBehind.RetryIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	writeBehindDone = make(chan bool)
+
+	go func() {
+		defer close(writeBehindDone)
+		for {
+			select {
+			case <-writeBehindDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				// Always run, even if no datastores use write-behind any more: objects staged before
+				// the config changed still need writing.
+				doRecurringWriteBehind()
+			}
+		}
+	}()
+}
+
+func StopWriteBehindRecurring() {
+	writeBehindDone <- true
+}
+
+func doRecurringWriteBehind() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_write_behind"})
+	datastore.ProcessWriteBehindQueue(ctx)
+}
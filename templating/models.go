@@ -9,9 +9,10 @@ type ViewExportPartModel struct {
 }
 
 type ViewExportModel struct {
-	ExportID    string
-	Entity      string
-	ExportParts []*ViewExportPartModel
+	ExportID     string
+	Entity       string
+	ExpiresHuman string
+	ExportParts  []*ViewExportPartModel
 }
 
 type ExportIndexMediaModel struct {
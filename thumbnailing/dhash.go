@@ -0,0 +1,55 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// DifferenceHash calculates the dHash of an image: a 64 bit perceptual hash which barely changes when the
+// image is resized, recompressed, or slightly edited. The hash is returned hex encoded. Returns
+// ErrUnsupported if the image can't be decoded, and common.ErrMediaTooLarge without decoding the image
+// if it has more than maxPixels pixels.
+func DifferenceHash(b []byte, maxPixels int) (string, error) {
+	err := checkDecodeSize(b, maxPixels)
+	if err != nil {
+		return "", err
+	}
+	img, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		return "", ErrUnsupported
+	}
+
+	// Each bit is whether a pixel is brighter than the one to its right, in a 9x8 greyscale copy
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Lanczos))
+	hash := uint64(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+// HashDistance returns the number of bits which differ between two hex encoded dHashes, or -1 if either
+// can't be parsed.
+func HashDistance(a string, b string) int {
+	aHash, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return -1
+	}
+	bHash, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return -1
+	}
+	return bits.OnesCount64(aHash ^ bHash)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/scratch"
 )
 
 type svgGenerator struct {
@@ -38,8 +39,13 @@ func (d svgGenerator) GenerateThumbnail(b []byte, contentType string, width int,
 		return nil, errors.New("svg: error generating temp key: " + err.Error())
 	}
 
-	tempFile1 := path.Join(os.TempDir(), "media_repo."+key+".1.svg")
-	tempFile2 := path.Join(os.TempDir(), "media_repo."+key+".2.png")
+	tempDir, err := scratch.Dir("thumbnails")
+	if err != nil {
+		return nil, errors.New("svg: error preparing temp directory: " + err.Error())
+	}
+
+	tempFile1 := path.Join(tempDir, "media_repo."+key+".1.svg")
+	tempFile2 := path.Join(tempDir, "media_repo."+key+".2.png")
 
 	defer os.Remove(tempFile1)
 	defer os.Remove(tempFile2)
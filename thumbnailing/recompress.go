@@ -0,0 +1,75 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// RecompressImage re-encodes a still JPEG or PNG image in the same format, shrinking it to fit within
+// the given width and height if it is larger. Limits of zero or less are not applied. The re-encoded
+// image has no metadata, so JPEGs are rotated according to their EXIF orientation first. Returns
+// ErrUnsupported for other types of images, and common.ErrMediaTooLarge without decoding the image
+// if it has more than maxPixels pixels.
+func RecompressImage(b []byte, contentType string, maxWidth int, maxHeight int, maxPixels int, jpegQuality int) ([]byte, error) {
+	var format imaging.Format
+	switch contentType {
+	case "image/jpeg", "image/jpg":
+		format = imaging.JPEG
+	case "image/png":
+		if util.IsAnimatedPNG(b) {
+			return nil, ErrUnsupported
+		}
+		format = imaging.PNG
+	default:
+		return nil, ErrUnsupported
+	}
+
+	err := checkDecodeSize(b, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+	if ExceedsDimensions(width, height, maxWidth, maxHeight) {
+		if maxWidth > 0 {
+			width = maxWidth
+		}
+		if maxHeight > 0 {
+			height = maxHeight
+		}
+		img = imaging.Fit(img, width, height, imaging.Lanczos)
+	}
+
+	out := &bytes.Buffer{}
+	err = imaging.Encode(out, img, format, imaging.JPEGQuality(jpegQuality))
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// checkDecodeSize returns common.ErrMediaTooLarge if the image has more than maxPixels pixels, reading
+// only its header. Decoding the whole image would take memory in proportion to its pixel count rather
+// than its file size. A limit of zero or less is not applied.
+func checkDecodeSize(b []byte, maxPixels int) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+	conf, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return ErrUnsupported
+	}
+	if conf.Width*conf.Height > maxPixels {
+		return common.ErrMediaTooLarge
+	}
+	return nil
+}
@@ -50,10 +50,29 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 	if dimensional && (w * h) >= ctx.Config.Thumbnails.MaxPixels {
 		return nil, common.ErrMediaTooLarge
 	}
+	if dimensional && ExceedsDimensions(w, h, ctx.Config.Thumbnails.MaxWidth, ctx.Config.Thumbnails.MaxHeight) {
+		return nil, common.ErrMediaTooLarge
+	}
 
 	return generator.GenerateThumbnail(b, contentType, width, height, method, animated, ctx)
 }
 
+// GetImageDimensions returns the width and height of an image without decoding the whole thing. The
+// returned bool is false if the content type isn't an image type the thumbnailer supports.
+func GetImageDimensions(b []byte, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
+	generator := i.GetGenerator(b, contentType, false)
+	if generator == nil {
+		return false, 0, 0, nil
+	}
+	return generator.GetOriginDimensions(b, contentType, ctx)
+}
+
+// ExceedsDimensions returns true if the width or height is over its limit. Limits of zero or less are
+// not applied.
+func ExceedsDimensions(width int, height int, maxWidth int, maxHeight int) bool {
+	return (maxWidth > 0 && width > maxWidth) || (maxHeight > 0 && height > maxHeight)
+}
+
 func GetGenerator(imgStream io.ReadCloser, contentType string, animated bool) (i.Generator, error) {
 	defer cleanup.DumpAndCloseStream(imgStream)
 	b, err := ioutil.ReadAll(imgStream)
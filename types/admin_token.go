@@ -0,0 +1,12 @@
+package types
+
+// AdminToken is a token issued by the repo which grants a limited set of admin permissions (its
+// scopes) without needing a homeserver account. Only a hash of the token is kept.
+type AdminToken struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	TokenHash string   `json:"-"`
+	Scopes    []string `json:"scopes"`
+	CreatedBy string   `json:"created_by"`
+	CreatedTs int64    `json:"created_ts"`
+}
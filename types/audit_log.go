@@ -0,0 +1,11 @@
+package types
+
+type AuditLogEntry struct {
+	ID           int64
+	Ts           int64
+	UserId       string
+	Host         string
+	Action       string
+	Params       map[string]interface{}
+	AffectedMxcs []string
+}
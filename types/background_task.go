@@ -1,9 +1,11 @@
 package types
 
 type BackgroundTask struct {
-	ID      int
-	Name    string
-	Params  map[string]interface{}
-	StartTs int64
-	EndTs   int64
+	ID        int
+	Name      string
+	Params    map[string]interface{}
+	StartTs   int64
+	EndTs     int64
+	Progress  map[string]interface{}
+	Cancelled bool
 }
@@ -16,3 +16,14 @@ type DatastoreMigrationEstimate struct {
 	TotalHashesAffected     int64 `json:"total_hashes_affected"`
 	TotalBytes              int64 `json:"total_bytes"`
 }
+
+// DatastoreUsage describes the objects in a datastore. Exports don't record when they were written,
+// so they don't count towards growth.
+type DatastoreUsage struct {
+	Objects         int64 `json:"objects"`
+	Bytes           int64 `json:"bytes"`
+	ObjectsLastDay  int64 `json:"objects_last_24h"`
+	BytesLastDay    int64 `json:"bytes_last_24h"`
+	ObjectsLastWeek int64 `json:"objects_last_7d"`
+	BytesLastWeek   int64 `json:"bytes_last_7d"`
+}
@@ -0,0 +1,95 @@
+package types
+
+// ObjectListing is an object found while listing the contents of a datastore.
+type ObjectListing struct {
+	Location       string
+	SizeBytes      int64
+	LastModifiedTs int64
+}
+
+// ObjectReference is a database record which points at an object in a datastore.
+type ObjectReference struct {
+	Kind     string
+	Id       string
+	Location string
+}
+
+// ObjectReplica is a copy of an object which was written to another datastore.
+type ObjectReplica struct {
+	DatastoreId        string
+	Location           string
+	ReplicaDatastoreId string
+	ReplicaLocation    string
+}
+
+// WriteBehindEntry is an object which was staged locally and is waiting to be written to its datastore.
+type WriteBehindEntry struct {
+	DatastoreId   string
+	Location      string
+	Attempts      int
+	NextAttemptTs int64
+	LastError     string
+	CreationTs    int64
+}
+
+// DirectUpload is a file a client has been given permission to upload straight to a datastore, which
+// becomes media once the client says the upload is complete.
+type DirectUpload struct {
+	UploadId    string
+	Origin      string
+	UserId      string
+	DatastoreId string
+	Location    string
+	ContentType string
+	UploadName  string
+	ExpiresTs   int64
+
+	// SizeBytes is the size the client said the file would be. Zero for uploads started before the
+	// size was recorded.
+	SizeBytes int64
+}
+
+// PendingUpload is a media ID which was handed out before its contents were uploaded. Downloads of the
+// media wait for the contents until the upload happens or the ID expires.
+type PendingUpload struct {
+	Origin     string
+	MediaId    string
+	UserId     string
+	CreationTs int64
+	ExpiresTs  int64
+}
+
+// ResumableUpload is a file being uploaded in chunks over several requests, which becomes media once
+// all SizeBytes have been received.
+type ResumableUpload struct {
+	UploadId    string
+	Origin      string
+	MediaId     string
+	UserId      string
+	DatastoreId string
+	ContentType string
+	UploadName  string
+	SizeBytes   int64
+	OffsetBytes int64
+	ExpiresTs   int64
+}
+
+// ResumableUploadChunk is part of a resumable upload, stored as its own object until the upload is
+// finished.
+type ResumableUploadChunk struct {
+	UploadId    string
+	OffsetBytes int64
+	SizeBytes   int64
+	DatastoreId string
+	Location    string
+}
+
+// StagedUpload is a file written to a datastore for an upload which hasn't been committed as media yet.
+// Staged uploads left behind by a crash are cleaned up or completed on startup.
+type StagedUpload struct {
+	DatastoreId string
+	Location    string
+	Origin      string
+	MediaId     string
+	CreationTs  int64
+}
@@ -1,8 +1,9 @@
 package types
 
 type ExportMetadata struct {
-	ExportID string
-	Entity   string
+	ExportID  string
+	Entity    string
+	ExpiresTs int64
 }
 
 type ExportPart struct {
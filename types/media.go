@@ -14,6 +14,24 @@ type Media struct {
 	Location    string
 	CreationTs  int64
 	Quarantined bool
+
+	// StoredSizeBytes is the size of the media's object in its datastore, which may be smaller than
+	// SizeBytes if it was compressed.
+	StoredSizeBytes int64
+
+	// DetectedContentType is the content type found by looking at the media's contents, which may not
+	// match the ContentType given by the uploader. Empty if the type couldn't be detected.
+	DetectedContentType string
+
+	// Compressed is whether the media's object was compressed when it was stored in its datastore.
+	Compressed bool
+}
+
+// QuarantinedMedia is quarantined media along with when it was quarantined. The QuarantinedTs is
+// zero for media which was quarantined before the time was recorded.
+type QuarantinedMedia struct {
+	*Media
+	QuarantinedTs int64
 }
 
 type MinimalMedia struct {
@@ -35,6 +53,34 @@ type MinimalMediaMetadata struct {
 	DatastoreId  string
 }
 
+// QuarantinedOrigin is a remote server which no new media is downloaded from.
+type QuarantinedOrigin struct {
+	Origin        string `json:"origin"`
+	QuarantinedBy string `json:"quarantined_by"`
+	QuarantinedTs int64  `json:"quarantined_ts"`
+}
+
 func (m *Media) MxcUri() string {
 	return "mxc://" + m.Origin + "/" + m.MediaId
 }
+
+// EffectiveContentType returns the detected content type if useDetected is true and one was detected,
+// or the content type the media was uploaded with otherwise.
+func (m *Media) EffectiveContentType(useDetected bool) string {
+	if useDetected && m.DetectedContentType != "" {
+		return m.DetectedContentType
+	}
+	return m.ContentType
+}
+
+// MediaSearchFilter narrows down a media search. Empty strings and nil values are not filtered on.
+type MediaSearchFilter struct {
+	Origin       string
+	UserId       string
+	ContentType  string
+	MinSizeBytes *int64
+	MaxSizeBytes *int64
+	AfterTs      *int64
+	BeforeTs     *int64
+	Quarantined  *bool
+}
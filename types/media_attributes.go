@@ -1,9 +1,21 @@
 package types
 
 type MediaAttributes struct {
-	Origin  string
-	MediaId string
-	Purpose string
+	Origin    string
+	MediaId   string
+	Purpose   string
+	Protected bool
+
+	// ExpiresTs is when the media is purged, or zero if it doesn't expire.
+	ExpiresTs int64
+
+	// OriginalSizeBytes is the size of the upload before it was recompressed, or zero if it wasn't.
+	OriginalSizeBytes int64
+
+	// RestrictedRoomId and RestrictedEventId are the room (and optionally event in it) the requester
+	// must be able to see to download the media. Both are empty if the media isn't restricted.
+	RestrictedRoomId  string
+	RestrictedEventId string
 }
 
 const PurposeNone = "none"
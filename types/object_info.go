@@ -4,4 +4,11 @@ type ObjectInfo struct {
 	Location   string
 	Sha256Hash string
 	SizeBytes  int64
+
+	// StoredSizeBytes is the size of the object in the datastore, which may differ from SizeBytes when
+	// the content was compressed or encrypted.
+	StoredSizeBytes int64
+
+	// Compressed is whether the object was compressed before it was stored.
+	Compressed bool
 }
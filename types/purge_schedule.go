@@ -0,0 +1,24 @@
+package types
+
+type PurgeSchedule struct {
+	ID            int64
+	Kind          string
+	Target        string
+	IncludeLocal  bool
+	OlderThanDays int
+	TimeOfDay     string
+	IntervalDays  int
+	CreatedBy     string
+	CreatedTs     int64
+	NextRunTs     int64
+}
+
+type PurgeScheduleRun struct {
+	ID             int64
+	ScheduleID     int64
+	StartTs        int64
+	EndTs          int64
+	Purged         int
+	BytesReclaimed int64
+	Error          string
+}
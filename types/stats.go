@@ -4,3 +4,59 @@ type UserStats struct {
 	UserId        string
 	UploadedBytes int64
 }
+
+type UserStorageUsage struct {
+	UserId       string `json:"user_id"`
+	Bytes        int64  `json:"bytes"`
+	Media        int64  `json:"media"`
+	LastUploadTs int64  `json:"last_upload_ts"`
+}
+
+type OriginUsage struct {
+	Origin       string `json:"origin"`
+	Media        int64  `json:"media"`
+	Bytes        int64  `json:"bytes"`
+	LastAccessTs int64  `json:"last_access_ts"`
+}
+
+type UserQuota struct {
+	UserId    string `json:"user_id"`
+	MaxBytes  int64  `json:"max_bytes"`
+	MaxFiles  int64  `json:"max_files"`
+	UpdatedTs int64  `json:"updated_ts"`
+}
+
+// UserRateLimit replaces the configured rate limit for one user and action (upload, download, or
+// preview). A RequestsPerSecond of zero means the user isn't limited.
+type UserRateLimit struct {
+	UserId            string  `json:"user_id"`
+	Action            string  `json:"action"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	UpdatedTs         int64   `json:"updated_ts"`
+}
+
+// UploadBan is a user ID, or glob pattern of user IDs, which can't upload new media.
+type UploadBan struct {
+	Pattern  string `json:"pattern"`
+	BannedBy string `json:"banned_by"`
+	BannedTs int64  `json:"banned_ts"`
+}
+
+const HashTypeSha256 = "sha256"
+const HashTypeDHash = "dhash"
+
+const BlockActionReject = "reject"
+const BlockActionQuarantine = "quarantine"
+
+// BlockedHash is the hash of content which can't be stored. The hash is hex encoded, and is either the
+// SHA-256 hash of the file or a dHash (a perceptual hash which also matches resized or recompressed
+// copies of an image).
+type BlockedHash struct {
+	HashType string `json:"hash_type"`
+	Hash     string `json:"hash"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	AddedBy  string `json:"added_by"`
+	AddedTs  int64  `json:"added_ts"`
+}
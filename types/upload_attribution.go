@@ -0,0 +1,13 @@
+package types
+
+// UploadAttribution is where an upload came from, so abuse reports about the media can be traced back
+// to the session which uploaded it. TokenHash is the SHA-256 hash of the access token used, rather than
+// the token itself.
+type UploadAttribution struct {
+	Origin     string
+	MediaId    string
+	IpAddress  string
+	UserAgent  string
+	TokenHash  string
+	RecordedTs int64
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	limiter        *rate.Limiter
+}
+
+// Limiters are shared by everything using the same key, so that a cap holds no matter how many
+// streams are running at once.
+var bandwidthLimiters = make(map[string]*bandwidthLimiter)
+var bandwidthLock = &sync.Mutex{}
+
+// GetBandwidthLimiter returns the limiter shared by everything using the key, replacing it if the limit
+// was changed in the config. Returns nil if there is no limit.
+func GetBandwidthLimiter(key string, bytesPerSecond int64) *rate.Limiter {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+
+	if bytesPerSecond <= 0 {
+		delete(bandwidthLimiters, key)
+		return nil
+	}
+
+	if l, ok := bandwidthLimiters[key]; ok && l.bytesPerSecond == bytesPerSecond {
+		return l.limiter
+	}
+
+	// Allow up to a second's worth of bytes at once
+	l := rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+	bandwidthLimiters[key] = &bandwidthLimiter{bytesPerSecond: bytesPerSecond, limiter: l}
+	return l
+}
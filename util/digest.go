@@ -0,0 +1,81 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+// GetSha256Digest returns the SHA-256 hash of the body given in a Content-Digest (RFC 9530) or Digest
+// (RFC 3230) header. Returns nil if neither header has a SHA-256 hash, and an error if the hash can't
+// be parsed.
+func GetSha256Digest(header http.Header) ([]byte, error) {
+	if val, ok := findDigest(header.Get("Content-Digest")); ok {
+		// Structured field byte sequences are wrapped in colons
+		if len(val) < 2 || val[0] != ':' || val[len(val)-1] != ':' {
+			return nil, errors.New("invalid sha-256 value in Content-Digest")
+		}
+		return decodeSha256Digest(val[1 : len(val)-1])
+	}
+	if val, ok := findDigest(header.Get("Digest")); ok {
+		return decodeSha256Digest(val)
+	}
+	return nil, nil
+}
+
+func findDigest(headerVal string) (string, bool) {
+	for _, member := range strings.Split(headerVal, ",") {
+		parts := strings.SplitN(member, "=", 2)
+		if len(parts) == 2 && strings.ToLower(strings.TrimSpace(parts[0])) == "sha-256" {
+			return strings.TrimSpace(parts[1]), true
+		}
+	}
+	return "", false
+}
+
+func decodeSha256Digest(val string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sha256.Size {
+		return nil, errors.New("sha-256 digest has the wrong length")
+	}
+	return b, nil
+}
+
+type digestVerifyingReader struct {
+	r        io.ReadCloser
+	hasher   hash.Hash
+	expected []byte
+}
+
+// NewDigestVerifyingReader hashes the stream as it is read. Once the end of the stream is reached, reads
+// fail with common.ErrContentDigestMismatch if the stream's SHA-256 hash isn't the one expected.
+func NewDigestVerifyingReader(r io.ReadCloser, expectedSha256 []byte) io.ReadCloser {
+	return &digestVerifyingReader{
+		r:        r,
+		hasher:   sha256.New(),
+		expected: expectedSha256,
+	}
+}
+
+func (d *digestVerifyingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hasher.Write(p[:n])
+	if err == io.EOF && subtle.ConstantTimeCompare(d.hasher.Sum(nil), d.expected) != 1 {
+		return n, common.ErrContentDigestMismatch
+	}
+	return n, err
+}
+
+func (d *digestVerifyingReader) Close() error {
+	return d.r.Close()
+}
@@ -1,7 +1,7 @@
 package util
 
 import (
-	"io/ioutil"
+	"regexp"
 	"strings"
 	"unicode/utf8"
 
@@ -9,38 +9,67 @@ import (
 	"golang.org/x/net/html/charset"
 )
 
+// The HTML spec only looks at the first 1024 bytes for a declared charset, however plenty of
+// pages in the wild put it further down than that.
+const charsetPrescanBytes = 4096
+
+var metaCharsetRegex = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.\-]+)`)
+
 func ToUtf8(text string, possibleContentType string) string {
-	if utf8.ValidString(text) {
-		return text
-	}
+	raw := []byte(text)
 
-	textCharset := ""
+	// A byte order mark or a charset in the Content-Type header is authoritative
+	enc, _, certain := charset.DetermineEncoding(raw, possibleContentType)
+	if !certain {
+		enc = nil
 
-	if possibleContentType != "" {
-		_, name, ok := charset.DetermineEncoding([]byte(text), possibleContentType)
-		if ok {
-			textCharset = name
+		// Next best is the charset the document declares for itself
+		if declared := getDeclaredCharset(raw); declared != "" {
+			enc, _ = charset.Lookup(declared)
 		}
 	}
 
-	if textCharset == "" {
+	if enc == nil {
+		if utf8.Valid(raw) {
+			return text
+		}
+
+		// Nothing was declared, so try and guess what it might be
 		detector := chardet.NewTextDetector()
-		cs, err := detector.DetectBest([]byte(text))
+		cs, err := detector.DetectBest(raw)
 		if err != nil {
 			return text // best we can do
 		}
-		textCharset = cs.Charset
+		enc, _ = charset.Lookup(normalizeDetectedCharset(cs.Charset))
+		if enc == nil {
+			return text // best we can do
+		}
 	}
 
-	r, err := charset.NewReader(strings.NewReader(text), textCharset)
+	converted, err := enc.NewDecoder().Bytes(raw)
 	if err != nil {
 		return text // best we can do
 	}
 
-	converted, err := ioutil.ReadAll(r)
-	if err != nil {
-		return text // best we can do
+	return string(converted)
+}
+
+func getDeclaredCharset(raw []byte) string {
+	if len(raw) > charsetPrescanBytes {
+		raw = raw[:charsetPrescanBytes]
 	}
 
-	return string(converted)
+	matches := metaCharsetRegex.FindSubmatch(raw)
+	if len(matches) < 2 {
+		return ""
+	}
+	return string(matches[1])
+}
+
+func normalizeDetectedCharset(name string) string {
+	// chardet's name for GB18030 isn't in the WHATWG encoding list
+	if strings.EqualFold(name, "GB-18030") {
+		return "gb18030"
+	}
+	return name
 }
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SanitizeFilename cleans up a filename given by an uploader (or remote server) so it is safe to put in
+// headers and show to users. Control characters and characters which change the direction of text
+// (which can make "exe.png" display as "gnp.exe") are removed, path separators and quotes are replaced,
+// and the name is normalized and shortened according to the policy. The extension is kept when the
+// name is shortened.
+func SanitizeFilename(filename string, policy config.FilenamesConfig) string {
+	if !policy.Enabled || filename == "" {
+		return filename
+	}
+
+	switch strings.ToLower(policy.Normalization) {
+	case "nfc":
+		filename = norm.NFC.String(filename)
+	case "nfkc":
+		filename = norm.NFKC.String(filename)
+	}
+
+	filename = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		if r == '/' || r == '\\' || r == '"' {
+			return '_'
+		}
+		if policy.AsciiOnly && r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+
+	if policy.MaxLength > 0 && utf8.RuneCountInString(filename) > policy.MaxLength {
+		ext := filepath.Ext(filename)
+		if utf8.RuneCountInString(ext) >= policy.MaxLength {
+			ext = ""
+		}
+		name := []rune(strings.TrimSuffix(filename, ext))
+		filename = strings.TrimSpace(string(name[:policy.MaxLength-utf8.RuneCountInString(ext)])) + ext
+	}
+
+	return filename
+}
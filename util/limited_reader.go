@@ -0,0 +1,38 @@
+package util
+
+import (
+	"io"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+type hardLimitedReader struct {
+	r         io.ReadCloser
+	remaining int64
+}
+
+// NewHardLimitedReader fails reads with common.ErrMediaTooLarge once more than maxBytes have been read.
+// Unlike io.LimitReader, the stream isn't silently cut short, and every read after the limit fails
+// straight away so callers draining the stream stop too.
+func NewHardLimitedReader(r io.ReadCloser, maxBytes int64) io.ReadCloser {
+	return &hardLimitedReader{r: r, remaining: maxBytes}
+}
+
+func (l *hardLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, common.ErrMediaTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, common.ErrMediaTooLarge
+	}
+	return n, err
+}
+
+func (l *hardLimitedReader) Close() error {
+	return l.r.Close()
+}
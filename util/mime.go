@@ -2,8 +2,20 @@ package util
 
 import (
 	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
 )
 
 func FixContentType(ct string) string {
 	return strings.Split(ct, ";")[0]
 }
+
+// DetectContentType returns the content type of a file based on its contents, without parameters such
+// as the charset. Returns an empty string if the type couldn't be detected.
+func DetectContentType(b []byte) string {
+	ct := FixContentType(mimetype.Detect(b).String())
+	if ct == "application/octet-stream" {
+		return ""
+	}
+	return ct
+}
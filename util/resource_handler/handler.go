@@ -1,7 +1,9 @@
 package resource_handler
 
 import (
+	"errors"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jeffail/tunny"
@@ -10,10 +12,31 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var ErrQueueFull = errors.New("resource handler queue is full")
+var ErrQueueTimeout = errors.New("timed out waiting for resource handler")
+
 type ResourceHandler struct {
-	pool      *tunny.Pool
-	eventBus  *emitter.Emitter
-	itemCache *cache.Cache
+	pool         *tunny.Pool
+	eventBus     *emitter.Emitter
+	itemCache    *cache.Cache
+	maxQueueSize int
+	queueTimeout time.Duration
+	queued       int64 // accessed atomically
+}
+
+// The states of a queuedRequest
+const (
+	requestQueued int32 = iota
+	requestStarted
+	requestAbandoned
+)
+
+// queuedRequest is a WorkRequest waiting for a worker. Whichever of the worker picking it up or the
+// caller giving up on waiting happens first decides whether the work is done.
+type queuedRequest struct {
+	request *WorkRequest
+	state   int32 // accessed atomically
+	started chan bool
 }
 
 type resource struct {
@@ -27,13 +50,35 @@ type WorkRequest struct {
 }
 
 func New(workers int, fetchFn func(object *WorkRequest) interface{}) (*ResourceHandler, error) {
-	workFn := func(i interface{}) interface{} { return fetchFn(i.(*WorkRequest)) }
-	pool := tunny.NewFunc(workers, workFn)
+	handler := &ResourceHandler{
+		eventBus:  &emitter.Emitter{},
+		itemCache: cache.New(30*time.Second, 1*time.Minute), // cache work for 30ish seconds
+	}
+	handler.pool = tunny.NewFunc(workers, func(i interface{}) interface{} {
+		queued := i.(*queuedRequest)
+		if !atomic.CompareAndSwapInt32(&queued.state, requestQueued, requestStarted) {
+			// The caller stopped waiting before a worker was free
+			return ErrQueueTimeout
+		}
+		atomic.AddInt64(&handler.queued, -1)
+		close(queued.started)
+		return fetchFn(queued.request)
+	})
+	return handler, nil
+}
 
-	bus := &emitter.Emitter{}
-	itemCache := cache.New(30*time.Second, 1*time.Minute) // cache work for 30ish seconds
+// NewWithQueueLimits is like New, but rejects work when maxQueueSize requests are already waiting
+// for a worker, and gives up on requests which wait longer than queueTimeout for a worker. Once a
+// worker has started on a request, it is waited for however long it takes. The resource's result
+// will be ErrQueueFull or ErrQueueTimeout respectively. A zero value disables the associated limit.
+func NewWithQueueLimits(workers int, maxQueueSize int, queueTimeout time.Duration, fetchFn func(object *WorkRequest) interface{}) (*ResourceHandler, error) {
+	handler, err := New(workers, fetchFn)
+	if err != nil {
+		return nil, err
+	}
 
-	handler := &ResourceHandler{pool, bus, itemCache}
+	handler.maxQueueSize = maxQueueSize
+	handler.queueTimeout = queueTimeout
 	return handler, nil
 }
 
@@ -73,10 +118,16 @@ func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan inte
 	h.itemCache.Set(id, &resource{false, nil}, cache.NoExpiration)
 
 	go func() {
-		// Queue the work (ignore errors)
-		result := h.pool.Process(&WorkRequest{id, metadata})
+		result := h.process(&WorkRequest{id, metadata})
 		h.eventBus.Emit("complete_"+id, result)
 
+		if result == ErrQueueFull || result == ErrQueueTimeout {
+			// Don't cache the failure: the next caller should get a chance to try again
+			h.itemCache.Delete(id)
+			resultChan <- result
+			return
+		}
+
 		// Cache the result for future callers
 		newResource := &resource{
 			isComplete: true,
@@ -90,3 +141,34 @@ func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan inte
 
 	return resultChan
 }
+
+func (h *ResourceHandler) process(request *WorkRequest) interface{} {
+	queuedNow := atomic.AddInt64(&h.queued, 1)
+	if h.maxQueueSize > 0 && queuedNow > int64(h.maxQueueSize) {
+		atomic.AddInt64(&h.queued, -1)
+		logrus.Warn("Resource handler queue is full - rejecting resource ID " + request.Id)
+		return ErrQueueFull
+	}
+
+	queued := &queuedRequest{request: request, state: requestQueued, started: make(chan bool)}
+	resultChan := make(chan interface{}, 1)
+	go func() {
+		resultChan <- h.pool.Process(queued)
+	}()
+
+	if h.queueTimeout > 0 {
+		select {
+		case <-queued.started:
+		case <-time.After(h.queueTimeout):
+			if atomic.CompareAndSwapInt32(&queued.state, requestQueued, requestAbandoned) {
+				// The worker which eventually picks this up will skip it
+				atomic.AddInt64(&h.queued, -1)
+				logrus.Warn("Timed out waiting for a worker for resource ID " + request.Id)
+				return ErrQueueTimeout
+			}
+			// A worker picked it up just in time
+		}
+	}
+
+	return <-resultChan
+}
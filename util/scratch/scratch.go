@@ -0,0 +1,108 @@
+package scratch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// Prefix of the temporary files written by the s3, azure, and webdav datastores to their tempPath. It
+// is specific enough not to match files written by anything else sharing the directory.
+const datastoreTempPrefix = "matrix-media-repo-datastore-"
+
+// DatastoreTempPattern is the ioutil.TempFile pattern for temporary files in a datastore's tempPath.
+// Only files matching it are cleaned up from there.
+const DatastoreTempPattern = datastoreTempPrefix + "*"
+
+// BasePath returns the directory the media repo keeps its temporary files in. Everything in it can
+// be deleted once it is stale.
+func BasePath() string {
+	if config.Get().Temp.Path != "" {
+		return config.Get().Temp.Path
+	}
+	return path.Join(os.TempDir(), "matrix-media-repo")
+}
+
+// Dir returns the directory for temporary files written by the given part of the media repo (such
+// as "thumbnails"), creating it if needed.
+func Dir(pipeline string) (string, error) {
+	dir := path.Join(BasePath(), pipeline)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// CreateFile creates a new temporary file for the given part of the media repo, like ioutil.TempFile.
+// The caller is responsible for removing the file.
+func CreateFile(pipeline string, pattern string) (*os.File, error) {
+	dir, err := Dir(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, pattern)
+}
+
+// CleanupStale deletes temporary files which haven't been modified in the configured amount of
+// time, such as those left behind by a crash. This covers the media repo's own temporary directory
+// and the tempPath of each datastore, returning the number of files deleted.
+func CleanupStale(log *logrus.Entry) int {
+	maxAge := time.Duration(config.Get().Temp.StaleAfterMinutes) * time.Minute
+	if maxAge <= 0 {
+		return 0
+	}
+	cutoff := time.Now().Add(-maxAge)
+
+	removed := removeOlderThan(BasePath(), cutoff, true, log)
+	for _, dsConf := range config.UniqueDatastores() {
+		if tempPath := dsConf.Options["tempPath"]; tempPath != "" {
+			removed += removeOlderThan(tempPath, cutoff, false, log)
+		}
+	}
+	return removed
+}
+
+// removeOlderThan deletes files last modified before the cutoff. Only files the datastores would
+// have written are deleted from datastore temp paths, as they may be shared with other programs.
+func removeOlderThan(dir string, cutoff time.Time, everything bool, log *logrus.Entry) int {
+	removed := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if p != dir && !everything {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !everything && !strings.HasPrefix(info.Name(), datastoreTempPrefix) {
+			return nil
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		err = os.Remove(p)
+		if err != nil {
+			log.Warn("Error removing stale temporary file ", p, ": ", err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		log.Warn("Error cleaning up temporary files in ", dir, ": ", err)
+	}
+	return removed
+}
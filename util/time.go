@@ -9,3 +9,7 @@ func NowMillis() int64 {
 func FromMillis(m int64) time.Time {
 	return time.Unix(0, m*int64(time.Millisecond))
 }
+
+func TimeToMillis(t time.Time) int64 {
+	return t.UnixNano() / 1000000
+}
@@ -0,0 +1,237 @@
+package util_encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted objects are a header followed by a series of AES-GCM sealed chunks. Each chunk's nonce is
+// the header's random prefix, the chunk counter, and a flag for the final chunk, which stops chunks
+// from being reordered, dropped, or the object being truncated on a chunk boundary.
+// See https://eprint.iacr.org/2015/189.pdf (the STREAM construction)
+
+const chunkSize = 64 * 1024
+const noncePrefixSize = 7
+
+var magic = []byte("MMRENC\x00\x01")
+
+var ErrInvalidKey = errors.New("encryption key must be 32 bytes")
+var ErrCorrupted = errors.New("encrypted object is corrupted or was encrypted with a different key")
+
+func headerSize() int64 {
+	return int64(len(magic) + noncePrefixSize)
+}
+
+// EncryptedSize returns the size of the encrypted object for plaintext of the given size.
+func EncryptedSize(plainSize int64) int64 {
+	chunks := (plainSize + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return headerSize() + plainSize + chunks*16
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptingReader struct {
+	gcm     cipher.AEAD
+	source  io.ReadCloser
+	reader  *bufio.Reader
+	prefix  []byte
+	counter uint32
+	buf     *bytes.Buffer
+	done    bool
+}
+
+// NewEncryptingReader returns a reader of the encrypted form of the source. Closing the reader
+// closes the source.
+func NewEncryptingReader(key []byte, source io.ReadCloser) (io.ReadCloser, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(magic)
+	buf.Write(prefix)
+
+	return &encryptingReader{
+		gcm:    gcm,
+		source: source,
+		reader: bufio.NewReaderSize(source, chunkSize),
+		prefix: prefix,
+		buf:    buf,
+	}, nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.sealNextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *encryptingReader) sealNextChunk() error {
+	plain := make([]byte, chunkSize)
+	n, err := io.ReadFull(r.reader, plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	final := n < chunkSize
+	if !final {
+		// A full chunk is only the last one if there's nothing after it
+		if _, err := r.reader.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.buf.Write(r.gcm.Seal(nil, chunkNonce(r.prefix, r.counter, final), plain[:n], nil))
+	r.counter++
+	r.done = final
+	return nil
+}
+
+func (r *encryptingReader) Close() error {
+	return r.source.Close()
+}
+
+type decryptingReader struct {
+	gcm     cipher.AEAD
+	source  io.ReadCloser
+	reader  *bufio.Reader
+	prefix  []byte
+	counter uint32
+	buf     *bytes.Buffer
+	done    bool
+}
+
+// NewDecryptingReader returns a reader of the plaintext of an object written by NewEncryptingReader.
+// Objects which were not encrypted are passed through unaltered so that encryption can be enabled
+// on a datastore which already has media in it. Closing the reader closes the source.
+func NewDecryptingReader(key []byte, source io.ReadCloser) (io.ReadCloser, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(source, chunkSize+gcm.Overhead()+1)
+	header, err := reader.Peek(int(headerSize()))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(header) < int(headerSize()) || !bytes.Equal(header[:len(magic)], magic) {
+		return &plainReader{reader: reader, source: source}, nil
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	copy(prefix, header[len(magic):])
+	_, err = reader.Discard(int(headerSize()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		gcm:    gcm,
+		source: source,
+		reader: reader,
+		prefix: prefix,
+		buf:    &bytes.Buffer{},
+	}, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.openNextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *decryptingReader) openNextChunk() error {
+	sealed := make([]byte, chunkSize+r.gcm.Overhead())
+	n, err := io.ReadFull(r.reader, sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	final := n < len(sealed)
+	if !final {
+		if _, err := r.reader.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := r.gcm.Open(nil, chunkNonce(r.prefix, r.counter, final), sealed[:n], nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+
+	r.buf.Write(plain)
+	r.counter++
+	r.done = final
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.source.Close()
+}
+
+type plainReader struct {
+	reader *bufio.Reader
+	source io.ReadCloser
+}
+
+func (r *plainReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func (r *plainReader) Close() error {
+	return r.source.Close()
+}
@@ -15,16 +15,45 @@ type ExifOrientation struct {
 }
 
 func GetExifOrientation(img io.ReadCloser) (*ExifOrientation, error) {
+	orientation, err := GetExifOrientationValue(img)
+	if err != nil {
+		return nil, err
+	}
+	if orientation == 0 {
+		return nil, nil // not found
+	}
+
+	flipHorizontal := orientation < 5 && (orientation%2) == 0
+	flipVertical := orientation > 4 && (orientation%2) != 0
+	degrees := 0
+
+	// TODO: There's probably a better way to represent this
+	if orientation == 1 || orientation == 2 {
+		degrees = 0
+	} else if orientation == 3 || orientation == 4 {
+		degrees = 180
+	} else if orientation == 5 || orientation == 6 {
+		degrees = 270
+	} else if orientation == 7 || orientation == 8 {
+		degrees = 90
+	}
+
+	return &ExifOrientation{degrees, flipVertical, flipHorizontal}, nil
+}
+
+// GetExifOrientationValue returns the raw EXIF orientation (1 to 8) of the image, or 0 if it doesn't
+// have one.
+func GetExifOrientationValue(img io.ReadCloser) (uint16, error) {
 	defer cleanup.DumpAndCloseStream(img)
 
 	rawExif, err := exif.SearchAndExtractExifWithReader(img)
 	if err != nil {
-		return nil, errors.New("exif: error reading possible exif data: " + err.Error())
+		return 0, errors.New("exif: error reading possible exif data: " + err.Error())
 	}
 
 	tags, _, err := exif.GetFlatExifData(rawExif, nil)
 	if err != nil {
-		return nil, errors.New("exif: error parsing exif data: " + err.Error())
+		return 0, errors.New("exif: error parsing exif data: " + err.Error())
 	}
 
 	var tag exif.ExifTag
@@ -35,7 +64,7 @@ func GetExifOrientation(img io.ReadCloser) (*ExifOrientation, error) {
 		}
 	}
 	if tag.TagName != "Orientation" {
-		return nil, nil // not found
+		return 0, nil // not found
 	}
 
 	var orientation uint16 = 0
@@ -43,7 +72,7 @@ func GetExifOrientation(img io.ReadCloser) (*ExifOrientation, error) {
 	if !ok || len(vals) <= 0 {
 		orientation, ok = tag.Value.(uint16)
 		if !ok {
-			return nil, errors.New("exif: error parsing orientation: parse error (not an int)")
+			return 0, errors.New("exif: error parsing orientation: parse error (not an int)")
 		}
 	} else {
 		orientation = vals[0]
@@ -51,27 +80,12 @@ func GetExifOrientation(img io.ReadCloser) (*ExifOrientation, error) {
 
 	// Some devices produce invalid exif data when they intend to mean "no orientation"
 	if orientation == 0 {
-		return nil, nil
+		return 0, nil
 	}
 
 	if orientation < 1 || orientation > 8 {
-		return nil, errors.New(fmt.Sprintf("orientation out of range: %d", orientation))
-	}
-
-	flipHorizontal := orientation < 5 && (orientation%2) == 0
-	flipVertical := orientation > 4 && (orientation%2) != 0
-	degrees := 0
-
-	// TODO: There's probably a better way to represent this
-	if orientation == 1 || orientation == 2 {
-		degrees = 0
-	} else if orientation == 3 || orientation == 4 {
-		degrees = 180
-	} else if orientation == 5 || orientation == 6 {
-		degrees = 270
-	} else if orientation == 7 || orientation == 8 {
-		degrees = 90
+		return 0, errors.New(fmt.Sprintf("orientation out of range: %d", orientation))
 	}
 
-	return &ExifOrientation{degrees, flipVertical, flipHorizontal}, nil
+	return orientation, nil
 }
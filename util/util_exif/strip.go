@@ -0,0 +1,168 @@
+package util_exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// StripMetadata removes EXIF, XMP, IPTC, and text metadata (which can include where a photo was taken)
+// from JPEG, PNG, and WebP images without re-encoding them. The EXIF orientation of JPEGs is kept so
+// photos still display the right way up. Other files are returned unchanged.
+func StripMetadata(b []byte) ([]byte, error) {
+	if len(b) >= 3 && b[0] == 0xFF && b[1] == 0xD8 && b[2] == 0xFF {
+		return stripJpeg(b)
+	}
+	if bytes.HasPrefix(b, pngSignature) {
+		return stripPng(b)
+	}
+	if len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP" {
+		return stripWebp(b)
+	}
+	return b, nil
+}
+
+func stripJpeg(b []byte) ([]byte, error) {
+	// Errors mean there's no EXIF data to keep the orientation of
+	orientation, _ := GetExifOrientationValue(ioutil.NopCloser(bytes.NewReader(b)))
+
+	out := &bytes.Buffer{}
+	out.Write(b[0:2]) // start of image
+	wroteOrientation := orientation <= 1
+	i := 2
+	for i < len(b) {
+		if b[i] != 0xFF || i+1 >= len(b) {
+			return nil, errors.New("jpeg: invalid marker")
+		}
+		marker := b[i+1]
+		if marker == 0xFF {
+			i++ // fill byte
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan (or end of image): the rest is image data
+			if !wroteOrientation {
+				out.Write(jpegOrientationSegment(orientation))
+				wroteOrientation = true
+			}
+			out.Write(b[i:])
+			break
+		}
+		if i+4 > len(b) {
+			return nil, errors.New("jpeg: truncated segment")
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(b[i+2:i+4]))
+		if end < i+4 || end > len(b) {
+			return nil, errors.New("jpeg: invalid segment length")
+		}
+
+		// The EXIF segment goes after the JFIF segment if there is one, as that must be first
+		if !wroteOrientation && marker != 0xE0 {
+			out.Write(jpegOrientationSegment(orientation))
+			wroteOrientation = true
+		}
+		if keepJpegSegment(marker, b[i+4:end]) {
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+func keepJpegSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0: // JFIF
+		return true
+	case marker == 0xE2: // colour profile
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE: // Adobe colour transform
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	case marker >= 0xE1 && marker <= 0xEF: // EXIF, XMP, IPTC, and other application data
+		return false
+	case marker == 0xFE: // comment
+		return false
+	}
+	return true
+}
+
+// jpegOrientationSegment builds an EXIF segment holding only the given orientation.
+func jpegOrientationSegment(orientation uint16) []byte {
+	payload := &bytes.Buffer{}
+	payload.WriteString("Exif\x00\x00")
+	payload.Write([]byte{'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08}) // big endian, first IFD at 8
+	binary.Write(payload, binary.BigEndian, uint16(1))                  // one entry
+	binary.Write(payload, binary.BigEndian, uint16(0x0112))             // orientation
+	binary.Write(payload, binary.BigEndian, uint16(3))                  // short
+	binary.Write(payload, binary.BigEndian, uint32(1))                  // one value
+	binary.Write(payload, binary.BigEndian, orientation)
+	binary.Write(payload, binary.BigEndian, uint16(0)) // padding
+	binary.Write(payload, binary.BigEndian, uint32(0)) // no next IFD
+
+	segment := &bytes.Buffer{}
+	segment.Write([]byte{0xFF, 0xE1})
+	binary.Write(segment, binary.BigEndian, uint16(payload.Len()+2))
+	segment.Write(payload.Bytes())
+	return segment.Bytes()
+}
+
+func stripPng(b []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	out.Write(pngSignature)
+	i := len(pngSignature)
+	for i < len(b) {
+		if i+8 > len(b) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(b[i:i+4]))
+		if end < i+12 || end > len(b) {
+			return nil, errors.New("png: invalid chunk length")
+		}
+
+		switch string(b[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			// metadata
+		default:
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+func stripWebp(b []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	out.Write(b[0:12]) // the RIFF size is fixed at the end
+	vp8xFlags := -1
+	i := 12
+	for i < len(b) {
+		if i+8 > len(b) {
+			return nil, errors.New("webp: truncated chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(b[i+4 : i+8]))
+		end := i + 8 + size + size%2 // chunks are padded to an even size
+		if end < i+8 || end > len(b) {
+			return nil, errors.New("webp: invalid chunk length")
+		}
+
+		switch string(b[i : i+4]) {
+		case "EXIF", "XMP ":
+			// metadata
+		case "VP8X":
+			vp8xFlags = out.Len() + 8
+			out.Write(b[i:end])
+		default:
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	if vp8xFlags >= 0 && vp8xFlags < len(stripped) {
+		stripped[vp8xFlags] &^= 0x08 | 0x04 // EXIF and XMP present flags
+	}
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}